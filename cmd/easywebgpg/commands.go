@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"h-cloud.io/web-gpg/internal/app"
+)
+
+const commandUsage = `usage: easywebgpg [command]
+
+Without a command, the server starts. Commands manage the master passwords
+that open the data key; run them with the server stopped and MASTER_PASSWORD
+set to one of them:
+
+  rotate-master-password         change MASTER_PASSWORD to NEW_MASTER_PASSWORD
+  add-master-password NAME       also open the data key with NEW_MASTER_PASSWORD,
+                                 or with a printed recovery key if it is unset
+  remove-master-password NAME    remove another master password
+  list-master-passwords          list the names of the master passwords
+  upgrade-encryption             apply the ARGON2_* settings to MASTER_PASSWORD
+                                 and rewrite stored secrets in the current format
+`
+
+// runCommand runs the command in args and returns the exit status.
+func runCommand(a *app.App, args []string) int {
+	ctx := context.Background()
+	if a.MasterPassword == "" {
+		slog.Error("set MASTER_PASSWORD to the current master password")
+		return 2
+	}
+	switch {
+	case args[0] == "rotate-master-password" && len(args) == 1:
+		newPassword := os.Getenv("NEW_MASTER_PASSWORD")
+		if newPassword == "" {
+			slog.Error("set NEW_MASTER_PASSWORD to the new master password")
+			return 2
+		}
+		if err := a.RotateMasterPassword(ctx, a.MasterPassword, newPassword); err != nil {
+			slog.Error("master password rotation failed; nothing was changed", "err", err)
+			return 1
+		}
+		slog.Info("restart the server with MASTER_PASSWORD set to the new master password")
+	case args[0] == "add-master-password" && len(args) == 2:
+		password := os.Getenv("NEW_MASTER_PASSWORD")
+		recovery := password == ""
+		if recovery {
+			b := make([]byte, 32)
+			if _, err := rand.Read(b); err != nil {
+				slog.Error("failed to generate recovery key", "err", err)
+				return 1
+			}
+			password = base64.RawURLEncoding.EncodeToString(b)
+		}
+		if err := a.AddMasterPassword(ctx, args[1], password); err != nil {
+			slog.Error("failed to add master password", "name", args[1], "err", err)
+			return 1
+		}
+		slog.Info("master password added", "name", args[1])
+		if recovery {
+			fmt.Println(password)
+		}
+	case args[0] == "remove-master-password" && len(args) == 2:
+		if err := a.Crypto.RemoveMasterPassword(ctx, args[1]); err != nil {
+			slog.Error("failed to remove master password", "name", args[1], "err", err)
+			return 1
+		}
+		slog.Info("master password removed", "name", args[1])
+	case args[0] == "list-master-passwords" && len(args) == 1:
+		names, err := a.Crypto.MasterPasswords(ctx)
+		if err != nil {
+			slog.Error("failed to list master passwords", "err", err)
+			return 1
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+	case args[0] == "upgrade-encryption" && len(args) == 1:
+		if err := a.UpgradeEncryption(ctx); err != nil {
+			slog.Error("encryption upgrade failed; nothing was changed", "err", err)
+			return 1
+		}
+	default:
+		fmt.Fprint(os.Stderr, commandUsage)
+		return 2
+	}
+	return 0
+}
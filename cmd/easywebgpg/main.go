@@ -57,6 +57,9 @@ func findDirectory(name string, candidates []string) string {
 func loadTemplates() *template.Template {
 	indexCandidates := []string{"templates/index.html", "./templates/index.html", "../templates/index.html", "../../templates/index.html", "/templates/index.html"}
 	loginCandidates := []string{"templates/login.html", "./templates/login.html", "../templates/login.html", "../../templates/login.html", "/templates/login.html"}
+	dropCandidates := []string{"templates/drop.html", "./templates/drop.html", "../templates/drop.html", "../../templates/drop.html", "/templates/drop.html"}
+	secretCandidates := []string{"templates/secret.html", "./templates/secret.html", "../templates/secret.html", "../../templates/secret.html", "/templates/secret.html"}
+	directoryCandidates := []string{"templates/directory.html", "./templates/directory.html", "../templates/directory.html", "../../templates/directory.html", "/templates/directory.html"}
 
 	indexPath := findFile(indexCandidates)
 	if indexPath == "" {
@@ -68,6 +71,15 @@ func loadTemplates() *template.Template {
 	if loginPath := findFile(loginCandidates); loginPath != "" {
 		files = append(files, loginPath)
 	}
+	if dropPath := findFile(dropCandidates); dropPath != "" {
+		files = append(files, dropPath)
+	}
+	if secretPath := findFile(secretCandidates); secretPath != "" {
+		files = append(files, secretPath)
+	}
+	if directoryPath := findFile(directoryCandidates); directoryPath != "" {
+		files = append(files, directoryPath)
+	}
 
 	tmpl := template.Must(template.ParseFiles(files...))
 	slog.Debug("templates loaded", "files", files)
@@ -105,6 +117,9 @@ func main() {
 	}
 
 	cryptoSvc := cm.NewCryptoService(db)
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(&app.App{DB: db, Crypto: cryptoSvc, MasterPassword: os.Getenv("MASTER_PASSWORD")}, os.Args[1:]))
+	}
 	tmpl := loadTemplates()
 
 	staticDir := findDirectory("static", []string{"static", "./static", "../static", "../../static", "/static"})
@@ -115,6 +130,18 @@ func main() {
 		Templates:      tmpl,
 		Crypto:         cryptoSvc,
 		MasterPassword: os.Getenv("MASTER_PASSWORD"),
+		TrustPolicy:    app.ParseTrustPolicy(os.Getenv("TRUST_POLICY")),
+		PGPProfile:     app.ParsePGPProfile(os.Getenv("PGP_PROFILE")),
+		WKDDomains:     app.ParseDomainList(os.Getenv("WKD_DOMAINS")),
+		KeyPolicy:      app.ParseKeyPolicy(os.Getenv("KEY_POLICY"), os.Getenv("KEY_MIN_BITS"), os.Getenv("KEY_WEAK_ALGORITHMS")),
+		KeyFetcher:     app.NewKeyFetcher(os.Getenv("KEYSERVER_URL"), os.Getenv("KEY_LOOKUP_WKD")),
+		KeyDirectory:   app.ParseKeyDirectory(os.Getenv("KEY_DIRECTORY")),
+		WebAuthn:       app.NewWebAuthn(os.Getenv("WEBAUTHN_ORIGIN")),
+		OIDC:           app.NewOIDC(context.Background(), os.Getenv("OIDC_ISSUER"), os.Getenv("OIDC_CLIENT_ID"), os.Getenv("OIDC_CLIENT_SECRET"), os.Getenv("OIDC_REDIRECT_URL"), os.Getenv("OIDC_ROLES")),
+	}
+
+	if err := a.BackfillKeyMetadata(context.Background()); err != nil {
+		slog.Warn("key metadata backfill failed", "err", err)
 	}
 
 	mux := http.NewServeMux()
@@ -123,15 +150,70 @@ func main() {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.Write([]byte(time.Now().Format("15:04:05 MST — Jan 2 2006")))
 	})
+	// Public key distribution: unauthenticated by design, serves only
+	// published keys.
+	mux.HandleFunc("/.well-known/openpgpkey/", a.WKDHandler)
+	mux.HandleFunc("/pks/lookup", a.HKPLookupHandler)
+	mux.HandleFunc("/directory/", a.DirectoryHandler)
+	// Anonymous submissions to drop-enabled keys, with their own rate limit.
+	mux.HandleFunc("/drop/", app.RateLimit(app.DropRateLimiter, a.DropHandler))
+	// One-time secret links: the key is in the URL fragment, so recipients
+	// need no account.
+	mux.HandleFunc("/s/", app.RateLimit(app.SecretRateLimiter, a.SecretHandler))
 	mux.HandleFunc("/auth", app.RateLimit(app.AuthRateLimiter, a.AuthHandler))
+	// Passkey login, as the first factor or after the password.
+	mux.HandleFunc("/auth/passkey/begin", a.BeginPasskeyLoginHandler)
+	mux.HandleFunc("/auth/passkey/finish", app.RateLimit(app.AuthRateLimiter, a.FinishPasskeyLoginHandler))
+	// Single sign-on at the OpenID Connect provider.
+	mux.HandleFunc("/auth/oidc", a.OIDCLoginHandler)
+	mux.HandleFunc("/auth/oidc/callback", app.RateLimit(app.AuthRateLimiter, a.OIDCCallbackHandler))
 	mux.HandleFunc("/logout", a.LogoutHandler)
 
-	mux.HandleFunc("/", a.WithAuth(a.IndexHandler))
-	mux.HandleFunc("/keys", a.WithAuth(a.AddKeyHandler))
-	mux.HandleFunc("/keys/view", a.WithAuth(a.ViewKeyHandler))
-	mux.HandleFunc("/keys/delete", a.WithAuth(a.DeleteKeyHandler))
-	mux.HandleFunc("/encrypt", a.WithAuth(a.EncryptHandler))
-	mux.HandleFunc("/decrypt", a.WithAuth(a.DecryptHandler))
+	// Every signed-in route requires a role: viewers browse keys, encryptors
+	// and decryptors may also use them, administrators change them.
+	mux.HandleFunc("/", a.WithAuth(app.RequireRole(app.RoleViewer, a.IndexHandler)))
+	mux.HandleFunc("/keys", a.WithAuth(app.RequireRole(app.RoleAdmin, a.AddKeyHandler)))
+	mux.HandleFunc("/keys/import/gnupg", a.WithAuth(app.RequireRole(app.RoleAdmin, a.ImportGnuPGHandler)))
+	mux.HandleFunc("/keys/passphrase", a.WithAuth(app.RequireRole(app.RoleAdmin, a.SetPassphraseHandler)))
+	mux.HandleFunc("/keys/generate", a.WithAuth(app.RequireRole(app.RoleAdmin, a.GenerateKeyHandler)))
+	mux.HandleFunc("/keys/publish", a.WithAuth(app.RequireRole(app.RoleAdmin, a.PublishKeyHandler)))
+	mux.HandleFunc("/keys/drop", a.WithAuth(app.RequireRole(app.RoleAdmin, a.DropKeyHandler)))
+	mux.HandleFunc("/keys/share", a.WithAuth(app.RequireRole(app.RoleAdmin, a.ShareKeyHandler)))
+	mux.HandleFunc("/pks/add", a.WithAuth(app.RequireRole(app.RoleAdmin, a.HKPAddHandler)))
+	mux.HandleFunc("/keys/lint", a.WithAuth(app.RequireRole(app.RoleAdmin, a.LintKeysHandler)))
+	mux.HandleFunc("/keys/lookup", a.WithAuth(app.RequireRole(app.RoleAdmin, a.LookupKeyHandler)))
+	mux.HandleFunc("/keys/view", a.WithAuth(app.RequireRole(app.RoleViewer, a.ViewKeyHandler)))
+	mux.HandleFunc("/keys/qr", a.WithAuth(app.RequireRole(app.RoleViewer, a.FingerprintQRHandler)))
+	mux.HandleFunc("/keys/compare", a.WithAuth(app.RequireRole(app.RoleViewer, a.CompareFingerprintHandler)))
+	mux.HandleFunc("/keys/delete", a.WithAuth(app.RequireRole(app.RoleAdmin, a.DeleteKeyHandler)))
+	mux.HandleFunc("/keys/certify", a.WithAuth(app.RequireRole(app.RoleAdmin, a.CertifyKeyHandler)))
+	mux.HandleFunc("/keys/trust", a.WithAuth(app.RequireRole(app.RoleAdmin, a.SetTrustHandler)))
+	mux.HandleFunc("/identities/pin", a.WithAuth(app.RequireRole(app.RoleAdmin, a.PinKeyHandler)))
+	mux.HandleFunc("/identities/history", a.WithAuth(app.RequireRole(app.RoleViewer, a.IdentityHistoryHandler)))
+	mux.HandleFunc("/groups", a.WithAuth(app.RequireRole(app.RoleViewer, a.GroupsHandler)))
+	mux.HandleFunc("/groups/delete", a.WithAuth(app.RequireRole(app.RoleAdmin, a.DeleteGroupHandler)))
+	mux.HandleFunc("/encrypt", a.WithAuth(app.RequireRole(app.RoleEncryptor, a.EncryptHandler)))
+	mux.HandleFunc("/decrypt", a.WithAuth(app.RequireRole(app.RoleDecryptor, a.DecryptHandler)))
+	mux.HandleFunc("/secrets", a.WithAuth(app.RequireRole(app.RoleEncryptor, a.CreateSecretHandler)))
+	mux.HandleFunc("/inbox", a.WithAuth(app.RequireRole(app.RoleDecryptor, a.InboxHandler)))
+	mux.HandleFunc("/inbox/status", a.WithAuth(app.RequireRole(app.RoleDecryptor, a.InboxStatusHandler)))
+	mux.HandleFunc("/inbox/delete", a.WithAuth(app.RequireRole(app.RoleDecryptor, a.DeleteInboxMessageHandler)))
+	mux.HandleFunc("/users", a.WithAuth(app.RequireRole(app.RoleAdmin, a.UsersHandler)))
+	mux.HandleFunc("/users/delete", a.WithAuth(app.RequireRole(app.RoleAdmin, a.DeleteUserHandler)))
+	mux.HandleFunc("/users/password", a.WithAuth(app.RequireRole(app.RoleViewer, a.UserPasswordHandler)))
+	mux.HandleFunc("/users/role", a.WithAuth(app.RequireRole(app.RoleAdmin, a.UserRoleHandler)))
+	mux.HandleFunc("/2fa", a.WithAuth(app.RequireRole(app.RoleViewer, a.TwoFactorHandler)))
+	mux.HandleFunc("/2fa/confirm", a.WithAuth(app.RequireRole(app.RoleViewer, a.ConfirmTwoFactorHandler)))
+	mux.HandleFunc("/2fa/disable", a.WithAuth(app.RequireRole(app.RoleViewer, a.DisableTwoFactorHandler)))
+	mux.HandleFunc("/passkeys", a.WithAuth(app.RequireRole(app.RoleViewer, a.PasskeysHandler)))
+	mux.HandleFunc("/passkeys/register/begin", a.WithAuth(app.RequireRole(app.RoleViewer, a.BeginPasskeyRegistrationHandler)))
+	mux.HandleFunc("/passkeys/register/finish", a.WithAuth(app.RequireRole(app.RoleViewer, a.FinishPasskeyRegistrationHandler)))
+	mux.HandleFunc("/passkeys/delete", a.WithAuth(app.RequireRole(app.RoleViewer, a.DeletePasskeyHandler)))
+	mux.HandleFunc("/tokens", a.WithAuth(app.RequireRole(app.RoleViewer, a.APITokensHandler)))
+	mux.HandleFunc("/tokens/revoke", a.WithAuth(app.RequireRole(app.RoleViewer, a.RevokeAPITokenHandler)))
+	mux.HandleFunc("/sessions", a.WithAuth(app.RequireRole(app.RoleViewer, a.SessionsHandler)))
+	mux.HandleFunc("/sessions/revoke", a.WithAuth(app.RequireRole(app.RoleViewer, a.RevokeSessionHandler)))
+	mux.HandleFunc("/sessions/revoke-all", a.WithAuth(app.RequireRole(app.RoleViewer, a.RevokeAllSessionsHandler)))
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -5,9 +5,11 @@ import (
 	"log/slog"
 	"net/http"
 
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/jmoiron/sqlx"
 
 	cm "h-cloud.io/web-gpg/internal/crypto"
+	kf "h-cloud.io/web-gpg/internal/keyfetch"
 	mm "h-cloud.io/web-gpg/internal/models"
 )
 
@@ -18,22 +20,101 @@ type App struct {
 	DB             *sqlx.DB
 	Templates      *template.Template
 	Crypto         *cm.CryptoService
-	MasterPassword string // read once at startup from MASTER_PASSWORD env
+	MasterPassword string             // read once at startup from MASTER_PASSWORD env
+	TrustPolicy    TrustPolicy        // read once at startup from TRUST_POLICY env
+	KeyPolicy      KeyPolicy          // read once at startup from KEY_POLICY, KEY_MIN_BITS, KEY_WEAK_ALGORITHMS env
+	PGPProfile     string             // read once at startup from PGP_PROFILE env; empty means ProfileDefault
+	WKDDomains     []string           // read once at startup from WKD_DOMAINS env; empty serves any domain
+	KeyFetcher     *kf.Client         // built once at startup from KEYSERVER_URL, KEY_LOOKUP_WKD env; nil disables lookups
+	KeyDirectory   bool               // read once at startup from KEY_DIRECTORY env; false hides the public key directory
+	WebAuthn       *webauthn.WebAuthn // built once at startup from WEBAUTHN_ORIGIN env; nil disables passkeys
+	OIDC           *OIDC              // built once at startup from OIDC_* env; nil disables single sign-on
 }
 
-// IndexHandler renders the main page with all stored keys.
+// IndexHandler renders the main page with the keys the current user may use
+// and recipient groups.
 func (a *App) IndexHandler(w http.ResponseWriter, r *http.Request) {
 	var keys []mm.Key
-	err := a.DB.SelectContext(r.Context(), &keys,
-		"SELECT id, name, armored, is_private, encrypted_password, created_at FROM keys ORDER BY created_at DESC")
+	scope, args := keyScope(r.Context(), false)
+	err := a.DB.SelectContext(r.Context(), &keys, a.DB.Rebind(
+		`SELECT id, name, armored, is_private, encrypted_password, trust_level, certified_by, certified_at, fingerprint, pin_conflict, lint_warnings, published, drop_enabled,
+		owner_id, (SELECT username FROM users WHERE users.id = keys.owner_id) AS owner_name, shared, created_at
+		FROM keys WHERE `+scope+" ORDER BY created_at DESC"), args...)
 	if err != nil {
 		slog.Error("failed to load keys", "err", err)
 		http.Error(w, "failed to load keys", http.StatusInternalServerError)
 		return
 	}
 
+	groups, err := a.loadGroups(r.Context())
+	if err != nil {
+		slog.Error("failed to load recipient groups", "err", err)
+		http.Error(w, "failed to load recipient groups", http.StatusInternalServerError)
+		return
+	}
+
+	inbox, err := a.loadInbox(r.Context(), inboxUnread, inboxRead)
+	if err != nil {
+		slog.Error("failed to load inbox", "err", err)
+		http.Error(w, "failed to load inbox", http.StatusInternalServerError)
+		return
+	}
+
+	// Accounts only matter when logins are required.
+	user := currentUser(r.Context())
+	var users []mm.User
+	var twoFactor twoFactorStatus
+	var passkeys []passkey
+	var tokens []apiToken
+	var sessions []session
+	var scopes []string
+	if user != nil {
+		scopes = Roles[:roleRank(user.Role)+1]
+		if twoFactor, err = a.twoFactorStatus(r.Context(), user.ID); err != nil {
+			slog.Error("failed to load two-factor status", "err", err)
+			http.Error(w, "failed to load two-factor status", http.StatusInternalServerError)
+			return
+		}
+		if passkeys, err = a.loadPasskeys(r.Context(), user.ID); err != nil {
+			slog.Error("failed to load passkeys", "err", err)
+			http.Error(w, "failed to load passkeys", http.StatusInternalServerError)
+			return
+		}
+		if tokens, err = a.loadAPITokens(r.Context(), user.ID); err != nil {
+			slog.Error("failed to load API tokens", "err", err)
+			http.Error(w, "failed to load API tokens", http.StatusInternalServerError)
+			return
+		}
+		if sessions, err = a.loadSessions(r.Context(), user.ID); err != nil {
+			slog.Error("failed to load sessions", "err", err)
+			http.Error(w, "failed to load sessions", http.StatusInternalServerError)
+			return
+		}
+	}
+	if user != nil && hasRole(r.Context(), RoleAdmin) {
+		if users, err = a.loadUsers(r.Context()); err != nil {
+			slog.Error("failed to load users", "err", err)
+			http.Error(w, "failed to load users", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	data := map[string]interface{}{
-		"Keys": keys,
+		"User":         user,
+		"Users":        users,
+		"TwoFactor":    twoFactor,
+		"WebAuthn":     a.WebAuthn != nil,
+		"Passkeys":     passkeys,
+		"APITokens":    tokens,
+		"TokenScopes":  scopes,
+		"Sessions":     sessions,
+		"Roles":        Roles,
+		"Can":          userPermissions(r.Context()),
+		"Keys":         keys,
+		"Groups":       groups,
+		"Inbox":        inbox,
+		"Profile":      a.profileName(""),
+		"KeyDirectory": a.KeyDirectory,
 	}
 	if err := a.Templates.ExecuteTemplate(w, "index.html", data); err != nil {
 		slog.Error("failed to render template", "template", "index.html", "err", err)
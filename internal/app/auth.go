@@ -1,70 +1,314 @@
 package app
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"log/slog"
 	"net/http"
+	"strings"
+	"time"
 
 	cm "h-cloud.io/web-gpg/internal/crypto"
+	mm "h-cloud.io/web-gpg/internal/models"
 )
 
-func (a *App) requireAuth(w http.ResponseWriter, r *http.Request) bool {
+// requireAuth returns the logged-in user and their session, or renders the
+// login page (for "/") or redirects to it and returns false. The user is nil
+// when authentication is disabled.
+func (a *App) requireAuth(w http.ResponseWriter, r *http.Request) (*mm.User, *session, bool) {
 	if a.MasterPassword == "" {
-		return true
+		return nil, nil, true
 	}
 
-	c, err := r.Cookie("webgpg_auth")
-	if err != nil || !a.Crypto.VerifyAuthCookieValue(c.Value, authCookieMaxAge) {
+	user, s := a.sessionUser(r)
+	if user == nil {
 		if r.URL.Path == "/" {
-			if err := a.Templates.ExecuteTemplate(w, "login.html", map[string]interface{}{}); err != nil {
-				w.Header().Set("Content-Type", "text/html; charset=utf-8")
-				w.Write([]byte(`<form method="post" action="/auth"><input type="password" name="password" placeholder="Master password"/><button type="submit">Unlock</button></form>`))
-			}
-			return false
+			a.renderLogin(w, r, "")
+			return nil, nil, false
 		}
 		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return false
+		return nil, nil, false
+	}
+	return user, s, true
+}
+
+// renderLogin shows the login page, asking for a username once accounts
+// exist.
+func (a *App) renderLogin(w http.ResponseWriter, r *http.Request, loginErr string) {
+	n, err := a.countUsers(r.Context())
+	if err != nil {
+		slog.Error("failed to count users", "err", err)
+	}
+	data := map[string]interface{}{"Accounts": n > 0, "Passkeys": a.WebAuthn != nil, "OIDC": a.OIDC != nil}
+	if loginErr != "" {
+		data["Error"] = loginErr
+	}
+	if err := a.Templates.ExecuteTemplate(w, "login.html", data); err != nil {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<form method="post" action="/auth"><input name="username" placeholder="Username"/><input type="password" name="password" placeholder="Password"/><button type="submit">Unlock</button></form>`))
+	}
+}
+
+// renderTwoFactorLogin shows the second login step, asking userID for a
+// TOTP or recovery code or a passkey, whichever they set up.
+func (a *App) renderTwoFactorLogin(w http.ResponseWriter, r *http.Request, userID int64, loginErr string) {
+	totp, passkeys, err := a.secondFactors(r.Context(), userID)
+	if err != nil {
+		slog.Error("failed to load second factors", "user_id", userID, "err", err)
+	}
+	data := map[string]interface{}{"TwoFactor": true, "TOTP": totp, "Passkeys": passkeys}
+	if loginErr != "" {
+		data["Error"] = loginErr
+	}
+	if err := a.Templates.ExecuteTemplate(w, "login.html", data); err != nil {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<form method="post" action="/auth"><input name="code" placeholder="Code"/><button type="submit">Verify</button></form>`))
 	}
-	return true
 }
 
-// WithAuth wraps a handler with authentication enforcement.
+// WithAuth wraps a handler with authentication enforcement, by auth cookie
+// or API token. The handler can read the logged-in user with currentUser.
 func (a *App) WithAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !a.requireAuth(w, r) {
+		if token, ok := bearerToken(r); ok && a.MasterPassword != "" {
+			user, t := a.tokenUser(r, token)
+			if user == nil {
+				slog.Warn("API request refused: invalid token", "ip", r.RemoteAddr, "path", r.URL.Path)
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, "invalid or expired API token", http.StatusUnauthorized)
+				return
+			}
+			next(w, r.WithContext(withToken(withUser(r.Context(), user), t.ID)))
+			return
+		}
+		user, s, ok := a.requireAuth(w, r)
+		if !ok {
 			return
 		}
+		if user != nil {
+			r = r.WithContext(withSession(withUser(r.Context(), user), s.ID))
+		}
 		next(w, r)
 	}
 }
 
-// AuthHandler validates the master password and sets an auth cookie.
+// AuthHandler validates a username and password, or the master password
+// while no accounts exist and single sign-on is off, and sets an auth cookie
+// naming the user. Users with two-factor authentication or passkeys get a
+// short-lived, single-use second factor cookie instead and are asked for a
+// "code" or a passkey, which completes the login.
 func (a *App) AuthHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if r.FormValue("code") != "" {
+		a.secondFactorLogin(w, r)
+		return
+	}
 
-	pass := r.FormValue("password")
-	ok, err := a.Crypto.VerifyMasterPassword(pass)
+	n, err := a.countUsers(r.Context())
 	if err != nil {
-		if errors.Is(err, cm.ErrMasterPasswordNotSet) {
-			http.Error(w, "server not configured for master password", http.StatusInternalServerError)
+		slog.Error("failed to count users", "err", err)
+		http.Error(w, "internal error verifying password", http.StatusInternalServerError)
+		return
+	}
+	pass := r.FormValue("password")
+	var userID int64
+	if n == 0 && a.OIDC != nil {
+		slog.Warn("login failed: master password login is disabled by single sign-on", "ip", r.RemoteAddr)
+		a.renderLogin(w, r, "please sign in with single sign-on")
+		return
+	}
+	if n == 0 {
+		ok, err := a.Crypto.VerifyMasterPassword(pass)
+		if err != nil {
+			if errors.Is(err, cm.ErrMasterPasswordNotSet) {
+				http.Error(w, "server not configured for master password", http.StatusInternalServerError)
+				return
+			}
+			slog.Error("failed to verify master password", "err", err)
+			http.Error(w, "internal error verifying password", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			slog.Warn("login failed: invalid password", "ip", r.RemoteAddr)
+			a.renderLogin(w, r, "invalid password")
+			return
+		}
+	} else {
+		username := strings.ToLower(strings.TrimSpace(r.FormValue("username")))
+		u, err := a.loadUser(r.Context(), "username", username)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("failed to load user", "username", username, "err", err)
+			http.Error(w, "internal error verifying password", http.StatusInternalServerError)
+			return
+		}
+		if u == nil || !matchPassphrase(u.PasswordHash, pass) {
+			slog.Warn("login failed: invalid username or password", "username", username, "ip", r.RemoteAddr)
+			a.renderLogin(w, r, "invalid username or password")
 			return
 		}
-		slog.Error("failed to verify master password", "err", err)
+		userID = u.ID
+	}
+
+	totp, passkeys, err := a.secondFactors(r.Context(), userID)
+	if err != nil {
+		slog.Error("failed to load second factors", "user_id", userID, "err", err)
 		http.Error(w, "internal error verifying password", http.StatusInternalServerError)
 		return
 	}
+	if totp || passkeys {
+		locked, err := a.secondFactorLocked(r.Context(), userID)
+		if err != nil {
+			slog.Error("failed to load second factor", "user_id", userID, "err", err)
+			http.Error(w, "internal error verifying password", http.StatusInternalServerError)
+			return
+		}
+		if locked {
+			slog.Warn("login refused: second factor locked", "user_id", userID, "ip", r.RemoteAddr)
+			a.renderLogin(w, r, "too many invalid codes, please try again later")
+			return
+		}
+		if err := a.startPendingLogin(w, r, userID); err != nil {
+			slog.Error("failed to store pending login", "err", err)
+			http.Error(w, "failed to create auth token: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		slog.Info("password accepted, second factor required", "user_id", userID, "ip", r.RemoteAddr)
+		a.renderTwoFactorLogin(w, r, userID, "")
+		return
+	}
+	a.setAuthCookie(w, r, userID)
+}
+
+// secondFactorLogin completes a login started with a password once "code"
+// is a valid TOTP or recovery code. The password step allows one attempt:
+// after an invalid code the password has to be entered again, and too many
+// invalid codes in a row lock the account's second factor for a while.
+func (a *App) secondFactorLogin(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.takePendingLogin(w, r)
+	if !ok {
+		a.renderLogin(w, r, "login timed out, please enter your password again")
+		return
+	}
+	locked, err := a.secondFactorLocked(r.Context(), userID)
+	if err != nil {
+		slog.Error("failed to load second factor", "user_id", userID, "err", err)
+		http.Error(w, "internal error verifying code", http.StatusInternalServerError)
+		return
+	}
+	if locked {
+		slog.Warn("login refused: second factor locked", "user_id", userID, "ip", r.RemoteAddr)
+		a.renderLogin(w, r, "too many invalid codes, please try again later")
+		return
+	}
+	ok, err = a.verifySecondFactor(r.Context(), userID, r.FormValue("code"))
+	if err != nil {
+		slog.Error("failed to verify second factor", "user_id", userID, "err", err)
+		http.Error(w, "internal error verifying code", http.StatusInternalServerError)
+		return
+	}
 	if !ok {
-		slog.Warn("login failed: invalid password", "ip", r.RemoteAddr)
-		a.Templates.ExecuteTemplate(w, "login.html", map[string]interface{}{"Error": "invalid password"})
+		slog.Warn("login failed: invalid second factor", "user_id", userID, "ip", r.RemoteAddr)
+		locked, err := a.recordSecondFactorFailure(r.Context(), userID)
+		if err != nil {
+			slog.Error("failed to count invalid second factor", "user_id", userID, "err", err)
+		}
+		if locked {
+			slog.Warn("second factor locked after too many invalid codes", "user_id", userID)
+			a.renderLogin(w, r, "too many invalid codes, please try again later")
+			return
+		}
+		a.renderLogin(w, r, "invalid code, please enter your password again")
 		return
 	}
+	if err := a.resetSecondFactorFailures(r.Context(), userID); err != nil {
+		slog.Warn("failed to reset invalid second factor count", "user_id", userID, "err", err)
+	}
+	a.setAuthCookie(w, r, userID)
+}
+
+// secondFactors reports whether userID has TOTP enabled and whether they
+// have passkeys, either of which is asked for after the password. Passkeys
+// are ignored while WEBAUTHN_ORIGIN is unset.
+func (a *App) secondFactors(ctx context.Context, userID int64) (totp, passkeys bool, err error) {
+	if totp, err = a.twoFactorEnabled(ctx, userID); err != nil || a.WebAuthn == nil {
+		return totp, false, err
+	}
+	n, err := a.countPasskeys(ctx, userID)
+	return totp, n > 0, err
+}
 
-	val, err := a.Crypto.CreateAuthCookieValue()
+// startPendingLogin records that userID gave the right password and sets
+// the second factor cookie naming the record.
+func (a *App) startPendingLogin(w http.ResponseWriter, r *http.Request, userID int64) error {
+	token, err := randomToken()
 	if err != nil {
-		slog.Error("failed to create auth cookie", "err", err)
+		return err
+	}
+	a.purgeExpiredPendingLogins(r.Context())
+	q := a.DB.Rebind("INSERT INTO pending_logins (token_hash, user_id, expires_at) VALUES (?, ?, ?)")
+	expires := time.Now().UTC().Add(time.Duration(twoFactorCookieMaxAge) * time.Second)
+	if _, err := a.DB.ExecContext(r.Context(), q, hashToken(token), userID, expires); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "webgpg_2fa",
+		Value:    token,
+		Path:     "/auth",
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		MaxAge:   int(twoFactorCookieMaxAge),
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+// takePendingLogin returns and deletes the unexpired pending login of this
+// browser, so each password step leads to at most one second factor
+// attempt.
+func (a *App) takePendingLogin(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	c, err := r.Cookie("webgpg_2fa")
+	if err != nil {
+		return 0, false
+	}
+	http.SetCookie(w, &http.Cookie{Name: "webgpg_2fa", Value: "", Path: "/auth", MaxAge: -1})
+	var userID int64
+	q := a.DB.Rebind("SELECT user_id FROM pending_logins WHERE token_hash = ? AND expires_at > ?")
+	if err := a.DB.GetContext(r.Context(), &userID, q, hashToken(c.Value), time.Now().UTC()); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("failed to load pending login", "err", err)
+		}
+		return 0, false
+	}
+	res, err := a.DB.ExecContext(r.Context(), a.DB.Rebind("DELETE FROM pending_logins WHERE token_hash = ?"), hashToken(c.Value))
+	if err != nil {
+		slog.Error("failed to delete pending login", "err", err)
+		return 0, false
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return 0, false
+	}
+	return userID, true
+}
+
+// purgeExpiredPendingLogins deletes pending logins that were never
+// completed. Failures are only logged: expired ones are refused anyway.
+func (a *App) purgeExpiredPendingLogins(ctx context.Context) {
+	q := a.DB.Rebind("DELETE FROM pending_logins WHERE expires_at < ?")
+	if _, err := a.DB.ExecContext(ctx, q, time.Now().UTC()); err != nil {
+		slog.Warn("failed to purge expired pending logins", "err", err)
+	}
+}
+
+// setAuthCookie logs userID in with a new session and redirects to the main
+// page.
+func (a *App) setAuthCookie(w http.ResponseWriter, r *http.Request, userID int64) {
+	val, err := a.startSession(r, userID)
+	if err != nil {
+		slog.Error("failed to start session", "err", err)
 		http.Error(w, "failed to create auth token: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -78,7 +322,7 @@ func (a *App) AuthHandler(w http.ResponseWriter, r *http.Request) {
 		SameSite: http.SameSiteLaxMode,
 	}
 	http.SetCookie(w, cookie)
-	slog.Info("login successful", "ip", r.RemoteAddr)
+	slog.Info("login successful", "user_id", userID, "ip", r.RemoteAddr)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
@@ -90,8 +334,15 @@ func isHTTPS(r *http.Request) bool {
 	return r.Header.Get("X-Forwarded-Proto") == "https"
 }
 
-// LogoutHandler clears the auth cookie and redirects to root.
+// LogoutHandler ends the session, clears the auth cookie and redirects to
+// root.
 func (a *App) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie("webgpg_auth"); err == nil {
+		q := a.DB.Rebind("DELETE FROM sessions WHERE token_hash = ?")
+		if _, err := a.DB.ExecContext(r.Context(), q, hashToken(c.Value)); err != nil {
+			slog.Error("failed to end session", "err", err)
+		}
+	}
 	cookie := &http.Cookie{Name: "webgpg_auth", Value: "", Path: "/", MaxAge: -1}
 	http.SetCookie(w, cookie)
 	slog.Info("logout", "ip", r.RemoteAddr)
@@ -0,0 +1,158 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v3/crypto"
+)
+
+// directoryPrefix is the path of the public key directory. Keys are
+// downloaded from directoryPrefix + "<fingerprint>.asc".
+const directoryPrefix = "/directory/"
+
+// ParseKeyDirectory parses the KEY_DIRECTORY env value. The directory is off
+// unless enabled; invalid values keep it off.
+func ParseKeyDirectory(s string) bool {
+	if s == "" {
+		return false
+	}
+	enabled, err := strconv.ParseBool(s)
+	if err != nil {
+		slog.Warn("invalid KEY_DIRECTORY, directory disabled", "value", s)
+		return false
+	}
+	return enabled
+}
+
+// directoryEntry is a published key as listed by directory.html.
+type directoryEntry struct {
+	Name        string
+	UserIDs     []string
+	Fingerprint string // grouped in blocks of four for reading aloud
+	Download    string
+	Created     time.Time
+	Expires     time.Time // zero if the key does not expire
+	Expired     bool
+	Revoked     bool
+	fpr         string
+	armored     string // public key only
+}
+
+// directoryPage is the data rendered by directory.html.
+type directoryPage struct {
+	Keys []directoryEntry
+}
+
+// loadDirectory returns the published keys ordered by name, each once and
+// reduced to its public key.
+func (a *App) loadDirectory(ctx context.Context) ([]directoryEntry, error) {
+	var rows []struct {
+		ID        int64     `db:"id"`
+		Name      string    `db:"name"`
+		Armored   string    `db:"armored"`
+		CreatedAt time.Time `db:"created_at"`
+	}
+	q := a.DB.Rebind("SELECT id, name, armored, created_at FROM keys WHERE published = ? ORDER BY name, id")
+	if err := a.DB.SelectContext(ctx, &rows, q, true); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	seen := map[string]bool{}
+	var entries []directoryEntry
+	for _, row := range rows {
+		k, err := crypto.NewKeyFromArmored(row.Armored)
+		if err != nil {
+			slog.Warn("skipping unparsable published key", "key_id", row.ID, "err", err)
+			continue
+		}
+		fpr := k.GetFingerprint()
+		if seen[fpr] {
+			continue
+		}
+		seen[fpr] = true
+		pub := k
+		if k.IsPrivate() {
+			if pub, err = k.ToPublic(); err != nil {
+				slog.Warn("skipping published key without public part", "key_id", row.ID, "err", err)
+				continue
+			}
+		}
+		armored, err := pub.Armor()
+		if err != nil {
+			slog.Warn("skipping published key that cannot be armored", "key_id", row.ID, "err", err)
+			continue
+		}
+		e := pub.GetEntity()
+		entry := directoryEntry{
+			Name:        row.Name,
+			Fingerprint: groupFingerprint(fpr),
+			Download:    directoryPrefix + fpr + ".asc",
+			Created:     e.PrimaryKey.CreationTime,
+			Expires:     keyExpiry(e),
+			Revoked:     e.Revoked(now),
+			fpr:         fpr,
+			armored:     armored,
+		}
+		entry.Expired = !entry.Expires.IsZero() && now.After(entry.Expires)
+		for _, ident := range sortedIdentities(e) {
+			entry.UserIDs = append(entry.UserIDs, ident.Name)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// DirectoryHandler serves the public key directory when KEY_DIRECTORY is
+// enabled: /directory/ lists the published keys, /directory/<fingerprint>.asc
+// downloads one of them and /directory/all.asc all of them. Only public keys
+// are ever served. The directory is unauthenticated by design and must not
+// be wrapped in WithAuth.
+func (a *App) DirectoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.KeyDirectory {
+		http.NotFound(w, r)
+		return
+	}
+	entries, err := a.loadDirectory(r.Context())
+	if err != nil {
+		slog.Error("failed to load key directory", "err", err)
+		http.Error(w, "failed to load keys", http.StatusInternalServerError)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, directoryPrefix)
+	if name == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := a.Templates.ExecuteTemplate(w, "directory.html", directoryPage{Keys: entries}); err != nil {
+			slog.Error("failed to render template", "template", "directory.html", "err", err)
+		}
+		return
+	}
+
+	fpr, ok := strings.CutSuffix(strings.ToLower(name), ".asc")
+	if !ok || (fpr != "all" && !isHexFingerprint(fpr)) {
+		http.NotFound(w, r)
+		return
+	}
+	var blocks []string
+	for _, e := range entries {
+		if fpr == "all" || e.fpr == fpr {
+			blocks = append(blocks, e.armored)
+		}
+	}
+	if len(blocks) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pgp-keys")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+fpr+`.asc"`)
+	w.Write([]byte(strings.Join(blocks, "\n")))
+}
@@ -0,0 +1,94 @@
+package app_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	gcrypto "github.com/ProtonMail/gopenpgp/v3/crypto"
+
+	apppkg "h-cloud.io/web-gpg/internal/app"
+)
+
+// TestDirectoryHandler verifies the public key directory lists and serves
+// only published keys, never their private parts, and only when enabled.
+func TestDirectoryHandler(t *testing.T) {
+	a, _ := setupTestApp(t)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		a.DirectoryHandler(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	alice := generateTestKey(t, "Alice", "alice@example.com", "")
+	addPublishedKey(t, a, "alice", alice, nil)
+	if w := get("/directory/"); w.Code != http.StatusNotFound {
+		t.Fatalf("disabled directory: expected 404, got %d", w.Code)
+	}
+	a.KeyDirectory = true
+
+	team := generateTestKey(t, "Security Team", "security@example.com", "")
+	priv, _ := team.Armor()
+	postForm(a.AddKeyHandler, "/keys", url.Values{"name": {"security"}, "armored": {priv}})
+	var teamID int64
+	a.DB.Get(&teamID, "SELECT id FROM keys WHERE name = 'security'")
+	postForm(a.PublishKeyHandler, "/keys/publish", url.Values{"id": {fmt.Sprint(teamID)}})
+	hidden := generateTestKey(t, "Hidden", "hidden@example.com", "")
+	pub, _ := hidden.GetArmoredPublicKey()
+	postForm(a.AddKeyHandler, "/keys", url.Values{"name": {"hidden"}, "armored": {pub}})
+
+	w := get("/directory/")
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "alice@example.com") || !strings.Contains(body, "security@example.com") {
+		t.Fatalf("directory page: %d %s", w.Code, body)
+	}
+	if strings.Contains(body, "hidden@example.com") {
+		t.Error("unpublished keys must not be listed")
+	}
+	if !strings.Contains(body, strings.ToUpper(team.GetFingerprint()[:4])+" ") || !strings.Contains(body, "does not expire") {
+		t.Error("directory should show the grouped fingerprint and expiry")
+	}
+	if strings.Index(body, "alice@example.com") > strings.Index(body, "security@example.com") {
+		t.Error("keys should be listed by name")
+	}
+
+	w = get("/directory/" + strings.ToUpper(team.GetFingerprint()) + ".asc")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/pgp-keys" {
+		t.Fatalf("download: %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	k, err := gcrypto.NewKeyFromArmored(w.Body.String())
+	if err != nil || k.IsPrivate() || k.GetFingerprint() != team.GetFingerprint() {
+		t.Errorf("download should be the public key of the team key: %v", err)
+	}
+	if strings.Contains(w.Body.String(), "PRIVATE KEY") {
+		t.Error("the directory must never serve private keys")
+	}
+
+	w = get("/directory/all.asc")
+	if w.Code != http.StatusOK || strings.Count(w.Body.String(), "BEGIN PGP PUBLIC KEY BLOCK") != 2 {
+		t.Errorf("download all: %d %s", w.Code, w.Body.String())
+	}
+
+	for _, path := range []string{
+		"/directory/" + hidden.GetFingerprint() + ".asc",
+		"/directory/not-a-fingerprint.asc",
+		"/directory/" + team.GetFingerprint(),
+	} {
+		if w := get(path); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", path, w.Code)
+		}
+	}
+}
+
+// TestParseKeyDirectory verifies the directory stays off unless enabled.
+func TestParseKeyDirectory(t *testing.T) {
+	for in, want := range map[string]bool{"": false, "true": true, "1": true, "false": false, "yes please": false} {
+		if got := apppkg.ParseKeyDirectory(in); got != want {
+			t.Errorf("ParseKeyDirectory(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v3/crypto"
+
+	mm "h-cloud.io/web-gpg/internal/models"
+)
+
+// dropPrefix is the path of the public drop pages, followed by the key's
+// fingerprint.
+const dropPrefix = "/drop/"
+
+// maxDropBytes caps the size of a drop page submission, including files.
+const maxDropBytes = 10 << 20
+
+// DropRateLimiter is the rate limiter for the public drop pages.
+// Allows up to 20 requests per IP per 10-minute window.
+var DropRateLimiter = NewRateLimiter(10*time.Minute, 20)
+
+// dropPage is the data rendered by drop.html.
+type dropPage struct {
+	Name        string
+	Fingerprint string // grouped in blocks of four for reading aloud
+	UserIDs     []string
+	Action      string
+	Delivered   int64 // inbox message id of the accepted submission
+	Error       string
+}
+
+// dropKey returns the drop-enabled key with fingerprint fpr, or
+// sql.ErrNoRows.
+func (a *App) dropKey(ctx context.Context, fpr string) (*mm.Key, error) {
+	var k mm.Key
+	q := a.DB.Rebind("SELECT id, name, armored, fingerprint FROM keys WHERE fingerprint = ? AND drop_enabled = ? ORDER BY id LIMIT 1")
+	if err := a.DB.GetContext(ctx, &k, q, fpr, true); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// groupFingerprint formats fpr upper-case in space-separated blocks of four.
+func groupFingerprint(fpr string) string {
+	fpr = strings.ToUpper(fpr)
+	var blocks []string
+	for len(fpr) > 4 {
+		blocks = append(blocks, fpr[:4])
+		fpr = fpr[4:]
+	}
+	return strings.Join(append(blocks, fpr), " ")
+}
+
+// DropHandler serves the public "encrypt to us" page of a drop-enabled key at
+// /drop/<fingerprint>. Outsiders paste a "message" or upload a "file", which
+// is encrypted to the public part of the key and stored in the inbox together
+// with the optional "contact" field and the client address. The page is
+// unauthenticated by design and must not be wrapped in WithAuth; it is rate
+// limited with DropRateLimiter instead.
+func (a *App) DropHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fpr := strings.ToLower(strings.TrimPrefix(r.URL.Path, dropPrefix))
+	if !isHexFingerprint(fpr) {
+		http.NotFound(w, r)
+		return
+	}
+	k, err := a.dropKey(r.Context(), fpr)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		slog.Error("drop: failed to load key", "fingerprint", fpr, "err", err)
+		http.Error(w, "failed to load key", http.StatusInternalServerError)
+		return
+	}
+	parsed, err := crypto.NewKeyFromArmored(k.Armored)
+	if err != nil {
+		slog.Error("drop: failed to parse stored key", "key_id", k.ID, "err", err)
+		http.Error(w, "stored key is invalid", http.StatusInternalServerError)
+		return
+	}
+	// Only the public key is ever used, even if the private key is stored.
+	pub := parsed
+	if parsed.IsPrivate() {
+		if pub, err = parsed.ToPublic(); err != nil {
+			slog.Error("drop: failed to extract public key", "key_id", k.ID, "err", err)
+			http.Error(w, "stored key is invalid", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	page := dropPage{Name: k.Name, Fingerprint: groupFingerprint(fpr), Action: dropPrefix + fpr}
+	for name := range pub.GetEntity().Identities {
+		page.UserIDs = append(page.UserIDs, name)
+	}
+	sort.Strings(page.UserIDs)
+	if r.Method == http.MethodGet {
+		a.renderDropPage(w, http.StatusOK, page)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxDropBytes)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(maxDropBytes); err != nil {
+			page.Error = fmt.Sprintf("the submission is too large or malformed (limit %d MB)", maxDropBytes>>20)
+			a.renderDropPage(w, http.StatusBadRequest, page)
+			return
+		}
+	}
+	data, filename, err := dropSubmission(r)
+	if err != nil {
+		page.Error = err.Error()
+		a.renderDropPage(w, http.StatusUnprocessableEntity, page)
+		return
+	}
+
+	encHandle, err := a.pgp("").Encryption().Recipient(pub).New()
+	if err != nil {
+		slog.Error("drop: failed to build encryption handle", "key_id", k.ID, "err", err)
+		http.Error(w, "failed to prepare encryption", http.StatusInternalServerError)
+		return
+	}
+	msg, err := encHandle.Encrypt(data)
+	if err != nil {
+		slog.Error("drop: encryption failed", "key_id", k.ID, "err", err)
+		http.Error(w, "encryption failed", http.StatusInternalServerError)
+		return
+	}
+	armored, err := msg.Armor()
+	if err != nil {
+		slog.Error("drop: failed to armor ciphertext", "key_id", k.ID, "err", err)
+		http.Error(w, "encryption failed", http.StatusInternalServerError)
+		return
+	}
+	id, err := a.storeInboxMessage(r.Context(), inboxSubmission{
+		KeyID:      k.ID,
+		Ciphertext: armored,
+		Filename:   filename,
+		Size:       len(data),
+		Contact:    r.FormValue("contact"),
+		RemoteAddr: clientIP(r),
+		UserAgent:  r.UserAgent(),
+	})
+	if err != nil {
+		slog.Error("drop: failed to store submission", "key_id", k.ID, "err", err)
+		http.Error(w, "failed to store submission", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("drop: submission stored", "key_id", k.ID, "message_id", id, "bytes", len(data), "file", filename != "")
+	page.Delivered = id
+	a.renderDropPage(w, http.StatusOK, page)
+}
+
+// dropSubmission returns the uploaded "file" and its base name if one was
+// sent, otherwise the pasted "message".
+func dropSubmission(r *http.Request) (data []byte, filename string, err error) {
+	if r.MultipartForm != nil {
+		if files := r.MultipartForm.File["file"]; len(files) > 0 && files[0].Size > 0 {
+			f, err := files[0].Open()
+			if err != nil {
+				return nil, "", errors.New("the uploaded file could not be read")
+			}
+			defer f.Close()
+			data, err := io.ReadAll(f)
+			if err != nil {
+				return nil, "", errors.New("the uploaded file could not be read")
+			}
+			return data, filepath.Base(files[0].Filename), nil
+		}
+	}
+	message := r.FormValue("message")
+	if strings.TrimSpace(message) == "" {
+		return nil, "", errors.New("enter a message or choose a file to encrypt")
+	}
+	return []byte(message), "", nil
+}
+
+// renderDropPage renders drop.html with status.
+func (a *App) renderDropPage(w http.ResponseWriter, status int, page dropPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(status)
+	if err := a.Templates.ExecuteTemplate(w, "drop.html", page); err != nil {
+		slog.Error("failed to render template", "template", "drop.html", "err", err)
+	}
+}
+
+// DropKeyHandler sets whether a key accepts submissions through its public
+// drop page. "drop_enabled" defaults to true; "false" or "0" disables it.
+func (a *App) DropKeyHandler(w http.ResponseWriter, r *http.Request) {
+	a.setKeyFlag(w, r, "drop_enabled")
+}
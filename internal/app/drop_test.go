@@ -0,0 +1,118 @@
+package app_test
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// armoredMessageRe finds an armored PGP message in a rendered page.
+var armoredMessageRe = regexp.MustCompile(`(?s)-----BEGIN PGP MESSAGE-----.*?-----END PGP MESSAGE-----`)
+
+// TestDropHandler verifies the public drop page only exists for opted-in
+// keys and stores pasted messages and uploaded files in the inbox, encrypted
+// to them.
+func TestDropHandler(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	key := generateTestKey(t, "Security Team", "security@example.com", "")
+	priv, _ := key.Armor()
+	postForm(a.AddKeyHandler, "/keys", url.Values{"name": {"security"}, "armored": {priv}})
+	var id int64
+	db.Get(&id, "SELECT id FROM keys WHERE name = 'security'")
+	path := "/drop/" + key.GetFingerprint()
+
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		a.DropHandler(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+	if w := get(); w.Code != http.StatusNotFound {
+		t.Fatalf("drop page of a key that did not opt in: expected 404, got %d", w.Code)
+	}
+
+	if w := postForm(a.DropKeyHandler, "/keys/drop", url.Values{"id": {fmt.Sprint(id)}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("enable drop: expected 303, got %d: %s", w.Code, w.Body.String())
+	}
+	w := get()
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "security@example.com") {
+		t.Fatalf("drop page: %d %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), strings.ToUpper(key.GetFingerprint()[:4])+" ") {
+		t.Error("drop page should show the grouped fingerprint")
+	}
+
+	w = postForm(a.DropHandler, path, url.Values{"message": {"found a bug"}, "contact": {"reporter@example.net"}})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "delivered") {
+		t.Fatalf("submit message: expected 200 confirmation, got %d: %s", w.Code, w.Body.String())
+	}
+	if armoredMessageRe.MatchString(w.Body.String()) {
+		t.Error("the confirmation page should not echo the ciphertext")
+	}
+	var stored struct {
+		KeyID      int64   `db:"key_id"`
+		Ciphertext string  `db:"ciphertext"`
+		Filename   *string `db:"filename"`
+		Contact    *string `db:"submitter_contact"`
+		Status     string  `db:"status"`
+	}
+	if err := db.Get(&stored, "SELECT key_id, ciphertext, filename, submitter_contact, status FROM inbox_messages ORDER BY id DESC LIMIT 1"); err != nil {
+		t.Fatalf("load inbox message: %v", err)
+	}
+	if stored.KeyID != id || stored.Status != "unread" || stored.Filename != nil || stored.Contact == nil || *stored.Contact != "reporter@example.net" {
+		t.Errorf("unexpected inbox message %+v", stored)
+	}
+	if got := decryptWith(t, key, stored.Ciphertext); got != "found a bug" {
+		t.Errorf("decrypted %q", got)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "report.txt")
+	fw.Write([]byte("proof of concept"))
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, path, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w = httptest.NewRecorder()
+	a.DropHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("submit file: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if err := db.Get(&stored, "SELECT key_id, ciphertext, filename, submitter_contact, status FROM inbox_messages ORDER BY id DESC LIMIT 1"); err != nil {
+		t.Fatalf("load inbox message: %v", err)
+	}
+	if stored.Filename == nil || *stored.Filename != "report.txt" {
+		t.Errorf("expected filename report.txt, got %v", stored.Filename)
+	}
+	if got := decryptWith(t, key, stored.Ciphertext); got != "proof of concept" {
+		t.Errorf("decrypted file %q", got)
+	}
+
+	if w := postForm(a.DropHandler, path, url.Values{"message": {"  "}}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("empty submission: expected 422, got %d", w.Code)
+	}
+	if w := postForm(a.DropHandler, "/drop/not-a-fingerprint", url.Values{"message": {"x"}}); w.Code != http.StatusNotFound {
+		t.Errorf("invalid fingerprint: expected 404, got %d", w.Code)
+	}
+
+	partner := generateTestKey(t, "Partner", "partner@example.com", "")
+	pub, _ := partner.GetArmoredPublicKey()
+	postForm(a.AddKeyHandler, "/keys", url.Values{"name": {"partner"}, "armored": {pub}})
+	var partnerID int64
+	db.Get(&partnerID, "SELECT id FROM keys WHERE name = 'partner'")
+	postForm(a.DropKeyHandler, "/keys/drop", url.Values{"id": {fmt.Sprint(partnerID)}})
+	if w := postForm(a.DropHandler, "/drop/"+partner.GetFingerprint(), url.Values{"message": {"hi"}}); w.Code != http.StatusOK {
+		t.Errorf("drop page of a public key: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	postForm(a.DropKeyHandler, "/keys/drop", url.Values{"id": {fmt.Sprint(id)}, "drop_enabled": {"false"}})
+	if w := get(); w.Code != http.StatusNotFound {
+		t.Errorf("closed drop page: expected 404, got %d", w.Code)
+	}
+}
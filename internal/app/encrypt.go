@@ -1,8 +1,11 @@
 package app
 
 import (
+	"errors"
 	"log/slog"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/ProtonMail/gopenpgp/v3/crypto"
@@ -10,54 +13,145 @@ import (
 	mm "h-cloud.io/web-gpg/internal/models"
 )
 
-// EncryptHandler encrypts plaintext using the selected PGP key.
+// EncryptHandler encrypts plaintext to the selected PGP key, or to every key
+// in the "recipients" list (key ids, email addresses and group names).
 func (a *App) EncryptHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 	keyID := r.FormValue("key")
+	recipients := r.FormValue("recipients")
 	plaintext := r.FormValue("input")
-
-	var k mm.Key
-	q := a.DB.Rebind("SELECT id, name, armored, is_private, encrypted_password FROM keys WHERE id = ?")
-	if err := a.DB.GetContext(r.Context(), &k, q, keyID); err != nil {
-		slog.Warn("encrypt: key not found", "key_id", keyID, "err", err)
-		http.Error(w, "key not found", http.StatusUnprocessableEntity)
+	profileName, ok := a.requestProfile(w, r)
+	if !ok {
 		return
 	}
 
-	kp, err := crypto.NewKeyFromArmored(k.Armored)
+	var keys []mm.Key
+	if strings.TrimSpace(recipients) != "" {
+		resolved, err := a.resolveRecipients(r.Context(), recipients)
+		if err != nil {
+			var rerr *recipientError
+			if errors.As(err, &rerr) {
+				slog.Warn("encrypt: unresolved recipient", "recipients", recipients, "err", err)
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			slog.Error("encrypt: failed to resolve recipients", "recipients", recipients, "err", err)
+			http.Error(w, "failed to resolve recipients: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		keys = resolved
+	} else {
+		var k mm.Key
+		scope, args := keyScope(r.Context(), false)
+		q := a.DB.Rebind("SELECT id, name, armored, is_private, encrypted_password, trust_level FROM keys WHERE id = ? AND " + scope)
+		if err := a.DB.GetContext(r.Context(), &k, q, append([]interface{}{keyID}, args...)...); err != nil {
+			slog.Warn("encrypt: key not found", "key_id", keyID, "err", err)
+			http.Error(w, "key not found", http.StatusUnprocessableEntity)
+			return
+		}
+		keys = []mm.Key{k}
+	}
+
+	ring, err := crypto.NewKeyRing(nil)
 	if err != nil {
-		slog.Error("encrypt: failed to parse stored key", "key_id", keyID, "name", k.Name, "err", err)
-		http.Error(w, "stored key is invalid: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "failed to prepare encryption: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	for i := range keys {
+		k := &keys[i]
+		if !a.checkRecipientTrust(w, k) {
+			return
+		}
+		kp, err := crypto.NewKeyFromArmored(k.Armored)
+		if err != nil {
+			slog.Error("encrypt: failed to parse stored key", "key_id", k.ID, "name", k.Name, "err", err)
+			http.Error(w, "stored key is invalid: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := ring.AddKey(kp); err != nil {
+			slog.Error("encrypt: failed to add recipient", "key_id", k.ID, "name", k.Name, "err", err)
+			http.Error(w, "failed to add recipient "+k.Name+": "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 
-	encHandle, err := crypto.PGP().Encryption().Recipient(kp).New()
+	// The profile decides whether SEIPDv2 (AEAD) may be used; go-crypto falls
+	// back to SEIPDv1 unless every recipient key advertises SEIPDv2 support.
+	encHandle, err := a.pgp(profileName).Encryption().Recipients(ring).New()
 	if err != nil {
-		slog.Error("encrypt: failed to build encryption handle", "key_id", keyID, "name", k.Name, "err", err)
+		slog.Error("encrypt: failed to build encryption handle", "recipients", len(keys), "err", err)
 		http.Error(w, "failed to prepare encryption: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	pgpMsg, err := encHandle.Encrypt([]byte(plaintext))
 	if err != nil {
-		slog.Error("PGP encryption failed", "key_id", keyID, "err", err)
+		slog.Error("PGP encryption failed", "recipients", len(keys), "err", err)
 		http.Error(w, "encryption failed: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	armored, err := pgpMsg.Armor()
 	if err != nil {
-		slog.Error("encrypt: failed to armor ciphertext", "key_id", keyID, "err", err)
+		slog.Error("encrypt: failed to armor ciphertext", "recipients", len(keys), "err", err)
 		http.Error(w, "failed to armor message: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	format := messageFormat(pgpMsg)
+	slog.Debug("message encrypted", "recipients", len(keys), "profile", profileName, "format", format)
+
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-PGP-Profile", profileName)
+	w.Header().Set("X-PGP-Format", format)
 	w.Write([]byte(armored))
 }
 
+// unlockPrivateKey parses a stored private key and, if it is passphrase
+// protected, unlocks it with the stored passphrase. On failure it writes an
+// HTTP error and returns nil. op prefixes log messages (e.g. "decrypt").
+func (a *App) unlockPrivateKey(w http.ResponseWriter, k *mm.Key, op string) *crypto.Key {
+	priv, err := crypto.NewKeyFromArmored(k.Armored)
+	if err != nil {
+		slog.Error(op+": failed to parse stored private key", "key_id", k.ID, "name", k.Name, "err", err)
+		http.Error(w, "stored private key is invalid: "+err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+
+	locked, err := priv.IsLocked()
+	if err != nil {
+		slog.Error(op+": failed to inspect private key lock state", "key_id", k.ID, "name", k.Name, "err", err)
+		http.Error(w, "failed to inspect private key: "+err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	if !locked {
+		return priv
+	}
+
+	if k.EncryptedPasshex == nil || *k.EncryptedPasshex == "" {
+		http.Error(w, "private key is passphrase-protected but no passphrase was stored", http.StatusUnprocessableEntity)
+		return nil
+	}
+	pwBytes, err := a.Crypto.Decrypt(*k.EncryptedPasshex)
+	if err != nil {
+		slog.Error(op+": failed to decrypt stored passphrase", "key_id", k.ID, "name", k.Name, "err", err)
+		http.Error(w, "failed to decrypt stored passphrase: "+err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	unlocked, err := priv.Unlock(pwBytes)
+	if err != nil {
+		slog.Warn(op+": stored passphrase did not unlock private key", "key_id", k.ID, "name", k.Name, "err", err)
+		http.Error(w, "stored passphrase is wrong for this key: "+err.Error(), http.StatusUnprocessableEntity)
+		return nil
+	}
+	return unlocked
+}
+
 // DecryptHandler decrypts a PGP message using the selected private key.
+// With "message" set to an inbox message id, that message is decrypted with
+// the key it was submitted to and marked as read; uploaded files are
+// returned as attachments.
 func (a *App) DecryptHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -66,9 +160,24 @@ func (a *App) DecryptHandler(w http.ResponseWriter, r *http.Request) {
 	keyID := r.FormValue("key")
 	input := r.FormValue("input")
 
+	var inboxMsg *inboxCiphertext
+	if id := r.FormValue("message"); id != "" {
+		var m inboxCiphertext
+		scope, args := inboxScope(r.Context())
+		q := a.DB.Rebind("SELECT id, key_id, ciphertext, filename, status FROM inbox_messages WHERE id = ? AND " + scope)
+		if err := a.DB.GetContext(r.Context(), &m, q, append([]any{id}, args...)...); err != nil {
+			slog.Warn("decrypt: inbox message not found", "message_id", id, "err", err)
+			http.Error(w, "message not found", http.StatusUnprocessableEntity)
+			return
+		}
+		inboxMsg = &m
+		keyID, input = strconv.FormatInt(m.KeyID, 10), m.Ciphertext
+	}
+
 	var k mm.Key
-	q := a.DB.Rebind("SELECT id, name, armored, is_private, encrypted_password FROM keys WHERE id = ?")
-	if err := a.DB.GetContext(r.Context(), &k, q, keyID); err != nil {
+	scope, args := keyScope(r.Context(), false)
+	q := a.DB.Rebind("SELECT id, name, armored, is_private, encrypted_password FROM keys WHERE id = ? AND " + scope)
+	if err := a.DB.GetContext(r.Context(), &k, q, append([]interface{}{keyID}, args...)...); err != nil {
 		slog.Warn("decrypt: key not found", "key_id", keyID, "err", err)
 		http.Error(w, "key not found", http.StatusUnprocessableEntity)
 		return
@@ -79,50 +188,17 @@ func (a *App) DecryptHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	priv, err := crypto.NewKeyFromArmored(k.Armored)
-	if err != nil {
-		slog.Error("decrypt: failed to parse stored private key", "key_id", keyID, "name", k.Name, "err", err)
-		http.Error(w, "stored private key is invalid: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	locked, err := priv.IsLocked()
-	if err != nil {
-		slog.Error("decrypt: failed to inspect private key lock state", "key_id", keyID, "name", k.Name, "err", err)
-		http.Error(w, "failed to inspect private key: "+err.Error(), http.StatusInternalServerError)
+	keyToUse := a.unlockPrivateKey(w, &k, "decrypt")
+	if keyToUse == nil {
 		return
 	}
 
-	var keyToUse *crypto.Key
-	if locked {
-		if k.EncryptedPasshex != nil && *k.EncryptedPasshex != "" {
-			pwBytes, err := a.Crypto.Decrypt(*k.EncryptedPasshex)
-			if err != nil {
-				slog.Error("decrypt: failed to decrypt stored passphrase", "key_id", keyID, "name", k.Name, "err", err)
-				http.Error(w, "failed to decrypt stored passphrase: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
-			unlocked, err := priv.Unlock(pwBytes)
-			if err != nil {
-				slog.Warn("decrypt: stored passphrase did not unlock private key", "key_id", keyID, "name", k.Name, "err", err)
-				http.Error(w, "stored passphrase is wrong for this key: "+err.Error(), http.StatusUnprocessableEntity)
-				return
-			}
-			keyToUse = unlocked
-		} else {
-			http.Error(w, "private key is passphrase-protected but no passphrase was stored", http.StatusUnprocessableEntity)
-			return
-		}
-	} else {
-		keyToUse = priv
-	}
-
 	if !strings.HasPrefix(strings.TrimSpace(input), "-----BEGIN PGP MESSAGE-----") {
 		http.Error(w, "invalid armored message", http.StatusUnprocessableEntity)
 		return
 	}
 
-	decHandle, err := crypto.PGP().Decryption().DecryptionKey(keyToUse).New()
+	decHandle, err := a.pgp("").Decryption().DecryptionKey(keyToUse).New()
 	if err != nil {
 		slog.Error("decrypt: failed to build decryption handle", "key_id", keyID, "name", k.Name, "err", err)
 		http.Error(w, "failed to prepare decryption: "+err.Error(), http.StatusInternalServerError)
@@ -135,6 +211,29 @@ func (a *App) DecryptHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if inboxMsg != nil {
+		if inboxMsg.Status == inboxUnread {
+			if err := a.setInboxStatus(r.Context(), inboxMsg.ID, inboxRead); err != nil {
+				slog.Warn("decrypt: failed to mark inbox message read", "message_id", inboxMsg.ID, "err", err)
+			}
+		}
+		if inboxMsg.Filename != nil {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": *inboxMsg.Filename}))
+			w.Write(decResult.Bytes())
+			return
+		}
+	}
+
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Write(decResult.Bytes())
 }
+
+// inboxCiphertext is the part of an inbox message DecryptHandler needs.
+type inboxCiphertext struct {
+	ID         int64   `db:"id"`
+	KeyID      int64   `db:"key_id"`
+	Ciphertext string  `db:"ciphertext"`
+	Filename   *string `db:"filename"`
+	Status     string  `db:"status"`
+}
@@ -0,0 +1,278 @@
+package app
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/ProtonMail/gopenpgp/v3/crypto"
+	"rsc.io/qr"
+)
+
+// pgpWordsEven and pgpWordsOdd are the PGP word list: bytes at even
+// positions of a fingerprint are read from the two-syllable list, bytes at
+// odd positions from the three-syllable list, so swapped or dropped words
+// are noticed when reading aloud.
+var pgpWordsEven = [256]string{
+	"aardvark", "absurd", "accrue", "acme", "adrift", "adult", "afflict", "ahead",
+	"aimless", "Algol", "allow", "alone", "ammo", "ancient", "apple", "artist",
+	"assume", "Athens", "atlas", "Aztec", "baboon", "backfield", "backward", "banjo",
+	"beaming", "bedlamp", "beehive", "beeswax", "befriend", "Belfast", "berserk", "billiard",
+	"bison", "blackjack", "blockade", "blowtorch", "bluebird", "bombast", "bookshelf", "brackish",
+	"breadline", "breakup", "brickyard", "briefcase", "Burbank", "button", "buzzard", "cement",
+	"chairlift", "chatter", "checkup", "chisel", "choking", "chopper", "Christmas", "clamshell",
+	"classic", "classroom", "cleanup", "clockwork", "cobra", "commence", "concert", "cowbell",
+	"crackdown", "cranky", "crowfoot", "crucial", "crumpled", "crusade", "cubic", "dashboard",
+	"deadbolt", "deckhand", "dogsled", "dragnet", "drainage", "dreadful", "drifter", "dropper",
+	"drumbeat", "drunken", "Dupont", "dwelling", "eating", "edict", "egghead", "eightball",
+	"endorse", "endow", "enlist", "erase", "escape", "exceed", "eyeglass", "eyetooth",
+	"facial", "fallout", "flagpole", "flatfoot", "flytrap", "fracture", "framework", "freedom",
+	"frighten", "gazelle", "Geiger", "glitter", "glucose", "goggles", "goldfish", "gremlin",
+	"guidance", "hamlet", "highchair", "hockey", "indoors", "indulge", "inverse", "involve",
+	"island", "jawbone", "keyboard", "kickoff", "kiwi", "klaxon", "locale", "lockup",
+	"merit", "minnow", "miser", "Mohawk", "mural", "music", "necklace", "Neptune",
+	"newborn", "nightbird", "Oakland", "obtuse", "offload", "optic", "orca", "payday",
+	"peachy", "pheasant", "physique", "playhouse", "Pluto", "preclude", "prefer", "preshrunk",
+	"printer", "prowler", "pupil", "puppy", "python", "quadrant", "quiver", "quota",
+	"ragtime", "ratchet", "rebirth", "reform", "regain", "reindeer", "rematch", "repay",
+	"retouch", "revenge", "reward", "rhythm", "ribcage", "ringbolt", "robust", "rocker",
+	"ruffled", "sailboat", "sawdust", "scallion", "scenic", "scorecard", "Scotland", "seabird",
+	"select", "sentence", "shadow", "shamrock", "showgirl", "skullcap", "skydive", "slingshot",
+	"slowdown", "snapline", "snapshot", "snowcap", "snowslide", "solo", "southward", "soybean",
+	"spaniel", "spearhead", "spellbind", "spheroid", "spigot", "spindle", "spyglass", "stagehand",
+	"stagnate", "stairway", "standard", "stapler", "steamship", "sterling", "stockman", "stopwatch",
+	"stormy", "sugar", "surmount", "suspense", "sweatband", "swelter", "tactics", "talon",
+	"tapeworm", "tempest", "tiger", "tissue", "tonic", "topmost", "tracker", "transit",
+	"trauma", "treadmill", "Trojan", "trouble", "tumor", "tunnel", "tycoon", "uncut",
+	"unearth", "unwind", "uproot", "upset", "upshot", "vapor", "village", "virus",
+	"Vulcan", "waffle", "wallet", "watchword", "wayside", "willow", "woodlark", "Zulu",
+}
+
+var pgpWordsOdd = [256]string{
+	"adroitness", "adviser", "aftermath", "aggregate", "alkali", "almighty", "amulet", "amusement",
+	"antenna", "applicant", "Apollo", "armistice", "article", "asteroid", "Atlantic", "atmosphere",
+	"autopsy", "Babylon", "backwater", "barbecue", "belowground", "bifocals", "bodyguard", "bookseller",
+	"borderline", "bottomless", "Bradbury", "bravado", "Brazilian", "breakaway", "Burlington", "businessman",
+	"butterfat", "Camelot", "candidate", "cannonball", "Capricorn", "caravan", "caretaker", "celebrate",
+	"cellulose", "certify", "chambermaid", "Cherokee", "Chicago", "clergyman", "coherence", "combustion",
+	"commando", "company", "component", "concurrent", "confidence", "conformist", "congregate", "consensus",
+	"consulting", "corporate", "corrosion", "councilman", "crossover", "crucifix", "cumbersome", "customer",
+	"Dakota", "decadence", "December", "decimal", "designing", "detector", "detergent", "determine",
+	"dictator", "dinosaur", "direction", "disable", "disbelief", "disruptive", "distortion", "document",
+	"embezzle", "enchanting", "enrollment", "enterprise", "equation", "equipment", "escapade", "Eskimo",
+	"everyday", "examine", "existence", "exodus", "fascinate", "filament", "finicky", "forever",
+	"fortitude", "frequency", "gadgetry", "Galveston", "getaway", "glossary", "gossamer", "graduate",
+	"gravity", "guitarist", "hamburger", "Hamilton", "handiwork", "hazardous", "headwaters", "hemisphere",
+	"hesitate", "hideaway", "holiness", "hurricane", "hydraulic", "impartial", "impetus", "inception",
+	"indigo", "inertia", "infancy", "inferno", "informant", "insincere", "insurgent", "integrate",
+	"intention", "inventive", "Istanbul", "Jamaica", "Jupiter", "leprosy", "letterhead", "liberty",
+	"maritime", "matchmaker", "maverick", "Medusa", "megaton", "microscope", "microwave", "midsummer",
+	"millionaire", "miracle", "misnomer", "molasses", "molecule", "Montana", "monument", "mosquito",
+	"narrative", "nebula", "newsletter", "Norwegian", "October", "Ohio", "onlooker", "opulent",
+	"Orlando", "outfielder", "Pacific", "pandemic", "Pandora", "paperweight", "paragon", "paragraph",
+	"paramount", "passenger", "pedigree", "Pegasus", "penetrate", "perceptive", "performance", "pharmacy",
+	"phonetic", "photograph", "pioneer", "pocketful", "politeness", "positive", "potato", "processor",
+	"provincial", "proximate", "puberty", "publisher", "pyramid", "quantity", "racketeer", "rebellion",
+	"recipe", "recover", "repellent", "replica", "reproduce", "resistor", "responsive", "retraction",
+	"retrieval", "retrospect", "revenue", "revival", "revolver", "sandalwood", "sardonic", "Saturday",
+	"savagery", "scavenger", "sensation", "sociable", "souvenir", "specialist", "speculate", "stethoscope",
+	"stupendous", "supportive", "surrender", "suspicious", "sympathy", "tambourine", "telephone", "therapist",
+	"tobacco", "tolerance", "tomorrow", "torpedo", "tradition", "travesty", "trombonist", "truncated",
+	"typewriter", "ultimate", "undaunted", "underfoot", "unicorn", "unify", "universe", "unravel",
+	"upcoming", "vacancy", "vagabond", "vertigo", "Virginia", "visitor", "vocalist", "voyager",
+	"warranty", "Waterloo", "whimsical", "Wichita", "Wilmington", "Wyoming", "yesteryear", "Yucatan",
+}
+
+// PGPWords returns the PGP word list reading of the hex fingerprint fpr, or
+// nil if fpr is not hex.
+func PGPWords(fpr string) []string {
+	b, err := hex.DecodeString(fpr)
+	if err != nil {
+		return nil
+	}
+	words := make([]string, len(b))
+	for i, c := range b {
+		if i%2 == 0 {
+			words[i] = pgpWordsEven[c]
+		} else {
+			words[i] = pgpWordsOdd[c]
+		}
+	}
+	return words
+}
+
+// fingerprintFromWords decodes a PGP word list reading back to a lower-case
+// hex fingerprint. Words are matched case-insensitively and must alternate
+// between the two lists as they do when generated.
+func fingerprintFromWords(words []string) (string, bool) {
+	b := make([]byte, len(words))
+	for i, w := range words {
+		list := &pgpWordsEven
+		if i%2 == 1 {
+			list = &pgpWordsOdd
+		}
+		found := false
+		for c, candidate := range list {
+			if strings.EqualFold(candidate, w) {
+				b[i], found = byte(c), true
+				break
+			}
+		}
+		if !found {
+			return "", false
+		}
+	}
+	return hex.EncodeToString(b), true
+}
+
+// parseFingerprint normalizes a fingerprint as people paste it: hex in any
+// case with spaces, colons or a 0x or openpgp4fpr: prefix, or its PGP word
+// list reading. Only full v4 and v6 fingerprints are accepted; key IDs are too
+// short to verify a key.
+func parseFingerprint(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	if len(s) > len("openpgp4fpr:") && strings.EqualFold(s[:len("openpgp4fpr:")], "openpgp4fpr:") {
+		s = s[len("openpgp4fpr:"):]
+	}
+	if fields := strings.Fields(s); len(fields) == 20 || len(fields) == 32 {
+		if fpr, ok := fingerprintFromWords(fields); ok {
+			return fpr, true
+		}
+	}
+	s = strings.TrimPrefix(strings.ToLower(s), "0x")
+	s = strings.NewReplacer(" ", "", ":", "", "\t", "", "\n", "", "\r", "").Replace(s)
+	return s, isHexFingerprint(s)
+}
+
+// fingerprintQR renders the openpgp4fpr URI of fpr as an SVG QR code. The
+// URI is upper-cased so it fits the compact alphanumeric QR mode.
+func fingerprintQR(fpr string) (string, error) {
+	return qrSVG("OPENPGP4FPR:" + strings.ToUpper(fpr))
+}
+
+// qrSVG renders text as an SVG QR code.
+func qrSVG(text string) (string, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return "", err
+	}
+	const quiet = 4 // modules of white border required around the code
+	size := code.Size + 2*quiet
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, size, size)
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if code.Black(x, y) {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x+quiet, y+quiet)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.String(), nil
+}
+
+// keyFingerprint returns the lower-case fingerprint of a stored key, parsing
+// armored for rows stored before fingerprints were recorded.
+func keyFingerprint(fingerprint *string, armored string) string {
+	if fingerprint != nil && *fingerprint != "" {
+		return strings.ToLower(*fingerprint)
+	}
+	if key, err := crypto.NewKeyFromArmored(armored); err == nil {
+		return key.GetFingerprint()
+	}
+	return ""
+}
+
+// FingerprintQRHandler returns the fingerprint of key "id" as an SVG QR code
+// of its openpgp4fpr URI, for scanning with a phone's OpenPGP app.
+func (a *App) FingerprintQRHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusUnprocessableEntity)
+		return
+	}
+	var k struct {
+		Armored     string  `db:"armored"`
+		Fingerprint *string `db:"fingerprint"`
+	}
+	scope, args := keyScope(r.Context(), false)
+	q := a.DB.Rebind("SELECT armored, fingerprint FROM keys WHERE id = ? AND " + scope)
+	if err := a.DB.GetContext(r.Context(), &k, q, append([]interface{}{id}, args...)...); err != nil {
+		http.Error(w, "key not found", http.StatusNotFound)
+		return
+	}
+	fpr := keyFingerprint(k.Fingerprint, k.Armored)
+	if fpr == "" {
+		http.Error(w, "stored key is invalid", http.StatusInternalServerError)
+		return
+	}
+	svg, err := fingerprintQR(fpr)
+	if err != nil {
+		slog.Error("failed to render fingerprint QR code", "key_id", id, "err", err)
+		http.Error(w, "failed to render QR code", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Write([]byte(svg))
+}
+
+// fingerprintMatch is a stored key matched by CompareFingerprintHandler.
+type fingerprintMatch struct {
+	ID     int64  `json:"id"`
+	Name   string `json:"name"`
+	Subkey bool   `json:"subkey"` // the fingerprint is one of the key's subkeys
+}
+
+// CompareFingerprintHandler reports which stored keys, if any, carry
+// "fingerprint", given as hex in any common notation or as PGP words. The
+// response holds the normalized fingerprint, its PGP words and the matches.
+func (a *App) CompareFingerprintHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fpr, ok := parseFingerprint(r.FormValue("fingerprint"))
+	if !ok {
+		http.Error(w, "invalid fingerprint: expected 40 or 64 hex digits, or 20 or 32 PGP words", http.StatusUnprocessableEntity)
+		return
+	}
+	var rows []struct {
+		ID      int64  `db:"id"`
+		Name    string `db:"name"`
+		Armored string `db:"armored"`
+	}
+	scope, args := keyScope(r.Context(), false)
+	if err := a.DB.SelectContext(r.Context(), &rows, a.DB.Rebind("SELECT id, name, armored FROM keys WHERE "+scope+" ORDER BY id"), args...); err != nil {
+		slog.Error("failed to load keys", "err", err)
+		http.Error(w, "failed to load keys", http.StatusInternalServerError)
+		return
+	}
+	matches := []fingerprintMatch{}
+	for _, row := range rows {
+		k, err := crypto.NewKeyFromArmored(row.Armored)
+		if err != nil {
+			continue
+		}
+		e := k.GetEntity()
+		if hex.EncodeToString(e.PrimaryKey.Fingerprint) == fpr {
+			matches = append(matches, fingerprintMatch{ID: row.ID, Name: row.Name})
+			continue
+		}
+		for _, sub := range e.Subkeys {
+			if hex.EncodeToString(sub.PublicKey.Fingerprint) == fpr {
+				matches = append(matches, fingerprintMatch{ID: row.ID, Name: row.Name, Subkey: true})
+				break
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"fingerprint": groupFingerprint(fpr),
+		"words":       PGPWords(fpr),
+		"matches":     matches,
+	})
+}
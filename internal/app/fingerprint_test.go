@@ -0,0 +1,135 @@
+package app_test
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	apppkg "h-cloud.io/web-gpg/internal/app"
+)
+
+// TestPGPWords verifies the word list against the published example and
+// that every byte maps to a distinct word.
+func TestPGPWords(t *testing.T) {
+	got := strings.Join(apppkg.PGPWords("E58294F2E9A227486E8B061B31CC528FD7FA3F19"), " ")
+	want := "topmost Istanbul Pluto vagabond treadmill Pacific brackish dictator goldfish Medusa afflict bravado chatter revolver Dupont midsummer stopwatch whimsical cowbell bottomless"
+	if got != want {
+		t.Errorf("PGPWords:\n got %s\nwant %s", got, want)
+	}
+
+	// Every byte value once at an even and once at an odd position.
+	all := make([]byte, 512)
+	for i := range all {
+		all[i] = byte(i / 2)
+	}
+	seen := map[string]bool{}
+	for _, w := range apppkg.PGPWords(hex.EncodeToString(all)) {
+		if w == "" || seen[strings.ToLower(w)] {
+			t.Errorf("word %q is empty or used twice", w)
+		}
+		seen[strings.ToLower(w)] = true
+	}
+	if apppkg.PGPWords("not hex") != nil {
+		t.Error("expected nil for invalid input")
+	}
+}
+
+// TestFingerprintQRHandler verifies the QR code is served as SVG.
+func TestFingerprintQRHandler(t *testing.T) {
+	a, _ := setupTestApp(t)
+	key := generateTestKey(t, "Alice", "alice@example.com", "")
+	id := addPublishedKey(t, a, "alice", key, nil)
+
+	w := httptest.NewRecorder()
+	a.FingerprintQRHandler(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/keys/qr?id=%d", id), nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/svg+xml" {
+		t.Fatalf("QR code: %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if body := w.Body.String(); !strings.HasPrefix(body, "<svg") || !strings.Contains(body, "h1v1h-1z") {
+		t.Errorf("expected an SVG QR code, got %.100s", body)
+	}
+
+	w = httptest.NewRecorder()
+	a.ViewKeyHandler(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/keys/view?id=%d", id), nil))
+	body := w.Body.String()
+	if !strings.Contains(body, fmt.Sprintf(`src="/keys/qr?id=%d"`, id)) || !strings.Contains(body, "openpgp4fpr:"+key.GetFingerprint()) {
+		t.Error("key view should embed the QR code")
+	}
+	if !strings.Contains(body, strings.Join(apppkg.PGPWords(key.GetFingerprint()), " ")) {
+		t.Error("key view should show the PGP words")
+	}
+
+	for path, code := range map[string]int{"/keys/qr": http.StatusUnprocessableEntity, "/keys/qr?id=9999": http.StatusNotFound} {
+		w := httptest.NewRecorder()
+		a.FingerprintQRHandler(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != code {
+			t.Errorf("%s: expected %d, got %d", path, code, w.Code)
+		}
+	}
+}
+
+// TestCompareFingerprintHandler verifies received fingerprints are matched
+// against stored keys in every common notation.
+func TestCompareFingerprintHandler(t *testing.T) {
+	a, _ := setupTestApp(t)
+	alice := generateTestKey(t, "Alice", "alice@example.com", "")
+	aliceID := addPublishedKey(t, a, "alice", alice, nil)
+	fpr := alice.GetFingerprint()
+	var grouped []string
+	for i := 0; i < len(fpr); i += 4 {
+		grouped = append(grouped, strings.ToUpper(fpr[i:i+4]))
+	}
+	subkey := hex.EncodeToString(alice.GetEntity().Subkeys[0].PublicKey.Fingerprint)
+
+	compare := func(input string) (int, []struct {
+		ID     int64 `json:"id"`
+		Subkey bool  `json:"subkey"`
+	}) {
+		t.Helper()
+		w := postForm(a.CompareFingerprintHandler, "/keys/compare", url.Values{"fingerprint": {input}})
+		var resp struct {
+			Matches []struct {
+				ID     int64 `json:"id"`
+				Subkey bool  `json:"subkey"`
+			} `json:"matches"`
+		}
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+		}
+		return w.Code, resp.Matches
+	}
+
+	for _, input := range []string{
+		fpr,
+		strings.Join(grouped, " "),
+		"0x" + strings.ToUpper(fpr),
+		"openpgp4fpr:" + fpr,
+		strings.Join(grouped, ":"),
+		strings.ToLower(strings.Join(apppkg.PGPWords(fpr), " ")),
+	} {
+		code, matches := compare(input)
+		if code != http.StatusOK || len(matches) != 1 || matches[0].ID != aliceID || matches[0].Subkey {
+			t.Errorf("compare %q: %d %+v", input, code, matches)
+		}
+	}
+
+	if code, matches := compare(subkey); code != http.StatusOK || len(matches) != 1 || !matches[0].Subkey {
+		t.Errorf("compare subkey: %d %+v", code, matches)
+	}
+	other := generateTestKey(t, "Mallory", "alice@example.com", "")
+	if code, matches := compare(other.GetFingerprint()); code != http.StatusOK || len(matches) != 0 {
+		t.Errorf("compare unknown key: %d %+v", code, matches)
+	}
+	for _, input := range []string{"", fpr[:16], "aardvark adroitness", fpr + "00"} {
+		if code, _ := compare(input); code != http.StatusUnprocessableEntity {
+			t.Errorf("compare %q: expected 422, got %d", input, code)
+		}
+	}
+}
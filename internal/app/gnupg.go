@@ -0,0 +1,311 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ownertrustLevels maps GnuPG ownertrust values (the low nibble of the second
+// field in `gpg --export-ownertrust` output) to trust levels. 0-2 are
+// "unknown", "expired" and "undefined", which all mean no decision was made.
+var ownertrustLevels = map[int]string{
+	0: TrustUnknown,
+	1: TrustUnknown,
+	2: TrustUnknown,
+	3: TrustNever,
+	4: TrustMarginal,
+	5: TrustFull,
+	6: TrustUltimate,
+}
+
+// parseOwnertrust reads `gpg --export-ownertrust` output ("FPR:VALUE:" per
+// line, '#' comments) into a map from lower-case fingerprint to trust level.
+func parseOwnertrust(r io.Reader) (map[string]string, error) {
+	levels := map[string]string{}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("ownertrust line %d: expected FINGERPRINT:VALUE:", n)
+		}
+		fpr := strings.ToLower(fields[0])
+		if !isHexFingerprint(fpr) {
+			return nil, fmt.Errorf("ownertrust line %d: invalid fingerprint %q", n, fields[0])
+		}
+		v, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("ownertrust line %d: invalid trust value %q", n, fields[1])
+		}
+		// The high bits carry flags such as "disabled"; only the low nibble
+		// is the trust value.
+		level, ok := ownertrustLevels[v&0x0f]
+		if !ok {
+			return nil, fmt.Errorf("ownertrust line %d: unknown trust value %d", n, v)
+		}
+		levels[fpr] = level
+	}
+	return levels, sc.Err()
+}
+
+// isHexFingerprint reports whether s is a v4 (40 hex digits) or v5/v6
+// (64 hex digits) fingerprint.
+func isHexFingerprint(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// gnupgImportResult reports what happened to one key of a GnuPG import.
+type gnupgImportResult struct {
+	ID              int64  `json:"id,omitempty"`
+	Name            string `json:"name"`
+	Fingerprint     string `json:"fingerprint"`
+	Private         bool   `json:"private"`
+	Trust           string `json:"trust"`
+	Status          string `json:"status"` // imported, upgraded, exists or failed
+	NeedsPassphrase bool   `json:"needs_passphrase"`
+	Error           string `json:"error,omitempty"`
+}
+
+// ImportGnuPGHandler bulk-imports keys exported from a GnuPG home directory.
+// It accepts the output of `gpg --export-secret-keys` (or `gpg --export`) as
+// the "keyfile" upload or "armored" field, and optionally the output of
+// `gpg --export-ownertrust` as an "ownertrust" upload or field, whose trust
+// values are applied to the imported keys.
+//
+// Passphrases for protected private keys are taken from "passphrase_<FPR>"
+// fields, falling back to a shared "passphrase" field. A passphrase is only
+// stored if it unlocks the key; keys left without one are reported with
+// needs_passphrase so the client can prompt and send it to /keys/passphrase.
+// Keys already stored (same fingerprint) have their trust level updated, and
+// a stored public key is upgraded to the private key when one is imported.
+func (a *App) ImportGnuPGHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		r.Body = http.MaxBytesReader(w, r.Body, maxKeyUploadBytes)
+		if err := r.ParseMultipartForm(maxKeyUploadBytes); err != nil {
+			http.Error(w, "invalid upload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	material, err := submittedKeyMaterial(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	keys, err := parseKeyMaterial(material)
+	if err != nil {
+		slog.Error("gnupg import: failed to parse keys", "err", err)
+		http.Error(w, "invalid PGP key export: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ownertrust, err := submittedText(r, "ownertrust")
+	if err != nil {
+		http.Error(w, "failed to read ownertrust: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	levels, err := parseOwnertrust(strings.NewReader(ownertrust))
+	if err != nil {
+		http.Error(w, "invalid ownertrust: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	passphrases := map[string]string{}
+	for field, values := range r.Form {
+		if fpr, ok := strings.CutPrefix(field, "passphrase_"); ok && len(values) > 0 && values[0] != "" {
+			passphrases[strings.ToLower(fpr)] = values[0]
+		}
+	}
+	shared := r.FormValue("passphrase")
+	mode := parsePinMode(r.FormValue("pin"))
+
+	results := make([]gnupgImportResult, 0, len(keys))
+	imported := 0
+	for _, pk := range keys {
+		fpr := pk.Key.GetFingerprint()
+		res := gnupgImportResult{
+			Name:        keyDisplayName(pk.Key),
+			Fingerprint: strings.ToUpper(fpr),
+			Private:     pk.Key.IsPrivate(),
+			Trust:       TrustUnknown,
+		}
+		if level, ok := levels[fpr]; ok {
+			res.Trust = level
+		}
+
+		existing, err := a.keyIDByFingerprint(r.Context(), fpr)
+		if err != nil {
+			res.Status, res.Error = "failed", err.Error()
+			results = append(results, res)
+			continue
+		}
+		if existing != 0 {
+			res.ID, res.Status = existing, "exists"
+			_, setTrust := levels[fpr]
+			if err := a.updateStoredKey(r.Context(), &res, pk, setTrust, passphrases[fpr], shared); err != nil {
+				res.Status, res.Error, res.NeedsPassphrase = "failed", err.Error(), false
+			}
+			results = append(results, res)
+			continue
+		}
+
+		lint, err := a.lintForImport(pk.Key)
+		if err != nil {
+			res.Status, res.Error = "failed", err.Error()
+			results = append(results, res)
+			continue
+		}
+		rec := keyRecord{Name: res.Name, Armored: pk.Armored, Key: pk.Key, TrustLevel: res.Trust, LintWarnings: lint}
+		if res.Private {
+			res.NeedsPassphrase, res.Error = a.importPassphrase(&rec, passphrases[fpr], shared)
+		}
+
+		id, err := a.insertKey(r.Context(), rec, mode)
+		if err != nil {
+			var conflict *pinConflictError
+			if !errors.As(err, &conflict) {
+				slog.Error("gnupg import: failed to insert key", "fingerprint", res.Fingerprint, "err", err)
+			}
+			res.Status, res.Error, res.NeedsPassphrase = "failed", err.Error(), false
+			results = append(results, res)
+			continue
+		}
+		res.ID, res.Status = id, "imported"
+		imported++
+		results = append(results, res)
+	}
+
+	slog.Info("gnupg import finished", "keys", len(keys), "imported", imported, "ownertrust_entries", len(levels))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"keys": results})
+}
+
+// updateStoredKey applies an import to the already stored key res.ID: the
+// ownertrust level if setTrust, and the private key with its passphrase if
+// only the public key is stored. Keys outside the user's own keyring cannot
+// be changed.
+func (a *App) updateStoredKey(ctx context.Context, res *gnupgImportResult, pk parsedKey, setTrust bool, specific, shared string) error {
+	var storedPrivate bool
+	if err := a.DB.GetContext(ctx, &storedPrivate, a.DB.Rebind("SELECT is_private FROM keys WHERE id = ?"), res.ID); err != nil {
+		return err
+	}
+	var set []string
+	var args []interface{}
+	if setTrust {
+		set = append(set, "trust_level = ?")
+		args = append(args, res.Trust)
+	}
+	upgrade := res.Private && !storedPrivate
+	if upgrade {
+		rec := keyRecord{Name: res.Name, Armored: pk.Armored, Key: pk.Key}
+		res.NeedsPassphrase, res.Error = a.importPassphrase(&rec, specific, shared)
+		set = append(set, "armored = ?", "is_private = ?", "encrypted_password = ?", "password_bcrypt = ?")
+		args = append(args, rec.Armored, true, rec.EncryptedPassword, rec.PasswordBcrypt)
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	scope, scopeArgs := keyScope(ctx, true)
+	q := a.DB.Rebind("UPDATE keys SET " + strings.Join(set, ", ") + " WHERE id = ? AND " + scope)
+	result, err := a.DB.ExecContext(ctx, q, append(append(args, res.ID), scopeArgs...)...)
+	if err != nil {
+		return fmt.Errorf("update stored key: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errors.New("the stored key belongs to another user and was not changed")
+	}
+	if upgrade {
+		res.Status = "upgraded"
+		slog.Info("gnupg import: stored public key upgraded to private key", "id", res.ID, "fingerprint", res.Fingerprint)
+	}
+	return nil
+}
+
+// importPassphrase seals the passphrase for a private key being imported.
+// specific is the passphrase sent for this key's fingerprint; shared is the
+// one sent for all keys and is silently skipped if it does not fit. It
+// reports whether the key still needs a passphrase and, if a passphrase was
+// rejected, why.
+func (a *App) importPassphrase(rec *keyRecord, specific, shared string) (needsPassphrase bool, problem string) {
+	locked, err := rec.Key.IsLocked()
+	if err != nil {
+		return true, "failed to inspect private key: " + err.Error()
+	}
+	if !locked {
+		return false, ""
+	}
+	password := specific
+	if password == "" {
+		password = shared
+	}
+	if password == "" {
+		return true, ""
+	}
+	if err := checkPassphrase(rec.Key, password); err != nil {
+		if specific == "" {
+			return true, ""
+		}
+		return true, err.Error()
+	}
+	enc, hash, err := a.sealPassphrase(password)
+	if err != nil {
+		slog.Error("gnupg import: failed to encrypt passphrase", "name", rec.Name, "err", err)
+		return true, "failed to store passphrase: " + err.Error()
+	}
+	rec.EncryptedPassword, rec.PasswordBcrypt = enc, hash
+	return false, ""
+}
+
+// keyIDByFingerprint returns the id of the stored key with fingerprint fpr
+// that the current user may use, or 0 if there is none.
+func (a *App) keyIDByFingerprint(ctx context.Context, fpr string) (int64, error) {
+	var id int64
+	scope, args := keyScope(ctx, false)
+	q := a.DB.Rebind("SELECT id FROM keys WHERE fingerprint = ? AND " + scope + " ORDER BY id LIMIT 1")
+	err := a.DB.GetContext(ctx, &id, q, append([]interface{}{fpr}, args...)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return id, err
+}
+
+// submittedText returns the contents of the uploaded file named field if one
+// was sent, otherwise the form value of the same name.
+func submittedText(r *http.Request, field string) (string, error) {
+	if r.MultipartForm != nil {
+		if files := r.MultipartForm.File[field]; len(files) > 0 && files[0].Size > 0 {
+			f, err := files[0].Open()
+			if err != nil {
+				return "", err
+			}
+			defer f.Close()
+			b, err := io.ReadAll(f)
+			return string(b), err
+		}
+	}
+	return r.FormValue(field), nil
+}
@@ -0,0 +1,215 @@
+package app_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	gcrypto "github.com/ProtonMail/gopenpgp/v3/crypto"
+)
+
+type gnupgImportResponse struct {
+	Keys []struct {
+		ID              int64  `json:"id"`
+		Name            string `json:"name"`
+		Fingerprint     string `json:"fingerprint"`
+		Trust           string `json:"trust"`
+		Status          string `json:"status"`
+		NeedsPassphrase bool   `json:"needs_passphrase"`
+		Error           string `json:"error"`
+	} `json:"keys"`
+}
+
+// TestImportGnuPGHandler verifies a GnuPG secret key export is imported with
+// ownertrust levels applied and passphrases stored only where they unlock
+// the key.
+func TestImportGnuPGHandler(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	alice := generateTestKey(t, "Alice", "alice@example.com", "alice-pass")
+	bob := generateTestKey(t, "Bob", "bob@example.com", "bob-pass")
+	carol := generateTestKey(t, "Carol", "carol@example.com", "")
+	var export []byte
+	for _, k := range []interface{ Serialize() ([]byte, error) }{alice, bob, carol} {
+		b, err := k.Serialize()
+		if err != nil {
+			t.Fatalf("serialize: %v", err)
+		}
+		export = append(export, b...)
+	}
+	ownertrust := fmt.Sprintf("# List of assigned trustvalues\n%s:6:\n%s:3:\n%s:5:\n",
+		strings.ToUpper(alice.GetFingerprint()), strings.ToUpper(bob.GetFingerprint()), strings.ToUpper(carol.GetFingerprint()))
+
+	fields := map[string]string{
+		"ownertrust": ownertrust,
+		"passphrase": "alice-pass",
+		// A wrong passphrase sent for one key must not be stored.
+		"passphrase_" + strings.ToUpper(bob.GetFingerprint()): "wrong",
+	}
+	w := postMultipart(t, a.ImportGnuPGHandler, "/keys/import/gnupg", fields, "secring.gpg", export)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp gnupgImportResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v (%s)", err, w.Body.String())
+	}
+	if len(resp.Keys) != 3 {
+		t.Fatalf("expected 3 results, got %+v", resp.Keys)
+	}
+
+	want := map[string]struct {
+		trust       string
+		needsPass   bool
+		hasPassword bool
+	}{
+		"Alice <alice@example.com>": {"ultimate", false, true},
+		"Bob <bob@example.com>":     {"never", true, false},
+		"Carol <carol@example.com>": {"full", false, false},
+	}
+	for _, res := range resp.Keys {
+		exp, ok := want[res.Name]
+		if !ok || res.Status != "imported" {
+			t.Errorf("unexpected result %+v", res)
+			continue
+		}
+		if res.Trust != exp.trust || res.NeedsPassphrase != exp.needsPass {
+			t.Errorf("%s: trust=%s needs_passphrase=%v, want %s/%v", res.Name, res.Trust, res.NeedsPassphrase, exp.trust, exp.needsPass)
+		}
+		var row struct {
+			Trust    string  `db:"trust_level"`
+			Password *string `db:"encrypted_password"`
+		}
+		if err := db.Get(&row, "SELECT trust_level, encrypted_password FROM keys WHERE id = ?", res.ID); err != nil {
+			t.Fatalf("load %s: %v", res.Name, err)
+		}
+		if row.Trust != exp.trust || (row.Password != nil) != exp.hasPassword {
+			t.Errorf("%s stored trust=%s password=%v, want %s/%v", res.Name, row.Trust, row.Password != nil, exp.trust, exp.hasPassword)
+		}
+	}
+	if !strings.Contains(w.Body.String(), "passphrase does not unlock the key") {
+		t.Error("expected the wrong per-key passphrase to be reported")
+	}
+
+	// Re-importing only updates trust.
+	fields = map[string]string{"ownertrust": strings.ToUpper(bob.GetFingerprint()) + ":4:\n"}
+	w = postMultipart(t, a.ImportGnuPGHandler, "/keys/import/gnupg", fields, "secring.gpg", export)
+	var count int
+	db.Get(&count, "SELECT COUNT(*) FROM keys")
+	if count != 3 {
+		t.Fatalf("re-import duplicated keys: have %d", count)
+	}
+	var trust string
+	db.Get(&trust, "SELECT trust_level FROM keys WHERE fingerprint = ?", bob.GetFingerprint())
+	if trust != "marginal" {
+		t.Errorf("re-import trust = %q, want marginal", trust)
+	}
+}
+
+// TestImportGnuPGHandler_StoredKeys verifies importing the private half of a
+// stored public key upgrades it with its passphrase, and that trust is not
+// reported as applied to another user's shared key.
+func TestImportGnuPGHandler_StoredKeys(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	frank := generateTestKey(t, "Frank", "frank@example.com", "frank-pass")
+	pub, _ := frank.GetPublicKey()
+	postMultipart(t, a.ImportGnuPGHandler, "/keys/import/gnupg", nil, "pubring.gpg", pub)
+	priv, _ := frank.Serialize()
+	w := postMultipart(t, a.ImportGnuPGHandler, "/keys/import/gnupg", map[string]string{"passphrase": "frank-pass"}, "secring.gpg", priv)
+	var resp gnupgImportResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Keys) != 1 || resp.Keys[0].Status != "upgraded" || resp.Keys[0].NeedsPassphrase {
+		t.Fatalf("private half of a stored key: %s", w.Body.String())
+	}
+	var row struct {
+		Private  bool    `db:"is_private"`
+		Password *string `db:"encrypted_password"`
+	}
+	db.Get(&row, "SELECT is_private, encrypted_password FROM keys WHERE id = ?", resp.Keys[0].ID)
+	if !row.Private || row.Password == nil {
+		t.Errorf("expected the stored key to become private with a passphrase: %+v", row)
+	}
+	var count int
+	db.Get(&count, "SELECT COUNT(*) FROM keys")
+	if count != 1 {
+		t.Errorf("upgrading must not duplicate the key, have %d keys", count)
+	}
+
+	bootstrap := login(t, a, "", "test-master-password")
+	as(a, bootstrap, a.UsersHandler, http.MethodPost, "/users", url.Values{"username": {"admin"}, "password": {"admin-password"}})
+	admin := login(t, a, "admin", "admin-password")
+	as(a, admin, a.UsersHandler, http.MethodPost, "/users", url.Values{"username": {"alice"}, "password": {"alice-password"}})
+	alice := login(t, a, "alice", "alice-password")
+	gina, _ := generateTestKey(t, "Gina", "gina@example.com", "").GetArmoredPublicKey()
+	as(a, admin, a.AddKeyHandler, http.MethodPost, "/keys", url.Values{"name": {"gina"}, "armored": {gina}})
+	var ginaID string
+	db.Get(&ginaID, "SELECT id FROM keys WHERE name = 'gina'")
+	as(a, admin, a.ShareKeyHandler, http.MethodPost, "/keys/share", url.Values{"id": {ginaID}})
+	var ginaFpr string
+	db.Get(&ginaFpr, "SELECT fingerprint FROM keys WHERE id = ?", ginaID)
+	w = as(a, alice, a.ImportGnuPGHandler, http.MethodPost, "/keys/import/gnupg", url.Values{"armored": {gina}, "ownertrust": {strings.ToUpper(ginaFpr) + ":6:"}})
+	resp = gnupgImportResponse{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Keys) != 1 || resp.Keys[0].Status != "failed" {
+		t.Errorf("trust for another user's shared key: %s", w.Body.String())
+	}
+	var trust string
+	db.Get(&trust, "SELECT trust_level FROM keys WHERE id = ?", ginaID)
+	if trust != "unknown" {
+		t.Errorf("another user's key trust changed to %q", trust)
+	}
+}
+
+// TestImportGnuPGHandler_InvalidOwnertrust verifies malformed ownertrust
+// input is rejected before anything is stored.
+func TestImportGnuPGHandler_InvalidOwnertrust(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	bin, _ := generateTestKey(t, "Dave", "dave@example.com", "").GetPublicKey()
+	for _, ot := range []string{"not-a-fingerprint:6:", strings.Repeat("A", 40) + ":x:", strings.Repeat("A", 40) + ":9:"} {
+		w := postMultipart(t, a.ImportGnuPGHandler, "/keys/import/gnupg", map[string]string{"ownertrust": ot}, "pub.gpg", bin)
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%q: expected 422, got %d", ot, w.Code)
+		}
+	}
+	var count int
+	db.Get(&count, "SELECT COUNT(*) FROM keys")
+	if count != 0 {
+		t.Errorf("expected nothing stored, have %d keys", count)
+	}
+}
+
+// TestSetPassphraseHandler verifies a passphrase is stored only if it unlocks
+// the key, after which the key decrypts without prompting.
+func TestSetPassphraseHandler(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	key := generateTestKey(t, "Erin", "erin@example.com", "erin-pass")
+	armored, _ := key.Armor()
+	postForm(a.AddKeyHandler, "/keys", url.Values{"name": {"erin"}, "armored": {armored}})
+	var id int64
+	db.Get(&id, "SELECT id FROM keys WHERE name = 'erin'")
+
+	if w := postForm(a.SetPassphraseHandler, "/keys/passphrase", url.Values{"id": {fmt.Sprint(id)}, "password": {"nope"}}); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("wrong passphrase: expected 422, got %d", w.Code)
+	}
+	if w := postForm(a.SetPassphraseHandler, "/keys/passphrase", url.Values{"id": {fmt.Sprint(id)}, "password": {"erin-pass"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("set passphrase: expected 303, got %d: %s", w.Code, w.Body.String())
+	}
+
+	pub, _ := key.ToPublic()
+	encHandle, _ := gcrypto.PGP().Encryption().Recipient(pub).New()
+	msg, err := encHandle.Encrypt([]byte("hello erin"))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	armoredMsg, _ := msg.ArmorBytes()
+	dec := postForm(a.DecryptHandler, "/decrypt", url.Values{"key": {fmt.Sprint(id)}, "input": {string(armoredMsg)}})
+	if dec.Code != http.StatusOK || dec.Body.String() != "hello erin" {
+		t.Fatalf("decrypt with stored passphrase: %d %q", dec.Code, dec.Body.String())
+	}
+}
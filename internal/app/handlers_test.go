@@ -46,7 +46,7 @@ func setupTestApp(t *testing.T) (*apppkg.App, *sqlx.DB) {
 
 	crypto := cm.NewCryptoService(db)
 
-	files := []string{"../../templates/index.html", "../../templates/login.html"}
+	files := []string{"../../templates/index.html", "../../templates/login.html", "../../templates/drop.html", "../../templates/secret.html", "../../templates/directory.html"}
 	tmpl, err := template.ParseFiles(files...)
 	if err != nil {
 		t.Fatalf("parse templates: %v", err)
@@ -0,0 +1,346 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	openpgp "github.com/ProtonMail/go-crypto/openpgp/v2"
+)
+
+// maxHKPResults caps the number of keys returned by one HKP lookup.
+const maxHKPResults = 100
+
+// hkpQuery is a parsed /pks/lookup search term.
+type hkpQuery struct {
+	keyID uint64 // 0x-prefixed 8 or 16 hex digit key ID
+	short bool   // keyID is a 32-bit short ID
+	fpr   string // 0x-prefixed 40 or 64 hex digit fingerprint, lower-cased
+	text  string // anything else, lower-cased
+	exact bool
+}
+
+// parseHKPSearch parses an HKP search term: a 0x-prefixed key ID or
+// fingerprint, or text to look for in user IDs.
+func parseHKPSearch(search string, exact bool) (hkpQuery, error) {
+	search = strings.TrimSpace(search)
+	if search == "" {
+		return hkpQuery{}, errors.New("missing search")
+	}
+	hex, ok := strings.CutPrefix(strings.ToLower(search), "0x")
+	if !ok {
+		return hkpQuery{text: strings.ToLower(search), exact: exact}, nil
+	}
+	switch len(hex) {
+	case 8, 16:
+		id, err := strconv.ParseUint(hex, 16, 64)
+		if err != nil {
+			return hkpQuery{}, fmt.Errorf("invalid key ID %q", search)
+		}
+		return hkpQuery{keyID: id, short: len(hex) == 8}, nil
+	case 40, 64:
+		if !isHexFingerprint(hex) {
+			return hkpQuery{}, fmt.Errorf("invalid fingerprint %q", search)
+		}
+		return hkpQuery{fpr: hex}, nil
+	}
+	return hkpQuery{}, fmt.Errorf("invalid key ID or fingerprint %q", search)
+}
+
+// matches reports whether e is found by q. Key IDs and fingerprints match the
+// primary key and subkeys; text matches user IDs case-insensitively, either
+// as a substring or, with exact, the whole user ID or its address.
+func (q hkpQuery) matches(e *openpgp.Entity) bool {
+	if q.text != "" {
+		for _, ident := range e.Identities {
+			uid := strings.ToLower(ident.Name)
+			switch {
+			case !q.exact && strings.Contains(uid, q.text):
+				return true
+			case q.exact && (uid == q.text || (ident.UserId != nil && strings.ToLower(ident.UserId.Email) == strings.Trim(q.text, "<>"))):
+				return true
+			}
+		}
+		return false
+	}
+	keys := []*packet.PublicKey{e.PrimaryKey}
+	for _, sub := range e.Subkeys {
+		keys = append(keys, sub.PublicKey)
+	}
+	for _, pk := range keys {
+		switch {
+		case q.fpr != "" && fmt.Sprintf("%x", pk.Fingerprint) == q.fpr:
+			return true
+		case q.short && uint32(pk.KeyId) == uint32(q.keyID):
+			return true
+		case q.keyID != 0 && !q.short && pk.KeyId == q.keyID:
+			return true
+		}
+	}
+	return false
+}
+
+// HKPLookupHandler implements the HKP /pks/lookup endpoint over published
+// keys, so `gpg --keyserver` can search and fetch them:
+//   - op=get returns the matching keys as one armored key block
+//   - op=index and op=vindex list them, vindex including certifications
+//   - options=mr selects the machine-readable formats
+//
+// It is public and must not be wrapped in WithAuth.
+func (a *App) HKPLookupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	op := r.FormValue("op")
+	if op != "get" && op != "index" && op != "vindex" {
+		http.Error(w, "unsupported op "+strconv.Quote(op)+": expected get, index or vindex", http.StatusNotImplemented)
+		return
+	}
+	options := map[string]bool{}
+	for _, o := range strings.Split(r.FormValue("options"), ",") {
+		options[strings.TrimSpace(o)] = true
+	}
+	q, err := parseHKPSearch(r.FormValue("search"), r.FormValue("exact") == "on")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	published, err := a.publishedKeysFor(r.Context(), func(string) bool { return true })
+	if err != nil {
+		slog.Error("hkp: failed to load published keys", "err", err)
+		http.Error(w, "failed to load keys", http.StatusInternalServerError)
+		return
+	}
+	var entities []*openpgp.Entity
+	for _, pk := range published {
+		if e := pk.Key.GetEntity(); q.matches(e) {
+			entities = append(entities, e)
+		}
+	}
+	if len(entities) == 0 {
+		http.Error(w, "no keys found", http.StatusNotFound)
+		return
+	}
+	if len(entities) > maxHKPResults {
+		http.Error(w, "too many keys found; refine the search", http.StatusRequestEntityTooLarge)
+		return
+	}
+	slog.Debug("hkp: lookup", "op", op, "search", r.FormValue("search"), "keys", len(entities))
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if op == "get" {
+		var buf bytes.Buffer
+		aw, err := armor.Encode(&buf, "PGP PUBLIC KEY BLOCK", nil)
+		if err == nil {
+			for _, e := range entities {
+				if err = e.Serialize(aw); err != nil {
+					break
+				}
+			}
+		}
+		if err == nil {
+			err = aw.Close()
+		}
+		if err != nil {
+			slog.Error("hkp: failed to serialize keys", "err", err)
+			http.Error(w, "failed to serialize keys", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pgp-keys")
+		w.Write(buf.Bytes())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if options["mr"] {
+		writeHKPMachineIndex(w, entities)
+		return
+	}
+	writeHKPIndex(w, entities, op == "vindex")
+}
+
+// hkpTime formats t for HKP machine-readable output: seconds since the
+// epoch, or empty for the zero time.
+func hkpTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// keyExpiry returns when e's primary key expires, or the zero time if it
+// does not.
+func keyExpiry(e *openpgp.Entity) time.Time {
+	sig, err := e.PrimarySelfSignature(time.Now(), nil)
+	if err != nil || sig == nil || sig.KeyLifetimeSecs == nil || *sig.KeyLifetimeSecs == 0 {
+		return time.Time{}
+	}
+	return e.PrimaryKey.CreationTime.Add(time.Duration(*sig.KeyLifetimeSecs) * time.Second)
+}
+
+// sortedIdentities returns e's identities ordered by user ID.
+func sortedIdentities(e *openpgp.Entity) []*openpgp.Identity {
+	idents := make([]*openpgp.Identity, 0, len(e.Identities))
+	for _, ident := range e.Identities {
+		idents = append(idents, ident)
+	}
+	sort.Slice(idents, func(i, j int) bool { return idents[i].Name < idents[j].Name })
+	return idents
+}
+
+// writeHKPMachineIndex writes the machine-readable index
+// (draft-shaw-openpgp-hkp section 5.2) of entities.
+func writeHKPMachineIndex(w http.ResponseWriter, entities []*openpgp.Entity) {
+	fmt.Fprintf(w, "info:1:%d\n", len(entities))
+	now := time.Now()
+	for _, e := range entities {
+		bits, _ := e.PrimaryKey.BitLength()
+		expires := keyExpiry(e)
+		flags := ""
+		if e.Revoked(now) {
+			flags += "r"
+		}
+		if !expires.IsZero() && expires.Before(now) {
+			flags += "e"
+		}
+		fmt.Fprintf(w, "pub:%X:%d:%d:%s:%s:%s\n", e.PrimaryKey.Fingerprint, e.PrimaryKey.PubKeyAlgo, bits,
+			hkpTime(e.PrimaryKey.CreationTime), hkpTime(expires), flags)
+		for _, ident := range sortedIdentities(e) {
+			var created time.Time
+			if sig := latestSignature(ident.SelfCertifications); sig != nil {
+				created = sig.CreationTime
+			}
+			uidFlags := ""
+			if len(ident.Revocations) > 0 {
+				uidFlags = "r"
+			}
+			fmt.Fprintf(w, "uid:%s:%s::%s\n", url.PathEscape(ident.Name), hkpTime(created), uidFlags)
+		}
+	}
+}
+
+// writeHKPIndex writes a human-readable key listing in the style of
+// `gpg --list-keys`; verbose adds the certifications on each user ID.
+func writeHKPIndex(w http.ResponseWriter, entities []*openpgp.Entity, verbose bool) {
+	for i, e := range entities {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		bits, _ := e.PrimaryKey.BitLength()
+		line := fmt.Sprintf("pub   %s%d/%X %s", strings.ToLower(algorithmName(e.PrimaryKey.PubKeyAlgo)), bits,
+			e.PrimaryKey.Fingerprint, e.PrimaryKey.CreationTime.UTC().Format("2006-01-02"))
+		if e.Revoked(time.Now()) {
+			line += " [revoked]"
+		} else if expires := keyExpiry(e); !expires.IsZero() {
+			line += " [expires: " + expires.UTC().Format("2006-01-02") + "]"
+		}
+		fmt.Fprintln(w, line)
+		for _, ident := range sortedIdentities(e) {
+			fmt.Fprintf(w, "uid   %s\n", ident.Name)
+			if !verbose {
+				continue
+			}
+			sigs := append(append([]*packet.VerifiableSignature{}, ident.SelfCertifications...), ident.OtherCertifications...)
+			for _, s := range sigs {
+				if s == nil || s.Packet == nil || s.Packet.IssuerKeyId == nil {
+					continue
+				}
+				fmt.Fprintf(w, "sig   %016X %s\n", *s.Packet.IssuerKeyId, s.Packet.CreationTime.UTC().Format("2006-01-02"))
+			}
+		}
+	}
+}
+
+// HKPAddHandler implements the HKP /pks/add endpoint: it stores and publishes
+// the public keys in the armored "keytext" field, so `gpg --send-keys` can
+// upload to Easy-Web-GPG. Keys already stored are published unchanged, or
+// skipped if they are another user's personal keys.
+// Submissions holding private key material are refused. New keys go through
+// the key policy and identity pinning like AddKeyHandler; "pin" selects the
+// pin mode.
+func (a *App) HKPAddHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	keytext := r.FormValue("keytext")
+	if strings.TrimSpace(keytext) == "" {
+		http.Error(w, "missing keytext", http.StatusUnprocessableEntity)
+		return
+	}
+	keys, err := parseKeyMaterial([]byte(keytext))
+	if err != nil {
+		http.Error(w, "invalid PGP key: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, pk := range keys {
+		if pk.Key.IsPrivate() {
+			http.Error(w, "keyserver submissions must not contain private keys", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	mode := parsePinMode(r.FormValue("pin"))
+	var added, published, skipped int
+	var failures []string
+	for _, pk := range keys {
+		name := keyDisplayName(pk.Key)
+		existing, err := a.keyIDByFingerprint(r.Context(), pk.Key.GetFingerprint())
+		if err != nil {
+			slog.Error("hkp: failed to look up key", "name", name, "err", err)
+			failures = append(failures, name+": "+err.Error())
+			continue
+		}
+		if existing != 0 {
+			scope, args := keyScope(r.Context(), true)
+			q := a.DB.Rebind("UPDATE keys SET published = ? WHERE id = ? AND " + scope)
+			res, err := a.DB.ExecContext(r.Context(), q, append([]interface{}{true, existing}, args...)...)
+			if err != nil {
+				slog.Error("hkp: failed to publish key", "id", existing, "err", err)
+				failures = append(failures, name+": "+err.Error())
+				continue
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				skipped++
+				continue
+			}
+			published++
+			continue
+		}
+
+		lint, err := a.lintForImport(pk.Key)
+		if err != nil {
+			failures = append(failures, name+": "+err.Error())
+			continue
+		}
+		rec := keyRecord{Name: name, Armored: pk.Armored, Key: pk.Key, LintWarnings: lint, Published: true}
+		if _, err := a.insertKey(r.Context(), rec, mode); err != nil {
+			var conflict *pinConflictError
+			if !errors.As(err, &conflict) {
+				slog.Error("hkp: failed to insert key", "name", name, "err", err)
+			}
+			failures = append(failures, name+": "+err.Error())
+			continue
+		}
+		added++
+	}
+
+	slog.Info("hkp: keys submitted", "keys", len(keys), "added", added, "published", published, "skipped", skipped, "failed", len(failures))
+	if len(failures) > 0 {
+		http.Error(w, fmt.Sprintf("stored %d of %d keys; failed: %s", added+published, len(keys), strings.Join(failures, "; ")), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%d keys added, %d already stored keys published, %d skipped as another user's keys\n", added, published, skipped)
+}
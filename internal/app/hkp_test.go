@@ -0,0 +1,134 @@
+package app_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	openpgp "github.com/ProtonMail/go-crypto/openpgp/v2"
+)
+
+// hkpLookup sends an HKP lookup with the given query parameters.
+func hkpLookup(handler http.HandlerFunc, params url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/pks/lookup?"+params.Encode(), nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+// TestHKPLookupHandler verifies get, index and vindex lookups by key ID,
+// fingerprint and user ID text, over published keys only.
+func TestHKPLookupHandler(t *testing.T) {
+	a, _ := setupTestApp(t)
+
+	alice := generateTestKey(t, "Alice", "alice@example.com", "")
+	addPublishedKey(t, a, "alice", alice, nil)
+	hidden, _ := generateTestKey(t, "Hidden", "hidden@example.com", "").GetArmoredPublicKey()
+	postForm(a.AddKeyHandler, "/keys", url.Values{"name": {"hidden"}, "armored": {hidden}})
+
+	fpr := strings.ToUpper(alice.GetFingerprint())
+	for _, search := range []string{"0x" + fpr, "0x" + fpr[24:], "0x" + fpr[32:], "alice@EXAMPLE.com"} {
+		w := hkpLookup(a.HKPLookupHandler, url.Values{"op": {"get"}, "options": {"mr"}, "search": {search}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("get %s: expected 200, got %d: %s", search, w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/pgp-keys" {
+			t.Errorf("get %s: Content-Type = %q", search, ct)
+		}
+		entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(w.Body.String()))
+		if err != nil || len(entities) != 1 || entities[0].PrivateKey != nil {
+			t.Fatalf("get %s: expected one public key, got %d (%v)", search, len(entities), err)
+		}
+	}
+
+	w := hkpLookup(a.HKPLookupHandler, url.Values{"op": {"index"}, "options": {"mr"}, "search": {"alice"}})
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.HasPrefix(body, "info:1:1\npub:"+fpr+":") {
+		t.Fatalf("mr index: %d %q", w.Code, body)
+	}
+	if !strings.Contains(body, "\nuid:Alice%20%3Calice@example.com%3E:") {
+		t.Errorf("mr index missing escaped uid line: %q", body)
+	}
+
+	w = hkpLookup(a.HKPLookupHandler, url.Values{"op": {"vindex"}, "search": {"alice"}})
+	if !strings.Contains(w.Body.String(), "uid   Alice <alice@example.com>") || !strings.Contains(w.Body.String(), "sig   ") {
+		t.Errorf("vindex should list user IDs and signatures: %q", w.Body.String())
+	}
+
+	tests := []struct {
+		params url.Values
+		code   int
+	}{
+		{url.Values{"op": {"get"}, "search": {"hidden@example.com"}}, http.StatusNotFound},
+		{url.Values{"op": {"get"}, "search": {"alice"}, "exact": {"on"}}, http.StatusNotFound},
+		{url.Values{"op": {"get"}, "search": {"alice@example.com"}, "exact": {"on"}}, http.StatusOK},
+		{url.Values{"op": {"get"}, "search": {"0x1234"}}, http.StatusUnprocessableEntity},
+		{url.Values{"op": {"get"}}, http.StatusUnprocessableEntity},
+		{url.Values{"op": {"stats"}, "search": {"alice"}}, http.StatusNotImplemented},
+	}
+	for _, tt := range tests {
+		if w := hkpLookup(a.HKPLookupHandler, tt.params); w.Code != tt.code {
+			t.Errorf("%v: expected %d, got %d", tt.params, tt.code, w.Code)
+		}
+	}
+}
+
+// TestHKPAddHandler verifies submitted public keys are stored and published,
+// already stored keys are published unless they are another user's, and
+// private keys are refused.
+func TestHKPAddHandler(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	bob := generateTestKey(t, "Bob", "bob@example.com", "")
+	bobPub, _ := bob.GetArmoredPublicKey()
+	w := postForm(a.HKPAddHandler, "/pks/add", url.Values{"keytext": {bobPub}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := hkpLookup(a.HKPLookupHandler, url.Values{"op": {"get"}, "search": {"bob@example.com"}}); w.Code != http.StatusOK {
+		t.Errorf("submitted key should be published, lookup got %d", w.Code)
+	}
+
+	carolPub, _ := generateTestKey(t, "Carol", "carol@example.com", "").GetArmoredPublicKey()
+	postForm(a.AddKeyHandler, "/keys", url.Values{"name": {"carol"}, "armored": {carolPub}})
+	if w := postForm(a.HKPAddHandler, "/pks/add", url.Values{"keytext": {carolPub}}); w.Code != http.StatusOK {
+		t.Fatalf("resubmit: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var count int
+	db.Get(&count, "SELECT COUNT(*) FROM keys WHERE published = ?", true)
+	if count != 2 {
+		t.Errorf("expected 2 published keys, have %d", count)
+	}
+	db.Get(&count, "SELECT COUNT(*) FROM keys")
+	if count != 2 {
+		t.Errorf("resubmitting a stored key must not duplicate it, have %d keys", count)
+	}
+
+	bootstrap := login(t, a, "", "test-master-password")
+	as(a, bootstrap, a.UsersHandler, http.MethodPost, "/users", url.Values{"username": {"admin"}, "password": {"admin-password"}})
+	admin := login(t, a, "admin", "admin-password")
+	as(a, admin, a.UsersHandler, http.MethodPost, "/users", url.Values{"username": {"carol"}, "password": {"carol-password"}})
+	carol := login(t, a, "carol", "carol-password")
+	erinPub, _ := generateTestKey(t, "Erin", "erin@example.com", "").GetArmoredPublicKey()
+	as(a, admin, a.AddKeyHandler, http.MethodPost, "/keys", url.Values{"name": {"erin"}, "armored": {erinPub}})
+	var erinID string
+	db.Get(&erinID, "SELECT id FROM keys WHERE name = 'erin'")
+	as(a, admin, a.ShareKeyHandler, http.MethodPost, "/keys/share", url.Values{"id": {erinID}})
+	w = as(a, carol, a.HKPAddHandler, http.MethodPost, "/pks/add", url.Values{"keytext": {erinPub}})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "0 already stored keys published, 1 skipped") {
+		t.Errorf("another user's key: %d %s", w.Code, w.Body.String())
+	}
+	if w := hkpLookup(a.HKPLookupHandler, url.Values{"op": {"get"}, "search": {"erin@example.com"}}); w.Code != http.StatusNotFound {
+		t.Errorf("another user's key should stay unpublished, lookup got %d", w.Code)
+	}
+
+	priv, _ := generateTestKey(t, "Dave", "dave@example.com", "").Armor()
+	if w := postForm(a.HKPAddHandler, "/pks/add", url.Values{"keytext": {priv}}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("private key: expected 422, got %d", w.Code)
+	}
+	if w := postForm(a.HKPAddHandler, "/pks/add", url.Values{}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("missing keytext: expected 422, got %d", w.Code)
+	}
+}
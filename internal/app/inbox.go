@@ -0,0 +1,197 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	mm "h-cloud.io/web-gpg/internal/models"
+)
+
+// Inbox message states.
+const (
+	inboxUnread   = "unread"
+	inboxRead     = "read"
+	inboxArchived = "archived"
+)
+
+// maxInboxField caps the length of the free-text submission metadata.
+const maxInboxField = 500
+
+// inboxSubmission is a drop page submission ready to be stored.
+type inboxSubmission struct {
+	KeyID      int64
+	Ciphertext string
+	Filename   string // empty for pasted messages
+	Size       int    // plaintext bytes
+	Contact    string
+	RemoteAddr string
+	UserAgent  string
+}
+
+// nullIfEmpty returns nil for an empty s, truncated to maxInboxField bytes
+// otherwise.
+func nullIfEmpty(s string) *string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	if len(s) > maxInboxField {
+		s = strings.ToValidUTF8(s[:maxInboxField], "")
+	}
+	return &s
+}
+
+// storeInboxMessage saves sub as an unread inbox message and returns its id.
+func (a *App) storeInboxMessage(ctx context.Context, sub inboxSubmission) (int64, error) {
+	var id int64
+	q := a.DB.Rebind(`INSERT INTO inbox_messages (key_id, ciphertext, filename, size, submitter_contact, remote_addr, user_agent, status, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`)
+	err := a.DB.GetContext(ctx, &id, q, sub.KeyID, sub.Ciphertext, nullIfEmpty(sub.Filename), sub.Size,
+		nullIfEmpty(sub.Contact), nullIfEmpty(sub.RemoteAddr), nullIfEmpty(sub.UserAgent), inboxUnread, time.Now())
+	return id, err
+}
+
+// inboxScope returns a condition on inbox_messages matching the messages
+// submitted to keys the current user may use, and its arguments.
+func inboxScope(ctx context.Context) (string, []any) {
+	scope, args := keyScope(ctx, false)
+	return "key_id IN (SELECT id FROM keys WHERE " + scope + ")", args
+}
+
+// removeInboxMessages deletes the messages submitted to keyID. Used when a
+// key is deleted, since nobody can decrypt them any more and a key reusing
+// the id must not inherit them.
+func removeInboxMessages(ctx context.Context, tx execer, keyID int64) error {
+	_, err := tx.ExecContext(ctx, tx.Rebind("DELETE FROM inbox_messages WHERE key_id = ?"), keyID)
+	return err
+}
+
+// loadInbox returns the inbox messages with one of statuses that the current
+// user may read, newest first.
+func (a *App) loadInbox(ctx context.Context, statuses ...string) ([]mm.InboxMessage, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(statuses)), ", ")
+	args := make([]any, len(statuses))
+	for i, s := range statuses {
+		args[i] = s
+	}
+	scope, scopeArgs := inboxScope(ctx)
+	args = append(args, scopeArgs...)
+	q := a.DB.Rebind(`SELECT m.id, m.key_id, k.name AS key_name, m.filename, m.size, m.submitter_contact, m.remote_addr,
+		m.user_agent, m.status, m.created_at, m.read_at
+		FROM inbox_messages m LEFT JOIN keys k ON k.id = m.key_id
+		WHERE m.status IN (` + placeholders + `) AND ` + scope + ` ORDER BY m.created_at DESC, m.id DESC`)
+	messages := []mm.InboxMessage{}
+	if err := a.DB.SelectContext(ctx, &messages, q, args...); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// InboxHandler lists inbox messages as JSON, without their ciphertext.
+// "status" selects unread, read or archived messages; by default unread and
+// read messages are listed.
+func (a *App) InboxHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	statuses := []string{inboxUnread, inboxRead}
+	if s := r.FormValue("status"); s != "" {
+		if !validInboxStatus(s) {
+			http.Error(w, "invalid status: expected unread, read or archived", http.StatusUnprocessableEntity)
+			return
+		}
+		statuses = []string{s}
+	}
+	messages, err := a.loadInbox(r.Context(), statuses...)
+	if err != nil {
+		slog.Error("failed to load inbox", "err", err)
+		http.Error(w, "failed to load inbox", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// validInboxStatus reports whether s is an inbox message state.
+func validInboxStatus(s string) bool {
+	return s == inboxUnread || s == inboxRead || s == inboxArchived
+}
+
+// InboxStatusHandler marks the inbox message "id" as unread, read or
+// archived.
+func (a *App) InboxStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.FormValue("id")
+	status := r.FormValue("status")
+	if id == "" || !validInboxStatus(status) {
+		http.Error(w, "missing id or invalid status: expected unread, read or archived", http.StatusUnprocessableEntity)
+		return
+	}
+	if err := a.setInboxStatus(r.Context(), id, status); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "message not found", http.StatusNotFound)
+			return
+		}
+		slog.Error("failed to update inbox message", "id", id, "status", status, "err", err)
+		http.Error(w, "failed to update message: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("inbox message updated", "id", id, "status", status)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// setInboxStatus sets the status of message id, recording when it was first
+// read. It returns sql.ErrNoRows if there is no such message.
+func (a *App) setInboxStatus(ctx context.Context, id any, status string) error {
+	scope, args := inboxScope(ctx)
+	q := a.DB.Rebind("UPDATE inbox_messages SET status = ?, read_at = COALESCE(read_at, ?) WHERE id = ? AND " + scope)
+	var readAt *time.Time
+	if status != inboxUnread {
+		now := time.Now()
+		readAt = &now
+	}
+	res, err := a.DB.ExecContext(ctx, q, append([]any{status, readAt, id}, args...)...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteInboxMessageHandler permanently deletes the inbox message "id".
+func (a *App) DeleteInboxMessageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusUnprocessableEntity)
+		return
+	}
+	scope, args := inboxScope(r.Context())
+	res, err := a.DB.ExecContext(r.Context(), a.DB.Rebind("DELETE FROM inbox_messages WHERE id = ? AND "+scope), append([]any{id}, args...)...)
+	if err != nil {
+		slog.Error("failed to delete inbox message", "id", id, "err", err)
+		http.Error(w, "failed to delete message: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return
+	}
+	slog.Info("inbox message deleted", "id", id)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,142 @@
+package app_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	mm "h-cloud.io/web-gpg/internal/models"
+)
+
+// TestInboxHandlers verifies drop page submissions can be listed, decrypted,
+// moved between states and deleted, and are deleted with their key.
+func TestInboxHandlers(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	key := generateTestKey(t, "Security Team", "security@example.com", "")
+	priv, _ := key.Armor()
+	postForm(a.AddKeyHandler, "/keys", url.Values{"name": {"security"}, "armored": {priv}})
+	var keyID int64
+	db.Get(&keyID, "SELECT id FROM keys WHERE name = 'security'")
+	postForm(a.DropKeyHandler, "/keys/drop", url.Values{"id": {fmt.Sprint(keyID)}})
+	path := "/drop/" + key.GetFingerprint()
+
+	postForm(a.DropHandler, path, url.Values{"message": {"first report"}})
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(url.Values{"message": {"second report"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.Header.Set("User-Agent", "test-agent")
+	a.DropHandler(httptest.NewRecorder(), req)
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "poc.bin")
+	fw.Write([]byte{0, 1, 2, 3})
+	mw.Close()
+	req = httptest.NewRequest(http.MethodPost, path, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	a.DropHandler(httptest.NewRecorder(), req)
+
+	list := func(query string) []mm.InboxMessage {
+		t.Helper()
+		w := httptest.NewRecorder()
+		a.InboxHandler(w, httptest.NewRequest(http.MethodGet, "/inbox"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("list inbox%s: expected 200, got %d: %s", query, w.Code, w.Body.String())
+		}
+		var messages []mm.InboxMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &messages); err != nil {
+			t.Fatalf("decode inbox: %v", err)
+		}
+		return messages
+	}
+
+	messages := list("")
+	if len(messages) != 3 {
+		t.Fatalf("expected 3 messages, got %+v", messages)
+	}
+	file, second, first := messages[0], messages[1], messages[2]
+	if file.Filename == nil || *file.Filename != "poc.bin" || file.Size != 4 {
+		t.Errorf("unexpected file message %+v", file)
+	}
+	if second.RemoteAddr == nil || *second.RemoteAddr != "203.0.113.7" || second.UserAgent == nil || *second.UserAgent != "test-agent" {
+		t.Errorf("expected submitter address and user agent, got %+v", second)
+	}
+	if first.KeyName == nil || *first.KeyName != "security" || first.Status != "unread" || first.ReadAt != nil {
+		t.Errorf("unexpected message %+v", first)
+	}
+	w := httptest.NewRecorder()
+	a.InboxHandler(w, httptest.NewRequest(http.MethodGet, "/inbox", nil))
+	if strings.Contains(w.Body.String(), "PGP MESSAGE") {
+		t.Error("the inbox listing should not include ciphertext")
+	}
+
+	w = postForm(a.DecryptHandler, "/decrypt", url.Values{"message": {fmt.Sprint(first.ID)}})
+	if w.Code != http.StatusOK || w.Body.String() != "first report" {
+		t.Fatalf("decrypt inbox message: %d %q", w.Code, w.Body.String())
+	}
+	w = postForm(a.DecryptHandler, "/decrypt", url.Values{"message": {fmt.Sprint(file.ID)}})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Disposition") != "attachment; filename=poc.bin" || w.Body.String() != "\x00\x01\x02\x03" {
+		t.Fatalf("decrypt inbox file: %d %q %q", w.Code, w.Header().Get("Content-Disposition"), w.Body.String())
+	}
+	for _, m := range list("?status=read") {
+		if m.ReadAt == nil {
+			t.Errorf("message %d was read but has no read_at", m.ID)
+		}
+	}
+	if got := list("?status=read"); len(got) != 2 {
+		t.Errorf("expected the decrypted messages to be marked read, got %+v", got)
+	}
+	if w := postForm(a.DecryptHandler, "/decrypt", url.Values{"message": {"9999"}}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("decrypt missing message: expected 422, got %d", w.Code)
+	}
+
+	if w := postForm(a.InboxStatusHandler, "/inbox/status", url.Values{"id": {fmt.Sprint(second.ID)}, "status": {"archived"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("archive: expected 303, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := list(""); len(got) != 2 {
+		t.Errorf("archived messages should not be listed by default, got %+v", got)
+	}
+	if got := list("?status=archived"); len(got) != 1 || got[0].ID != second.ID {
+		t.Errorf("expected the archived message, got %+v", got)
+	}
+	if w := postForm(a.InboxStatusHandler, "/inbox/status", url.Values{"id": {fmt.Sprint(second.ID)}, "status": {"spam"}}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("invalid status: expected 422, got %d", w.Code)
+	}
+	if w := postForm(a.InboxStatusHandler, "/inbox/status", url.Values{"id": {"9999"}, "status": {"read"}}); w.Code != http.StatusNotFound {
+		t.Errorf("missing message: expected 404, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	a.InboxHandler(w, httptest.NewRequest(http.MethodGet, "/inbox?status=spam", nil))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("list invalid status: expected 422, got %d", w.Code)
+	}
+
+	if w := postForm(a.DeleteInboxMessageHandler, "/inbox/delete", url.Values{"id": {fmt.Sprint(first.ID)}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("delete: expected 303, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := postForm(a.DeleteInboxMessageHandler, "/inbox/delete", url.Values{"id": {fmt.Sprint(first.ID)}}); w.Code != http.StatusNotFound {
+		t.Errorf("delete twice: expected 404, got %d", w.Code)
+	}
+	if got := list(""); len(got) != 1 || got[0].ID != file.ID {
+		t.Errorf("expected only the file message left, got %+v", got)
+	}
+
+	db.MustExec("INSERT INTO inbox_messages (key_id, ciphertext, status) VALUES (?, ?, ?)", 9999, "orphan", "unread")
+	if got := list(""); len(got) != 1 {
+		t.Errorf("messages for keys that do not exist should not be listed, got %+v", got)
+	}
+	if w := postForm(a.DeleteKeyHandler, "/keys/delete", url.Values{"id": {fmt.Sprint(keyID)}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("delete key: expected 303, got %d: %s", w.Code, w.Body.String())
+	}
+	var count int
+	db.Get(&count, "SELECT COUNT(*) FROM inbox_messages WHERE key_id = ?", keyID)
+	if count != 0 {
+		t.Errorf("deleting a key should delete its %d inbox messages", count)
+	}
+}
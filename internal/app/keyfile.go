@@ -0,0 +1,113 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	openpgp "github.com/ProtonMail/go-crypto/openpgp/v2"
+	"github.com/ProtonMail/gopenpgp/v3/crypto"
+)
+
+// maxKeyUploadBytes caps the size of an add-key request, including uploaded
+// key files. Keys with embedded photo IDs can run to a few hundred KB.
+const maxKeyUploadBytes = 5 << 20
+
+// keyFileExtensions are the accepted extensions for uploaded key files.
+var keyFileExtensions = map[string]bool{".asc": true, ".gpg": true, ".pgp": true, ".key": true}
+
+// parsedKey is one key read from submitted key material, together with the
+// armored text to store for it.
+type parsedKey struct {
+	Key     *crypto.Key
+	Armored string
+}
+
+// submittedKeyMaterial returns the bytes of the uploaded "keyfile" if one was
+// sent, otherwise the pasted "armored" form value.
+func submittedKeyMaterial(r *http.Request) ([]byte, error) {
+	if r.MultipartForm != nil {
+		if files := r.MultipartForm.File["keyfile"]; len(files) > 0 && files[0].Size > 0 {
+			fh := files[0]
+			ext := strings.ToLower(filepath.Ext(fh.Filename))
+			if !keyFileExtensions[ext] {
+				return nil, fmt.Errorf("unsupported key file type %q: expected .asc, .gpg, .pgp or .key", ext)
+			}
+			f, err := fh.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			return io.ReadAll(f)
+		}
+	}
+	return []byte(r.FormValue("armored")), nil
+}
+
+// isBinaryPGP reports whether data starts with a binary OpenPGP packet
+// header rather than text, ignoring leading whitespace and a UTF-8 BOM.
+// Packet headers always have the high bit set; ASCII armor never does.
+func isBinaryPGP(data []byte) bool {
+	data = bytes.TrimLeft(data, "\ufeff \t\r\n")
+	return len(data) > 0 && data[0]&0x80 != 0
+}
+
+// parseKeyMaterial reads one or more keys from armored text or binary
+// OpenPGP packets, detecting the encoding automatically. A single armored key
+// keeps its (sanitized) original armor; every other key is re-armored.
+func parseKeyMaterial(data []byte) ([]parsedKey, error) {
+	var entities openpgp.EntityList
+	var err error
+	armoredInput := !isBinaryPGP(data)
+	if armoredInput {
+		data = []byte(sanitizeArmored(string(data)))
+		entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	} else {
+		entities, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(entities) == 0 {
+		return nil, errors.New("no keys found")
+	}
+
+	keys := make([]parsedKey, 0, len(entities))
+	for _, e := range entities {
+		k, err := crypto.NewKeyFromEntity(e)
+		if err != nil {
+			return nil, err
+		}
+		pk := parsedKey{Key: k}
+		switch {
+		case armoredInput && len(entities) == 1:
+			pk.Armored = string(data)
+		case k.IsPrivate():
+			pk.Armored, err = k.Armor()
+		default:
+			pk.Armored, err = k.GetArmoredPublicKey()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("armor key %s: %w", k.GetFingerprint(), err)
+		}
+		keys = append(keys, pk)
+	}
+	return keys, nil
+}
+
+// keyDisplayName returns the primary user ID of k, or its fingerprint if it
+// has none. Used to name keys imported without an explicit name.
+func keyDisplayName(k *crypto.Key) string {
+	if _, ident := k.GetEntity().PrimaryIdentity(time.Now(), nil); ident != nil {
+		return ident.Name
+	}
+	for name := range k.GetEntity().Identities {
+		return name
+	}
+	return strings.ToUpper(k.GetFingerprint())
+}
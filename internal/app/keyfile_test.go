@@ -0,0 +1,125 @@
+package app_test
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postMultipart invokes handler with a multipart body holding fields and,
+// if filename is non-empty, a "keyfile" upload.
+func postMultipart(t *testing.T, handler http.HandlerFunc, path string, fields map[string]string, filename string, content []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	if filename != "" {
+		fw, err := mw.CreateFormFile("keyfile", filename)
+		if err != nil {
+			t.Fatalf("create form file: %v", err)
+		}
+		fw.Write(content)
+	}
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, path, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+// TestAddKeyHandler_BinaryKeyFile verifies a binary .gpg upload is detected,
+// re-armored for storage and named after its user ID.
+func TestAddKeyHandler_BinaryKeyFile(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	key := generateTestKey(t, "Binary User", "binary@example.com", "")
+	bin, err := key.GetPublicKey()
+	if err != nil {
+		t.Fatalf("serialize public key: %v", err)
+	}
+
+	w := postMultipart(t, a.AddKeyHandler, "/keys", nil, "binary.gpg", bin)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected 303, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var row struct {
+		Name        string `db:"name"`
+		Armored     string `db:"armored"`
+		Fingerprint string `db:"fingerprint"`
+	}
+	if err := db.Get(&row, "SELECT name, armored, fingerprint FROM keys"); err != nil {
+		t.Fatalf("load key: %v", err)
+	}
+	if !strings.HasPrefix(row.Armored, "-----BEGIN PGP PUBLIC KEY BLOCK-----") {
+		t.Errorf("expected stored key to be armored, got %.40q", row.Armored)
+	}
+	if row.Name != "Binary User <binary@example.com>" {
+		t.Errorf("name = %q, want primary user ID", row.Name)
+	}
+	if row.Fingerprint != key.GetFingerprint() {
+		t.Errorf("fingerprint = %q, want %q", row.Fingerprint, key.GetFingerprint())
+	}
+}
+
+// TestAddKeyHandler_ArmoredKeyFile verifies an armored private key upload
+// goes through the same import path as a pasted key.
+func TestAddKeyHandler_ArmoredKeyFile(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	armored, _ := generateTestKey(t, "Armored", "armored@example.com", "").Armor()
+	w := postMultipart(t, a.AddKeyHandler, "/keys", map[string]string{"name": "uploaded"}, "secret.asc", []byte("\ufeff"+armored))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected 303, got %d: %s", w.Code, w.Body.String())
+	}
+	var isPrivate bool
+	if err := db.Get(&isPrivate, "SELECT is_private FROM keys WHERE name = 'uploaded'"); err != nil {
+		t.Fatalf("load key: %v", err)
+	}
+	if !isPrivate {
+		t.Error("expected uploaded key to be stored as private")
+	}
+}
+
+// TestAddKeyHandler_MultiKeyFile verifies every key in a binary keyring export
+// is imported.
+func TestAddKeyHandler_MultiKeyFile(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	var ring []byte
+	for _, email := range []string{"one@example.com", "two@example.com"} {
+		bin, _ := generateTestKey(t, "Ring", email, "").GetPublicKey()
+		ring = append(ring, bin...)
+	}
+
+	w := postMultipart(t, a.AddKeyHandler, "/keys", map[string]string{"name": "team"}, "team.pgp", ring)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected 303, got %d: %s", w.Code, w.Body.String())
+	}
+	var names []string
+	db.Select(&names, "SELECT name FROM keys ORDER BY name")
+	if len(names) != 2 || !strings.HasPrefix(names[0], "team: ") {
+		t.Fatalf("unexpected imported key names: %q", names)
+	}
+}
+
+// TestAddKeyHandler_KeyFileRejected verifies unsupported extensions and
+// garbage content are refused.
+func TestAddKeyHandler_KeyFileRejected(t *testing.T) {
+	a, _ := setupTestApp(t)
+
+	bin, _ := generateTestKey(t, "Wrong", "wrong@example.com", "").GetPublicKey()
+	if w := postMultipart(t, a.AddKeyHandler, "/keys", nil, "key.txt", bin); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("wrong extension: expected 422, got %d", w.Code)
+	}
+	if w := postMultipart(t, a.AddKeyHandler, "/keys", nil, "key.gpg", []byte{0x99, 0x00, 0x01, 0x02}); w.Code != http.StatusBadRequest {
+		t.Errorf("corrupt binary: expected 400, got %d", w.Code)
+	}
+}
@@ -0,0 +1,297 @@
+package app
+
+import (
+	gocrypto "crypto"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/ProtonMail/gopenpgp/v3/crypto"
+)
+
+// KeyPolicyMode controls what happens to keys that fail the lint pass. The
+// zero value warns.
+type KeyPolicyMode int
+
+const (
+	KeyPolicyWarn   KeyPolicyMode = iota // store the key and record its weaknesses
+	KeyPolicyOff                         // do not lint keys on import
+	KeyPolicyReject                      // refuse keys with weaknesses
+)
+
+// defaultMinKeyBits is the smallest accepted RSA, DSA or ElGamal key size.
+const defaultMinKeyBits = 2048
+
+// defaultWeakAlgorithms are flagged regardless of key size.
+var defaultWeakAlgorithms = map[packet.PublicKeyAlgorithm]bool{
+	packet.PubKeyAlgoDSA:     true,
+	packet.PubKeyAlgoElGamal: true,
+}
+
+// algorithmNames maps the names accepted in KEY_WEAK_ALGORITHMS to their
+// OpenPGP algorithm ids.
+var algorithmNames = map[string][]packet.PublicKeyAlgorithm{
+	"rsa":     {packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSAEncryptOnly, packet.PubKeyAlgoRSASignOnly},
+	"dsa":     {packet.PubKeyAlgoDSA},
+	"elgamal": {packet.PubKeyAlgoElGamal},
+	"ecdh":    {packet.PubKeyAlgoECDH},
+	"ecdsa":   {packet.PubKeyAlgoECDSA},
+	"eddsa":   {packet.PubKeyAlgoEdDSA},
+}
+
+// weakHashes are signature digests that no longer protect self-signatures.
+var weakHashes = map[gocrypto.Hash]bool{
+	gocrypto.MD5:       true,
+	gocrypto.SHA1:      true,
+	gocrypto.RIPEMD160: true,
+}
+
+// KeyPolicy holds the key quality thresholds applied on import. The zero
+// value warns about keys below defaultMinKeyBits or using
+// defaultWeakAlgorithms.
+type KeyPolicy struct {
+	Mode           KeyPolicyMode
+	MinKeyBits     int                                // 0 means defaultMinKeyBits
+	WeakAlgorithms map[packet.PublicKeyAlgorithm]bool // nil means defaultWeakAlgorithms
+}
+
+// ParseKeyPolicy builds a KeyPolicy from the KEY_POLICY ("off", "warn",
+// "reject"), KEY_MIN_BITS and KEY_WEAK_ALGORITHMS (comma-separated, e.g.
+// "dsa,elgamal"; "none" flags no algorithm) env values. Invalid values are
+// logged and replaced by the defaults.
+func ParseKeyPolicy(mode, minBits, weakAlgorithms string) KeyPolicy {
+	var p KeyPolicy
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", "warn":
+		p.Mode = KeyPolicyWarn
+	case "off":
+		p.Mode = KeyPolicyOff
+	case "reject":
+		p.Mode = KeyPolicyReject
+	default:
+		slog.Warn("unknown KEY_POLICY, using warn", "value", mode)
+	}
+
+	if minBits = strings.TrimSpace(minBits); minBits != "" {
+		if n, err := strconv.Atoi(minBits); err == nil && n > 0 {
+			p.MinKeyBits = n
+		} else {
+			slog.Warn("invalid KEY_MIN_BITS, using default", "value", minBits, "default", defaultMinKeyBits)
+		}
+	}
+
+	if weakAlgorithms = strings.TrimSpace(weakAlgorithms); weakAlgorithms != "" {
+		p.WeakAlgorithms = map[packet.PublicKeyAlgorithm]bool{}
+		for _, name := range splitList(strings.ToLower(weakAlgorithms)) {
+			if name == "none" {
+				continue
+			}
+			algos, ok := algorithmNames[name]
+			if !ok {
+				slog.Warn("unknown algorithm in KEY_WEAK_ALGORITHMS, ignored", "value", name)
+				continue
+			}
+			for _, algo := range algos {
+				p.WeakAlgorithms[algo] = true
+			}
+		}
+	}
+	return p
+}
+
+func (p KeyPolicy) minKeyBits() int {
+	if p.MinKeyBits > 0 {
+		return p.MinKeyBits
+	}
+	return defaultMinKeyBits
+}
+
+func (p KeyPolicy) weakAlgorithm(algo packet.PublicKeyAlgorithm) bool {
+	if p.WeakAlgorithms == nil {
+		return defaultWeakAlgorithms[algo]
+	}
+	return p.WeakAlgorithms[algo]
+}
+
+// keyPolicyError is returned when a key is refused under KeyPolicyReject.
+type keyPolicyError struct {
+	warnings []string
+}
+
+func (e *keyPolicyError) Error() string {
+	return "key rejected by key policy: " + strings.Join(e.warnings, "; ")
+}
+
+// lintKey returns the weaknesses of k under policy p: weak or undersized
+// primary keys and subkeys, and current self-signatures made with a weak
+// digest. The result is empty for a key without weaknesses.
+func lintKey(k *crypto.Key, p KeyPolicy) []string {
+	e := k.GetEntity()
+	warnings := []string{}
+
+	warnings = append(warnings, lintPublicKey("primary key", e.PrimaryKey, p)...)
+	for _, sub := range e.Subkeys {
+		label := fmt.Sprintf("subkey %X", sub.PublicKey.KeyId)
+		warnings = append(warnings, lintPublicKey(label, sub.PublicKey, p)...)
+		if sig := latestSignature(sub.Bindings); sig != nil && weakHashes[sig.Hash] {
+			warnings = append(warnings, fmt.Sprintf("%s binding signature uses %s", label, sig.Hash))
+		}
+	}
+
+	names := make([]string, 0, len(e.Identities))
+	for name := range e.Identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if sig := latestSignature(e.Identities[name].SelfCertifications); sig != nil && weakHashes[sig.Hash] {
+			warnings = append(warnings, fmt.Sprintf("self-signature on %q uses %s", name, sig.Hash))
+		}
+	}
+	if sig := latestSignature(e.DirectSignatures); sig != nil && weakHashes[sig.Hash] {
+		warnings = append(warnings, fmt.Sprintf("direct-key signature uses %s", sig.Hash))
+	}
+	return warnings
+}
+
+// lintPublicKey checks the algorithm and size of one (sub)key.
+func lintPublicKey(label string, pk *packet.PublicKey, p KeyPolicy) []string {
+	var warnings []string
+	name := algorithmName(pk.PubKeyAlgo)
+	if p.weakAlgorithm(pk.PubKeyAlgo) {
+		warnings = append(warnings, fmt.Sprintf("%s uses %s", label, name))
+	}
+	switch pk.PubKeyAlgo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSAEncryptOnly, packet.PubKeyAlgoRSASignOnly,
+		packet.PubKeyAlgoDSA, packet.PubKeyAlgoElGamal:
+		bits, err := pk.BitLength()
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: cannot determine key size: %v", label, err))
+		} else if int(bits) < p.minKeyBits() {
+			warnings = append(warnings, fmt.Sprintf("%s is %s-%d (minimum %d)", label, name, bits, p.minKeyBits()))
+		}
+	}
+	return warnings
+}
+
+// latestSignature returns the most recent signature in sigs, or nil.
+func latestSignature(sigs []*packet.VerifiableSignature) *packet.Signature {
+	var latest *packet.Signature
+	for _, s := range sigs {
+		if s == nil || s.Packet == nil {
+			continue
+		}
+		if latest == nil || s.Packet.CreationTime.After(latest.CreationTime) {
+			latest = s.Packet
+		}
+	}
+	return latest
+}
+
+func algorithmName(algo packet.PublicKeyAlgorithm) string {
+	switch algo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSAEncryptOnly, packet.PubKeyAlgoRSASignOnly:
+		return "RSA"
+	case packet.PubKeyAlgoDSA:
+		return "DSA"
+	case packet.PubKeyAlgoElGamal:
+		return "ElGamal"
+	case packet.PubKeyAlgoECDH:
+		return "ECDH"
+	case packet.PubKeyAlgoECDSA:
+		return "ECDSA"
+	case packet.PubKeyAlgoEdDSA:
+		return "EdDSA"
+	case packet.PubKeyAlgoX25519:
+		return "X25519"
+	case packet.PubKeyAlgoX448:
+		return "X448"
+	case packet.PubKeyAlgoEd25519:
+		return "Ed25519"
+	case packet.PubKeyAlgoEd448:
+		return "Ed448"
+	}
+	return fmt.Sprintf("algorithm %d", algo)
+}
+
+// lintForImport applies the key policy to a key being imported. It returns
+// the value for the lint_warnings column (nil when linting is off) or a
+// *keyPolicyError if the policy rejects the key.
+func (a *App) lintForImport(k *crypto.Key) (*string, error) {
+	if a.KeyPolicy.Mode == KeyPolicyOff {
+		return nil, nil
+	}
+	warnings := lintKey(k, a.KeyPolicy)
+	if len(warnings) > 0 && a.KeyPolicy.Mode == KeyPolicyReject {
+		return nil, &keyPolicyError{warnings: warnings}
+	}
+	joined := strings.Join(warnings, "\n")
+	return &joined, nil
+}
+
+// keyLintResult is one entry of the LintKeysHandler report.
+type keyLintResult struct {
+	ID          int64    `json:"id"`
+	Name        string   `json:"name"`
+	Fingerprint string   `json:"fingerprint"`
+	Warnings    []string `json:"warnings"`
+	// Rejected reports whether the key would be refused on import under the
+	// current policy.
+	Rejected bool   `json:"rejected"`
+	Error    string `json:"error,omitempty"`
+}
+
+// LintKeysHandler runs the lint pass over every stored key, records the
+// results and returns them as JSON. It reports weaknesses even when the
+// policy mode is off; existing keys are never removed.
+func (a *App) LintKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	type row struct {
+		ID      int64  `db:"id"`
+		Name    string `db:"name"`
+		Armored string `db:"armored"`
+	}
+	var rows []row
+	scope, args := keyScope(r.Context(), false)
+	if err := a.DB.SelectContext(r.Context(), &rows, a.DB.Rebind("SELECT id, name, armored FROM keys WHERE "+scope+" ORDER BY id"), args...); err != nil {
+		slog.Error("lint: failed to load keys", "err", err)
+		http.Error(w, "failed to load keys", http.StatusInternalServerError)
+		return
+	}
+
+	results := make([]keyLintResult, 0, len(rows))
+	weak := 0
+	for _, k := range rows {
+		res := keyLintResult{ID: k.ID, Name: k.Name, Warnings: []string{}}
+		key, err := crypto.NewKeyFromArmored(k.Armored)
+		if err != nil {
+			res.Error = "stored key is invalid: " + err.Error()
+			results = append(results, res)
+			continue
+		}
+		res.Fingerprint = strings.ToUpper(key.GetFingerprint())
+		res.Warnings = lintKey(key, a.KeyPolicy)
+		res.Rejected = len(res.Warnings) > 0 && a.KeyPolicy.Mode == KeyPolicyReject
+		if len(res.Warnings) > 0 {
+			weak++
+		}
+		joined := strings.Join(res.Warnings, "\n")
+		if _, err := a.DB.ExecContext(r.Context(), a.DB.Rebind("UPDATE keys SET lint_warnings = ? WHERE id = ?"), joined, k.ID); err != nil {
+			slog.Error("lint: failed to record results", "key_id", k.ID, "err", err)
+			res.Error = "failed to record results: " + err.Error()
+		}
+		results = append(results, res)
+	}
+
+	slog.Info("keys linted", "keys", len(rows), "weak", weak)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,152 @@
+package app_test
+
+import (
+	gocrypto "crypto"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	openpgp "github.com/ProtonMail/go-crypto/openpgp/v2"
+	gcrypto "github.com/ProtonMail/gopenpgp/v3/crypto"
+
+	apppkg "h-cloud.io/web-gpg/internal/app"
+)
+
+// generateWeakKey creates an RSA-1024 key whose self-signatures use SHA-1,
+// like keys made by old GnuPG versions.
+func generateWeakKey(t *testing.T, name, email string) *gcrypto.Key {
+	t.Helper()
+	cfg := &packet.Config{
+		Algorithm: packet.PubKeyAlgoRSA,
+		RSABits:   1024,
+		Time:      func() time.Time { return time.Now().Add(-time.Minute) },
+	}
+	e, err := openpgp.NewEntity(name, "", email, cfg)
+	if err != nil {
+		t.Fatalf("generate weak key: %v", err)
+	}
+	// go-crypto no longer creates SHA-1 signatures by default, so re-sign the
+	// user ID certification explicitly. The salt notation has no SHA-1 size.
+	noSalt := false
+	cfg.NonDeterministicSignaturesViaNotation = &noSalt
+	for _, ident := range e.Identities {
+		sig := ident.SelfCertifications[0].Packet
+		sig.Hash = gocrypto.SHA1
+		if err := sig.SignUserId(ident.UserId.Id, e.PrimaryKey, e.PrivateKey, cfg); err != nil {
+			t.Fatalf("re-sign user ID with SHA-1: %v", err)
+		}
+	}
+	k, err := gcrypto.NewKeyFromEntity(e)
+	if err != nil {
+		t.Fatalf("wrap weak key: %v", err)
+	}
+	return k
+}
+
+// TestAddKeyHandler_KeyLintWarn verifies weak keys are stored with their
+// weaknesses recorded under the default warn policy, and strong keys are
+// recorded as clean.
+func TestAddKeyHandler_KeyLintWarn(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	weakPub, _ := generateWeakKey(t, "Old", "old@example.com").GetArmoredPublicKey()
+	w := postForm(a.AddKeyHandler, "/keys", url.Values{"name": {"old"}, "armored": {weakPub}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected 303, got %d: %s", w.Code, w.Body.String())
+	}
+	if h := w.Header().Get("X-Key-Warning"); !strings.Contains(h, "RSA-1024") {
+		t.Errorf("X-Key-Warning = %q, want RSA-1024 mentioned", h)
+	}
+	var warnings string
+	db.Get(&warnings, "SELECT lint_warnings FROM keys WHERE name = 'old'")
+	for _, want := range []string{"primary key is RSA-1024 (minimum 2048)", "uses SHA-1"} {
+		if !strings.Contains(warnings, want) {
+			t.Errorf("lint_warnings %q missing %q", warnings, want)
+		}
+	}
+
+	strongPub, _ := generateTestKey(t, "New", "new@example.com", "").GetArmoredPublicKey()
+	postForm(a.AddKeyHandler, "/keys", url.Values{"name": {"new"}, "armored": {strongPub}})
+	var clean *string
+	db.Get(&clean, "SELECT lint_warnings FROM keys WHERE name = 'new'")
+	if clean == nil || *clean != "" {
+		t.Errorf("expected strong key to be recorded as linted and clean, got %v", clean)
+	}
+}
+
+// TestAddKeyHandler_KeyLintReject verifies the reject policy refuses weak keys.
+func TestAddKeyHandler_KeyLintReject(t *testing.T) {
+	a, db := setupTestApp(t)
+	a.KeyPolicy = apppkg.ParseKeyPolicy("reject", "", "")
+
+	weakPub, _ := generateWeakKey(t, "Old", "old@example.com").GetArmoredPublicKey()
+	w := postForm(a.AddKeyHandler, "/keys", url.Values{"name": {"old"}, "armored": {weakPub}})
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "key policy") {
+		t.Fatalf("expected 422 policy rejection, got %d: %s", w.Code, w.Body.String())
+	}
+	var count int
+	db.Get(&count, "SELECT COUNT(*) FROM keys")
+	if count != 0 {
+		t.Errorf("expected rejected key not to be stored, have %d", count)
+	}
+}
+
+// TestLintKeysHandler verifies the batch endpoint reports and records
+// weaknesses of keys stored before linting existed.
+func TestLintKeysHandler(t *testing.T) {
+	a, db := setupTestApp(t)
+	a.KeyPolicy = apppkg.ParseKeyPolicy("reject", "", "")
+
+	weakPub, _ := generateWeakKey(t, "Legacy", "legacy@example.com").GetArmoredPublicKey()
+	strongPub, _ := generateTestKey(t, "Modern", "modern@example.com", "").GetArmoredPublicKey()
+	db.Exec("INSERT INTO keys (name, armored, is_private, created_at) VALUES (?, ?, ?, ?)", "legacy", weakPub, false, time.Now())
+	db.Exec("INSERT INTO keys (name, armored, is_private, created_at) VALUES (?, ?, ?, ?)", "modern", strongPub, false, time.Now())
+
+	w := postForm(a.LintKeysHandler, "/keys/lint", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var results []struct {
+		Name     string   `json:"name"`
+		Warnings []string `json:"warnings"`
+		Rejected bool     `json:"rejected"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatalf("decode: %v (%s)", err, w.Body.String())
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %+v", results)
+	}
+	for _, res := range results {
+		weak := res.Name == "legacy"
+		if (len(res.Warnings) > 0) != weak || res.Rejected != weak {
+			t.Errorf("%s: warnings=%v rejected=%v", res.Name, res.Warnings, res.Rejected)
+		}
+	}
+
+	var stored string
+	db.Get(&stored, "SELECT lint_warnings FROM keys WHERE name = 'legacy'")
+	if !strings.Contains(stored, "RSA-1024") {
+		t.Errorf("expected lint results to be recorded, got %q", stored)
+	}
+}
+
+// TestParseKeyPolicy verifies env parsing of the key policy thresholds.
+func TestParseKeyPolicy(t *testing.T) {
+	p := apppkg.ParseKeyPolicy("Reject", "3072", "rsa, dsa")
+	if p.Mode != apppkg.KeyPolicyReject || p.MinKeyBits != 3072 {
+		t.Errorf("unexpected policy %+v", p)
+	}
+	if !p.WeakAlgorithms[packet.PubKeyAlgoRSA] || !p.WeakAlgorithms[packet.PubKeyAlgoDSA] || p.WeakAlgorithms[packet.PubKeyAlgoElGamal] {
+		t.Errorf("unexpected weak algorithms %v", p.WeakAlgorithms)
+	}
+
+	p = apppkg.ParseKeyPolicy("bogus", "-1", "none")
+	if p.Mode != apppkg.KeyPolicyWarn || p.MinKeyBits != 0 || len(p.WeakAlgorithms) != 0 || p.WeakAlgorithms == nil {
+		t.Errorf("invalid values should fall back to defaults, got %+v", p)
+	}
+}
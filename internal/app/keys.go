@@ -2,14 +2,16 @@ package app
 
 import (
 	"crypto/sha256"
+	"database/sql"
 	"errors"
 	"fmt"
 	"html/template"
 	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
-	"time"
 
+	"github.com/ProtonMail/gopenpgp/v3/constants"
 	"github.com/ProtonMail/gopenpgp/v3/crypto"
 	"golang.org/x/crypto/bcrypt"
 
@@ -69,62 +71,297 @@ func sanitizeArmored(s string) string {
 	return strings.Join(block, "\n") + "\n"
 }
 
-// AddKeyHandler stores a new PGP key.
+// AddKeyHandler stores new PGP keys from pasted ASCII armor or an uploaded
+// .asc/.gpg/.pgp/.key file. Armored and binary key data are detected
+// automatically; a file holding several keys imports all of them.
 func (a *App) AddKeyHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	name := r.FormValue("name")
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		r.Body = http.MaxBytesReader(w, r.Body, maxKeyUploadBytes)
+		if err := r.ParseMultipartForm(maxKeyUploadBytes); err != nil {
+			http.Error(w, "invalid upload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
 	password := r.FormValue("password")
 
-	armored := sanitizeArmored(r.FormValue("armored"))
-
-	k, err := crypto.NewKeyFromArmored(armored)
+	material, err := submittedKeyMaterial(r)
 	if err != nil {
-		slog.Error("failed to parse armored PGP key", "name", name, "err", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	keys, err := parseKeyMaterial(material)
+	if err != nil {
+		slog.Error("failed to parse PGP key", "name", name, "err", err)
 		http.Error(w, "invalid PGP key: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	isPrivate := k.IsPrivate()
 
-	var encrypted *string
-	var bcryptHash *string
+	var encrypted, bcryptHash *string
 	if password != "" {
-		enc, err := a.Crypto.Encrypt([]byte(password))
+		if encrypted, bcryptHash, err = a.sealPassphrase(password); err != nil {
+			a.writePassphraseError(w, name, err)
+			return
+		}
+	}
+
+	mode := parsePinMode(r.FormValue("pin"))
+	var failures []string
+	serverFailure := false
+	for _, pk := range keys {
+		keyName := name
+		switch {
+		case keyName == "":
+			keyName = keyDisplayName(pk.Key)
+		case len(keys) > 1:
+			keyName = name + ": " + keyDisplayName(pk.Key)
+		}
+
+		lint, err := a.lintForImport(pk.Key)
 		if err != nil {
-			if errors.Is(err, cm.ErrMasterPasswordNotSet) {
-				http.Error(w, "server not configured to store passphrases: set MASTER_PASSWORD env var", http.StatusInternalServerError)
+			slog.Warn("key refused by key policy", "name", keyName, "err", err)
+			if len(keys) == 1 {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			failures = append(failures, keyName+": "+err.Error())
+			continue
+		}
+		if lint != nil && *lint != "" {
+			slog.Warn("key has weaknesses", "name", keyName, "warnings", *lint)
+			w.Header().Add("X-Key-Warning", keyName+": "+strings.ReplaceAll(*lint, "\n", "; "))
+		}
+
+		rec := keyRecord{Name: keyName, Armored: pk.Armored, Key: pk.Key, EncryptedPassword: encrypted, PasswordBcrypt: bcryptHash, LintWarnings: lint}
+		if _, err := a.insertKey(r.Context(), rec, mode); err != nil {
+			var conflict *pinConflictError
+			if errors.As(err, &conflict) && len(keys) == 1 {
+				slog.Warn("key refused: identity pinned to another key", "name", keyName, "err", err)
+				http.Error(w, err.Error()+"; resubmit with pin=replace to replace the pinned key or pin=keep to store this key flagged", http.StatusConflict)
 				return
 			}
-			slog.Error("failed to encrypt passphrase for storage", "name", name, "err", err)
-			http.Error(w, "failed to encrypt passphrase: "+err.Error(), http.StatusInternalServerError)
+			if !errors.As(err, &conflict) {
+				slog.Error("failed to insert key", "name", keyName, "err", err)
+				serverFailure = true
+			}
+			failures = append(failures, keyName+": "+err.Error())
+			continue
+		}
+		slog.Info("key added", "name", keyName, "private", pk.Key.IsPrivate())
+	}
+
+	if len(failures) > 0 {
+		status := http.StatusUnprocessableEntity
+		if serverFailure && len(failures) == len(keys) {
+			status = http.StatusInternalServerError
+		}
+		msg := "failed to store key: " + failures[0]
+		if len(keys) > 1 {
+			msg = fmt.Sprintf("stored %d of %d keys; failed: %s", len(keys)-len(failures), len(keys), strings.Join(failures, "; "))
+		}
+		http.Error(w, msg, status)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// GenerateKeyHandler creates a new key pair with the requested OpenPGP
+// profile ("profile" form field, defaulting to PGP_PROFILE) and stores it as
+// a private key with ultimate trust. The key is locked with "password" if
+// given, using the profile's S2K (Argon2 under rfc9580), and the passphrase
+// is stored for decryption like in AddKeyHandler.
+func (a *App) GenerateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	uidName := strings.TrimSpace(r.FormValue("uid_name"))
+	email := strings.TrimSpace(r.FormValue("email"))
+	if email == "" || !strings.Contains(email, "@") {
+		http.Error(w, "missing or invalid email", http.StatusUnprocessableEntity)
+		return
+	}
+	profileName, ok := a.requestProfile(w, r)
+	if !ok {
+		return
+	}
+	security := constants.StandardSecurity
+	if r.FormValue("security") == "high" {
+		security = constants.HighSecurity
+	}
+	password := r.FormValue("password")
+
+	pgp := a.pgp(profileName)
+	key, err := pgp.KeyGeneration().AddUserId(uidName, email).New().GenerateKeyWithSecurity(security)
+	if err != nil {
+		slog.Error("key generation failed", "profile", profileName, "err", err)
+		http.Error(w, "key generation failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var encrypted, bcryptHash *string
+	if password != "" {
+		if key, err = pgp.LockKey(key, []byte(password)); err != nil {
+			slog.Error("failed to lock generated key", "profile", profileName, "err", err)
+			http.Error(w, "failed to lock key: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
-		encrypted = &enc
-		// Pre-hash with SHA-256 so input is always 32 bytes; bcrypt silently
-		// truncates at 72 bytes and rejects longer inputs in recent versions.
-		ph := sha256.Sum256([]byte(password))
-		if h, err := bcrypt.GenerateFromPassword(ph[:], bcrypt.DefaultCost); err != nil {
-			slog.Warn("failed to bcrypt passphrase; key stored without bcrypt hash", "name", name, "err", err)
-		} else {
-			hs := string(h)
-			bcryptHash = &hs
+		if encrypted, bcryptHash, err = a.sealPassphrase(password); err != nil {
+			a.writePassphraseError(w, email, err)
+			return
 		}
 	}
+	armored, err := key.Armor()
+	if err != nil {
+		http.Error(w, "failed to armor key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	q := a.DB.Rebind("INSERT INTO keys (name, armored, is_private, encrypted_password, password_bcrypt, created_at) VALUES (?, ?, ?, ?, ?, ?)")
-	if _, err = a.DB.ExecContext(r.Context(), q, name, armored, isPrivate, encrypted, bcryptHash, time.Now()); err != nil {
-		slog.Error("failed to insert key", "name", name, "err", err)
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		name = keyDisplayName(key)
+	}
+	lint, err := a.lintForImport(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	rec := keyRecord{Name: name, Armored: armored, Key: key, EncryptedPassword: encrypted, PasswordBcrypt: bcryptHash,
+		TrustLevel: TrustUltimate, LintWarnings: lint}
+	if _, err := a.insertKey(r.Context(), rec, parsePinMode(r.FormValue("pin"))); err != nil {
+		var conflict *pinConflictError
+		if errors.As(err, &conflict) {
+			http.Error(w, err.Error()+"; resubmit with pin=replace to replace the pinned key or pin=keep to store this key flagged", http.StatusConflict)
+			return
+		}
+		slog.Error("failed to store generated key", "name", name, "err", err)
 		http.Error(w, "failed to store key: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	slog.Info("key generated", "name", name, "profile", profileName, "version", key.GetVersion())
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// sealPassphrase encrypts a key passphrase with the master key for storage
+// and computes its bcrypt hash. A bcrypt failure is only logged: the hash is
+// optional and the key stays usable without it.
+func (a *App) sealPassphrase(password string) (encrypted, hash *string, err error) {
+	enc, err := a.Crypto.Encrypt([]byte(password))
+	if err != nil {
+		return nil, nil, err
+	}
+	if h, err := bcryptPassphrase(password); err != nil {
+		slog.Warn("failed to bcrypt passphrase; key stored without bcrypt hash", "err", err)
+	} else {
+		hash = &h
+	}
+	return &enc, hash, nil
+}
+
+// bcryptPassphrase returns the bcrypt hash of password. The input is
+// pre-hashed with SHA-256 so it is always 32 bytes; bcrypt silently
+// truncates at 72 bytes and rejects longer inputs in recent versions.
+func bcryptPassphrase(password string) (string, error) {
+	ph := sha256.Sum256([]byte(password))
+	h, err := bcrypt.GenerateFromPassword(ph[:], bcrypt.DefaultCost)
+	return string(h), err
+}
+
+// matchPassphrase reports whether password matches a bcryptPassphrase hash.
+func matchPassphrase(hash, password string) bool {
+	ph := sha256.Sum256([]byte(password))
+	return bcrypt.CompareHashAndPassword([]byte(hash), ph[:]) == nil
+}
+
+// writePassphraseError reports a sealPassphrase failure for the named key.
+func (a *App) writePassphraseError(w http.ResponseWriter, name string, err error) {
+	if errors.Is(err, cm.ErrMasterPasswordNotSet) {
+		http.Error(w, "server not configured to store passphrases: set MASTER_PASSWORD env var", http.StatusInternalServerError)
+		return
+	}
+	slog.Error("failed to encrypt passphrase for storage", "name", name, "err", err)
+	http.Error(w, "failed to encrypt passphrase: "+err.Error(), http.StatusInternalServerError)
+}
+
+// SetPassphraseHandler stores the passphrase for a passphrase-protected
+// private key, e.g. one imported from GnuPG without it. The passphrase must
+// unlock the key.
+func (a *App) SetPassphraseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusUnprocessableEntity)
+		return
+	}
+	password := r.FormValue("password")
+	if password == "" {
+		http.Error(w, "missing password", http.StatusUnprocessableEntity)
+		return
+	}
+	var k mm.Key
+	scope, args := keyScope(r.Context(), true)
+	q := a.DB.Rebind("SELECT id, name, armored, is_private FROM keys WHERE id = ? AND " + scope)
+	if err := a.DB.GetContext(r.Context(), &k, q, append([]interface{}{id}, args...)...); err != nil {
+		http.Error(w, "key not found", http.StatusNotFound)
+		return
+	}
+	if !k.IsPrivate {
+		http.Error(w, "key is not a private key", http.StatusUnprocessableEntity)
+		return
+	}
+	priv, err := crypto.NewKeyFromArmored(k.Armored)
+	if err != nil {
+		slog.Error("set passphrase: failed to parse stored private key", "key_id", k.ID, "err", err)
+		http.Error(w, "stored private key is invalid: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := checkPassphrase(priv, password); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
 
-	slog.Info("key added", "name", name, "private", isPrivate)
+	encrypted, bcryptHash, err := a.sealPassphrase(password)
+	if err != nil {
+		a.writePassphraseError(w, k.Name, err)
+		return
+	}
+	q = a.DB.Rebind("UPDATE keys SET encrypted_password = ?, password_bcrypt = ? WHERE id = ?")
+	if _, err := a.DB.ExecContext(r.Context(), q, encrypted, bcryptHash, k.ID); err != nil {
+		slog.Error("failed to store passphrase", "key_id", k.ID, "err", err)
+		http.Error(w, "failed to store passphrase: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("key passphrase stored", "key_id", k.ID, "name", k.Name)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-// ViewKeyHandler returns key details as an HTML fragment.
+// checkPassphrase verifies that password unlocks the private key k. Keys
+// that are not passphrase-protected are refused, since there is nothing to
+// store.
+func checkPassphrase(k *crypto.Key, password string) error {
+	locked, err := k.IsLocked()
+	if err != nil {
+		return fmt.Errorf("failed to inspect private key: %w", err)
+	}
+	if !locked {
+		return errors.New("key is not passphrase-protected")
+	}
+	unlocked, err := k.Unlock([]byte(password))
+	if err != nil {
+		return errors.New("passphrase does not unlock the key")
+	}
+	unlocked.ClearPrivateParams()
+	return nil
+}
+
+// ViewKeyHandler returns key details as an HTML fragment, with the
+// fingerprint also as PGP words and a QR code for verifying it.
 func (a *App) ViewKeyHandler(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get("id")
 	if id == "" {
@@ -132,8 +369,9 @@ func (a *App) ViewKeyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var k mm.Key
-	q := a.DB.Rebind("SELECT id, name, armored, is_private, encrypted_password, created_at FROM keys WHERE id = ?")
-	if err := a.DB.GetContext(r.Context(), &k, q, id); err != nil {
+	scope, args := keyScope(r.Context(), false)
+	q := a.DB.Rebind("SELECT id, name, armored, is_private, encrypted_password, trust_level, certified_at, fingerprint, pin_conflict, lint_warnings, created_at FROM keys WHERE id = ? AND " + scope)
+	if err := a.DB.GetContext(r.Context(), &k, q, append([]interface{}{id}, args...)...); err != nil {
 		http.Error(w, "key not found", http.StatusNotFound)
 		return
 	}
@@ -141,18 +379,63 @@ func (a *App) ViewKeyHandler(w http.ResponseWriter, r *http.Request) {
 	keyType := "Public"
 	if k.IsPrivate {
 		keyType = "Private"
+		// Only those who may use private keys see them.
+		if !hasRole(r.Context(), RoleDecryptor) {
+			pub, err := publicArmor(k.Armored)
+			if err != nil {
+				slog.Error("view: failed to parse stored key", "key_id", k.ID, "err", err)
+				http.Error(w, "stored key is invalid: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			k.Armored = pub
+		}
+	}
+
+	trust := "Trust: " + k.TrustLevel
+	if k.CertifiedAt != nil {
+		trust += ", certified " + k.CertifiedAt.Format("2 Jan 2006")
+	}
+	if k.PinConflict {
+		trust += ", conflicts with pinned identity"
+	}
+	fpr := keyFingerprint(k.Fingerprint, k.Armored)
+	fingerprint, words, qrCode := "", "", ""
+	if fpr != "" {
+		fingerprint = groupFingerprint(fpr)
+		words = strings.Join(PGPWords(fpr), " ")
+		qrCode = fmt.Sprintf(`<img src="/keys/qr?id=%d" alt="QR code of the fingerprint" title="openpgp4fpr:%s" class="mt-2 w-40 h-40 rounded bg-white">`, k.ID, fpr)
+	}
+
+	weaknesses := ""
+	if ws := k.Weaknesses(); len(ws) > 0 {
+		weaknesses = "Weaknesses: " + strings.Join(ws, "; ")
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	fmt.Fprintf(w, `<div class="p-3 border border-[#292e42] rounded-md bg-[#24283b]"><strong class="text-[#c0caf5]">%s</strong> <span class="text-[#565f89]">—</span> <span class="text-[#7aa2f7]">%s</span> <span class="text-[#565f89]">— Added %s</span><pre class="mt-2 p-2 bg-[#16161e] text-sm text-[#a9b1d6] rounded overflow-x-auto">%s</pre></div>`,
+	fmt.Fprintf(w, `<div class="p-3 border border-[#292e42] rounded-md bg-[#24283b]"><strong class="text-[#c0caf5]">%s</strong> <span class="text-[#565f89]">—</span> <span class="text-[#7aa2f7]">%s</span> <span class="text-[#565f89]">— Added %s</span> <span class="text-[#565f89]">— %s</span><div class="mt-1 text-xs font-mono text-[#565f89]">%s</div><div class="mt-1 text-xs text-[#a9b1d6]">%s</div>%s<div class="mt-1 text-xs text-[#ff9e64]">%s</div><pre class="mt-2 p-2 bg-[#16161e] text-sm text-[#a9b1d6] rounded overflow-x-auto">%s</pre></div>`,
 		template.HTMLEscapeString(k.Name),
 		keyType,
 		template.HTMLEscapeString(k.CreatedAt.String()),
+		template.HTMLEscapeString(trust),
+		template.HTMLEscapeString(fingerprint),
+		template.HTMLEscapeString(words),
+		qrCode,
+		template.HTMLEscapeString(weaknesses),
 		template.HTMLEscapeString(k.Armored),
 	)
 }
 
-// DeleteKeyHandler removes a key by ID.
+// publicArmor returns the armored public part of an armored key.
+func publicArmor(armored string) (string, error) {
+	k, err := crypto.NewKeyFromArmored(armored)
+	if err != nil {
+		return "", err
+	}
+	return k.GetArmoredPublicKey()
+}
+
+// DeleteKeyHandler removes a key by ID, with the inbox messages submitted
+// to it.
 func (a *App) DeleteKeyHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -163,8 +446,38 @@ func (a *App) DeleteKeyHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing id", http.StatusUnprocessableEntity)
 		return
 	}
-	q := a.DB.Rebind("DELETE FROM keys WHERE id = ?")
-	if _, err := a.DB.ExecContext(r.Context(), q, id); err != nil {
+	keyID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusUnprocessableEntity)
+		return
+	}
+	err = func() error {
+		tx, err := a.DB.BeginTxx(r.Context(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck
+		scope, args := keyScope(r.Context(), true)
+		res, err := tx.ExecContext(r.Context(), tx.Rebind("DELETE FROM keys WHERE id = ? AND "+scope), append([]interface{}{keyID}, args...)...)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return sql.ErrNoRows
+		}
+		if err := unpinKey(r.Context(), tx, keyID); err != nil {
+			return err
+		}
+		if err := removeInboxMessages(r.Context(), tx, keyID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
 		slog.Error("failed to delete key", "id", id, "err", err)
 		http.Error(w, "failed to delete key: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -172,3 +485,41 @@ func (a *App) DeleteKeyHandler(w http.ResponseWriter, r *http.Request) {
 	slog.Info("key deleted", "id", id)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
+
+// setKeyFlag handles a POST setting the boolean column of the key "id" from
+// the form field of the same name, which defaults to true. column is
+// interpolated into the query and must be a constant.
+func (a *App) setKeyFlag(w http.ResponseWriter, r *http.Request, column string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusUnprocessableEntity)
+		return
+	}
+	value := true
+	if v := r.FormValue(column); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "invalid "+column+" value", http.StatusUnprocessableEntity)
+			return
+		}
+		value = b
+	}
+	scope, args := keyScope(r.Context(), true)
+	q := a.DB.Rebind("UPDATE keys SET " + column + " = ? WHERE id = ? AND " + scope)
+	res, err := a.DB.ExecContext(r.Context(), q, append([]interface{}{value, id}, args...)...)
+	if err != nil {
+		slog.Error("failed to update key flag", "id", id, "flag", column, "err", err)
+		http.Error(w, "failed to update key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "key not found", http.StatusNotFound)
+		return
+	}
+	slog.Info("key flag changed", "id", id, "flag", column, "value", value)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
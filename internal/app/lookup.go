@@ -0,0 +1,91 @@
+package app
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	kf "h-cloud.io/web-gpg/internal/keyfetch"
+)
+
+// keyLookupTimeout bounds each request to a keyserver or WKD host.
+const keyLookupTimeout = 10 * time.Second
+
+// NewKeyFetcher builds the external key lookup client from the KEYSERVER_URL
+// and KEY_LOOKUP_WKD env values. KEYSERVER_URL defaults to
+// keys.openpgp.org; "none" disables keyserver lookups and "false" for
+// KEY_LOOKUP_WKD disables WKD lookups. Invalid values fall back to the
+// defaults.
+func NewKeyFetcher(keyserver, wkd string) *kf.Client {
+	keyserver = strings.TrimSpace(keyserver)
+	switch strings.ToLower(keyserver) {
+	case "":
+		keyserver = kf.DefaultKeyserver
+	case "none":
+		keyserver = ""
+	default:
+		if u, err := url.Parse(keyserver); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			slog.Warn("invalid KEYSERVER_URL, using default", "value", keyserver)
+			keyserver = kf.DefaultKeyserver
+		}
+	}
+	c := kf.New(keyserver, keyLookupTimeout)
+	if wkd != "" {
+		enabled, err := strconv.ParseBool(wkd)
+		if err != nil {
+			slog.Warn("invalid KEY_LOOKUP_WKD, using default", "value", wkd)
+			enabled = true
+		}
+		c.WKD = enabled
+	}
+	return c
+}
+
+// lookupCandidate is a key found by LookupKeyHandler, with the id of the
+// stored key of the same fingerprint if there is one.
+type lookupCandidate struct {
+	kf.Candidate
+	StoredID int64 `json:"stored_id,omitempty"`
+}
+
+// LookupKeyHandler looks up the keys for "email" in the address domain's Web
+// Key Directory and on the configured keyserver, and returns them as JSON for
+// preview. Nothing is stored: the chosen candidate's armored key is imported
+// by posting it to /keys like any other key.
+func (a *App) LookupKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.KeyFetcher == nil {
+		http.Error(w, "key lookup is disabled", http.StatusServiceUnavailable)
+		return
+	}
+	email := strings.TrimSpace(r.FormValue("email"))
+	if _, _, err := kf.SplitEmail(email); err != nil {
+		http.Error(w, "missing or invalid email", http.StatusUnprocessableEntity)
+		return
+	}
+
+	found, err := a.KeyFetcher.Lookup(r.Context(), email)
+	if err != nil {
+		slog.Error("key lookup failed", "email", email, "err", err)
+		http.Error(w, "key lookup failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	results := make([]lookupCandidate, 0, len(found))
+	for _, c := range found {
+		id, err := a.keyIDByFingerprint(r.Context(), strings.ToLower(c.Fingerprint))
+		if err != nil {
+			slog.Warn("failed to check for stored key", "fingerprint", c.Fingerprint, "err", err)
+		}
+		results = append(results, lookupCandidate{Candidate: c, StoredID: id})
+	}
+	slog.Info("key lookup", "email", email, "candidates", len(results))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
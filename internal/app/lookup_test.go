@@ -0,0 +1,97 @@
+package app_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	apppkg "h-cloud.io/web-gpg/internal/app"
+	kf "h-cloud.io/web-gpg/internal/keyfetch"
+)
+
+// lookupResult is one entry of the LookupKeyHandler response.
+type lookupResult struct {
+	Source      string `json:"source"`
+	Fingerprint string `json:"fingerprint"`
+	Armored     string `json:"armored"`
+	StoredID    int64  `json:"stored_id"`
+}
+
+// TestLookupKeyHandler verifies candidates from a keyserver are previewed and
+// import through AddKeyHandler, after which they are reported as stored.
+func TestLookupKeyHandler(t *testing.T) {
+	a, _ := setupTestApp(t)
+
+	if w := postForm(a.LookupKeyHandler, "/keys/lookup", url.Values{"email": {"joe@example.com"}}); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("without a fetcher: expected 503, got %d", w.Code)
+	}
+
+	joe := generateTestKey(t, "Joe", "joe@example.com", "")
+	armored, _ := joe.GetArmoredPublicKey()
+	keyserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pks/lookup" || r.URL.Query().Get("search") != "joe@example.com" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(armored))
+	}))
+	defer keyserver.Close()
+	a.KeyFetcher = &kf.Client{HTTP: keyserver.Client(), Keyserver: keyserver.URL}
+
+	lookup := func() []lookupResult {
+		t.Helper()
+		w := postForm(a.LookupKeyHandler, "/keys/lookup", url.Values{"email": {"joe@example.com"}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var results []lookupResult
+		if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return results
+	}
+
+	results := lookup()
+	if len(results) != 1 || results[0].Source != "hkp" || !strings.EqualFold(results[0].Fingerprint, joe.GetFingerprint()) || results[0].StoredID != 0 {
+		t.Fatalf("unexpected candidates %+v", results)
+	}
+	if w := postForm(a.AddKeyHandler, "/keys", url.Values{"armored": {results[0].Armored}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("import candidate: expected 303, got %d: %s", w.Code, w.Body.String())
+	}
+	if results := lookup(); len(results) != 1 || results[0].StoredID == 0 {
+		t.Errorf("imported candidate should be reported as stored, got %+v", results)
+	}
+
+	for _, email := range []string{"joe", "x@10.0.0.5:8443/admin?"} {
+		if w := postForm(a.LookupKeyHandler, "/keys/lookup", url.Values{"email": {email}}); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%q: expected 422, got %d", email, w.Code)
+		}
+	}
+	keyserver.Close()
+	if w := postForm(a.LookupKeyHandler, "/keys/lookup", url.Values{"email": {"joe@example.com"}}); w.Code != http.StatusBadGateway {
+		t.Errorf("keyserver down: expected 502, got %d", w.Code)
+	}
+}
+
+// TestNewKeyFetcher verifies env parsing of the lookup sources.
+func TestNewKeyFetcher(t *testing.T) {
+	tests := []struct {
+		keyserver, wkd string
+		wantServer     string
+		wantWKD        bool
+	}{
+		{"", "", kf.DefaultKeyserver, true},
+		{"https://keyserver.example.com/", "false", "https://keyserver.example.com", false},
+		{"none", "1", "", true},
+		{"ftp://nope", "maybe", kf.DefaultKeyserver, true},
+	}
+	for _, tt := range tests {
+		c := apppkg.NewKeyFetcher(tt.keyserver, tt.wkd)
+		if c.Keyserver != tt.wantServer || c.WKD != tt.wantWKD {
+			t.Errorf("NewKeyFetcher(%q, %q) = %q, %v", tt.keyserver, tt.wkd, c.Keyserver, c.WKD)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/jmoiron/sqlx"
+
+	cm "h-cloud.io/web-gpg/internal/crypto"
+)
+
+// RotateMasterPassword wraps the data key with newPassword instead of
+// oldPassword and ends every session, in one transaction. Stored key
+// passphrases and two-factor secrets from before data keys are re-encrypted
+// with a new data key on the way.
+func (a *App) RotateMasterPassword(ctx context.Context, oldPassword, newPassword string) error {
+	var keys, secrets int
+	err := a.Crypto.RotateMasterPassword(ctx, oldPassword, newPassword, func(tx *sqlx.Tx, re cm.Reencrypter) error {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM sessions"); err != nil {
+			return err
+		}
+		if re == nil {
+			return nil
+		}
+		var err error
+		keys, secrets, err = reencryptSecrets(ctx, tx, re)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("master password rotated", "reencrypted_key_passphrases", keys, "reencrypted_two_factor_secrets", secrets)
+	return nil
+}
+
+// UpgradeEncryption applies the configured Argon2 parameters to the data
+// key and rewrites the stored key passphrases and two-factor secrets in the
+// current ciphertext format. A database from before data keys is converted
+// instead, by rotating MASTER_PASSWORD to itself, which does both.
+func (a *App) UpgradeEncryption(ctx context.Context) error {
+	var keys, secrets int
+	err := a.Crypto.UpgradeEncryption(ctx, func(tx *sqlx.Tx, re cm.Reencrypter) error {
+		var err error
+		keys, secrets, err = reencryptSecrets(ctx, tx, re)
+		return err
+	})
+	if errors.Is(err, cm.ErrNoDataKey) {
+		return a.RotateMasterPassword(ctx, a.MasterPassword, a.MasterPassword)
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("encryption upgraded", "reencrypted_key_passphrases", keys, "reencrypted_two_factor_secrets", secrets)
+	return nil
+}
+
+// reencryptSecrets rewrites the stored key passphrases and two-factor
+// secrets with re and returns how many of each there were.
+func reencryptSecrets(ctx context.Context, tx *sqlx.Tx, re cm.Reencrypter) (keys, secrets int, err error) {
+	var passphrases []struct {
+		ID        int64  `db:"id"`
+		Encrypted string `db:"encrypted_password"`
+	}
+	if err := tx.SelectContext(ctx, &passphrases, "SELECT id, encrypted_password FROM keys WHERE encrypted_password IS NOT NULL"); err != nil {
+		return 0, 0, err
+	}
+	for _, p := range passphrases {
+		enc, err := re(p.Encrypted)
+		if err != nil {
+			return 0, 0, fmt.Errorf("passphrase of key %d: %w", p.ID, err)
+		}
+		if _, err := tx.ExecContext(ctx, tx.Rebind("UPDATE keys SET encrypted_password = ? WHERE id = ?"), enc, p.ID); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	var twoFactor []struct {
+		UserID int64  `db:"user_id"`
+		Secret string `db:"secret"`
+	}
+	if err := tx.SelectContext(ctx, &twoFactor, "SELECT user_id, secret FROM two_factor"); err != nil {
+		return 0, 0, err
+	}
+	for _, tf := range twoFactor {
+		enc, err := re(tf.Secret)
+		if err != nil {
+			return 0, 0, fmt.Errorf("two-factor secret of user %d: %w", tf.UserID, err)
+		}
+		if _, err := tx.ExecContext(ctx, tx.Rebind("UPDATE two_factor SET secret = ? WHERE user_id = ?"), enc, tf.UserID); err != nil {
+			return 0, 0, err
+		}
+	}
+	return len(passphrases), len(twoFactor), nil
+}
+
+// AddMasterPassword wraps the data key with password too, under name. A
+// database from before data keys is converted first, by rotating
+// MASTER_PASSWORD to itself.
+func (a *App) AddMasterPassword(ctx context.Context, name, password string) error {
+	err := a.Crypto.AddMasterPassword(ctx, name, password)
+	if !errors.Is(err, cm.ErrNoDataKey) {
+		return err
+	}
+	if err := a.RotateMasterPassword(ctx, a.MasterPassword, a.MasterPassword); err != nil {
+		return err
+	}
+	return a.Crypto.AddMasterPassword(ctx, name, password)
+}
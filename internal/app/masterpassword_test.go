@@ -0,0 +1,132 @@
+package app_test
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	gcrypto "github.com/ProtonMail/gopenpgp/v3/crypto"
+
+	apppkg "h-cloud.io/web-gpg/internal/app"
+)
+
+// TestRotateMasterPassword verifies key passphrases and two-factor secrets
+// stored before data keys still work under the new master password, that
+// everyone is logged out and that a wrong old password changes nothing.
+func TestRotateMasterPassword(t *testing.T) {
+	a, db := setupTestApp(t)
+	db.MustExec("INSERT INTO secrets (name, value) VALUES (?, ?)", "master_salt", "c2FsdHNhbHRzYWx0c2FsdA==")
+	bootstrap := login(t, a, "", "test-master-password")
+	as(a, bootstrap, a.UsersHandler, http.MethodPost, "/users", url.Values{"username": {"alice"}, "password": {"alice-password"}})
+	alice := login(t, a, "alice", "alice-password")
+
+	w := as(a, alice, a.TwoFactorHandler, http.MethodPost, "/2fa", nil)
+	var enrollment struct {
+		Secret string `json:"secret"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &enrollment)
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	if err != nil {
+		t.Fatalf("enroll: %d %s", w.Code, w.Body.String())
+	}
+
+	priv := generateTestKey(t, "Locked Key", "l@t.com", "keypass")
+	privArmored, _ := priv.Armor()
+	pubArmored, _ := priv.GetArmoredPublicKey()
+	encPass, err := a.Crypto.Encrypt([]byte("keypass"))
+	if err != nil {
+		t.Fatalf("encrypt passphrase: %v", err)
+	}
+	res, _ := db.Exec("INSERT INTO keys (name, armored, is_private, encrypted_password, created_at) VALUES (?, ?, ?, ?, ?)",
+		"locked-key", privArmored, true, &encPass, time.Now())
+	privID, _ := res.LastInsertId()
+	pubKey, _ := gcrypto.NewKeyFromArmored(pubArmored)
+	encHandle, _ := gcrypto.PGP().Encryption().Recipient(pubKey).New()
+	pgpMsg, _ := encHandle.Encrypt([]byte("secret data"))
+	armored, _ := pgpMsg.Armor()
+	decrypt := func() string {
+		w := postForm(a.DecryptHandler, "/decrypt", url.Values{"key": {fmt.Sprint(privID)}, "input": {armored}})
+		return strings.TrimSpace(w.Body.String())
+	}
+
+	if err := a.RotateMasterPassword(context.Background(), "wrong-password", "new-master-password"); err == nil {
+		t.Fatal("a wrong old password should fail the rotation")
+	}
+	if got := decrypt(); got != "secret data" || !loggedIn(a, alice) {
+		t.Fatalf("a failed rotation should change nothing, got %q", got)
+	}
+
+	if err := a.RotateMasterPassword(context.Background(), "test-master-password", "new-master-password"); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	t.Setenv("MASTER_PASSWORD", "new-master-password")
+	a.MasterPassword = "new-master-password"
+	if loggedIn(a, alice) {
+		t.Error("rotation should end every session")
+	}
+	if got := decrypt(); got != "secret data" {
+		t.Errorf("stored passphrase after rotation: got %q", got)
+	}
+	alice = login(t, a, "alice", "alice-password")
+	code := apppkg.TOTPCode(secret, time.Now())
+	if w := as(a, alice, a.ConfirmTwoFactorHandler, http.MethodPost, "/2fa/confirm", url.Values{"code": {code}}); w.Code != http.StatusOK {
+		t.Errorf("two-factor secret after rotation: %d %s", w.Code, w.Body.String())
+	}
+
+	if err := a.AddMasterPassword(context.Background(), "recovery", "recovery-key"); err != nil {
+		t.Fatalf("add master password: %v", err)
+	}
+	t.Setenv("MASTER_PASSWORD", "recovery-key")
+	if got := decrypt(); got != "secret data" {
+		t.Errorf("stored passphrase with the recovery key: got %q", got)
+	}
+}
+
+// TestUpgradeEncryption verifies a database from before data keys is
+// converted, and that stored passphrases keep working when ARGON2_* changes
+// and after the upgrade applies it.
+func TestUpgradeEncryption(t *testing.T) {
+	a, db := setupTestApp(t)
+	db.MustExec("INSERT INTO secrets (name, value) VALUES (?, ?)", "master_salt", "c2FsdHNhbHRzYWx0c2FsdA==")
+	encPass, err := a.Crypto.Encrypt([]byte("keypass"))
+	if err != nil {
+		t.Fatalf("encrypt passphrase: %v", err)
+	}
+	res, _ := db.Exec("INSERT INTO keys (name, armored, is_private, encrypted_password, created_at) VALUES (?, ?, ?, ?, ?)",
+		"locked-key", "armored", true, &encPass, time.Now())
+	id, _ := res.LastInsertId()
+	passphrase := func() string {
+		var enc string
+		db.Get(&enc, "SELECT encrypted_password FROM keys WHERE id = ?", id)
+		dec, err := a.Crypto.Decrypt(enc)
+		if err != nil {
+			t.Fatalf("decrypt passphrase: %v", err)
+		}
+		return string(dec)
+	}
+
+	t.Setenv("ARGON2_TIME", "2")
+	if got := passphrase(); got != "keypass" {
+		t.Fatalf("passphrase after changing ARGON2_TIME: %q", got)
+	}
+	if err := a.UpgradeEncryption(context.Background()); err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+	var wrapped string
+	db.Get(&wrapped, "SELECT value FROM secrets WHERE name = 'data_key:master'")
+	if !strings.HasPrefix(wrapped, "$argon2id$v=19$m=32768,t=2,p=2$") {
+		t.Fatalf("expected a data key wrapped with the new parameters: %q", wrapped)
+	}
+	if got := passphrase(); got != "keypass" {
+		t.Fatalf("passphrase after the upgrade: %q", got)
+	}
+	if err := a.UpgradeEncryption(context.Background()); err != nil {
+		t.Fatalf("upgrading again: %v", err)
+	}
+}
@@ -54,13 +54,18 @@ func (rl *rateLimiter) allow(ip string) bool {
 // Allows up to 10 attempts per IP per 15-minute window.
 var AuthRateLimiter = NewRateLimiter(15*time.Minute, 10)
 
+// clientIP returns the client address of r, preferring X-Forwarded-For.
+func clientIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		return fwd
+	}
+	return r.RemoteAddr
+}
+
 // RateLimit wraps a handler with IP-based rate limiting.
 func RateLimit(rl *rateLimiter, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ip := r.RemoteAddr
-		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
-			ip = fwd
-		}
+		ip := clientIP(r)
 		if !rl.allow(ip) {
 			slog.Warn("rate limit exceeded", "method", r.Method, "path", r.URL.Path, "ip", ip)
 			http.Error(w, "too many attempts, try again later", http.StatusTooManyRequests)
@@ -0,0 +1,291 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	mm "h-cloud.io/web-gpg/internal/models"
+)
+
+// oidcCookieMaxAge is how long a user may take to log in at the identity
+// provider, in seconds.
+const oidcCookieMaxAge int64 = 600
+
+// OIDC is the OpenID Connect identity provider users log in with.
+type OIDC struct {
+	config   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+	roles    map[string]string // group -> role; empty gives new users the viewer role
+}
+
+// NewOIDC discovers the identity provider at issuer and returns the single
+// sign-on configuration for the client registered there, redirecting back to
+// redirectURL. roles maps provider groups to roles as "group=role,...".
+// An empty issuer disables single sign-on, as do invalid values, which are
+// logged.
+func NewOIDC(ctx context.Context, issuer, clientID, clientSecret, redirectURL, roles string) *OIDC {
+	issuer = strings.TrimSpace(issuer)
+	if issuer == "" {
+		return nil
+	}
+	if clientID == "" || redirectURL == "" {
+		slog.Warn("OIDC_ISSUER is set without OIDC_CLIENT_ID or OIDC_REDIRECT_URL, single sign-on disabled")
+		return nil
+	}
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		slog.Warn("failed to discover OIDC provider, single sign-on disabled", "issuer", issuer, "err", err)
+		return nil
+	}
+	o := &OIDC{
+		config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "email", "profile", "groups"},
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: clientID}),
+		roles:    map[string]string{},
+	}
+	for _, pair := range strings.Split(roles, ",") {
+		group, role, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		group, role = strings.TrimSpace(group), strings.ToLower(strings.TrimSpace(role))
+		if group == "" {
+			continue
+		}
+		if roleRank(role) < 0 {
+			slog.Warn("ignoring OIDC_ROLES entry with an unknown role", "group", group, "role", role)
+			continue
+		}
+		o.roles[group] = role
+	}
+	return o
+}
+
+// role returns the highest role mapped to any of groups, or "" if none is.
+// Without a mapping every user gets the viewer role.
+func (o *OIDC) role(groups []string) string {
+	if len(o.roles) == 0 {
+		return RoleViewer
+	}
+	best := ""
+	for _, g := range groups {
+		if r, ok := o.roles[g]; ok && roleRank(r) > roleRank(best) {
+			best = r
+		}
+	}
+	return best
+}
+
+// oidcLogin is the state kept in a cookie while the user logs in at the
+// identity provider.
+type oidcLogin struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"` // PKCE code verifier
+	Started  int64  `json:"started"`
+}
+
+// oidcClaims are the ID token claims mapped to a local user.
+type oidcClaims struct {
+	Email         string   `json:"email"`
+	EmailVerified *bool    `json:"email_verified"`
+	Groups        []string `json:"groups"`
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// requireOIDC writes a 404 and returns false when single sign-on is not
+// configured.
+func (a *App) requireOIDC(w http.ResponseWriter) bool {
+	if a.OIDC == nil {
+		http.Error(w, "single sign-on is not configured: set OIDC_ISSUER", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// OIDCLoginHandler redirects to the identity provider with a new state,
+// nonce and PKCE challenge.
+func (a *App) OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.requireOIDC(w) {
+		return
+	}
+	login := oidcLogin{Verifier: oauth2.GenerateVerifier(), Started: time.Now().Unix()}
+	var err error
+	if login.State, err = randomToken(); err == nil {
+		login.Nonce, err = randomToken()
+	}
+	if err != nil {
+		http.Error(w, "failed to start login: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(login)
+	if err != nil {
+		http.Error(w, "failed to start login: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	val, err := a.Crypto.Encrypt(b)
+	if err != nil {
+		slog.Error("failed to encrypt OIDC login state", "err", err)
+		http.Error(w, "failed to start login: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Lax, not Strict: the provider redirects back with a cross-site GET.
+	http.SetCookie(w, &http.Cookie{
+		Name:     "webgpg_oidc",
+		Value:    val,
+		Path:     "/auth/oidc",
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		MaxAge:   int(oidcCookieMaxAge),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, a.OIDC.config.AuthCodeURL(login.State, oidc.Nonce(login.Nonce), oauth2.S256ChallengeOption(login.Verifier)), http.StatusFound)
+}
+
+// OIDCCallbackHandler completes a login at the identity provider: it checks
+// the state, redeems the code with the PKCE verifier, verifies the ID token
+// and logs in the local user named by its email claim.
+func (a *App) OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.requireOIDC(w) {
+		return
+	}
+	login, ok := a.pendingOIDCLogin(w, r)
+	if !ok || r.URL.Query().Get("state") != login.State {
+		slog.Warn("login failed: invalid OIDC state", "ip", r.RemoteAddr)
+		a.renderLogin(w, r, "single sign-on timed out, please try again")
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		slog.Warn("login failed: OIDC provider returned an error", "error", e, "description", r.URL.Query().Get("error_description"), "ip", r.RemoteAddr)
+		a.renderLogin(w, r, "single sign-on failed: "+e)
+		return
+	}
+	token, err := a.OIDC.config.Exchange(r.Context(), r.URL.Query().Get("code"), oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		slog.Warn("login failed: OIDC code exchange failed", "ip", r.RemoteAddr, "err", err)
+		a.renderLogin(w, r, "single sign-on failed")
+		return
+	}
+	raw, _ := token.Extra("id_token").(string)
+	idToken, err := a.OIDC.verifier.Verify(r.Context(), raw)
+	if err != nil || idToken.Nonce != login.Nonce {
+		slog.Warn("login failed: invalid OIDC ID token", "ip", r.RemoteAddr, "err", err)
+		a.renderLogin(w, r, "single sign-on failed")
+		return
+	}
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		slog.Warn("login failed: invalid OIDC claims", "ip", r.RemoteAddr, "err", err)
+		a.renderLogin(w, r, "single sign-on failed")
+		return
+	}
+	u, err := a.oidcUser(r.Context(), claims)
+	if err != nil {
+		if errors.Is(err, errOIDCRefused) {
+			slog.Warn("login failed: OIDC user refused", "email", claims.Email, "groups", claims.Groups, "ip", r.RemoteAddr, "err", err)
+			a.renderLogin(w, r, err.Error())
+			return
+		}
+		slog.Error("failed to map OIDC user", "email", claims.Email, "err", err)
+		http.Error(w, "failed to log in: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.setAuthCookie(w, r, u.ID)
+}
+
+// pendingOIDCLogin returns and clears the login state set by
+// OIDCLoginHandler.
+func (a *App) pendingOIDCLogin(w http.ResponseWriter, r *http.Request) (oidcLogin, bool) {
+	var login oidcLogin
+	c, err := r.Cookie("webgpg_oidc")
+	if err != nil {
+		return login, false
+	}
+	http.SetCookie(w, &http.Cookie{Name: "webgpg_oidc", Value: "", Path: "/auth/oidc", MaxAge: -1})
+	b, err := a.Crypto.Decrypt(c.Value)
+	if err != nil || json.Unmarshal(b, &login) != nil {
+		return login, false
+	}
+	if time.Now().Unix()-login.Started > oidcCookieMaxAge {
+		return login, false
+	}
+	return login, login.State != ""
+}
+
+// errOIDCRefused is wrapped by errors for identities that may not log in.
+var errOIDCRefused = errors.New("single sign-on refused")
+
+// oidcUser returns the local account for the identity in claims, creating it
+// on first login. An existing account is only matched when the provider
+// says the email address is verified, so an unverified address cannot take
+// over a local account. With OIDC_ROLES set, the account's role follows the
+// provider groups on every login, and identities in none of the groups are
+// refused.
+func (a *App) oidcUser(ctx context.Context, claims oidcClaims) (*mm.User, error) {
+	username := strings.ToLower(strings.TrimSpace(claims.Email))
+	if username == "" || !validUsername(username) {
+		return nil, fmt.Errorf("%w: the identity provider sent no usable email address", errOIDCRefused)
+	}
+	if claims.EmailVerified != nil && !*claims.EmailVerified {
+		return nil, fmt.Errorf("%w: the email address is not verified", errOIDCRefused)
+	}
+	role := a.OIDC.role(claims.Groups)
+	if role == "" {
+		return nil, fmt.Errorf("%w: your groups do not grant access", errOIDCRefused)
+	}
+	u, err := a.loadUser(ctx, "username", username)
+	if errors.Is(err, sql.ErrNoRows) {
+		// No password: the account can only log in through the provider
+		// until an administrator sets one.
+		q := a.DB.Rebind("INSERT INTO users (username, password_hash, role, created_at) VALUES (?, ?, ?, ?)")
+		if _, err := a.DB.ExecContext(ctx, q, username, "", role, time.Now()); err != nil {
+			return nil, err
+		}
+		slog.Info("user created by single sign-on", "username", username, "role", role)
+		return a.loadUser(ctx, "username", username)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if claims.EmailVerified == nil {
+		return nil, fmt.Errorf("%w: the identity provider did not verify the email address of an existing account", errOIDCRefused)
+	}
+	if len(a.OIDC.roles) > 0 && u.Role != role {
+		q := a.DB.Rebind("UPDATE users SET role = ? WHERE id = ?")
+		if _, err := a.DB.ExecContext(ctx, q, role, u.ID); err != nil {
+			return nil, err
+		}
+		slog.Info("user role changed by single sign-on", "username", username, "role", role)
+		u.Role = role
+	}
+	return u, nil
+}
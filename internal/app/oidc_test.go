@@ -0,0 +1,256 @@
+package app_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	apppkg "h-cloud.io/web-gpg/internal/app"
+)
+
+const (
+	testClientID    = "easy-web-gpg"
+	testRedirectURL = "https://gpg.example.com/auth/oidc/callback"
+)
+
+// mockIdP is an OpenID Connect provider that logs in whoever is set as its
+// current identity without asking.
+type mockIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu       sync.Mutex
+	identity map[string]any // claims of the next login
+	grants   map[string]mockGrant
+}
+
+type mockGrant struct {
+	nonce, challenge string
+	claims           map[string]any
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	idp := &mockIdP{key: key, grants: map[string]mockGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/keys",
+			"response_types_supported":              []string{"code"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "alg": "RS256", "use": "sig", "kid": "test",
+			"n": b64.EncodeToString(key.N.Bytes()),
+			"e": b64.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != testClientID || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+			http.Error(w, "bad authorization request", http.StatusBadRequest)
+			return
+		}
+		code := make([]byte, 16)
+		rand.Read(code)
+		idp.mu.Lock()
+		idp.grants[b64.EncodeToString(code)] = mockGrant{q.Get("nonce"), q.Get("code_challenge"), idp.identity}
+		idp.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {b64.EncodeToString(code)}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		grant, ok := idp.grants[r.FormValue("code")]
+		delete(idp.grants, r.FormValue("code"))
+		idp.mu.Unlock()
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || b64.EncodeToString(verifier[:]) != grant.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		claims := map[string]any{
+			"iss": idp.URL, "aud": testClientID, "sub": grant.claims["email"], "nonce": grant.nonce,
+			"iat": time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range grant.claims {
+			claims[k] = v
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access", "token_type": "Bearer", "expires_in": 3600,
+			"id_token": idp.sign(t, claims),
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// sign returns claims as an RS256 JWT.
+func (idp *mockIdP) sign(t *testing.T, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+func (idp *mockIdP) as(email string, groups ...string) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.identity = map[string]any{"email": email, "email_verified": true, "groups": groups}
+}
+
+// ssoStart begins a login and follows the provider's redirect back,
+// returning the state cookie and the callback URL.
+func ssoStart(t *testing.T, a *apppkg.App) (*http.Cookie, *url.URL) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	a.OIDCLoginHandler(w, httptest.NewRequest(http.MethodGet, "/auth/oidc", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("start login: %d %s", w.Code, w.Body.String())
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	res.Body.Close()
+	callback, err := url.Parse(res.Header.Get("Location"))
+	if res.StatusCode != http.StatusFound || err != nil {
+		t.Fatalf("authorize: %d %s", res.StatusCode, res.Header.Get("Location"))
+	}
+	return cookieNamed(w, "webgpg_oidc"), callback
+}
+
+// ssoFinish calls the callback the provider redirected to.
+func ssoFinish(a *apppkg.App, state *http.Cookie, callback *url.URL) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+	if state != nil {
+		req.AddCookie(state)
+	}
+	w := httptest.NewRecorder()
+	a.OIDCCallbackHandler(w, req)
+	return w
+}
+
+func ssoLogin(t *testing.T, a *apppkg.App) *httptest.ResponseRecorder {
+	t.Helper()
+	state, callback := ssoStart(t, a)
+	return ssoFinish(a, state, callback)
+}
+
+// TestOIDCLogin runs the authorization code flow against a mock provider and
+// verifies users are created and given roles from their groups, and that
+// state, PKCE and codes are checked.
+func TestOIDCLogin(t *testing.T) {
+	a, _ := setupTestApp(t)
+	idp := newMockIdP(t)
+
+	w := httptest.NewRecorder()
+	a.OIDCLoginHandler(w, httptest.NewRequest(http.MethodGet, "/auth/oidc", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("without OIDC_ISSUER: expected 404, got %d", w.Code)
+	}
+	if apppkg.NewOIDC(context.Background(), "", testClientID, "", testRedirectURL, "") != nil {
+		t.Error("an empty issuer should disable single sign-on")
+	}
+	a.OIDC = apppkg.NewOIDC(context.Background(), idp.URL, testClientID, "secret", testRedirectURL, "gpg-admins=admin, gpg-team=decryptor, staff=viewer, other=root")
+	if a.OIDC == nil {
+		t.Fatal("NewOIDC returned nil")
+	}
+
+	w = postForm(a.AuthHandler, "/auth", url.Values{"password": {"test-master-password"}})
+	if cookieNamed(w, "webgpg_auth") != nil {
+		t.Error("the master password should not log in with single sign-on")
+	}
+
+	idp.as("Alice@Example.com", "staff", "gpg-admins")
+	w = ssoLogin(t, a)
+	alice := cookieNamed(w, "webgpg_auth")
+	if w.Code != http.StatusSeeOther || alice == nil {
+		t.Fatalf("login: %d %s", w.Code, w.Body.String())
+	}
+	w = as(a, alice, apppkg.RequireRole(apppkg.RoleAdmin, a.UsersHandler), http.MethodGet, "/users", nil)
+	if !strings.Contains(w.Body.String(), `"username":"alice@example.com","role":"admin"`) {
+		t.Fatalf("expected alice to be an admin: %d %s", w.Code, w.Body.String())
+	}
+	if w := postForm(a.AuthHandler, "/auth", url.Values{"username": {"alice@example.com"}, "password": {""}}); cookieNamed(w, "webgpg_auth") != nil {
+		t.Error("an account created by single sign-on should have no password")
+	}
+
+	idp.as("alice@example.com", "gpg-team")
+	if w := ssoLogin(t, a); cookieNamed(w, "webgpg_auth") == nil {
+		t.Fatalf("second login: %d %s", w.Code, w.Body.String())
+	}
+	if w := as(a, alice, apppkg.RequireRole(apppkg.RoleAdmin, a.UsersHandler), http.MethodGet, "/users", nil); w.Code != http.StatusForbidden {
+		t.Errorf("role should follow the groups: expected 403, got %d", w.Code)
+	}
+
+	idp.as("mallory@example.com", "other")
+	if w := ssoLogin(t, a); cookieNamed(w, "webgpg_auth") != nil || !strings.Contains(w.Body.String(), "groups do not grant access") {
+		t.Errorf("unmapped groups: %d %s", w.Code, w.Body.String())
+	}
+	idp.mu.Lock()
+	idp.identity = map[string]any{"email": "eve@example.com", "email_verified": false, "groups": []string{"staff"}}
+	idp.mu.Unlock()
+	if w := ssoLogin(t, a); cookieNamed(w, "webgpg_auth") != nil {
+		t.Error("an unverified email should not log in")
+	}
+	idp.mu.Lock()
+	idp.identity = map[string]any{"email": "alice@example.com", "groups": []string{"gpg-admins"}}
+	idp.mu.Unlock()
+	if w := ssoLogin(t, a); cookieNamed(w, "webgpg_auth") != nil || !strings.Contains(w.Body.String(), "did not verify") {
+		t.Errorf("an email without email_verified should not log in to an existing account: %d %s", w.Code, w.Body.String())
+	}
+
+	idp.as("bob@example.com", "staff")
+	state, callback := ssoStart(t, a)
+	tampered := *callback
+	tampered.RawQuery = url.Values{"code": {callback.Query().Get("code")}, "state": {"forged"}}.Encode()
+	if w := ssoFinish(a, state, &tampered); cookieNamed(w, "webgpg_auth") != nil {
+		t.Error("a wrong state should be refused")
+	}
+	if w := ssoFinish(a, nil, callback); cookieNamed(w, "webgpg_auth") != nil {
+		t.Error("a callback without the state cookie should be refused")
+	}
+	otherState, otherCallback := ssoStart(t, a)
+	swapped := *otherCallback
+	swapped.RawQuery = url.Values{"code": {callback.Query().Get("code")}, "state": {otherCallback.Query().Get("state")}}.Encode()
+	if w := ssoFinish(a, otherState, &swapped); cookieNamed(w, "webgpg_auth") != nil {
+		t.Error("a code redeemed with another login's PKCE verifier should be refused")
+	}
+	state, callback = ssoStart(t, a)
+	if w := ssoFinish(a, state, callback); cookieNamed(w, "webgpg_auth") == nil {
+		t.Fatalf("bob: %d %s", w.Code, w.Body.String())
+	}
+	if w := ssoFinish(a, state, callback); cookieNamed(w, "webgpg_auth") != nil {
+		t.Error("a code should only be redeemed once")
+	}
+}
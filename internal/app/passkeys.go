@@ -0,0 +1,471 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+
+	mm "h-cloud.io/web-gpg/internal/models"
+)
+
+// passkeyCeremonyMaxAge is how long a passkey registration or login may take
+// between its two steps, in seconds.
+const passkeyCeremonyMaxAge int64 = 300
+
+// Purposes of a passkey ceremony.
+const (
+	ceremonyRegister = "register"
+	ceremonyLogin    = "login"
+)
+
+// NewWebAuthn builds the passkey relying party from the WEBAUTHN_ORIGIN env
+// value, the URL users open the app at, such as https://gpg.example.com.
+// Passkeys are bound to its host name. Empty or invalid values disable
+// passkeys.
+func NewWebAuthn(origin string) *webauthn.WebAuthn {
+	origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Hostname() == "" {
+		slog.Warn("invalid WEBAUTHN_ORIGIN, passkeys disabled", "value", origin)
+		return nil
+	}
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          u.Hostname(),
+		RPDisplayName: totpIssuer,
+		RPOrigins:     []string{u.Scheme + "://" + u.Host},
+	})
+	if err != nil {
+		slog.Warn("invalid WEBAUTHN_ORIGIN, passkeys disabled", "value", origin, "err", err)
+		return nil
+	}
+	return w
+}
+
+// passkey is a row of the passkeys table.
+type passkey struct {
+	ID         int64      `db:"id" json:"id"`
+	Name       string     `db:"name" json:"name"`
+	Credential string     `db:"credential" json:"-"` // JSON webauthn.Credential
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+	LastUsedAt *time.Time `db:"last_used_at" json:"last_used_at"`
+}
+
+// passkeyUser is an account with its passkeys, as the WebAuthn library sees
+// it. The user handle is the decimal account id.
+type passkeyUser struct {
+	*mm.User
+	credentials []webauthn.Credential
+}
+
+func (u *passkeyUser) WebAuthnID() []byte                         { return []byte(strconv.FormatInt(u.ID, 10)) }
+func (u *passkeyUser) WebAuthnName() string                       { return u.Username }
+func (u *passkeyUser) WebAuthnDisplayName() string                { return u.Username }
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+// loadPasskeys returns the passkeys of userID, oldest first.
+func (a *App) loadPasskeys(ctx context.Context, userID int64) ([]passkey, error) {
+	keys := []passkey{}
+	q := a.DB.Rebind("SELECT id, name, credential, created_at, last_used_at FROM passkeys WHERE user_id = ? ORDER BY created_at, id")
+	err := a.DB.SelectContext(ctx, &keys, q, userID)
+	return keys, err
+}
+
+// passkeyUser returns u with its passkeys.
+func (a *App) passkeyUser(ctx context.Context, u *mm.User) (*passkeyUser, error) {
+	keys, err := a.loadPasskeys(ctx, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	pu := &passkeyUser{User: u}
+	for _, k := range keys {
+		var c webauthn.Credential
+		if err := json.Unmarshal([]byte(k.Credential), &c); err != nil {
+			return nil, err
+		}
+		pu.credentials = append(pu.credentials, c)
+	}
+	return pu, nil
+}
+
+// passkeyCeremony is a row of the passkey_ceremonies table: the state kept
+// between the two steps of a passkey registration or login.
+type passkeyCeremony struct {
+	Purpose string `db:"purpose"`
+	UserID  *int64 `db:"user_id"` // nil for a login that finds the user by passkey
+	Session string `db:"session"` // JSON webauthn.SessionData
+}
+
+// startPasskeyCeremony stores session and sets a cookie naming it.
+func (a *App) startPasskeyCeremony(w http.ResponseWriter, r *http.Request, purpose string, userID *int64, session *webauthn.SessionData) error {
+	b, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	id, err := newSecretID()
+	if err != nil {
+		return err
+	}
+	a.purgeExpiredCeremonies(r.Context())
+	q := a.DB.Rebind("INSERT INTO passkey_ceremonies (id, purpose, user_id, session, expires_at) VALUES (?, ?, ?, ?, ?)")
+	expires := time.Now().UTC().Add(time.Duration(passkeyCeremonyMaxAge) * time.Second)
+	if _, err := a.DB.ExecContext(r.Context(), q, id, purpose, userID, string(b), expires); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "webgpg_passkey",
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		MaxAge:   int(passkeyCeremonyMaxAge),
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+// finishPasskeyCeremony returns and deletes the unexpired ceremony of
+// purpose started by this browser, so each finishes at most once.
+func (a *App) finishPasskeyCeremony(w http.ResponseWriter, r *http.Request, purpose string) (*passkeyCeremony, *webauthn.SessionData, bool) {
+	cookie, err := r.Cookie("webgpg_passkey")
+	if err != nil {
+		return nil, nil, false
+	}
+	http.SetCookie(w, &http.Cookie{Name: "webgpg_passkey", Value: "", Path: "/", MaxAge: -1})
+	var c passkeyCeremony
+	q := a.DB.Rebind("SELECT purpose, user_id, session FROM passkey_ceremonies WHERE id = ? AND expires_at > ?")
+	if err := a.DB.GetContext(r.Context(), &c, q, cookie.Value, time.Now().UTC()); err != nil || c.Purpose != purpose {
+		return nil, nil, false
+	}
+	res, err := a.DB.ExecContext(r.Context(), a.DB.Rebind("DELETE FROM passkey_ceremonies WHERE id = ?"), cookie.Value)
+	if err != nil {
+		slog.Error("failed to delete passkey ceremony", "err", err)
+		return nil, nil, false
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return nil, nil, false
+	}
+	var session webauthn.SessionData
+	if err := json.Unmarshal([]byte(c.Session), &session); err != nil {
+		return nil, nil, false
+	}
+	return &c, &session, true
+}
+
+// purgeExpiredCeremonies deletes passkey ceremonies that were never
+// finished. Failures are only logged: expired ceremonies are refused anyway.
+func (a *App) purgeExpiredCeremonies(ctx context.Context) {
+	q := a.DB.Rebind("DELETE FROM passkey_ceremonies WHERE expires_at < ?")
+	if _, err := a.DB.ExecContext(ctx, q, time.Now().UTC()); err != nil {
+		slog.Warn("failed to purge expired passkey ceremonies", "err", err)
+	}
+}
+
+// requireWebAuthn writes a 404 and returns false when passkeys are not
+// configured.
+func (a *App) requireWebAuthn(w http.ResponseWriter) bool {
+	if a.WebAuthn == nil {
+		http.Error(w, "passkeys are not configured: set WEBAUTHN_ORIGIN", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// PasskeysHandler lists the passkeys of the current user as JSON.
+func (a *App) PasskeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u := loginUser(w, r)
+	if u == nil {
+		return
+	}
+	keys, err := a.loadPasskeys(r.Context(), u.ID)
+	if err != nil {
+		slog.Error("failed to load passkeys", "user_id", u.ID, "err", err)
+		http.Error(w, "failed to load passkeys", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// BeginPasskeyRegistrationHandler returns the options for
+// navigator.credentials.create to add a passkey to the current user.
+func (a *App) BeginPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.requireWebAuthn(w) {
+		return
+	}
+	u := loginUser(w, r)
+	if u == nil {
+		return
+	}
+	pu, err := a.passkeyUser(r.Context(), u)
+	if err != nil {
+		slog.Error("failed to load passkeys", "user_id", u.ID, "err", err)
+		http.Error(w, "failed to start registration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	creation, session, err := a.WebAuthn.BeginRegistration(pu,
+		webauthn.WithExclusions(webauthn.Credentials(pu.credentials).CredentialDescriptors()),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired))
+	if err != nil {
+		slog.Error("failed to start passkey registration", "user_id", u.ID, "err", err)
+		http.Error(w, "failed to start registration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := a.startPasskeyCeremony(w, r, ceremonyRegister, &u.ID, session); err != nil {
+		slog.Error("failed to store passkey ceremony", "err", err)
+		http.Error(w, "failed to start registration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(creation)
+}
+
+// FinishPasskeyRegistrationHandler verifies the credential created by the
+// browser, sent as the JSON body, and stores it as a passkey named by the
+// "name" query parameter.
+func (a *App) FinishPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.requireWebAuthn(w) {
+		return
+	}
+	u := loginUser(w, r)
+	if u == nil {
+		return
+	}
+	c, session, ok := a.finishPasskeyCeremony(w, r, ceremonyRegister)
+	if !ok || c.UserID == nil || *c.UserID != u.ID {
+		http.Error(w, "registration expired, please try again", http.StatusUnprocessableEntity)
+		return
+	}
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if name == "" {
+		name = "Passkey"
+	}
+	pu, err := a.passkeyUser(r.Context(), u)
+	if err != nil {
+		slog.Error("failed to load passkeys", "user_id", u.ID, "err", err)
+		http.Error(w, "failed to register passkey: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cred, err := a.WebAuthn.FinishRegistration(pu, *session, r)
+	if err != nil {
+		slog.Warn("passkey registration failed", "user_id", u.ID, "err", err)
+		http.Error(w, "passkey registration failed: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	b, err := json.Marshal(cred)
+	if err != nil {
+		http.Error(w, "failed to register passkey: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	q := a.DB.Rebind("INSERT INTO passkeys (user_id, name, credential_id, credential, created_at) VALUES (?, ?, ?, ?, ?)")
+	if _, err := a.DB.ExecContext(r.Context(), q, u.ID, name, base64.RawURLEncoding.EncodeToString(cred.ID), string(b), time.Now()); err != nil {
+		slog.Error("failed to store passkey", "user_id", u.ID, "err", err)
+		http.Error(w, "failed to register passkey: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("passkey registered", "user_id", u.ID, "name", name)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// DeletePasskeyHandler removes passkey "id" of the current user.
+func (a *App) DeletePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u := loginUser(w, r)
+	if u == nil {
+		return
+	}
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusUnprocessableEntity)
+		return
+	}
+	res, err := a.DB.ExecContext(r.Context(), a.DB.Rebind("DELETE FROM passkeys WHERE id = ? AND user_id = ?"), id, u.ID)
+	if err != nil {
+		slog.Error("failed to delete passkey", "passkey_id", id, "err", err)
+		http.Error(w, "failed to delete passkey: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "passkey not found", http.StatusNotFound)
+		return
+	}
+	slog.Info("passkey deleted", "user_id", u.ID, "passkey_id", id)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// BeginPasskeyLoginHandler returns the options for navigator.credentials.get.
+// After a correct password it asks for a passkey of that user as the second
+// factor, using up the password step; otherwise any passkey logs in on its own, with user verification
+// required so it stands in for both factors.
+func (a *App) BeginPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.requireWebAuthn(w) {
+		return
+	}
+	var (
+		assertion *protocol.CredentialAssertion
+		session   *webauthn.SessionData
+		userID    *int64
+	)
+	if id, ok := a.takePendingLogin(w, r); ok {
+		u, err := a.userByID(r.Context(), id)
+		if err != nil {
+			http.Error(w, "login timed out, please enter your password again", http.StatusUnprocessableEntity)
+			return
+		}
+		pu, err := a.passkeyUser(r.Context(), u)
+		if err != nil {
+			slog.Error("failed to load passkeys", "user_id", id, "err", err)
+			http.Error(w, "failed to start login: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(pu.credentials) == 0 {
+			http.Error(w, "no passkeys registered", http.StatusUnprocessableEntity)
+			return
+		}
+		if assertion, session, err = a.WebAuthn.BeginLogin(pu); err != nil {
+			slog.Error("failed to start passkey login", "user_id", id, "err", err)
+			http.Error(w, "failed to start login: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		userID = &id
+	} else {
+		var err error
+		if assertion, session, err = a.WebAuthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired)); err != nil {
+			slog.Error("failed to start passkey login", "err", err)
+			http.Error(w, "failed to start login: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := a.startPasskeyCeremony(w, r, ceremonyLogin, userID, session); err != nil {
+		slog.Error("failed to store passkey ceremony", "err", err)
+		http.Error(w, "failed to start login: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(assertion)
+}
+
+// FinishPasskeyLoginHandler verifies the assertion sent by the browser as the
+// JSON body and sets the auth cookie.
+func (a *App) FinishPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.requireWebAuthn(w) {
+		return
+	}
+	c, session, ok := a.finishPasskeyCeremony(w, r, ceremonyLogin)
+	if !ok {
+		http.Error(w, "login expired, please try again", http.StatusUnprocessableEntity)
+		return
+	}
+	var (
+		user webauthn.User
+		cred *webauthn.Credential
+		err  error
+	)
+	if c.UserID != nil {
+		var u *mm.User
+		var pu *passkeyUser
+		if u, err = a.userByID(r.Context(), *c.UserID); err == nil {
+			if pu, err = a.passkeyUser(r.Context(), u); err == nil {
+				user = pu
+				cred, err = a.WebAuthn.FinishLogin(pu, *session, r)
+			}
+		}
+	} else {
+		user, cred, err = a.WebAuthn.FinishPasskeyLogin(func(_, userHandle []byte) (webauthn.User, error) {
+			id, err := strconv.ParseInt(string(userHandle), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			u, err := a.userByID(r.Context(), id)
+			if err != nil {
+				return nil, err
+			}
+			return a.passkeyUser(r.Context(), u)
+		}, *session, r)
+	}
+	if err != nil {
+		slog.Warn("login failed: invalid passkey", "ip", r.RemoteAddr, "err", err)
+		http.Error(w, "passkey login failed", http.StatusUnauthorized)
+		return
+	}
+	pu := user.(*passkeyUser)
+	if cred.Authenticator.CloneWarning {
+		slog.Warn("passkey signature counter went backwards, it may have been cloned", "user_id", pu.ID)
+	}
+	b, err := json.Marshal(cred)
+	if err != nil {
+		http.Error(w, "failed to log in: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	q := a.DB.Rebind("UPDATE passkeys SET credential = ?, last_used_at = ? WHERE credential_id = ? AND user_id = ?")
+	if _, err := a.DB.ExecContext(r.Context(), q, string(b), time.Now(), base64.RawURLEncoding.EncodeToString(cred.ID), pu.ID); err != nil {
+		slog.Error("failed to update passkey", "user_id", pu.ID, "err", err)
+		http.Error(w, "failed to log in: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.setAuthCookie(w, r, pu.ID)
+}
+
+// userByID returns account id, or the bootstrap administrator for id 0
+// while no accounts exist.
+func (a *App) userByID(ctx context.Context, id int64) (*mm.User, error) {
+	if id != 0 {
+		return a.loadUser(ctx, "id", id)
+	}
+	n, err := a.countUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		return nil, sql.ErrNoRows
+	}
+	return bootstrapAdmin, nil
+}
+
+// removePasskeys deletes the passkeys of userID.
+func removePasskeys(ctx context.Context, tx execer, userID int64) error {
+	_, err := tx.ExecContext(ctx, tx.Rebind("DELETE FROM passkeys WHERE user_id = ?"), userID)
+	return err
+}
+
+// countPasskeys returns the number of passkeys of userID.
+func (a *App) countPasskeys(ctx context.Context, userID int64) (int, error) {
+	var n int
+	err := a.DB.GetContext(ctx, &n, a.DB.Rebind("SELECT COUNT(*) FROM passkeys WHERE user_id = ?"), userID)
+	return n, err
+}
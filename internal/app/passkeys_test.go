@@ -0,0 +1,264 @@
+package app_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+
+	apppkg "h-cloud.io/web-gpg/internal/app"
+)
+
+const testOrigin = "https://gpg.example.com"
+
+var b64 = base64.RawURLEncoding
+
+// softAuthenticator is a passkey held in memory, answering the options the
+// app sends the way a browser and authenticator would.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{key: key, credentialID: id}
+}
+
+// authData builds authenticator data for rpID with flags, adding the
+// credential public key when attested.
+func (s *softAuthenticator) authData(t *testing.T, rpID string, flags byte, attested bool) []byte {
+	t.Helper()
+	rpHash := sha256.Sum256([]byte(rpID))
+	s.signCount++
+	var buf bytes.Buffer
+	buf.Write(rpHash[:])
+	buf.WriteByte(flags)
+	binary.Write(&buf, binary.BigEndian, s.signCount)
+	if attested {
+		x, y := make([]byte, 32), make([]byte, 32)
+		s.key.PublicKey.X.FillBytes(x)
+		s.key.PublicKey.Y.FillBytes(y)
+		cose, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+			PublicKeyData: webauthncose.PublicKeyData{KeyType: int64(webauthncose.EllipticKey), Algorithm: int64(webauthncose.AlgES256)},
+			Curve:         1, // P-256
+			XCoord:        x,
+			YCoord:        y,
+		})
+		if err != nil {
+			t.Fatalf("marshal public key: %v", err)
+		}
+		buf.Write(make([]byte, 16)) // AAGUID
+		binary.Write(&buf, binary.BigEndian, uint16(len(s.credentialID)))
+		buf.Write(s.credentialID)
+		buf.Write(cose)
+	}
+	return buf.Bytes()
+}
+
+func clientData(typ, challenge string) []byte {
+	b, _ := json.Marshal(map[string]string{"type": typ, "challenge": challenge, "origin": testOrigin})
+	return b
+}
+
+// create answers navigator.credentials.create options.
+func (s *softAuthenticator) create(t *testing.T, options []byte) []byte {
+	t.Helper()
+	var opts struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			RP        struct {
+				ID string `json:"id"`
+			} `json:"rp"`
+			User struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(options, &opts); err != nil {
+		t.Fatalf("creation options: %v: %s", err, options)
+	}
+	s.userHandle, _ = b64.DecodeString(opts.PublicKey.User.ID)
+	attestation, err := webauthncbor.Marshal(struct {
+		Format       string         `cbor:"fmt"`
+		AttStatement map[string]any `cbor:"attStmt"`
+		AuthData     []byte         `cbor:"authData"`
+	}{"none", map[string]any{}, s.authData(t, opts.PublicKey.RP.ID, 0x45, true)}) // UP, UV, AT
+	if err != nil {
+		t.Fatalf("marshal attestation: %v", err)
+	}
+	b, _ := json.Marshal(map[string]any{
+		"id":    b64.EncodeToString(s.credentialID),
+		"rawId": b64.EncodeToString(s.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64.EncodeToString(clientData("webauthn.create", opts.PublicKey.Challenge)),
+			"attestationObject": b64.EncodeToString(attestation),
+		},
+	})
+	return b
+}
+
+// get answers navigator.credentials.get options.
+func (s *softAuthenticator) get(t *testing.T, options []byte) []byte {
+	t.Helper()
+	var opts struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			RPID      string `json:"rpId"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(options, &opts); err != nil {
+		t.Fatalf("assertion options: %v: %s", err, options)
+	}
+	authData := s.authData(t, opts.PublicKey.RPID, 0x05, false) // UP, UV
+	cd := clientData("webauthn.get", opts.PublicKey.Challenge)
+	cdHash := sha256.Sum256(cd)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), cdHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, s.key, digest[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	b, _ := json.Marshal(map[string]any{
+		"id":    b64.EncodeToString(s.credentialID),
+		"rawId": b64.EncodeToString(s.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64.EncodeToString(cd),
+			"authenticatorData": b64.EncodeToString(authData),
+			"signature":         b64.EncodeToString(sig),
+			"userHandle":        b64.EncodeToString(s.userHandle),
+		},
+	})
+	return b
+}
+
+// call posts body to handler with cookies.
+func call(handler http.HandlerFunc, path string, body []byte, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for _, c := range cookies {
+		if c != nil {
+			req.AddCookie(c)
+		}
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+// passkeyLogin runs a passkey login, with pending from the password step or
+// nil for a login by passkey alone.
+func passkeyLogin(t *testing.T, a *apppkg.App, s *softAuthenticator, pending *http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	begin := call(a.BeginPasskeyLoginHandler, "/auth/passkey/begin", nil, pending)
+	if begin.Code != http.StatusOK {
+		t.Fatalf("begin login: %d %s", begin.Code, begin.Body.String())
+	}
+	return call(a.FinishPasskeyLoginHandler, "/auth/passkey/finish", s.get(t, begin.Body.Bytes()), cookieNamed(begin, "webgpg_passkey"))
+}
+
+// TestPasskeys registers a passkey with a software authenticator and verifies
+// it logs in alone, as a second factor after the password, and that
+// ceremonies cannot be replayed.
+func TestPasskeys(t *testing.T) {
+	a, _ := setupTestApp(t)
+	bootstrap := login(t, a, "", "test-master-password")
+	as(a, bootstrap, a.UsersHandler, http.MethodPost, "/users", url.Values{"username": {"alice"}, "password": {"alice-password"}})
+	alice := login(t, a, "alice", "alice-password")
+
+	if w := call(a.WithAuth(a.BeginPasskeyRegistrationHandler), "/passkeys/register/begin", nil, alice); w.Code != http.StatusNotFound {
+		t.Errorf("without WEBAUTHN_ORIGIN: expected 404, got %d", w.Code)
+	}
+	a.WebAuthn = apppkg.NewWebAuthn(testOrigin)
+	if a.WebAuthn == nil {
+		t.Fatal("NewWebAuthn returned nil")
+	}
+
+	s := newSoftAuthenticator(t)
+	begin := call(a.WithAuth(a.BeginPasskeyRegistrationHandler), "/passkeys/register/begin", nil, alice)
+	if begin.Code != http.StatusOK {
+		t.Fatalf("begin registration: %d %s", begin.Code, begin.Body.String())
+	}
+	ceremony := cookieNamed(begin, "webgpg_passkey")
+	response := s.create(t, begin.Body.Bytes())
+	w := call(a.WithAuth(a.FinishPasskeyRegistrationHandler), "/passkeys/register/finish?name=Laptop", response, alice, ceremony)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("finish registration: %d %s", w.Code, w.Body.String())
+	}
+	if w := call(a.WithAuth(a.FinishPasskeyRegistrationHandler), "/passkeys/register/finish?name=Again", response, alice, ceremony); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("replayed registration: expected 422, got %d", w.Code)
+	}
+	w = as(a, alice, a.PasskeysHandler, http.MethodGet, "/passkeys", nil)
+	var keys []struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &keys)
+	if len(keys) != 1 || keys[0].Name != "Laptop" || strings.Contains(w.Body.String(), "credential") {
+		t.Fatalf("unexpected passkeys: %s", w.Body.String())
+	}
+
+	w = passkeyLogin(t, a, s, nil)
+	if w.Code != http.StatusSeeOther || cookieNamed(w, "webgpg_auth") == nil {
+		t.Fatalf("passkey login: %d %s", w.Code, w.Body.String())
+	}
+
+	begin = call(a.BeginPasskeyLoginHandler, "/auth/passkey/begin", nil)
+	ceremony = cookieNamed(begin, "webgpg_passkey")
+	response = s.get(t, begin.Body.Bytes())
+	if w := call(a.FinishPasskeyLoginHandler, "/auth/passkey/finish", response, ceremony); cookieNamed(w, "webgpg_auth") == nil {
+		t.Fatalf("passkey login: %d %s", w.Code, w.Body.String())
+	}
+	if w := call(a.FinishPasskeyLoginHandler, "/auth/passkey/finish", response, ceremony); cookieNamed(w, "webgpg_auth") != nil {
+		t.Error("a replayed passkey login should be refused")
+	}
+	stranger := newSoftAuthenticator(t)
+	stranger.userHandle = s.userHandle
+	if w := passkeyLogin(t, a, stranger, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("unregistered passkey: expected 401, got %d", w.Code)
+	}
+
+	// With a passkey, the password alone no longer logs in.
+	password := postForm(a.AuthHandler, "/auth", url.Values{"username": {"alice"}, "password": {"alice-password"}})
+	if cookieNamed(password, "webgpg_auth") != nil || !strings.Contains(password.Body.String(), "passkey-btn") {
+		t.Fatal("the password alone should no longer log in")
+	}
+	if strings.Contains(password.Body.String(), `name="code"`) {
+		t.Error("without TOTP the second step should not ask for a code")
+	}
+	w = passkeyLogin(t, a, s, cookieNamed(password, "webgpg_2fa"))
+	if w.Code != http.StatusSeeOther || cookieNamed(w, "webgpg_auth") == nil {
+		t.Fatalf("passkey second factor: %d %s", w.Code, w.Body.String())
+	}
+
+	id := url.Values{"id": {strconv.FormatInt(keys[0].ID, 10)}}
+	if w := as(a, alice, a.DeletePasskeyHandler, http.MethodPost, "/passkeys/delete", id); w.Code != http.StatusSeeOther {
+		t.Fatalf("delete: %d %s", w.Code, w.Body.String())
+	}
+	if w := passkeyLogin(t, a, s, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("deleted passkey: expected 401, got %d", w.Code)
+	}
+	login(t, a, "alice", "alice-password")
+}
@@ -0,0 +1,398 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v3/crypto"
+	"github.com/jmoiron/sqlx"
+
+	mm "h-cloud.io/web-gpg/internal/models"
+)
+
+// Identity history events.
+const (
+	identityPinned   = "pinned"   // first key seen for an address
+	identityConflict = "conflict" // a different key claimed a pinned address
+	identityReplaced = "replaced" // the pin was explicitly moved to a new key
+	identityUnpinned = "unpinned" // the pinned key was deleted
+)
+
+// pinMode selects how insertKey treats a key whose email addresses are
+// already pinned to a different fingerprint.
+type pinMode int
+
+const (
+	pinStrict  pinMode = iota // refuse the key with a pinConflictError
+	pinKeep                   // store the key flagged, leave existing pins alone
+	pinReplace                // store the key and move the pins to it
+)
+
+// parsePinMode maps the "pin" form value ("keep", "replace") to a pinMode.
+func parsePinMode(s string) pinMode {
+	switch s {
+	case "keep":
+		return pinKeep
+	case "replace":
+		return pinReplace
+	}
+	return pinStrict
+}
+
+// pinConflict is an email address pinned to a key other than the one being imported.
+type pinConflict struct {
+	Email       string
+	Fingerprint string
+}
+
+// pinConflictError is returned by insertKey in strict mode when the key claims
+// addresses that are pinned to other keys.
+type pinConflictError struct {
+	conflicts []pinConflict
+}
+
+func (e *pinConflictError) Error() string {
+	parts := make([]string, len(e.conflicts))
+	for i, c := range e.conflicts {
+		parts[i] = c.Email + " is pinned to " + strings.ToUpper(c.Fingerprint)
+	}
+	return "identity conflict: " + strings.Join(parts, "; ")
+}
+
+// keyRecord is a parsed key ready to be inserted into the keys table.
+type keyRecord struct {
+	Name              string
+	Armored           string
+	Key               *crypto.Key
+	EncryptedPassword *string
+	PasswordBcrypt    *string
+	TrustLevel        string  // defaults to TrustUnknown
+	LintWarnings      *string // from lintForImport
+	Published         bool
+}
+
+// keyEmails returns the lower-cased, de-duplicated email addresses of all
+// user IDs on k.
+func keyEmails(k *crypto.Key) []string {
+	seen := map[string]bool{}
+	var emails []string
+	for _, ident := range k.GetEntity().Identities {
+		if ident.UserId == nil {
+			continue
+		}
+		e := strings.ToLower(strings.TrimSpace(ident.UserId.Email))
+		if e == "" || seen[e] {
+			continue
+		}
+		seen[e] = true
+		emails = append(emails, e)
+	}
+	sort.Strings(emails)
+	return emails
+}
+
+// insertKey stores rec and applies trust-on-first-use pinning to its email
+// addresses in a single transaction. It returns the new key's id.
+//
+// Pins belong to the keyring of the key, like the key itself: each user's
+// keys are pinned apart from the shared keyring and from each other.
+func (a *App) insertKey(ctx context.Context, rec keyRecord, mode pinMode) (int64, error) {
+	fpr := rec.Key.GetFingerprint()
+	emails := keyEmails(rec.Key)
+
+	tx, err := a.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	owner, shared := keyOwner(ctx)
+	conflicts, err := findPinConflicts(ctx, tx, owner, fpr, emails)
+	if err != nil {
+		return 0, err
+	}
+	if len(conflicts) > 0 && mode == pinStrict {
+		tx.Rollback() //nolint:errcheck
+		for _, c := range conflicts {
+			if err := recordIdentityEvent(ctx, a.DB, owner, c.Email, nil, fpr, identityConflict); err != nil {
+				slog.Warn("failed to record identity conflict", "email", c.Email, "err", err)
+			}
+		}
+		return 0, &pinConflictError{conflicts: conflicts}
+	}
+
+	trust := rec.TrustLevel
+	if trust == "" {
+		trust = TrustUnknown
+	}
+	var id int64
+	q := tx.Rebind(`INSERT INTO keys (name, armored, is_private, encrypted_password, password_bcrypt, trust_level, fingerprint, pin_conflict, lint_warnings, published, owner_id, shared, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`)
+	flagged := len(conflicts) > 0 && mode == pinKeep
+	if err := tx.GetContext(ctx, &id, q, rec.Name, rec.Armored, rec.Key.IsPrivate(), rec.EncryptedPassword, rec.PasswordBcrypt,
+		trust, fpr, flagged, rec.LintWarnings, rec.Published, owner, shared, time.Now()); err != nil {
+		return 0, err
+	}
+	if err := pinKey(ctx, tx, owner, id, fpr, emails, mode == pinReplace); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// keyringCond returns a condition on the owner_id column of identity_pins or
+// identity_history selecting the keyring of owner, nil for the shared
+// keyring, and its arguments.
+func keyringCond(owner *int64) (string, []interface{}) {
+	if owner == nil {
+		return "owner_id IS NULL", nil
+	}
+	return "owner_id = ?", []interface{}{*owner}
+}
+
+// findPinConflicts returns the addresses in emails that the keyring of owner
+// pins to a fingerprint other than fpr.
+func findPinConflicts(ctx context.Context, tx *sqlx.Tx, owner *int64, fpr string, emails []string) ([]pinConflict, error) {
+	keyring, args := keyringCond(owner)
+	var conflicts []pinConflict
+	for _, email := range emails {
+		var pinned string
+		q := tx.Rebind("SELECT fingerprint FROM identity_pins WHERE email = ? AND " + keyring)
+		err := tx.GetContext(ctx, &pinned, q, append([]interface{}{email}, args...)...)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if pinned != fpr {
+			conflicts = append(conflicts, pinConflict{Email: email, Fingerprint: pinned})
+		}
+	}
+	return conflicts, nil
+}
+
+// pinKey pins every address in emails that the keyring of owner, the owner
+// of keyID, does not pin yet to keyID. When replace is set, addresses pinned
+// to other fingerprints are moved to keyID and the previously pinned keys are
+// flagged; otherwise those addresses are left alone and a conflict is
+// recorded in the identity history.
+func pinKey(ctx context.Context, tx *sqlx.Tx, owner *int64, keyID int64, fpr string, emails []string, replace bool) error {
+	keyring, args := keyringCond(owner)
+	for _, email := range emails {
+		var pin struct {
+			KeyID       int64  `db:"key_id"`
+			Fingerprint string `db:"fingerprint"`
+		}
+		q := tx.Rebind("SELECT key_id, fingerprint FROM identity_pins WHERE email = ? AND " + keyring)
+		err := tx.GetContext(ctx, &pin, q, append([]interface{}{email}, args...)...)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			q := tx.Rebind("INSERT INTO identity_pins (owner_id, email, key_id, fingerprint, pinned_at) VALUES (?, ?, ?, ?, ?)")
+			if _, err := tx.ExecContext(ctx, q, owner, email, keyID, fpr, time.Now()); err != nil {
+				return err
+			}
+			if err := recordIdentityEvent(ctx, tx, owner, email, &keyID, fpr, identityPinned); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case pin.Fingerprint == fpr:
+			// Same key imported again; the pin already covers it.
+		case replace:
+			q := tx.Rebind("UPDATE identity_pins SET key_id = ?, fingerprint = ?, pinned_at = ? WHERE email = ? AND " + keyring)
+			if _, err := tx.ExecContext(ctx, q, append([]interface{}{keyID, fpr, time.Now(), email}, args...)...); err != nil {
+				return err
+			}
+			q = tx.Rebind("UPDATE keys SET pin_conflict = ? WHERE id = ? AND " + keyring)
+			if _, err := tx.ExecContext(ctx, q, append([]interface{}{true, pin.KeyID}, args...)...); err != nil {
+				return err
+			}
+			if err := recordIdentityEvent(ctx, tx, owner, email, &keyID, fpr, identityReplaced); err != nil {
+				return err
+			}
+			slog.Warn("identity pin replaced", "email", email, "old_fingerprint", pin.Fingerprint, "new_fingerprint", fpr)
+		default:
+			if err := recordIdentityEvent(ctx, tx, owner, email, &keyID, fpr, identityConflict); err != nil {
+				return err
+			}
+			slog.Warn("key conflicts with pinned identity", "email", email, "pinned_fingerprint", pin.Fingerprint, "fingerprint", fpr)
+		}
+	}
+	return nil
+}
+
+// recordIdentityEvent appends an entry to the identity history of the
+// keyring of owner.
+func recordIdentityEvent(ctx context.Context, db sqlx.ExtContext, owner *int64, email string, keyID *int64, fpr, event string) error {
+	q := db.Rebind("INSERT INTO identity_history (owner_id, email, key_id, fingerprint, event, created_at) VALUES (?, ?, ?, ?, ?, ?)")
+	_, err := db.ExecContext(ctx, q, owner, email, keyID, fpr, event, time.Now())
+	return err
+}
+
+// unpinKey removes the pins held by keyID, recording the removal in the
+// identity history. Used when a key is deleted.
+func unpinKey(ctx context.Context, tx *sqlx.Tx, keyID int64) error {
+	var pins []struct {
+		OwnerID     *int64 `db:"owner_id"`
+		Email       string `db:"email"`
+		Fingerprint string `db:"fingerprint"`
+	}
+	if err := tx.SelectContext(ctx, &pins, tx.Rebind("SELECT owner_id, email, fingerprint FROM identity_pins WHERE key_id = ?"), keyID); err != nil {
+		return err
+	}
+	for _, p := range pins {
+		if err := recordIdentityEvent(ctx, tx, p.OwnerID, p.Email, &keyID, p.Fingerprint, identityUnpinned); err != nil {
+			return err
+		}
+	}
+	_, err := tx.ExecContext(ctx, tx.Rebind("DELETE FROM identity_pins WHERE key_id = ?"), keyID)
+	return err
+}
+
+// movePins moves the pins and identity history of the keyring of userID to
+// the keyring of heir, nil for the shared keyring. Used when the user's keys
+// go to heir. Addresses the heir's keyring pins already keep that pin.
+func movePins(ctx context.Context, tx *sqlx.Tx, userID int64, heir *int64) error {
+	keyring, args := keyringCond(heir)
+	q := tx.Rebind("DELETE FROM identity_pins WHERE owner_id = ? AND email IN (SELECT email FROM identity_pins WHERE " + keyring + ")")
+	if _, err := tx.ExecContext(ctx, q, append([]interface{}{userID}, args...)...); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, tx.Rebind("UPDATE identity_pins SET owner_id = ? WHERE owner_id = ?"), heir, userID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, tx.Rebind("UPDATE identity_history SET owner_id = ? WHERE owner_id = ?"), heir, userID)
+	return err
+}
+
+// PinKeyHandler explicitly pins all email addresses of a stored key to it,
+// replacing any existing pins in the key's keyring. This is the confirmation
+// step for keys that were flagged as conflicting.
+func (a *App) PinKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusUnprocessableEntity)
+		return
+	}
+	var k mm.Key
+	scope, args := keyScope(r.Context(), true)
+	q := a.DB.Rebind("SELECT id, name, armored, owner_id FROM keys WHERE id = ? AND " + scope)
+	if err := a.DB.GetContext(r.Context(), &k, q, append([]interface{}{id}, args...)...); err != nil {
+		http.Error(w, "key not found", http.StatusNotFound)
+		return
+	}
+	parsed, err := crypto.NewKeyFromArmored(k.Armored)
+	if err != nil {
+		slog.Error("pin: failed to parse stored key", "key_id", k.ID, "name", k.Name, "err", err)
+		http.Error(w, "stored key is invalid: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = func() error {
+		tx, err := a.DB.BeginTxx(r.Context(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck
+		if err := pinKey(r.Context(), tx, k.OwnerID, k.ID, parsed.GetFingerprint(), keyEmails(parsed), true); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(r.Context(), tx.Rebind("UPDATE keys SET pin_conflict = ? WHERE id = ?"), false, k.ID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		slog.Error("failed to pin key", "key_id", k.ID, "err", err)
+		http.Error(w, "failed to pin key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("key pinned", "key_id", k.ID, "name", k.Name)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// historyScope returns a condition on identity_history restricting it to the
+// keyrings the current user may see, their own and the shared one, and its
+// arguments.
+func historyScope(ctx context.Context) (string, []interface{}) {
+	u := currentUser(ctx)
+	if u == nil || u.ID == 0 {
+		return "1 = 1", nil
+	}
+	return "(owner_id IS NULL OR owner_id = ?)", []interface{}{u.ID}
+}
+
+// IdentityHistoryHandler returns the key history of an email address in the
+// current user's keyring and the shared keyring as JSON.
+func (a *App) IdentityHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	email := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("email")))
+	if email == "" {
+		http.Error(w, "missing email", http.StatusUnprocessableEntity)
+		return
+	}
+	events := []mm.IdentityEvent{}
+	scope, args := historyScope(r.Context())
+	q := a.DB.Rebind("SELECT id, email, key_id, fingerprint, event, created_at FROM identity_history WHERE email = ? AND " + scope + " ORDER BY created_at, id")
+	if err := a.DB.SelectContext(r.Context(), &events, q, append([]interface{}{email}, args...)...); err != nil {
+		slog.Error("failed to load identity history", "email", email, "err", err)
+		http.Error(w, "failed to load identity history", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// BackfillKeyMetadata fills in fingerprints for keys stored before they were
+// recorded and pins their email addresses, oldest key first. Keys that
+// conflict with an existing pin are flagged rather than pinned.
+func (a *App) BackfillKeyMetadata(ctx context.Context) error {
+	var keys []mm.Key
+	if err := a.DB.SelectContext(ctx, &keys, "SELECT id, name, armored, owner_id FROM keys WHERE fingerprint IS NULL ORDER BY created_at, id"); err != nil {
+		return fmt.Errorf("load keys without fingerprint: %w", err)
+	}
+	for _, k := range keys {
+		parsed, err := crypto.NewKeyFromArmored(k.Armored)
+		if err != nil {
+			slog.Warn("backfill: skipping unparsable key", "key_id", k.ID, "name", k.Name, "err", err)
+			continue
+		}
+		fpr := parsed.GetFingerprint()
+		emails := keyEmails(parsed)
+
+		tx, err := a.DB.BeginTxx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		conflicts, err := findPinConflicts(ctx, tx, k.OwnerID, fpr, emails)
+		if err == nil {
+			q := tx.Rebind("UPDATE keys SET fingerprint = ?, pin_conflict = ? WHERE id = ?")
+			_, err = tx.ExecContext(ctx, q, fpr, len(conflicts) > 0, k.ID)
+		}
+		if err == nil {
+			err = pinKey(ctx, tx, k.OwnerID, k.ID, fpr, emails, false)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback() //nolint:errcheck
+			return fmt.Errorf("backfill key %d: %w", k.ID, err)
+		}
+	}
+	if len(keys) > 0 {
+		slog.Info("backfilled key fingerprints", "count", len(keys))
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package app_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	mm "h-cloud.io/web-gpg/internal/models"
+)
+
+// TestAddKeyHandler_PinsIdentityOnFirstUse verifies the first key for an email
+// address is pinned and a different key for the same address is refused
+// until the user explicitly keeps or replaces it.
+func TestAddKeyHandler_PinsIdentityOnFirstUse(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	first := generateTestKey(t, "Alice", "Alice@Example.com", "")
+	firstPub, _ := first.GetArmoredPublicKey()
+	second := generateTestKey(t, "Alice", "alice@example.com", "")
+	secondPub, _ := second.GetArmoredPublicKey()
+
+	if w := postForm(a.AddKeyHandler, "/keys", url.Values{"name": {"alice-1"}, "armored": {firstPub}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("add first key: expected 303, got %d: %s", w.Code, w.Body.String())
+	}
+	var pinned string
+	db.Get(&pinned, "SELECT fingerprint FROM identity_pins WHERE email = 'alice@example.com'")
+	if pinned != first.GetFingerprint() {
+		t.Fatalf("pinned fingerprint = %q, want %q", pinned, first.GetFingerprint())
+	}
+
+	// A different key for the same address is refused.
+	w := postForm(a.AddKeyHandler, "/keys", url.Values{"name": {"alice-2"}, "armored": {secondPub}})
+	if w.Code != http.StatusConflict {
+		t.Fatalf("conflicting key: expected 409, got %d: %s", w.Code, w.Body.String())
+	}
+	var count int
+	db.Get(&count, "SELECT COUNT(*) FROM keys")
+	if count != 1 {
+		t.Fatalf("expected refused key not to be stored, have %d keys", count)
+	}
+
+	// pin=keep stores it flagged without touching the pin.
+	if w := postForm(a.AddKeyHandler, "/keys", url.Values{"name": {"alice-2"}, "armored": {secondPub}, "pin": {"keep"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("keep conflicting key: expected 303, got %d: %s", w.Code, w.Body.String())
+	}
+	var flagged bool
+	db.Get(&flagged, "SELECT pin_conflict FROM keys WHERE name = 'alice-2'")
+	if !flagged {
+		t.Error("expected kept key to be flagged as conflicting")
+	}
+	db.Get(&pinned, "SELECT fingerprint FROM identity_pins WHERE email = 'alice@example.com'")
+	if pinned != first.GetFingerprint() {
+		t.Error("pin=keep must not move the pin")
+	}
+
+	// Explicit confirmation moves the pin and flags the previous key.
+	var secondID, firstID int64
+	db.Get(&secondID, "SELECT id FROM keys WHERE name = 'alice-2'")
+	db.Get(&firstID, "SELECT id FROM keys WHERE name = 'alice-1'")
+	if w := postForm(a.PinKeyHandler, "/identities/pin", url.Values{"id": {fmt.Sprint(secondID)}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("pin: expected 303, got %d: %s", w.Code, w.Body.String())
+	}
+	db.Get(&pinned, "SELECT fingerprint FROM identity_pins WHERE email = 'alice@example.com'")
+	if pinned != second.GetFingerprint() {
+		t.Errorf("pin not moved: got %q, want %q", pinned, second.GetFingerprint())
+	}
+	db.Get(&flagged, "SELECT pin_conflict FROM keys WHERE id = ?", secondID)
+	if flagged {
+		t.Error("newly pinned key should no longer be flagged")
+	}
+	db.Get(&flagged, "SELECT pin_conflict FROM keys WHERE id = ?", firstID)
+	if !flagged {
+		t.Error("previously pinned key should be flagged")
+	}
+
+	// The history records every step.
+	req := httptest.NewRequest(http.MethodGet, "/identities/history?email=alice@example.com", nil)
+	hw := httptest.NewRecorder()
+	a.IdentityHistoryHandler(hw, req)
+	var events []mm.IdentityEvent
+	if err := json.Unmarshal(hw.Body.Bytes(), &events); err != nil {
+		t.Fatalf("decode history: %v (%s)", err, hw.Body.String())
+	}
+	var got []string
+	for _, e := range events {
+		got = append(got, e.Event)
+	}
+	want := []string{"pinned", "conflict", "conflict", "replaced"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("history events = %v, want %v", got, want)
+	}
+}
+
+// TestAddKeyHandler_ReplacePinned verifies pin=replace stores the key and
+// moves the pin in one request.
+func TestAddKeyHandler_ReplacePinned(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	oldPub, _ := generateTestKey(t, "Bob", "bob@example.com", "").GetArmoredPublicKey()
+	newKey := generateTestKey(t, "Bob", "bob@example.com", "")
+	newPub, _ := newKey.GetArmoredPublicKey()
+
+	postForm(a.AddKeyHandler, "/keys", url.Values{"name": {"bob-old"}, "armored": {oldPub}})
+	if w := postForm(a.AddKeyHandler, "/keys", url.Values{"name": {"bob-new"}, "armored": {newPub}, "pin": {"replace"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("replace: expected 303, got %d: %s", w.Code, w.Body.String())
+	}
+	var pinned string
+	db.Get(&pinned, "SELECT fingerprint FROM identity_pins WHERE email = 'bob@example.com'")
+	if pinned != newKey.GetFingerprint() {
+		t.Fatalf("pinned fingerprint = %q, want %q", pinned, newKey.GetFingerprint())
+	}
+}
+
+// TestDeleteKeyHandler_Unpins verifies deleting the pinned key releases its
+// addresses so the next key is pinned on first use.
+func TestDeleteKeyHandler_Unpins(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	pub, _ := generateTestKey(t, "Carol", "carol@example.com", "").GetArmoredPublicKey()
+	postForm(a.AddKeyHandler, "/keys", url.Values{"name": {"carol"}, "armored": {pub}})
+	var id int64
+	db.Get(&id, "SELECT id FROM keys WHERE name = 'carol'")
+
+	if w := postForm(a.DeleteKeyHandler, "/keys/delete", url.Values{"id": {fmt.Sprint(id)}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("delete: expected 303, got %d: %s", w.Code, w.Body.String())
+	}
+	var count int
+	db.Get(&count, "SELECT COUNT(*) FROM identity_pins WHERE email = 'carol@example.com'")
+	if count != 0 {
+		t.Fatal("expected pin to be removed with its key")
+	}
+
+	replacement, _ := generateTestKey(t, "Carol", "carol@example.com", "").GetArmoredPublicKey()
+	if w := postForm(a.AddKeyHandler, "/keys", url.Values{"name": {"carol-2"}, "armored": {replacement}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("add replacement: expected 303, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// TestBackfillKeyMetadata verifies legacy rows get fingerprints and pins, with
+// the oldest key winning and later conflicting keys flagged.
+func TestBackfillKeyMetadata(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	older := generateTestKey(t, "Dan", "dan@example.com", "")
+	olderPub, _ := older.GetArmoredPublicKey()
+	newerPub, _ := generateTestKey(t, "Dan", "dan@example.com", "").GetArmoredPublicKey()
+	now := time.Now()
+	db.Exec("INSERT INTO keys (name, armored, is_private, created_at) VALUES (?, ?, ?, ?)", "dan-new", newerPub, false, now)
+	db.Exec("INSERT INTO keys (name, armored, is_private, created_at) VALUES (?, ?, ?, ?)", "dan-old", olderPub, false, now.Add(-time.Hour))
+
+	if err := a.BackfillKeyMetadata(context.Background()); err != nil {
+		t.Fatalf("backfill: %v", err)
+	}
+
+	var missing int
+	db.Get(&missing, "SELECT COUNT(*) FROM keys WHERE fingerprint IS NULL")
+	if missing != 0 {
+		t.Errorf("%d keys still without fingerprint", missing)
+	}
+	var pinned string
+	db.Get(&pinned, "SELECT fingerprint FROM identity_pins WHERE email = 'dan@example.com'")
+	if pinned != older.GetFingerprint() {
+		t.Errorf("expected the oldest key to be pinned")
+	}
+	var flagged bool
+	db.Get(&flagged, "SELECT pin_conflict FROM keys WHERE name = 'dan-new'")
+	if !flagged {
+		t.Error("expected newer conflicting key to be flagged")
+	}
+}
+
+// TestPinsPerKeyring verifies each user's keys are pinned in their own
+// keyring: importing a key another user pinned pins it again, pins and
+// history of other users are neither shown nor moved.
+func TestPinsPerKeyring(t *testing.T) {
+	a, db := setupTestApp(t)
+	bootstrap := login(t, a, "", "test-master-password")
+	as(a, bootstrap, a.UsersHandler, http.MethodPost, "/users", url.Values{"username": {"admin"}, "password": {"admin-password"}})
+	admin := login(t, a, "admin", "admin-password")
+	for _, name := range []string{"bob", "carol", "dave"} {
+		as(a, admin, a.UsersHandler, http.MethodPost, "/users", url.Values{"username": {name}, "password": {name + "-password"}, "role": {"encryptor"}})
+	}
+	bob := login(t, a, "bob", "bob-password")
+	carol := login(t, a, "carol", "carol-password")
+	dave := login(t, a, "dave", "dave-password")
+	var bobID int64
+	db.Get(&bobID, "SELECT id FROM users WHERE username = 'bob'")
+
+	aliceKey := generateTestKey(t, "Alice", "alice@example.com", "")
+	alicePub, _ := aliceKey.GetArmoredPublicKey()
+	impostor := generateTestKey(t, "Alice", "alice@example.com", "")
+	impostorPub, _ := impostor.GetArmoredPublicKey()
+	if w := as(a, bob, a.AddKeyHandler, http.MethodPost, "/keys", url.Values{"name": {"alice"}, "armored": {alicePub}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("bob adds alice: %d %s", w.Code, w.Body.String())
+	}
+
+	if w := as(a, dave, a.AddKeyHandler, http.MethodPost, "/keys", url.Values{"name": {"alice"}, "armored": {alicePub}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("dave adds the same key: %d %s", w.Code, w.Body.String())
+	}
+	if w := as(a, dave, a.EncryptHandler, http.MethodPost, "/encrypt", url.Values{"recipients": {"alice@example.com"}, "input": {"hi"}}); w.Code != http.StatusOK {
+		t.Errorf("encrypting to an address with a key another user pinned too: %d %s", w.Code, w.Body.String())
+	}
+
+	w := as(a, carol, a.AddKeyHandler, http.MethodPost, "/keys", url.Values{"name": {"alice"}, "armored": {impostorPub}})
+	if w.Code != http.StatusSeeOther || strings.Contains(strings.ToLower(w.Body.String()), aliceKey.GetFingerprint()) {
+		t.Fatalf("another user's pin should not conflict: %d %s", w.Code, w.Body.String())
+	}
+	var carolKey string
+	db.Get(&carolKey, "SELECT id FROM keys WHERE fingerprint = ?", impostor.GetFingerprint())
+	as(a, carol, a.PinKeyHandler, http.MethodPost, "/identities/pin", url.Values{"id": {carolKey}})
+	var pinned string
+	db.Get(&pinned, "SELECT fingerprint FROM identity_pins WHERE email = 'alice@example.com' AND owner_id = ?", bobID)
+	if pinned != aliceKey.GetFingerprint() {
+		t.Errorf("bob's pin moved to %q", pinned)
+	}
+	var flagged int
+	db.Get(&flagged, "SELECT COUNT(*) FROM keys WHERE pin_conflict = ?", true)
+	if flagged != 0 {
+		t.Errorf("pinning in one keyring flagged %d keys of others", flagged)
+	}
+	if w := as(a, carol, a.EncryptHandler, http.MethodPost, "/encrypt", url.Values{"recipients": {"alice@example.com"}, "input": {"hi"}}); w.Code != http.StatusOK {
+		t.Errorf("carol encrypting to her own pin: %d %s", w.Code, w.Body.String())
+	}
+
+	w = as(a, carol, a.IdentityHistoryHandler, http.MethodGet, "/identities/history?email=alice@example.com", nil)
+	var events []mm.IdentityEvent
+	json.Unmarshal(w.Body.Bytes(), &events)
+	if len(events) != 1 || events[0].Fingerprint != impostor.GetFingerprint() {
+		t.Errorf("carol should only see the history of her keyring: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,99 @@
+package app
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/ProtonMail/gopenpgp/v3/crypto"
+	"github.com/ProtonMail/gopenpgp/v3/profile"
+)
+
+// OpenPGP profiles selectable with PGP_PROFILE or the "profile" form field.
+const (
+	// ProfileDefault is gopenpgp's default: v4 Curve25519 keys and SEIPDv1
+	// messages, readable by practically every implementation.
+	ProfileDefault = "default"
+	// ProfileRFC4880 sticks to RFC 4880 algorithms (RSA keys) for peers that
+	// predate elliptic curve support.
+	ProfileRFC4880 = "rfc4880"
+	// ProfileRFC9580 follows the crypto refresh: v6 keys, Argon2 S2K and
+	// SEIPDv2 (AEAD) messages for recipients that advertise support.
+	ProfileRFC9580 = "rfc9580"
+)
+
+var pgpProfiles = map[string]func() *profile.Custom{
+	ProfileDefault: profile.Default,
+	ProfileRFC4880: profile.RFC4880,
+	ProfileRFC9580: profile.RFC9580,
+}
+
+// ParsePGPProfile maps the PGP_PROFILE env value to a profile name. Unknown
+// values fall back to the default profile.
+func ParsePGPProfile(s string) string {
+	name := strings.ToLower(strings.TrimSpace(s))
+	if name == "" {
+		return ProfileDefault
+	}
+	if _, ok := pgpProfiles[name]; !ok {
+		slog.Warn("unknown PGP_PROFILE, using default", "value", s)
+		return ProfileDefault
+	}
+	return name
+}
+
+// profileName returns name, or the server default profile if name is empty.
+func (a *App) profileName(name string) string {
+	if name != "" {
+		return name
+	}
+	if a.PGPProfile != "" {
+		return a.PGPProfile
+	}
+	return ProfileDefault
+}
+
+// pgp returns a gopenpgp handle for the named profile, or for the server
+// default if name is empty. name must be a known profile.
+func (a *App) pgp(name string) *crypto.PGPHandle {
+	return crypto.PGPWithProfile(pgpProfiles[a.profileName(name)]())
+}
+
+// requestProfile returns the profile requested with the "profile" form field,
+// or the server default. It writes a 422 and returns false for an unknown
+// profile.
+func (a *App) requestProfile(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := strings.ToLower(strings.TrimSpace(r.FormValue("profile")))
+	if name == "" {
+		return a.profileName(""), true
+	}
+	if _, ok := pgpProfiles[name]; !ok {
+		http.Error(w, "unknown profile "+name+": expected default, rfc4880 or rfc9580", http.StatusUnprocessableEntity)
+		return "", false
+	}
+	return name, true
+}
+
+// messageFormat names the encryption container of msg: "SEIPDv2" for AEAD
+// (RFC 9580) messages, "SEIPDv1" for RFC 4880 messages with MDC.
+func messageFormat(msg *crypto.PGPMessage) string {
+	p, err := packet.Read(bytes.NewReader(msg.BinaryDataPacket()))
+	if err != nil {
+		return "unknown"
+	}
+	switch se := p.(type) {
+	case *packet.SymmetricallyEncrypted:
+		if se.Version == 2 {
+			return "SEIPDv2"
+		}
+		if se.IntegrityProtected {
+			return "SEIPDv1"
+		}
+		return "SED"
+	case *packet.AEADEncrypted:
+		return "AEAD"
+	}
+	return "unknown"
+}
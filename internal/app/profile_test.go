@@ -0,0 +1,128 @@
+package app_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	gcrypto "github.com/ProtonMail/gopenpgp/v3/crypto"
+
+	apppkg "h-cloud.io/web-gpg/internal/app"
+)
+
+// generateStoredKey generates a key through GenerateKeyHandler and returns
+// its id and parsed key.
+func generateStoredKey(t *testing.T, a *apppkg.App, email string, form url.Values) (int64, *gcrypto.Key) {
+	t.Helper()
+	form.Set("email", email)
+	if w := postForm(a.GenerateKeyHandler, "/keys/generate", form); w.Code != http.StatusSeeOther {
+		t.Fatalf("generate %s: expected 303, got %d: %s", email, w.Code, w.Body.String())
+	}
+	var row struct {
+		ID      int64  `db:"id"`
+		Armored string `db:"armored"`
+		Trust   string `db:"trust_level"`
+	}
+	if err := a.DB.Get(&row, "SELECT id, armored, trust_level FROM keys ORDER BY id DESC LIMIT 1"); err != nil {
+		t.Fatalf("load generated key: %v", err)
+	}
+	if row.Trust != "ultimate" {
+		t.Errorf("generated key trust = %q, want ultimate", row.Trust)
+	}
+	k, err := gcrypto.NewKeyFromArmored(row.Armored)
+	if err != nil {
+		t.Fatalf("parse generated key: %v", err)
+	}
+	return row.ID, k
+}
+
+// TestGenerateKeyHandler_Profiles verifies the profile selects the key
+// version and algorithm, and that generated keys can be locked.
+func TestGenerateKeyHandler_Profiles(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	id, v6 := generateStoredKey(t, a, "v6@example.com", url.Values{"profile": {"rfc9580"}, "password": {"s3cret"}})
+	if v6.GetVersion() != 6 {
+		t.Errorf("rfc9580 key version = %d, want 6", v6.GetVersion())
+	}
+	if locked, _ := v6.IsLocked(); !locked {
+		t.Error("expected key generated with a password to be locked")
+	}
+	var stored *string
+	db.Get(&stored, "SELECT encrypted_password FROM keys WHERE id = ?", id)
+	if stored == nil {
+		t.Error("expected passphrase of generated key to be stored")
+	}
+
+	_, rsa := generateStoredKey(t, a, "rsa@example.com", url.Values{"profile": {"rfc4880"}})
+	if rsa.GetVersion() != 4 || rsa.GetEntity().PrimaryKey.PubKeyAlgo != packet.PubKeyAlgoRSA {
+		t.Errorf("rfc4880 key: version %d, algorithm %d; want v4 RSA", rsa.GetVersion(), rsa.GetEntity().PrimaryKey.PubKeyAlgo)
+	}
+
+	// The server default applies when no profile is requested.
+	a.PGPProfile = apppkg.ProfileRFC9580
+	if _, k := generateStoredKey(t, a, "default@example.com", url.Values{}); k.GetVersion() != 6 {
+		t.Errorf("server default rfc9580: key version = %d, want 6", k.GetVersion())
+	}
+
+	if w := postForm(a.GenerateKeyHandler, "/keys/generate", url.Values{"email": {"x@example.com"}, "profile": {"pgp2"}}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("unknown profile: expected 422, got %d", w.Code)
+	}
+}
+
+// TestEncryptHandler_ProfileAEAD verifies the RFC 9580 profile produces
+// SEIPDv2 messages for recipients that support it and falls back to SEIPDv1
+// as soon as one recipient does not.
+func TestEncryptHandler_ProfileAEAD(t *testing.T) {
+	a, _ := setupTestApp(t)
+
+	v6ID, _ := generateStoredKey(t, a, "modern@example.com", url.Values{"profile": {"rfc9580"}})
+	generateStoredKey(t, a, "legacy@example.com", url.Values{"profile": {"rfc4880"}})
+
+	tests := []struct {
+		form    url.Values
+		profile string
+		format  string
+	}{
+		{url.Values{"recipients": {"modern@example.com"}, "profile": {"rfc9580"}}, "rfc9580", "SEIPDv2"},
+		{url.Values{"recipients": {"legacy@example.com"}, "profile": {"rfc9580"}}, "rfc9580", "SEIPDv1"},
+		{url.Values{"recipients": {"modern@example.com, legacy@example.com"}, "profile": {"rfc9580"}}, "rfc9580", "SEIPDv1"},
+		{url.Values{"recipients": {"legacy@example.com"}}, "default", "SEIPDv1"},
+	}
+	for _, tt := range tests {
+		tt.form.Set("input", "profile test")
+		w := postForm(a.EncryptHandler, "/encrypt", tt.form)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: expected 200, got %d: %s", tt.form, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("X-PGP-Profile"); got != tt.profile {
+			t.Errorf("%v: profile = %q, want %q", tt.form["recipients"], got, tt.profile)
+		}
+		if got := w.Header().Get("X-PGP-Format"); got != tt.format {
+			t.Errorf("%v: format = %q, want %q", tt.form["recipients"], got, tt.format)
+		}
+	}
+
+	// AEAD messages decrypt with the stored v6 key.
+	w := postForm(a.EncryptHandler, "/encrypt", url.Values{"key": {fmt.Sprint(v6ID)}, "profile": {"rfc9580"}, "input": {"aead roundtrip"}})
+	dec := postForm(a.DecryptHandler, "/decrypt", url.Values{"key": {fmt.Sprint(v6ID)}, "input": {w.Body.String()}})
+	if dec.Code != http.StatusOK || dec.Body.String() != "aead roundtrip" {
+		t.Errorf("decrypt SEIPDv2: %d %q", dec.Code, dec.Body.String())
+	}
+
+	if w := postForm(a.EncryptHandler, "/encrypt", url.Values{"key": {fmt.Sprint(v6ID)}, "profile": {"nope"}, "input": {"x"}}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("unknown profile: expected 422, got %d", w.Code)
+	}
+}
+
+// TestParsePGPProfile verifies env parsing of the server default profile.
+func TestParsePGPProfile(t *testing.T) {
+	tests := map[string]string{"": "default", "RFC9580": "rfc9580", " rfc4880 ": "rfc4880", "pgp2": "default"}
+	for in, want := range tests {
+		if got := apppkg.ParsePGPProfile(in); got != want {
+			t.Errorf("ParsePGPProfile(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
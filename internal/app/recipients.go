@@ -0,0 +1,270 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	mm "h-cloud.io/web-gpg/internal/models"
+)
+
+// recipientError is a recipient that could not be resolved to a key. It is
+// reported to the client as 422.
+type recipientError struct {
+	msg string
+}
+
+func (e *recipientError) Error() string { return e.msg }
+
+// splitList splits a comma, semicolon or whitespace separated list and drops
+// empty entries.
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+}
+
+// resolveRecipients turns a recipient list into stored keys. Each entry is a
+// key id, an email address (resolved to its pinned key) or a recipient group
+// name (expanded to its members' pinned keys). Duplicates are removed.
+func (a *App) resolveRecipients(ctx context.Context, spec string) ([]mm.Key, error) {
+	var keys []mm.Key
+	seen := map[int64]bool{}
+	add := func(k mm.Key) {
+		if !seen[k.ID] {
+			seen[k.ID] = true
+			keys = append(keys, k)
+		}
+	}
+
+	for _, entry := range splitList(spec) {
+		switch {
+		case isNumeric(entry):
+			var k mm.Key
+			scope, args := keyScope(ctx, false)
+			q := a.DB.Rebind("SELECT id, name, armored, is_private, trust_level FROM keys WHERE id = ? AND " + scope)
+			if err := a.DB.GetContext(ctx, &k, q, append([]interface{}{entry}, args...)...); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return nil, &recipientError{"key not found: " + entry}
+				}
+				return nil, err
+			}
+			add(k)
+		case strings.Contains(entry, "@"):
+			k, err := a.pinnedKey(ctx, entry)
+			if err != nil {
+				return nil, err
+			}
+			add(k)
+		default:
+			emails, err := a.groupMembers(ctx, entry)
+			if err != nil {
+				return nil, err
+			}
+			for _, email := range emails {
+				k, err := a.pinnedKey(ctx, email)
+				if err != nil {
+					return nil, &recipientError{"group " + entry + ": " + err.Error()}
+				}
+				add(k)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, &recipientError{"no recipients given"}
+	}
+	return keys, nil
+}
+
+// pinnedKey returns the key pinned for an email address among the keys the
+// current user may use. A pin in the user's own keyring comes first, then
+// the shared keyring's, then those of keys other users share.
+func (a *App) pinnedKey(ctx context.Context, email string) (mm.Key, error) {
+	var k mm.Key
+	var userID int64
+	if u := currentUser(ctx); u != nil {
+		userID = u.ID
+	}
+	scope, args := keyScope(ctx, false)
+	q := a.DB.Rebind(`SELECT k.id, k.name, k.armored, k.is_private, k.trust_level
+		FROM identity_pins p JOIN (SELECT * FROM keys WHERE ` + scope + `) k ON k.id = p.key_id WHERE p.email = ?
+		ORDER BY CASE WHEN p.owner_id = ? THEN 0 WHEN p.owner_id IS NULL THEN 1 ELSE 2 END, p.pinned_at, p.key_id LIMIT 1`)
+	err := a.DB.GetContext(ctx, &k, q, append(args, strings.ToLower(email), userID)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return k, &recipientError{"no key pinned for " + email}
+	}
+	return k, err
+}
+
+// groupMembers returns the member addresses of a recipient group.
+func (a *App) groupMembers(ctx context.Context, name string) ([]string, error) {
+	var id int64
+	err := a.DB.GetContext(ctx, &id, a.DB.Rebind("SELECT id FROM recipient_groups WHERE name = ?"), name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, &recipientError{"unknown recipient group: " + name}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var emails []string
+	q := a.DB.Rebind("SELECT email FROM recipient_group_members WHERE group_id = ? ORDER BY email")
+	if err := a.DB.SelectContext(ctx, &emails, q, id); err != nil {
+		return nil, err
+	}
+	if len(emails) == 0 {
+		return nil, &recipientError{"recipient group " + name + " has no members"}
+	}
+	return emails, nil
+}
+
+func isNumeric(s string) bool {
+	_, err := strconv.ParseInt(s, 10, 64)
+	return err == nil
+}
+
+// validGroupName rejects names that would be parsed as a key id or an email
+// address in a recipient list.
+func validGroupName(name string) bool {
+	return name != "" && !isNumeric(name) && !strings.Contains(name, "@") && len(splitList(name)) == 1
+}
+
+// GroupsHandler lists recipient groups (GET) or, for administrators, creates
+// a group, replacing the members of an existing group with the same name
+// (POST).
+func (a *App) GroupsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		a.listGroups(w, r)
+	case http.MethodPost:
+		if requireRole(w, r, RoleAdmin) {
+			a.saveGroup(w, r)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *App) listGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := a.loadGroups(r.Context())
+	if err != nil {
+		slog.Error("failed to load recipient groups", "err", err)
+		http.Error(w, "failed to load groups", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
+
+// loadGroups returns all recipient groups with their members.
+func (a *App) loadGroups(ctx context.Context) ([]mm.RecipientGroup, error) {
+	groups := []mm.RecipientGroup{}
+	if err := a.DB.SelectContext(ctx, &groups, "SELECT id, name, created_at FROM recipient_groups ORDER BY name"); err != nil {
+		return nil, err
+	}
+	for i := range groups {
+		groups[i].Members = []string{}
+		q := a.DB.Rebind("SELECT email FROM recipient_group_members WHERE group_id = ? ORDER BY email")
+		if err := a.DB.SelectContext(ctx, &groups[i].Members, q, groups[i].ID); err != nil {
+			return nil, fmt.Errorf("load members of %s: %w", groups[i].Name, err)
+		}
+	}
+	return groups, nil
+}
+
+func (a *App) saveGroup(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	if !validGroupName(name) {
+		http.Error(w, "invalid group name: must not be empty, numeric, contain '@' or separators", http.StatusUnprocessableEntity)
+		return
+	}
+	var members []string
+	seen := map[string]bool{}
+	for _, m := range splitList(r.FormValue("members")) {
+		m = strings.ToLower(m)
+		if !strings.Contains(m, "@") {
+			http.Error(w, "invalid member address: "+m, http.StatusUnprocessableEntity)
+			return
+		}
+		if !seen[m] {
+			seen[m] = true
+			members = append(members, m)
+		}
+	}
+
+	err := func() error {
+		tx, err := a.DB.BeginTxx(r.Context(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck
+
+		var id int64
+		err = tx.GetContext(r.Context(), &id, tx.Rebind("SELECT id FROM recipient_groups WHERE name = ?"), name)
+		if errors.Is(err, sql.ErrNoRows) {
+			q := tx.Rebind("INSERT INTO recipient_groups (name, created_at) VALUES (?, ?) RETURNING id")
+			err = tx.GetContext(r.Context(), &id, q, name, time.Now())
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(r.Context(), tx.Rebind("DELETE FROM recipient_group_members WHERE group_id = ?"), id); err != nil {
+			return err
+		}
+		for _, m := range members {
+			q := tx.Rebind("INSERT INTO recipient_group_members (group_id, email) VALUES (?, ?)")
+			if _, err := tx.ExecContext(r.Context(), q, id, m); err != nil {
+				return fmt.Errorf("add member %s: %w", m, err)
+			}
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		slog.Error("failed to save recipient group", "group", name, "err", err)
+		http.Error(w, "failed to save group: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("recipient group saved", "group", name, "members", len(members))
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// DeleteGroupHandler removes a recipient group by name.
+func (a *App) DeleteGroupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "missing name", http.StatusUnprocessableEntity)
+		return
+	}
+	err := func() error {
+		tx, err := a.DB.BeginTxx(r.Context(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck
+		q := tx.Rebind("DELETE FROM recipient_group_members WHERE group_id IN (SELECT id FROM recipient_groups WHERE name = ?)")
+		if _, err := tx.ExecContext(r.Context(), q, name); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(r.Context(), tx.Rebind("DELETE FROM recipient_groups WHERE name = ?"), name); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		slog.Error("failed to delete recipient group", "group", name, "err", err)
+		http.Error(w, "failed to delete group: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("recipient group deleted", "group", name)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,128 @@
+package app_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	gcrypto "github.com/ProtonMail/gopenpgp/v3/crypto"
+
+	mm "h-cloud.io/web-gpg/internal/models"
+)
+
+// decryptWith decrypts an armored message with an in-memory private key.
+func decryptWith(t *testing.T, key *gcrypto.Key, armored string) string {
+	t.Helper()
+	dec, err := gcrypto.PGP().Decryption().DecryptionKey(key).New()
+	if err != nil {
+		t.Fatalf("decryption handle: %v", err)
+	}
+	res, err := dec.Decrypt([]byte(armored), gcrypto.Armor)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	return string(res.Bytes())
+}
+
+// TestEncryptHandler_RecipientsByEmailAndGroup verifies recipients can be
+// given as email addresses and group names and expand to the pinned keys.
+func TestEncryptHandler_RecipientsByEmailAndGroup(t *testing.T) {
+	a, _ := setupTestApp(t)
+
+	alice := generateTestKey(t, "Alice", "alice@example.com", "")
+	bob := generateTestKey(t, "Bob", "bob@example.com", "")
+	for name, k := range map[string]*gcrypto.Key{"alice": alice, "bob": bob} {
+		pub, _ := k.GetArmoredPublicKey()
+		if w := postForm(a.AddKeyHandler, "/keys", url.Values{"name": {name}, "armored": {pub}}); w.Code != http.StatusSeeOther {
+			t.Fatalf("add %s: expected 303, got %d: %s", name, w.Code, w.Body.String())
+		}
+	}
+
+	// Single email address.
+	w := postForm(a.EncryptHandler, "/encrypt", url.Values{"recipients": {"Alice@example.com"}, "input": {"for alice"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("encrypt to email: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := decryptWith(t, alice, w.Body.String()); got != "for alice" {
+		t.Fatalf("alice decrypted %q", got)
+	}
+
+	// Group expanding to both keys.
+	if w := postForm(a.GroupsHandler, "/groups", url.Values{"name": {"security-team"}, "members": {"alice@example.com,\nbob@example.com"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("save group: expected 303, got %d: %s", w.Code, w.Body.String())
+	}
+	w = postForm(a.EncryptHandler, "/encrypt", url.Values{"recipients": {"security-team"}, "input": {"for the team"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("encrypt to group: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	for name, k := range map[string]*gcrypto.Key{"alice": alice, "bob": bob} {
+		if got := decryptWith(t, k, w.Body.String()); got != "for the team" {
+			t.Errorf("%s decrypted %q", name, got)
+		}
+	}
+}
+
+// TestEncryptHandler_UnresolvedRecipients verifies unknown addresses and
+// groups are reported as 422.
+func TestEncryptHandler_UnresolvedRecipients(t *testing.T) {
+	a, _ := setupTestApp(t)
+
+	postForm(a.GroupsHandler, "/groups", url.Values{"name": {"ghosts"}, "members": {"nobody@example.com"}})
+
+	for _, recipients := range []string{"nobody@example.com", "no-such-group", "ghosts", "99999"} {
+		w := postForm(a.EncryptHandler, "/encrypt", url.Values{"recipients": {recipients}, "input": {"x"}})
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: expected 422, got %d: %s", recipients, w.Code, w.Body.String())
+		}
+	}
+}
+
+// TestGroupsHandler verifies groups can be created, replaced, listed and deleted.
+func TestGroupsHandler(t *testing.T) {
+	a, _ := setupTestApp(t)
+
+	postForm(a.GroupsHandler, "/groups", url.Values{"name": {"ops"}, "members": {"a@example.com b@example.com"}})
+	postForm(a.GroupsHandler, "/groups", url.Values{"name": {"ops"}, "members": {"C@example.com"}})
+
+	list := func() []mm.RecipientGroup {
+		w := httptest.NewRecorder()
+		a.GroupsHandler(w, httptest.NewRequest(http.MethodGet, "/groups", nil))
+		var groups []mm.RecipientGroup
+		if err := json.Unmarshal(w.Body.Bytes(), &groups); err != nil {
+			t.Fatalf("decode groups: %v (%s)", err, w.Body.String())
+		}
+		return groups
+	}
+	groups := list()
+	if len(groups) != 1 || strings.Join(groups[0].Members, ",") != "c@example.com" {
+		t.Fatalf("unexpected groups after replace: %+v", groups)
+	}
+
+	if w := postForm(a.DeleteGroupHandler, "/groups/delete", url.Values{"name": {"ops"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("delete group: expected 303, got %d", w.Code)
+	}
+	if groups := list(); len(groups) != 0 {
+		t.Fatalf("expected no groups after delete, got %+v", groups)
+	}
+}
+
+// TestGroupsHandler_InvalidInput verifies names that would be ambiguous in a
+// recipient list and non-address members are rejected.
+func TestGroupsHandler_InvalidInput(t *testing.T) {
+	a, _ := setupTestApp(t)
+
+	tests := []url.Values{
+		{"name": {"42"}, "members": {"a@example.com"}},
+		{"name": {"a@b"}, "members": {"a@example.com"}},
+		{"name": {"two words"}, "members": {"a@example.com"}},
+		{"name": {"ok"}, "members": {"not-an-address"}},
+	}
+	for _, form := range tests {
+		if w := postForm(a.GroupsHandler, "/groups", form); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%v: expected 422, got %d", form, w.Code)
+		}
+	}
+}
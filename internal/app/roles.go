@@ -0,0 +1,74 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+)
+
+// Roles grant increasing access; each includes everything the previous one
+// may do.
+const (
+	RoleViewer    = "viewer"    // list keys and view their public parts
+	RoleEncryptor = "encryptor" // also encrypt and create secret links
+	RoleDecryptor = "decryptor" // also decrypt and read the inbox with private keys
+	RoleAdmin     = "admin"     // also add, change and delete keys, and manage users
+)
+
+// Roles lists the roles from least to most privileged.
+var Roles = []string{RoleViewer, RoleEncryptor, RoleDecryptor, RoleAdmin}
+
+// roleRank returns the position of role in Roles, or -1 if it is unknown.
+func roleRank(role string) int {
+	for i, r := range Roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// hasRole reports whether the current user holds role or a more privileged
+// one. Without authentication every request is allowed everything.
+func hasRole(ctx context.Context, role string) bool {
+	u := currentUser(ctx)
+	return u == nil || roleRank(u.Role) >= roleRank(role)
+}
+
+// requireRole writes a 403 and returns false unless the current user holds
+// role.
+func requireRole(w http.ResponseWriter, r *http.Request, role string) bool {
+	if hasRole(r.Context(), role) {
+		return true
+	}
+	u := currentUser(r.Context())
+	slog.Warn("access denied", "user", u.Username, "role", u.Role, "required", role, "path", r.URL.Path)
+	http.Error(w, role+" role required", http.StatusForbidden)
+	return false
+}
+
+// RequireRole wraps a handler so that it only runs for users holding role.
+// It must be wrapped by WithAuth, which identifies the user.
+func RequireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireRole(w, r, role) {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// permissions tells the templates which controls to show.
+type permissions struct {
+	Encrypt bool
+	Decrypt bool
+	Admin   bool
+}
+
+func userPermissions(ctx context.Context) permissions {
+	return permissions{
+		Encrypt: hasRole(ctx, RoleEncryptor),
+		Decrypt: hasRole(ctx, RoleDecryptor),
+		Admin:   hasRole(ctx, RoleAdmin),
+	}
+}
@@ -0,0 +1,86 @@
+package app_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	apppkg "h-cloud.io/web-gpg/internal/app"
+)
+
+// TestRoles verifies each role only reaches the routes it grants, that
+// viewers never see private key material, and that administrators can change
+// roles.
+func TestRoles(t *testing.T) {
+	a, db := setupTestApp(t)
+	bootstrap := login(t, a, "", "test-master-password")
+	as(a, bootstrap, a.UsersHandler, http.MethodPost, "/users", url.Values{"username": {"alice"}, "password": {"alice-password"}})
+	alice := login(t, a, "alice", "alice-password")
+	for name, role := range map[string]string{"vic": apppkg.RoleViewer, "eve": apppkg.RoleEncryptor, "dan": apppkg.RoleDecryptor} {
+		if w := as(a, alice, a.UsersHandler, http.MethodPost, "/users", url.Values{"username": {name}, "password": {name + "-password"}, "role": {role}}); w.Code != http.StatusSeeOther {
+			t.Fatalf("create %s: %d %s", name, w.Code, w.Body.String())
+		}
+	}
+	if w := as(a, alice, a.UsersHandler, http.MethodPost, "/users", url.Values{"username": {"mallory"}, "password": {"mallory-password"}, "role": {"root"}}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("unknown role: expected 422, got %d", w.Code)
+	}
+	vic := login(t, a, "vic", "vic-password")
+	eve := login(t, a, "eve", "eve-password")
+	dan := login(t, a, "dan", "dan-password")
+
+	key := generateTestKey(t, "Team", "team@example.com", "")
+	armored, _ := key.Armor()
+	as(a, alice, a.AddKeyHandler, http.MethodPost, "/keys", url.Values{"name": {"team"}, "armored": {armored}})
+	var keyID int64
+	db.Get(&keyID, "SELECT id FROM keys WHERE name = 'team'")
+	id := fmt.Sprint(keyID)
+	as(a, alice, a.ShareKeyHandler, http.MethodPost, "/keys/share", url.Values{"id": {id}})
+
+	encrypt := apppkg.RequireRole(apppkg.RoleEncryptor, a.EncryptHandler)
+	decrypt := apppkg.RequireRole(apppkg.RoleDecryptor, a.DecryptHandler)
+	del := apppkg.RequireRole(apppkg.RoleAdmin, a.DeleteKeyHandler)
+
+	if w := as(a, vic, encrypt, http.MethodPost, "/encrypt", url.Values{"key": {id}, "input": {"hi"}}); w.Code != http.StatusForbidden {
+		t.Errorf("viewer encrypting: expected 403, got %d", w.Code)
+	}
+	w := as(a, eve, encrypt, http.MethodPost, "/encrypt", url.Values{"key": {id}, "input": {"hi"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("encryptor encrypting: %d %s", w.Code, w.Body.String())
+	}
+	message := w.Body.String()
+	if w := as(a, eve, decrypt, http.MethodPost, "/decrypt", url.Values{"key": {id}, "input": {message}}); w.Code != http.StatusForbidden {
+		t.Errorf("encryptor decrypting: expected 403, got %d", w.Code)
+	}
+	if w := as(a, dan, decrypt, http.MethodPost, "/decrypt", url.Values{"key": {id}, "input": {message}}); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "hi") {
+		t.Errorf("decryptor decrypting: %d %s", w.Code, w.Body.String())
+	}
+	if w := as(a, dan, del, http.MethodPost, "/keys/delete", url.Values{"id": {id}}); w.Code != http.StatusForbidden {
+		t.Errorf("decryptor deleting a key: expected 403, got %d", w.Code)
+	}
+
+	view := "/keys/view?id=" + id
+	if body := as(a, vic, a.ViewKeyHandler, http.MethodGet, view, nil).Body.String(); strings.Contains(body, "PRIVATE KEY") || !strings.Contains(body, "PUBLIC KEY") {
+		t.Error("viewers should only see the public part of private keys")
+	}
+	if body := as(a, dan, a.ViewKeyHandler, http.MethodGet, view, nil).Body.String(); !strings.Contains(body, "PRIVATE KEY") {
+		t.Error("decryptors should see private keys")
+	}
+	if body := as(a, vic, a.IndexHandler, http.MethodGet, "/", nil).Body.String(); strings.Contains(body, "Generate Key") || strings.Contains(body, "Add User") {
+		t.Error("viewers should not see key or user management")
+	}
+
+	var eveID, aliceID int64
+	db.Get(&eveID, "SELECT id FROM users WHERE username = 'eve'")
+	db.Get(&aliceID, "SELECT id FROM users WHERE username = 'alice'")
+	if w := as(a, alice, a.UserRoleHandler, http.MethodPost, "/users/role", url.Values{"id": {fmt.Sprint(aliceID)}, "role": {apppkg.RoleViewer}}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("changing your own role: expected 422, got %d", w.Code)
+	}
+	if w := as(a, alice, a.UserRoleHandler, http.MethodPost, "/users/role", url.Values{"id": {fmt.Sprint(eveID)}, "role": {apppkg.RoleDecryptor}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("promote eve: %d %s", w.Code, w.Body.String())
+	}
+	if w := as(a, eve, decrypt, http.MethodPost, "/decrypt", url.Values{"key": {id}, "input": {message}}); w.Code != http.StatusOK {
+		t.Errorf("promoted decryptor decrypting: expected 200, got %d", w.Code)
+	}
+}
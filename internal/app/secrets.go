@@ -0,0 +1,284 @@
+package app
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// secretPrefix is the path of the one-time secret links, followed by the
+// secret's id.
+const secretPrefix = "/s/"
+
+// maxSecretBytes caps the size of a one-time secret.
+const maxSecretBytes = 64 << 10
+
+// Lifetime bounds of a one-time secret; "expires" defaults to a day.
+const (
+	defaultSecretTTL = 24 * time.Hour
+	minSecretTTL     = 5 * time.Minute
+	maxSecretTTL     = 7 * 24 * time.Hour
+)
+
+// SecretRateLimiter is the rate limiter for viewing one-time secrets.
+// Allows up to 30 requests per IP per 10-minute window, which also bounds
+// passphrase guessing.
+var SecretRateLimiter = NewRateLimiter(10*time.Minute, 30)
+
+// secretLink is the response of CreateSecretHandler. URL is relative to the
+// server and carries the decryption key in its fragment.
+type secretLink struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// storedSecret is a row of the secret_links table.
+type storedSecret struct {
+	ID               string    `db:"id"`
+	Ciphertext       string    `db:"ciphertext"`
+	PassphraseBcrypt *string   `db:"passphrase_bcrypt"`
+	ExpiresAt        time.Time `db:"expires_at"`
+}
+
+// secretPage is the data rendered by secret.html.
+type secretPage struct {
+	ID              string
+	Found           bool
+	NeedsPassphrase bool
+	ExpiresAt       time.Time
+}
+
+// sealSecret encrypts plaintext under a fresh AES-256-GCM key, bound to id as
+// additional data, and returns base64(nonce|ciphertext) and the key.
+func sealSecret(id string, plaintext []byte) (ciphertext string, key []byte, err error) {
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", nil, err
+	}
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, aesgcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	out := aesgcm.Seal(nonce, nonce, plaintext, []byte(id))
+	return base64.StdEncoding.EncodeToString(out), key, nil
+}
+
+// newSecretID returns a random, URL-safe secret id.
+func newSecretID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// parseSecretTTL parses the "expires" duration of a new secret.
+func parseSecretTTL(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultSecretTTL, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < minSecretTTL || d > maxSecretTTL {
+		return 0, fmt.Errorf("invalid expiry %q: expected a duration between %s and %s", s, minSecretTTL, maxSecretTTL)
+	}
+	return d, nil
+}
+
+// CreateSecretHandler stores "secret" as a one-time secret link. The secret
+// is encrypted under a random key that is returned only in the fragment of
+// the link, so the server keeps nothing that can decrypt it. "expires" is a
+// duration such as 1h (default 24h, at most 168h); an optional "passphrase"
+// must also be entered to view the secret.
+func (a *App) CreateSecretHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 2*maxSecretBytes)
+	secret := r.FormValue("secret")
+	if strings.TrimSpace(secret) == "" {
+		http.Error(w, "missing secret", http.StatusUnprocessableEntity)
+		return
+	}
+	if len(secret) > maxSecretBytes {
+		http.Error(w, fmt.Sprintf("secret too large: limit is %d KB", maxSecretBytes>>10), http.StatusRequestEntityTooLarge)
+		return
+	}
+	ttl, err := parseSecretTTL(r.FormValue("expires"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	id, err := newSecretID()
+	if err != nil {
+		slog.Error("failed to generate secret id", "err", err)
+		http.Error(w, "failed to create secret", http.StatusInternalServerError)
+		return
+	}
+	ciphertext, key, err := sealSecret(id, []byte(secret))
+	if err != nil {
+		slog.Error("failed to encrypt secret", "err", err)
+		http.Error(w, "failed to create secret", http.StatusInternalServerError)
+		return
+	}
+	var hash *string
+	if p := r.FormValue("passphrase"); p != "" {
+		h, err := bcryptPassphrase(p)
+		if err != nil {
+			slog.Error("failed to hash secret passphrase", "err", err)
+			http.Error(w, "failed to create secret", http.StatusInternalServerError)
+			return
+		}
+		hash = &h
+	}
+
+	a.purgeExpiredSecrets(r.Context())
+	expires := time.Now().UTC().Add(ttl)
+	q := a.DB.Rebind("INSERT INTO secret_links (id, ciphertext, passphrase_bcrypt, expires_at, created_at) VALUES (?, ?, ?, ?, ?)")
+	if _, err := a.DB.ExecContext(r.Context(), q, id, ciphertext, hash, expires, time.Now().UTC()); err != nil {
+		slog.Error("failed to store secret", "err", err)
+		http.Error(w, "failed to store secret: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("one-time secret created", "id", id, "expires_at", expires, "passphrase", hash != nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(secretLink{
+		ID:        id,
+		URL:       secretPrefix + id + "#" + base64.RawURLEncoding.EncodeToString(key),
+		ExpiresAt: expires,
+	})
+}
+
+// purgeExpiredSecrets deletes the secrets that expired unseen. Failures are
+// only logged: expired secrets are refused when viewed regardless.
+func (a *App) purgeExpiredSecrets(ctx context.Context) {
+	q := a.DB.Rebind("DELETE FROM secret_links WHERE expires_at < ?")
+	res, err := a.DB.ExecContext(ctx, q, time.Now().UTC())
+	if err != nil {
+		slog.Warn("failed to purge expired secrets", "err", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		slog.Info("purged expired secrets", "count", n)
+	}
+}
+
+// loadSecret returns the unexpired secret id, or sql.ErrNoRows.
+func loadSecret(ctx context.Context, db sqlx.ExtContext, id string) (*storedSecret, error) {
+	var s storedSecret
+	q := db.Rebind("SELECT id, ciphertext, passphrase_bcrypt, expires_at FROM secret_links WHERE id = ?")
+	if err := sqlx.GetContext(ctx, db, &s, q, id); err != nil {
+		return nil, err
+	}
+	if time.Now().After(s.ExpiresAt) {
+		return nil, sql.ErrNoRows
+	}
+	return &s, nil
+}
+
+// SecretHandler serves the one-time secret links at /s/<id>. GET renders the
+// viewer page without consuming the secret, so link previews cannot burn it;
+// the page then POSTs the optional "passphrase" and receives the ciphertext
+// as JSON, which it decrypts in the browser with the key from the fragment.
+// The secret is deleted by that POST. A wrong passphrase is refused with 403
+// and leaves the secret in place. The links are unauthenticated by design and
+// must not be wrapped in WithAuth; they are rate limited with
+// SecretRateLimiter instead.
+func (a *App) SecretHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	id := strings.TrimPrefix(r.URL.Path, secretPrefix)
+
+	if r.Method == http.MethodGet {
+		page := secretPage{ID: id}
+		status := http.StatusNotFound
+		s, err := loadSecret(r.Context(), a.DB, id)
+		switch {
+		case err == nil:
+			page.Found, page.NeedsPassphrase, page.ExpiresAt = true, s.PassphraseBcrypt != nil, s.ExpiresAt
+			status = http.StatusOK
+		case !errors.Is(err, sql.ErrNoRows):
+			slog.Error("failed to load secret", "id", id, "err", err)
+			http.Error(w, "failed to load secret", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		if err := a.Templates.ExecuteTemplate(w, "secret.html", page); err != nil {
+			slog.Error("failed to render template", "template", "secret.html", "err", err)
+		}
+		return
+	}
+
+	tx, err := a.DB.BeginTxx(r.Context(), nil)
+	if err != nil {
+		slog.Error("failed to begin transaction", "err", err)
+		http.Error(w, "failed to load secret", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	s, err := loadSecret(r.Context(), tx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "this secret does not exist, has expired or was already viewed", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to load secret", "id", id, "err", err)
+		http.Error(w, "failed to load secret", http.StatusInternalServerError)
+		return
+	}
+	if s.PassphraseBcrypt != nil && !matchPassphrase(*s.PassphraseBcrypt, r.FormValue("passphrase")) {
+		slog.Warn("secret: wrong passphrase", "id", id, "ip", clientIP(r))
+		http.Error(w, "wrong passphrase", http.StatusForbidden)
+		return
+	}
+	// Deleting in the same transaction makes sure concurrent views cannot
+	// both receive the secret.
+	res, err := tx.ExecContext(r.Context(), tx.Rebind("DELETE FROM secret_links WHERE id = ?"), id)
+	if err != nil {
+		slog.Error("failed to delete secret", "id", id, "err", err)
+		http.Error(w, "failed to load secret", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "this secret does not exist, has expired or was already viewed", http.StatusNotFound)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		slog.Error("failed to commit secret deletion", "id", id, "err", err)
+		http.Error(w, "failed to load secret", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("one-time secret viewed and deleted", "id", id)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"ciphertext": s.Ciphertext})
+}
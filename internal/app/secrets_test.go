@@ -0,0 +1,144 @@
+package app_test
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createSecret creates a one-time secret and returns its path and the key
+// from the link's fragment.
+func createSecret(t *testing.T, handler http.HandlerFunc, form url.Values) (path, key string) {
+	t.Helper()
+	w := postForm(handler, "/secrets", form)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create secret: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var link struct {
+		ID        string    `json:"id"`
+		URL       string    `json:"url"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &link); err != nil {
+		t.Fatalf("decode secret link: %v", err)
+	}
+	path, key, ok := strings.Cut(link.URL, "#")
+	if !ok || path != "/s/"+link.ID || key == "" {
+		t.Fatalf("unexpected secret link %q", link.URL)
+	}
+	return path, key
+}
+
+// openSecret decrypts the ciphertext returned by the secret page the way the
+// browser does.
+func openSecret(t *testing.T, path, key, body string) string {
+	t.Helper()
+	var resp struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("decode secret response: %v", err)
+	}
+	rawKey, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil {
+		t.Fatalf("decode key: %v", err)
+	}
+	payload, _ := base64.StdEncoding.DecodeString(resp.Ciphertext)
+	block, _ := aes.NewCipher(rawKey)
+	aesgcm, _ := cipher.NewGCM(block)
+	plaintext, err := aesgcm.Open(nil, payload[:12], payload[12:], []byte(strings.TrimPrefix(path, "/s/")))
+	if err != nil {
+		t.Fatalf("decrypt secret: %v", err)
+	}
+	return string(plaintext)
+}
+
+// TestSecretHandlers verifies one-time secrets can be viewed exactly once,
+// never store their key, honor their passphrase and expire.
+func TestSecretHandlers(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	path, key := createSecret(t, a.CreateSecretHandler, url.Values{"secret": {"hunter2"}})
+	var stored string
+	db.Get(&stored, "SELECT ciphertext FROM secret_links")
+	if strings.Contains(stored, "hunter2") || strings.Contains(stored, key) {
+		t.Error("the server must store only the ciphertext")
+	}
+
+	w := httptest.NewRecorder()
+	a.SecretHandler(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), `id="secret-passphrase"`) {
+		t.Fatalf("view page: %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	a.SecretHandler(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("viewing the page must not consume the secret, got %d", w.Code)
+	}
+
+	w = postForm(a.SecretHandler, path, url.Values{})
+	if w.Code != http.StatusOK {
+		t.Fatalf("reveal: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := openSecret(t, path, key, w.Body.String()); got != "hunter2" {
+		t.Errorf("decrypted %q", got)
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Error("secret responses must not be cached")
+	}
+	if w := postForm(a.SecretHandler, path, url.Values{}); w.Code != http.StatusNotFound {
+		t.Errorf("second reveal: expected 404, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	a.SecretHandler(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("viewed secret page: expected 404, got %d", w.Code)
+	}
+
+	path, key = createSecret(t, a.CreateSecretHandler, url.Values{"secret": {"s3cret"}, "passphrase": {"open sesame"}, "expires": {"1h"}})
+	w = httptest.NewRecorder()
+	a.SecretHandler(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if !strings.Contains(w.Body.String(), `id="secret-passphrase"`) {
+		t.Error("the page should ask for the passphrase")
+	}
+	if w := postForm(a.SecretHandler, path, url.Values{"passphrase": {"wrong"}}); w.Code != http.StatusForbidden {
+		t.Errorf("wrong passphrase: expected 403, got %d", w.Code)
+	}
+	w = postForm(a.SecretHandler, path, url.Values{"passphrase": {"open sesame"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("a wrong passphrase must not burn the secret: got %d: %s", w.Code, w.Body.String())
+	}
+	if got := openSecret(t, path, key, w.Body.String()); got != "s3cret" {
+		t.Errorf("decrypted %q", got)
+	}
+
+	path, _ = createSecret(t, a.CreateSecretHandler, url.Values{"secret": {"stale"}})
+	db.Exec(db.Rebind("UPDATE secret_links SET expires_at = ?"), time.Now().UTC().Add(-time.Minute))
+	if w := postForm(a.SecretHandler, path, url.Values{}); w.Code != http.StatusNotFound {
+		t.Errorf("expired secret: expected 404, got %d", w.Code)
+	}
+	createSecret(t, a.CreateSecretHandler, url.Values{"secret": {"fresh"}})
+	var count int
+	db.Get(&count, "SELECT COUNT(*) FROM secret_links")
+	if count != 1 {
+		t.Errorf("expired secrets should be purged, %d rows left", count)
+	}
+
+	for _, form := range []url.Values{
+		{"secret": {" "}},
+		{"secret": {"x"}, "expires": {"1m"}},
+		{"secret": {"x"}, "expires": {"720h"}},
+		{"secret": {"x"}, "expires": {"soon"}},
+	} {
+		if w := postForm(a.CreateSecretHandler, "/secrets", form); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("create %v: expected 422, got %d", form, w.Code)
+		}
+	}
+}
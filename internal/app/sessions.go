@@ -0,0 +1,229 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	mm "h-cloud.io/web-gpg/internal/models"
+)
+
+// sessionIdleTimeout ends sessions that made no request for this long. Each
+// request pushes it back, up to authCookieMaxAge after the login.
+const sessionIdleTimeout = time.Hour
+
+// sessionTouchInterval limits how often a session's last_seen_at is written.
+const sessionTouchInterval = time.Minute
+
+// session is a row of the sessions table.
+type session struct {
+	ID         int64     `db:"id" json:"id"`
+	UserID     int64     `db:"user_id" json:"-"`
+	IP         string    `db:"ip" json:"ip"`
+	UserAgent  string    `db:"user_agent" json:"user_agent"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+	LastSeenAt time.Time `db:"last_seen_at" json:"last_seen_at"`
+	ExpiresAt  time.Time `db:"expires_at" json:"expires_at"`
+	Current    bool      `db:"-" json:"current"` // the session making the request
+}
+
+// idle reports whether s has timed out at now.
+func (s session) idle(now time.Time) bool {
+	return now.Sub(s.LastSeenAt) > sessionIdleTimeout || !now.Before(s.ExpiresAt)
+}
+
+const sessionColumns = "id, user_id, ip, user_agent, created_at, last_seen_at, expires_at"
+
+// withSession returns a copy of ctx carrying the session making the request.
+func withSession(ctx context.Context, id int64) context.Context {
+	return context.WithValue(ctx, sessionContextKey, id)
+}
+
+// currentSession returns the session making the request, or 0 for requests
+// made with an API token or without authentication.
+func currentSession(ctx context.Context) int64 {
+	id, _ := ctx.Value(sessionContextKey).(int64)
+	return id
+}
+
+// startSession records a new session of userID for the client of r and
+// returns its token, the auth cookie value.
+func (a *App) startSession(r *http.Request, userID int64) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	a.purgeExpiredSessions(r.Context())
+	now := time.Now().UTC()
+	q := a.DB.Rebind("INSERT INTO sessions (user_id, token_hash, ip, user_agent, created_at, last_seen_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	_, err = a.DB.ExecContext(r.Context(), q, userID, hashToken(token), clientIP(r), r.UserAgent(), now, now,
+		now.Add(time.Duration(authCookieMaxAge)*time.Second))
+	return token, err
+}
+
+// sessionUser returns the user and session of the auth cookie of r, or nil
+// if there is none or it was revoked or timed out. It marks the session as
+// seen, which keeps it from timing out.
+func (a *App) sessionUser(r *http.Request) (*mm.User, *session) {
+	c, err := r.Cookie("webgpg_auth")
+	if err != nil {
+		return nil, nil
+	}
+	var s session
+	q := a.DB.Rebind("SELECT " + sessionColumns + " FROM sessions WHERE token_hash = ?")
+	if err := a.DB.GetContext(r.Context(), &s, q, hashToken(c.Value)); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("failed to load session", "err", err)
+		}
+		return nil, nil
+	}
+	now := time.Now().UTC()
+	if s.idle(now) {
+		if _, err := a.DB.ExecContext(r.Context(), a.DB.Rebind("DELETE FROM sessions WHERE id = ?"), s.ID); err != nil {
+			slog.Warn("failed to delete timed out session", "session_id", s.ID, "err", err)
+		}
+		return nil, nil
+	}
+	u, err := a.userByID(r.Context(), s.UserID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("failed to load user", "user_id", s.UserID, "err", err)
+		}
+		return nil, nil
+	}
+	if now.Sub(s.LastSeenAt) > sessionTouchInterval {
+		q := a.DB.Rebind("UPDATE sessions SET last_seen_at = ?, ip = ? WHERE id = ?")
+		if _, err := a.DB.ExecContext(r.Context(), q, now, clientIP(r), s.ID); err != nil {
+			slog.Warn("failed to update session", "session_id", s.ID, "err", err)
+		}
+	}
+	return u, &s
+}
+
+// purgeExpiredSessions deletes sessions that timed out. Failures are only
+// logged: timed out sessions are refused anyway.
+func (a *App) purgeExpiredSessions(ctx context.Context) {
+	now := time.Now().UTC()
+	q := a.DB.Rebind("DELETE FROM sessions WHERE last_seen_at < ? OR expires_at < ?")
+	if _, err := a.DB.ExecContext(ctx, q, now.Add(-sessionIdleTimeout), now); err != nil {
+		slog.Warn("failed to purge expired sessions", "err", err)
+	}
+}
+
+// loadSessions returns the active sessions of userID, most recently seen
+// first.
+func (a *App) loadSessions(ctx context.Context, userID int64) ([]session, error) {
+	var all []session
+	q := a.DB.Rebind("SELECT " + sessionColumns + " FROM sessions WHERE user_id = ? ORDER BY last_seen_at DESC, id DESC")
+	if err := a.DB.SelectContext(ctx, &all, q, userID); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	current := currentSession(ctx)
+	sessions := []session{}
+	for _, s := range all {
+		if !s.idle(now) {
+			s.Current = s.ID == current
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions, nil
+}
+
+// SessionsHandler lists the active sessions of the current user as JSON.
+func (a *App) SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u := loginUser(w, r)
+	if u == nil {
+		return
+	}
+	sessions, err := a.loadSessions(r.Context(), u.ID)
+	if err != nil {
+		slog.Error("failed to load sessions", "user_id", u.ID, "err", err)
+		http.Error(w, "failed to load sessions", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// RevokeSessionHandler ends session "id" of the current user.
+func (a *App) RevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u := loginUser(w, r)
+	if u == nil {
+		return
+	}
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusUnprocessableEntity)
+		return
+	}
+	res, err := a.DB.ExecContext(r.Context(), a.DB.Rebind("DELETE FROM sessions WHERE id = ? AND user_id = ?"), id, u.ID)
+	if err != nil {
+		slog.Error("failed to revoke session", "session_id", id, "err", err)
+		http.Error(w, "failed to revoke session: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	slog.Info("session revoked", "user_id", u.ID, "session_id", id)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// RevokeAllSessionsHandler logs the current user out everywhere, including
+// this browser, or ends every session of account "id" when an administrator
+// asks.
+func (a *App) RevokeAllSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u := loginUser(w, r)
+	if u == nil {
+		return
+	}
+	id := u.ID
+	if s := r.FormValue("id"); s != "" {
+		var err error
+		if id, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(w, "invalid id", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if id != u.ID && !requireRole(w, r, RoleAdmin) {
+		return
+	}
+	res, err := a.DB.ExecContext(r.Context(), a.DB.Rebind("DELETE FROM sessions WHERE user_id = ?"), id)
+	if err != nil {
+		slog.Error("failed to revoke sessions", "user_id", id, "err", err)
+		http.Error(w, "failed to revoke sessions: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	n, _ := res.RowsAffected()
+	slog.Info("all sessions revoked", "user_id", id, "by", u.ID, "sessions", n)
+	if id == u.ID {
+		http.SetCookie(w, &http.Cookie{Name: "webgpg_auth", Value: "", Path: "/", MaxAge: -1})
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// removeSessions deletes the sessions of userID except session keep, which
+// is 0 to delete them all.
+func removeSessions(ctx context.Context, tx execer, userID, keep int64) error {
+	_, err := tx.ExecContext(ctx, tx.Rebind("DELETE FROM sessions WHERE user_id = ? AND id <> ?"), userID, keep)
+	return err
+}
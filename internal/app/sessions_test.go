@@ -0,0 +1,130 @@
+package app_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	apppkg "h-cloud.io/web-gpg/internal/app"
+)
+
+type testSession struct {
+	ID         int64     `json:"id"`
+	IP         string    `json:"ip"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	Current    bool      `json:"current"`
+}
+
+func sessionsOf(t *testing.T, a *apppkg.App, c *http.Cookie) []testSession {
+	t.Helper()
+	w := as(a, c, a.SessionsHandler, http.MethodGet, "/sessions", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("sessions: %d %s", w.Code, w.Body.String())
+	}
+	var sessions []testSession
+	json.Unmarshal(w.Body.Bytes(), &sessions)
+	return sessions
+}
+
+// loggedIn reports whether the auth cookie c still opens a session.
+func loggedIn(a *apppkg.App, c *http.Cookie) bool {
+	return as(a, c, a.SessionsHandler, http.MethodGet, "/sessions", nil).Code == http.StatusOK
+}
+
+// TestSessions verifies sessions are listed, end on logout, revocation,
+// inactivity and password changes, and that activity keeps them alive.
+func TestSessions(t *testing.T) {
+	a, _ := setupTestApp(t)
+	bootstrap := login(t, a, "", "test-master-password")
+	as(a, bootstrap, a.UsersHandler, http.MethodPost, "/users", url.Values{"username": {"admin"}, "password": {"admin-password"}})
+	admin := login(t, a, "admin", "admin-password")
+	as(a, admin, a.UsersHandler, http.MethodPost, "/users", url.Values{"username": {"alice"}, "password": {"alice-password"}})
+	laptop := login(t, a, "alice", "alice-password")
+	phone := login(t, a, "alice", "alice-password")
+
+	sessions := sessionsOf(t, a, laptop)
+	if len(sessions) != 2 || sessions[0].IP == "" {
+		t.Fatalf("expected 2 sessions, got %+v", sessions)
+	}
+	var phoneID int64
+	for _, s := range sessions {
+		if !s.Current {
+			phoneID = s.ID
+		}
+	}
+	if phoneID == 0 {
+		t.Fatalf("expected one current session: %+v", sessions)
+	}
+	if w := as(a, admin, a.RevokeSessionHandler, http.MethodPost, "/sessions/revoke", url.Values{"id": {strconv.FormatInt(phoneID, 10)}}); w.Code != http.StatusNotFound {
+		t.Errorf("revoking another user's session: expected 404, got %d", w.Code)
+	}
+	if w := as(a, laptop, a.RevokeSessionHandler, http.MethodPost, "/sessions/revoke", url.Values{"id": {strconv.FormatInt(phoneID, 10)}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("revoke: %d %s", w.Code, w.Body.String())
+	}
+	if loggedIn(a, phone) || !loggedIn(a, laptop) {
+		t.Error("only the revoked session should end")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/logout", nil)
+	req.AddCookie(laptop)
+	a.LogoutHandler(httptest.NewRecorder(), req)
+	if loggedIn(a, laptop) {
+		t.Error("a copy of the cookie should not outlive logout")
+	}
+
+	// Activity within the idle timeout keeps a session alive; an hour
+	// without any ends it.
+	laptop = login(t, a, "alice", "alice-password")
+	a.DB.MustExec(a.DB.Rebind("UPDATE sessions SET last_seen_at = ?"), time.Now().UTC().Add(-50*time.Minute))
+	if !loggedIn(a, laptop) {
+		t.Fatal("a session seen 50 minutes ago should still be active")
+	}
+	if s := sessionsOf(t, a, laptop); len(s) != 1 || time.Since(s[0].LastSeenAt) > time.Minute {
+		t.Errorf("a request should push back the idle timeout: %+v", s)
+	}
+	a.DB.MustExec(a.DB.Rebind("UPDATE sessions SET last_seen_at = ?"), time.Now().UTC().Add(-61*time.Minute))
+	if loggedIn(a, laptop) || loggedIn(a, admin) {
+		t.Error("idle sessions should end")
+	}
+
+	admin = login(t, a, "admin", "admin-password")
+	laptop = login(t, a, "alice", "alice-password")
+	phone = login(t, a, "alice", "alice-password")
+	if w := as(a, laptop, a.RevokeAllSessionsHandler, http.MethodPost, "/sessions/revoke-all", url.Values{"id": {"1"}}); w.Code != http.StatusForbidden {
+		t.Errorf("logging out another user as a viewer: expected 403, got %d", w.Code)
+	}
+	w := as(a, laptop, a.RevokeAllSessionsHandler, http.MethodPost, "/sessions/revoke-all", nil)
+	if w.Code != http.StatusSeeOther || cookieNamed(w, "webgpg_auth") != nil {
+		t.Fatalf("log out everywhere: %d %s", w.Code, w.Body.String())
+	}
+	if loggedIn(a, laptop) || loggedIn(a, phone) || !loggedIn(a, admin) {
+		t.Error("logging out everywhere should end every session of the user only")
+	}
+
+	laptop = login(t, a, "alice", "alice-password")
+	if w := as(a, admin, a.RevokeAllSessionsHandler, http.MethodPost, "/sessions/revoke-all", url.Values{"id": {"2"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("admin logging out alice: %d %s", w.Code, w.Body.String())
+	}
+	if loggedIn(a, laptop) || !loggedIn(a, admin) {
+		t.Error("an administrator should be able to log a user out everywhere")
+	}
+
+	laptop = login(t, a, "alice", "alice-password")
+	phone = login(t, a, "alice", "alice-password")
+	if w := as(a, laptop, a.UserPasswordHandler, http.MethodPost, "/users/password", url.Values{"id": {"2"}, "current_password": {"alice-password"}, "password": {"new-alice-password"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("change password: %d %s", w.Code, w.Body.String())
+	}
+	if !loggedIn(a, laptop) || loggedIn(a, phone) {
+		t.Error("changing your password should end your other sessions only")
+	}
+	if w := as(a, admin, a.UserPasswordHandler, http.MethodPost, "/users/password", url.Values{"id": {"2"}, "password": {"reset-alice-password"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("reset password: %d %s", w.Code, w.Body.String())
+	}
+	if loggedIn(a, laptop) || !loggedIn(a, admin) {
+		t.Error("a password reset should end every session of the user")
+	}
+}
@@ -0,0 +1,256 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	mm "h-cloud.io/web-gpg/internal/models"
+)
+
+// apiTokenPrefix starts every API token, so leaked tokens are easy to spot.
+const apiTokenPrefix = "ewg_"
+
+// Lifetimes of API tokens, in days.
+const (
+	defaultTokenDays = 30
+	maxTokenDays     = 365
+)
+
+// apiToken is a row of the api_tokens table. The token itself is only
+// shown once, when created.
+type apiToken struct {
+	ID         int64      `db:"id" json:"id"`
+	UserID     int64      `db:"user_id" json:"-"`
+	Name       string     `db:"name" json:"name"`
+	Prefix     string     `db:"prefix" json:"prefix"`
+	Scope      string     `db:"scope" json:"scope"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+	ExpiresAt  time.Time  `db:"expires_at" json:"expires_at"`
+	LastUsedAt *time.Time `db:"last_used_at" json:"last_used_at"`
+	LastUsedIP *string    `db:"last_used_ip" json:"last_used_ip"`
+	UseCount   int64      `db:"use_count" json:"use_count"`
+}
+
+// Expired reports whether the token can no longer be used.
+func (t apiToken) Expired() bool {
+	return !time.Now().Before(t.ExpiresAt)
+}
+
+// hashToken returns the stored digest of an API or session token. Tokens
+// are random, so a fast hash is enough and lets them be looked up directly.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAPIToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// withToken returns a copy of ctx recording that the request was
+// authenticated with API token id.
+func withToken(ctx context.Context, id int64) context.Context {
+	return context.WithValue(ctx, tokenContextKey, id)
+}
+
+// viaToken reports whether the request was authenticated with an API token
+// rather than a login.
+func viaToken(ctx context.Context) bool {
+	_, ok := ctx.Value(tokenContextKey).(int64)
+	return ok
+}
+
+// tokenUser returns the user an API token acts as, with their role lowered
+// to the token's scope, and records the use. It returns nil for unknown or
+// expired tokens and tokens of deleted accounts.
+func (a *App) tokenUser(r *http.Request, token string) (*mm.User, *apiToken) {
+	var t apiToken
+	q := a.DB.Rebind("SELECT id, user_id, name, prefix, scope, created_at, expires_at, last_used_at, last_used_ip, use_count FROM api_tokens WHERE token_hash = ?")
+	if err := a.DB.GetContext(r.Context(), &t, q, hashToken(token)); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("failed to load API token", "err", err)
+		}
+		return nil, nil
+	}
+	if t.Expired() {
+		return nil, nil
+	}
+	u, err := a.userByID(r.Context(), t.UserID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("failed to load user", "user_id", t.UserID, "err", err)
+		}
+		return nil, nil
+	}
+	q = a.DB.Rebind("UPDATE api_tokens SET last_used_at = ?, last_used_ip = ?, use_count = use_count + 1 WHERE id = ?")
+	if _, err := a.DB.ExecContext(r.Context(), q, time.Now(), clientIP(r), t.ID); err != nil {
+		slog.Warn("failed to record API token use", "token_id", t.ID, "err", err)
+	}
+	scoped := *u
+	if roleRank(t.Scope) < roleRank(scoped.Role) {
+		scoped.Role = t.Scope
+	}
+	return &scoped, &t
+}
+
+// loadAPITokens returns the API tokens of userID, newest first.
+func (a *App) loadAPITokens(ctx context.Context, userID int64) ([]apiToken, error) {
+	tokens := []apiToken{}
+	q := a.DB.Rebind("SELECT id, user_id, name, prefix, scope, created_at, expires_at, last_used_at, last_used_ip, use_count FROM api_tokens WHERE user_id = ? ORDER BY created_at DESC, id DESC")
+	err := a.DB.SelectContext(ctx, &tokens, q, userID)
+	return tokens, err
+}
+
+// tokenOwner returns the logged-in user who may manage API tokens, or writes
+// an error and returns nil. Tokens cannot be managed with a token.
+func tokenOwner(w http.ResponseWriter, r *http.Request) *mm.User {
+	if viaToken(r.Context()) {
+		http.Error(w, "API tokens cannot manage API tokens: log in instead", http.StatusForbidden)
+		return nil
+	}
+	return loginUser(w, r)
+}
+
+// APITokensHandler lists the current user's API tokens (GET) or creates one
+// from "name", "scope", a role no higher than the user's that defaults to
+// viewer, and "expires_days" (POST). Creating returns the token as JSON;
+// it is not shown again.
+func (a *App) APITokensHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		u := tokenOwner(w, r)
+		if u == nil {
+			return
+		}
+		tokens, err := a.loadAPITokens(r.Context(), u.ID)
+		if err != nil {
+			slog.Error("failed to load API tokens", "user_id", u.ID, "err", err)
+			http.Error(w, "failed to load API tokens", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokens)
+	case http.MethodPost:
+		a.createAPIToken(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *App) createAPIToken(w http.ResponseWriter, r *http.Request) {
+	u := tokenOwner(w, r)
+	if u == nil {
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || len(name) > 64 {
+		http.Error(w, "name is required, up to 64 characters", http.StatusUnprocessableEntity)
+		return
+	}
+	scope := r.FormValue("scope")
+	if scope == "" {
+		scope = RoleViewer
+	}
+	if roleRank(scope) < 0 {
+		http.Error(w, "invalid scope: expected viewer, encryptor, decryptor or admin", http.StatusUnprocessableEntity)
+		return
+	}
+	if roleRank(scope) > roleRank(u.Role) {
+		http.Error(w, "scope "+scope+" exceeds your role", http.StatusUnprocessableEntity)
+		return
+	}
+	days := defaultTokenDays
+	if v := r.FormValue("expires_days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTokenDays {
+			http.Error(w, "expires_days must be between 1 and "+strconv.Itoa(maxTokenDays), http.StatusUnprocessableEntity)
+			return
+		}
+		days = n
+	}
+	token, err := newAPIToken()
+	if err != nil {
+		http.Error(w, "failed to create API token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	t := apiToken{
+		UserID:    u.ID,
+		Name:      name,
+		Prefix:    token[:len(apiTokenPrefix)+8],
+		Scope:     scope,
+		CreatedAt: now,
+		ExpiresAt: now.AddDate(0, 0, days),
+	}
+	q := a.DB.Rebind("INSERT INTO api_tokens (user_id, name, token_hash, prefix, scope, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id")
+	if err := a.DB.GetContext(r.Context(), &t.ID, q, t.UserID, t.Name, hashToken(token), t.Prefix, t.Scope, t.CreatedAt, t.ExpiresAt); err != nil {
+		slog.Error("failed to store API token", "user_id", u.ID, "err", err)
+		http.Error(w, "failed to create API token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("API token created", "user_id", u.ID, "name", name, "scope", scope, "expires_at", t.ExpiresAt)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		apiToken
+		Token string `json:"token"`
+	}{t, token})
+}
+
+// RevokeAPITokenHandler deletes API token "id" of the current user.
+func (a *App) RevokeAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u := tokenOwner(w, r)
+	if u == nil {
+		return
+	}
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusUnprocessableEntity)
+		return
+	}
+	res, err := a.DB.ExecContext(r.Context(), a.DB.Rebind("DELETE FROM api_tokens WHERE id = ? AND user_id = ?"), id, u.ID)
+	if err != nil {
+		slog.Error("failed to revoke API token", "token_id", id, "err", err)
+		http.Error(w, "failed to revoke API token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "API token not found", http.StatusNotFound)
+		return
+	}
+	slog.Info("API token revoked", "user_id", u.ID, "token_id", id)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// removeAPITokens deletes the API tokens of userID.
+func removeAPITokens(ctx context.Context, tx execer, userID int64) error {
+	_, err := tx.ExecContext(ctx, tx.Rebind("DELETE FROM api_tokens WHERE user_id = ?"), userID)
+	return err
+}
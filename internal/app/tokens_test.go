@@ -0,0 +1,135 @@
+package app_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	apppkg "h-cloud.io/web-gpg/internal/app"
+)
+
+// bearer calls handler behind WithAuth with an API token.
+func bearer(a *apppkg.App, token string, method string, handler http.HandlerFunc) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Forwarded-For", "198.51.100.4")
+	w := httptest.NewRecorder()
+	a.WithAuth(handler)(w, req)
+	return w
+}
+
+// TestAPITokens verifies tokens authenticate with their scope as the highest
+// role, record their use and stop working once revoked or expired.
+func TestAPITokens(t *testing.T) {
+	a, _ := setupTestApp(t)
+	bootstrap := login(t, a, "", "test-master-password")
+	as(a, bootstrap, a.UsersHandler, http.MethodPost, "/users", url.Values{"username": {"admin"}, "password": {"admin-password"}})
+	admin := login(t, a, "admin", "admin-password")
+	as(a, admin, a.UsersHandler, http.MethodPost, "/users", url.Values{"username": {"alice"}, "password": {"alice-password"}, "role": {"decryptor"}})
+	alice := login(t, a, "alice", "alice-password")
+
+	if w := as(a, alice, a.APITokensHandler, http.MethodPost, "/tokens", url.Values{"name": {"too much"}, "scope": {"admin"}}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("scope above the user's role: expected 422, got %d", w.Code)
+	}
+	if w := as(a, alice, a.APITokensHandler, http.MethodPost, "/tokens", url.Values{"name": {"forever"}, "expires_days": {"0"}}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("no expiry: expected 422, got %d", w.Code)
+	}
+	w := as(a, alice, a.APITokensHandler, http.MethodPost, "/tokens", url.Values{"name": {"backup"}, "scope": {"encryptor"}, "expires_days": {"7"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("create: %d %s", w.Code, w.Body.String())
+	}
+	var created struct {
+		ID        int64     `json:"id"`
+		Token     string    `json:"token"`
+		Prefix    string    `json:"prefix"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if !strings.HasPrefix(created.Token, "ewg_") || !strings.HasPrefix(created.Token, created.Prefix) || time.Until(created.ExpiresAt) > 8*24*time.Hour {
+		t.Fatalf("unexpected token: %s", w.Body.String())
+	}
+
+	viewer := apppkg.RequireRole(apppkg.RoleViewer, a.IndexHandler)
+	if w := bearer(a, created.Token, http.MethodGet, apppkg.RequireRole(apppkg.RoleEncryptor, viewer)); w.Code != http.StatusOK {
+		t.Fatalf("token within its scope: %d %s", w.Code, w.Body.String())
+	}
+	if w := bearer(a, created.Token, http.MethodGet, apppkg.RequireRole(apppkg.RoleDecryptor, a.IndexHandler)); w.Code != http.StatusForbidden {
+		t.Errorf("token beyond its scope: expected 403, got %d", w.Code)
+	}
+	if w := bearer(a, created.Token, http.MethodGet, a.APITokensHandler); w.Code != http.StatusForbidden {
+		t.Errorf("managing tokens with a token: expected 403, got %d", w.Code)
+	}
+	w = bearer(a, created.Token+"x", http.MethodGet, viewer)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("unknown token: expected 401 with a challenge, got %d", w.Code)
+	}
+
+	w = as(a, alice, a.APITokensHandler, http.MethodGet, "/tokens", nil)
+	var tokens []struct {
+		UseCount   int64   `json:"use_count"`
+		LastUsedIP *string `json:"last_used_ip"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &tokens)
+	if len(tokens) != 1 || tokens[0].UseCount != 3 || tokens[0].LastUsedIP == nil || *tokens[0].LastUsedIP != "198.51.100.4" {
+		t.Errorf("unexpected usage: %s", w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), created.Token) {
+		t.Error("the token should not be listed")
+	}
+
+	id := url.Values{"id": {strconv.FormatInt(created.ID, 10)}}
+	if w := as(a, admin, a.RevokeAPITokenHandler, http.MethodPost, "/tokens/revoke", id); w.Code != http.StatusNotFound {
+		t.Errorf("revoking another user's token: expected 404, got %d", w.Code)
+	}
+	if w := as(a, alice, a.RevokeAPITokenHandler, http.MethodPost, "/tokens/revoke", id); w.Code != http.StatusSeeOther {
+		t.Fatalf("revoke: %d %s", w.Code, w.Body.String())
+	}
+	if w := bearer(a, created.Token, http.MethodGet, viewer); w.Code != http.StatusUnauthorized {
+		t.Errorf("revoked token: expected 401, got %d", w.Code)
+	}
+
+	w = as(a, alice, a.APITokensHandler, http.MethodPost, "/tokens", url.Values{"name": {"old"}})
+	json.Unmarshal(w.Body.Bytes(), &created)
+	a.DB.MustExec(a.DB.Rebind("UPDATE api_tokens SET expires_at = ? WHERE id = ?"), time.Now().Add(-time.Minute), created.ID)
+	if w := bearer(a, created.Token, http.MethodGet, viewer); w.Code != http.StatusUnauthorized {
+		t.Errorf("expired token: expected 401, got %d", w.Code)
+	}
+}
+
+// TestAPITokensCannotManageAccounts verifies a token cannot change how its
+// owner logs in: passwords, two-factor authentication, passkeys and sessions.
+func TestAPITokensCannotManageAccounts(t *testing.T) {
+	a, _ := setupTestApp(t)
+	a.WebAuthn = apppkg.NewWebAuthn(testOrigin)
+	bootstrap := login(t, a, "", "test-master-password")
+	as(a, bootstrap, a.UsersHandler, http.MethodPost, "/users", url.Values{"username": {"alice"}, "password": {"alice-password"}})
+	alice := login(t, a, "alice", "alice-password")
+	w := as(a, alice, a.APITokensHandler, http.MethodPost, "/tokens", url.Values{"name": {"ci"}})
+	var created struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+
+	for _, tc := range []struct {
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"/users/password", a.UserPasswordHandler},
+		{"/2fa", a.TwoFactorHandler},
+		{"/2fa/disable", a.DisableTwoFactorHandler},
+		{"/passkeys/register/begin", a.BeginPasskeyRegistrationHandler},
+		{"/sessions/revoke-all", a.RevokeAllSessionsHandler},
+	} {
+		if w := bearer(a, created.Token, http.MethodPost, tc.handler); w.Code != http.StatusForbidden {
+			t.Errorf("%s with a token: expected 403, got %d", tc.path, w.Code)
+		}
+	}
+	if !loggedIn(a, alice) {
+		t.Error("a token should not end its owner's sessions")
+	}
+}
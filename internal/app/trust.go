@@ -0,0 +1,199 @@
+package app
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v3/crypto"
+
+	mm "h-cloud.io/web-gpg/internal/models"
+)
+
+// Trust levels follow the GnuPG ownertrust vocabulary so that levels can be
+// carried over from (and back to) a GnuPG keyring unchanged.
+const (
+	TrustUnknown  = "unknown"
+	TrustNever    = "never"
+	TrustMarginal = "marginal"
+	TrustFull     = "full"
+	TrustUltimate = "ultimate"
+)
+
+// TrustPolicy controls what EncryptHandler does when the recipient key is
+// not verified. The zero value warns.
+type TrustPolicy int
+
+const (
+	TrustPolicyWarn TrustPolicy = iota
+	TrustPolicyOff
+	TrustPolicyBlock
+)
+
+// ParseTrustPolicy maps the TRUST_POLICY env value ("off", "warn", "block")
+// to a TrustPolicy. Unknown values fall back to warn.
+func ParseTrustPolicy(s string) TrustPolicy {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "warn":
+		return TrustPolicyWarn
+	case "off":
+		return TrustPolicyOff
+	case "block":
+		return TrustPolicyBlock
+	}
+	slog.Warn("unknown TRUST_POLICY, using warn", "value", s)
+	return TrustPolicyWarn
+}
+
+// validTrustLevel reports whether level is one of the known trust levels.
+func validTrustLevel(level string) bool {
+	switch level {
+	case TrustUnknown, TrustNever, TrustMarginal, TrustFull, TrustUltimate:
+		return true
+	}
+	return false
+}
+
+// keyVerified reports whether a key's trust level counts as verified.
+func keyVerified(level string) bool {
+	return level == TrustFull || level == TrustUltimate
+}
+
+// checkRecipientTrust applies the trust policy to an encryption recipient.
+// Keys marked "never" are always refused unless the policy is off; other
+// unverified keys are refused under the block policy and flagged with an
+// X-Trust-Warning header under the warn policy. It writes an HTTP error and
+// returns false when the recipient must not be used.
+func (a *App) checkRecipientTrust(w http.ResponseWriter, k *mm.Key) bool {
+	if a.TrustPolicy == TrustPolicyOff || keyVerified(k.TrustLevel) {
+		return true
+	}
+	if k.TrustLevel == TrustNever || a.TrustPolicy == TrustPolicyBlock {
+		slog.Warn("encrypt: recipient key refused by trust policy", "key_id", k.ID, "name", k.Name, "trust", k.TrustLevel)
+		http.Error(w, "recipient key "+k.Name+" is not verified (trust: "+k.TrustLevel+")", http.StatusUnprocessableEntity)
+		return false
+	}
+	w.Header().Add("X-Trust-Warning", "recipient key "+k.Name+" is not verified")
+	return true
+}
+
+// CertifyKeyHandler signs every user ID of a stored key with one of our
+// private keys and records the requested trust level (default "full").
+func (a *App) CertifyKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.FormValue("id")
+	signerID := r.FormValue("signer")
+	if id == "" || signerID == "" {
+		http.Error(w, "missing id or signer", http.StatusUnprocessableEntity)
+		return
+	}
+	if id == signerID {
+		http.Error(w, "a key cannot certify itself", http.StatusUnprocessableEntity)
+		return
+	}
+	level := r.FormValue("level")
+	if level == "" {
+		level = TrustFull
+	}
+	if level != TrustMarginal && level != TrustFull && level != TrustUltimate {
+		http.Error(w, "invalid certification level: "+level, http.StatusUnprocessableEntity)
+		return
+	}
+
+	const q = "SELECT id, name, armored, is_private, encrypted_password FROM keys WHERE id = ? AND "
+	var target, signer mm.Key
+	scope, args := keyScope(r.Context(), true)
+	if err := a.DB.GetContext(r.Context(), &target, a.DB.Rebind(q+scope), append([]interface{}{id}, args...)...); err != nil {
+		http.Error(w, "key not found", http.StatusNotFound)
+		return
+	}
+	scope, args = keyScope(r.Context(), false)
+	if err := a.DB.GetContext(r.Context(), &signer, a.DB.Rebind(q+scope), append([]interface{}{signerID}, args...)...); err != nil {
+		http.Error(w, "signing key not found", http.StatusUnprocessableEntity)
+		return
+	}
+	if !signer.IsPrivate {
+		http.Error(w, "signing key is not a private key", http.StatusUnprocessableEntity)
+		return
+	}
+
+	signingKey := a.unlockPrivateKey(w, &signer, "certify")
+	if signingKey == nil {
+		return
+	}
+	targetKey, err := crypto.NewKeyFromArmored(target.Armored)
+	if err != nil {
+		slog.Error("certify: failed to parse stored key", "key_id", target.ID, "name", target.Name, "err", err)
+		http.Error(w, "stored key is invalid: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	entity := targetKey.GetEntity()
+	for uid := range entity.Identities {
+		if err := entity.SignIdentity(uid, signingKey.GetEntity(), nil); err != nil {
+			slog.Error("certify: failed to sign user ID", "key_id", target.ID, "signer_id", signer.ID, "err", err)
+			http.Error(w, "failed to certify key: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var armored string
+	if targetKey.IsPrivate() {
+		armored, err = targetKey.Armor()
+	} else {
+		armored, err = targetKey.GetArmoredPublicKey()
+	}
+	if err != nil {
+		slog.Error("certify: failed to armor certified key", "key_id", target.ID, "err", err)
+		http.Error(w, "failed to armor certified key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	uq := a.DB.Rebind("UPDATE keys SET armored = ?, trust_level = ?, certified_by = ?, certified_at = ? WHERE id = ?")
+	if _, err := a.DB.ExecContext(r.Context(), uq, armored, level, signer.ID, time.Now(), target.ID); err != nil {
+		slog.Error("failed to store certified key", "key_id", target.ID, "err", err)
+		http.Error(w, "failed to store certified key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("key certified", "key_id", target.ID, "signer_id", signer.ID, "trust", level)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// SetTrustHandler records a trust level for a key without certifying it,
+// e.g. after an out-of-band fingerprint check or to mark a key as "never".
+func (a *App) SetTrustHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.FormValue("id")
+	level := r.FormValue("level")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusUnprocessableEntity)
+		return
+	}
+	if !validTrustLevel(level) {
+		http.Error(w, "invalid trust level: "+level, http.StatusUnprocessableEntity)
+		return
+	}
+
+	scope, args := keyScope(r.Context(), true)
+	q := a.DB.Rebind("UPDATE keys SET trust_level = ? WHERE id = ? AND " + scope)
+	res, err := a.DB.ExecContext(r.Context(), q, append([]interface{}{level, id}, args...)...)
+	if err != nil {
+		slog.Error("failed to update trust level", "id", id, "err", err)
+		http.Error(w, "failed to update trust level: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "key not found", http.StatusNotFound)
+		return
+	}
+	slog.Info("key trust updated", "id", id, "trust", level)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
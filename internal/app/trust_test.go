@@ -0,0 +1,172 @@
+package app_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	gcrypto "github.com/ProtonMail/gopenpgp/v3/crypto"
+
+	apppkg "h-cloud.io/web-gpg/internal/app"
+)
+
+// postForm invokes handler with a urlencoded POST body and returns the recorder.
+func postForm(handler http.HandlerFunc, path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+// TestCertifyKeyHandler verifies certifying a public key signs its user IDs
+// with the chosen private key and marks it as verified.
+func TestCertifyKeyHandler(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	signer := generateTestKey(t, "Our Team", "team@example.com", "signer-pass")
+	signerArmored, _ := signer.Armor()
+	encPass, err := a.Crypto.Encrypt([]byte("signer-pass"))
+	if err != nil {
+		t.Fatalf("encrypt passphrase: %v", err)
+	}
+	res, err := db.Exec("INSERT INTO keys (name, armored, is_private, encrypted_password, created_at) VALUES (?, ?, ?, ?, ?)",
+		"signer", signerArmored, true, &encPass, time.Now())
+	if err != nil {
+		t.Fatalf("insert signer: %v", err)
+	}
+	signerID, _ := res.LastInsertId()
+
+	contact := generateTestKey(t, "Alice", "alice@example.com", "")
+	contactPub, _ := contact.GetArmoredPublicKey()
+	res, _ = db.Exec("INSERT INTO keys (name, armored, is_private, created_at) VALUES (?, ?, ?, ?)",
+		"alice", contactPub, false, time.Now())
+	contactID, _ := res.LastInsertId()
+
+	w := postForm(a.CertifyKeyHandler, "/keys/certify", url.Values{
+		"id":     {fmt.Sprint(contactID)},
+		"signer": {fmt.Sprint(signerID)},
+	})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("certify: expected 303, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var row struct {
+		Armored     string `db:"armored"`
+		TrustLevel  string `db:"trust_level"`
+		CertifiedBy *int64 `db:"certified_by"`
+	}
+	if err := db.Get(&row, "SELECT armored, trust_level, certified_by FROM keys WHERE id = ?", contactID); err != nil {
+		t.Fatalf("load certified key: %v", err)
+	}
+	if row.TrustLevel != apppkg.TrustFull {
+		t.Errorf("trust_level = %q, want %q", row.TrustLevel, apppkg.TrustFull)
+	}
+	if row.CertifiedBy == nil || *row.CertifiedBy != signerID {
+		t.Errorf("certified_by = %v, want %d", row.CertifiedBy, signerID)
+	}
+
+	certified, err := gcrypto.NewKeyFromArmored(row.Armored)
+	if err != nil {
+		t.Fatalf("parse certified key: %v", err)
+	}
+	for uid, ident := range certified.GetEntity().Identities {
+		if len(ident.OtherCertifications) == 0 {
+			t.Errorf("identity %q has no third-party certification", uid)
+			continue
+		}
+		if got := ident.OtherCertifications[0].Packet.IssuerKeyId; got == nil || *got != signer.GetKeyID() {
+			t.Errorf("identity %q certified by %v, want %x", uid, got, signer.GetKeyID())
+		}
+	}
+}
+
+// TestCertifyKeyHandler_RejectsPublicSigner verifies a public key cannot be
+// used to certify another key.
+func TestCertifyKeyHandler_RejectsPublicSigner(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	one, _ := generateTestKey(t, "One", "one@example.com", "").GetArmoredPublicKey()
+	two, _ := generateTestKey(t, "Two", "two@example.com", "").GetArmoredPublicKey()
+	res1, _ := db.Exec("INSERT INTO keys (name, armored, is_private, created_at) VALUES (?, ?, ?, ?)", "one", one, false, time.Now())
+	res2, _ := db.Exec("INSERT INTO keys (name, armored, is_private, created_at) VALUES (?, ?, ?, ?)", "two", two, false, time.Now())
+	id1, _ := res1.LastInsertId()
+	id2, _ := res2.LastInsertId()
+
+	w := postForm(a.CertifyKeyHandler, "/keys/certify", url.Values{"id": {fmt.Sprint(id1)}, "signer": {fmt.Sprint(id2)}})
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// TestEncryptHandler_TrustPolicy verifies the trust policy is enforced when
+// encrypting to unverified and distrusted keys.
+func TestEncryptHandler_TrustPolicy(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	pub, _ := generateTestKey(t, "Bob", "bob@example.com", "").GetArmoredPublicKey()
+	res, _ := db.Exec("INSERT INTO keys (name, armored, is_private, created_at) VALUES (?, ?, ?, ?)", "bob", pub, false, time.Now())
+	keyID, _ := res.LastInsertId()
+	encrypt := url.Values{"key": {fmt.Sprint(keyID)}, "input": {"hi"}}
+
+	// Default policy warns but still encrypts.
+	w := postForm(a.EncryptHandler, "/encrypt", encrypt)
+	if w.Code != http.StatusOK {
+		t.Fatalf("warn policy: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("X-Trust-Warning") == "" {
+		t.Error("warn policy: expected X-Trust-Warning header")
+	}
+
+	// Block policy refuses unverified keys.
+	a.TrustPolicy = apppkg.TrustPolicyBlock
+	if w := postForm(a.EncryptHandler, "/encrypt", encrypt); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("block policy: expected 422, got %d", w.Code)
+	}
+
+	// Raising the trust level lets the encryption through without a warning.
+	if w := postForm(a.SetTrustHandler, "/keys/trust", url.Values{"id": {fmt.Sprint(keyID)}, "level": {"full"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("set trust: expected 303, got %d: %s", w.Code, w.Body.String())
+	}
+	w = postForm(a.EncryptHandler, "/encrypt", encrypt)
+	if w.Code != http.StatusOK || w.Header().Get("X-Trust-Warning") != "" {
+		t.Fatalf("verified key: expected 200 without warning, got %d (%q)", w.Code, w.Header().Get("X-Trust-Warning"))
+	}
+
+	// "never" is refused even under the warn policy.
+	a.TrustPolicy = apppkg.TrustPolicyWarn
+	postForm(a.SetTrustHandler, "/keys/trust", url.Values{"id": {fmt.Sprint(keyID)}, "level": {"never"}})
+	if w := postForm(a.EncryptHandler, "/encrypt", encrypt); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("distrusted key: expected 422, got %d", w.Code)
+	}
+}
+
+// TestSetTrustHandler_InvalidLevel verifies unknown trust levels are rejected.
+func TestSetTrustHandler_InvalidLevel(t *testing.T) {
+	a, _ := setupTestApp(t)
+
+	w := postForm(a.SetTrustHandler, "/keys/trust", url.Values{"id": {"1"}, "level": {"bogus"}})
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", w.Code)
+	}
+}
+
+// TestParseTrustPolicy verifies env values map to policies.
+func TestParseTrustPolicy(t *testing.T) {
+	tests := map[string]apppkg.TrustPolicy{
+		"":      apppkg.TrustPolicyWarn,
+		"warn":  apppkg.TrustPolicyWarn,
+		"OFF":   apppkg.TrustPolicyOff,
+		"block": apppkg.TrustPolicyBlock,
+		"nope":  apppkg.TrustPolicyWarn,
+	}
+	for in, want := range tests {
+		if got := apppkg.ParseTrustPolicy(in); got != want {
+			t.Errorf("ParseTrustPolicy(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,493 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	mm "h-cloud.io/web-gpg/internal/models"
+)
+
+// TOTP parameters. These are the RFC 6238 defaults, the only ones every
+// authenticator app supports.
+const (
+	totpPeriod = 30 // seconds per time step
+	totpDigits = 6
+	totpSkew   = 1 // time steps of clock drift accepted either way
+)
+
+// totpIssuer names this service in authenticator apps.
+const totpIssuer = "easy-web-gpg"
+
+// twoFactorCookieMaxAge is how long the second login step may take after the
+// password was accepted.
+const twoFactorCookieMaxAge int64 = 300
+
+// maxSecondFactorFailures is how many invalid second factor codes in a row
+// lock the second login step for secondFactorLockout.
+const (
+	maxSecondFactorFailures = 5
+	secondFactorLockout     = 15 * time.Minute
+)
+
+// recoveryCodeCount is the number of recovery codes issued on enrollment.
+const recoveryCodeCount = 10
+
+// totpEncoding encodes TOTP secrets the way authenticator apps expect them.
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPCode returns the RFC 6238 code of secret at time t.
+func TOTPCode(secret []byte, t time.Time) string {
+	return totpCode(secret, t.Unix()/totpPeriod)
+}
+
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%1000000)
+}
+
+// matchTOTP returns the time step whose code is code, within totpSkew steps
+// of now.
+func matchTOTP(secret []byte, code string, now time.Time) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for d := int64(-totpSkew); d <= totpSkew; d++ {
+		if hmac.Equal([]byte(totpCode(secret, current+d)), []byte(code)) {
+			return current + d, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI returns the otpauth URI authenticator apps enroll from.
+func totpURI(username string, secret []byte) string {
+	v := url.Values{
+		"secret": {totpEncoding.EncodeToString(secret)},
+		"issuer": {totpIssuer},
+		"digits": {strconv.Itoa(totpDigits)},
+		"period": {strconv.Itoa(totpPeriod)},
+	}
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+username) + "?" + v.Encode()
+}
+
+// normalizeCode strips the spaces and dashes people type into codes.
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// newRecoveryCode returns a random recovery code like "k3j9d-x2m4q".
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	s := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+	return s[:5] + "-" + s[5:], nil
+}
+
+// hashRecoveryCode returns the stored digest of a recovery code. Codes are
+// random, so a fast hash is enough and lets them be looked up directly.
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// twoFactor is a row of the two_factor table.
+type twoFactor struct {
+	Secret         string     `db:"secret"` // encrypted with the master key
+	Enabled        bool       `db:"enabled"`
+	LastStep       int64      `db:"last_step"`
+	FailedAttempts int        `db:"failed_attempts"`
+	LockedUntil    *time.Time `db:"locked_until"`
+}
+
+// locked reports whether too many invalid codes lock the second login step
+// at now.
+func (tf *twoFactor) locked(now time.Time) bool {
+	return tf.LockedUntil != nil && now.Before(*tf.LockedUntil)
+}
+
+// twoFactorStatus is the second factor state of an account.
+type twoFactorStatus struct {
+	Enabled       bool `json:"enabled"`
+	RecoveryCodes int  `json:"recovery_codes"` // unused recovery codes left
+}
+
+// loadTwoFactor returns the second factor of userID, or nil if there is none.
+func (a *App) loadTwoFactor(ctx context.Context, userID int64) (*twoFactor, error) {
+	var tf twoFactor
+	q := a.DB.Rebind("SELECT secret, enabled, last_step, failed_attempts, locked_until FROM two_factor WHERE user_id = ?")
+	if err := a.DB.GetContext(ctx, &tf, q, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &tf, nil
+}
+
+// twoFactorEnabled reports whether logging in as userID needs a second
+// factor.
+func (a *App) twoFactorEnabled(ctx context.Context, userID int64) (bool, error) {
+	tf, err := a.loadTwoFactor(ctx, userID)
+	return tf != nil && tf.Enabled, err
+}
+
+func (a *App) twoFactorStatus(ctx context.Context, userID int64) (twoFactorStatus, error) {
+	var st twoFactorStatus
+	enabled, err := a.twoFactorEnabled(ctx, userID)
+	if err != nil || !enabled {
+		return st, err
+	}
+	st.Enabled = true
+	q := a.DB.Rebind("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL")
+	err = a.DB.GetContext(ctx, &st.RecoveryCodes, q, userID)
+	return st, err
+}
+
+// acceptTOTP checks code against the secret of tf and records its time step,
+// so each code is accepted only once.
+func (a *App) acceptTOTP(ctx context.Context, userID int64, tf *twoFactor, code string) (bool, error) {
+	secret, err := a.Crypto.Decrypt(tf.Secret)
+	if err != nil {
+		return false, err
+	}
+	step, ok := matchTOTP(secret, code, time.Now())
+	if !ok || step <= tf.LastStep {
+		return false, nil
+	}
+	q := a.DB.Rebind("UPDATE two_factor SET last_step = ? WHERE user_id = ? AND last_step < ?")
+	res, err := a.DB.ExecContext(ctx, q, step, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// verifySecondFactor checks a TOTP code or an unused recovery code of
+// userID, using up the recovery code.
+func (a *App) verifySecondFactor(ctx context.Context, userID int64, code string) (bool, error) {
+	code = normalizeCode(code)
+	tf, err := a.loadTwoFactor(ctx, userID)
+	if err != nil || tf == nil || !tf.Enabled {
+		return false, err
+	}
+	if len(code) == totpDigits {
+		return a.acceptTOTP(ctx, userID, tf, code)
+	}
+	q := a.DB.Rebind("UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL")
+	res, err := a.DB.ExecContext(ctx, q, time.Now(), userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	if n == 1 {
+		slog.Info("recovery code used", "user_id", userID)
+	}
+	return n == 1, nil
+}
+
+// secondFactorLocked reports whether userID entered too many invalid codes
+// and has to wait before logging in again.
+func (a *App) secondFactorLocked(ctx context.Context, userID int64) (bool, error) {
+	tf, err := a.loadTwoFactor(ctx, userID)
+	return tf != nil && tf.locked(time.Now().UTC()), err
+}
+
+// recordSecondFactorFailure counts an invalid code of userID and reports
+// whether it locked the second login step. Locking starts the count over.
+func (a *App) recordSecondFactorFailure(ctx context.Context, userID int64) (bool, error) {
+	q := a.DB.Rebind("UPDATE two_factor SET failed_attempts = failed_attempts + 1 WHERE user_id = ?")
+	if _, err := a.DB.ExecContext(ctx, q, userID); err != nil {
+		return false, err
+	}
+	q = a.DB.Rebind("UPDATE two_factor SET failed_attempts = 0, locked_until = ? WHERE user_id = ? AND failed_attempts >= ?")
+	res, err := a.DB.ExecContext(ctx, q, time.Now().UTC().Add(secondFactorLockout), userID, maxSecondFactorFailures)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// resetSecondFactorFailures forgets the invalid codes of userID after a
+// successful login.
+func (a *App) resetSecondFactorFailures(ctx context.Context, userID int64) error {
+	q := a.DB.Rebind("UPDATE two_factor SET failed_attempts = 0, locked_until = NULL WHERE user_id = ?")
+	_, err := a.DB.ExecContext(ctx, q, userID)
+	return err
+}
+
+// removeTwoFactor deletes the second factor and recovery codes of userID.
+func removeTwoFactor(ctx context.Context, tx execer, userID int64) error {
+	if _, err := tx.ExecContext(ctx, tx.Rebind("DELETE FROM recovery_codes WHERE user_id = ?"), userID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, tx.Rebind("DELETE FROM two_factor WHERE user_id = ?"), userID)
+	return err
+}
+
+// execer is the part of sqlx.DB and sqlx.Tx used to run statements.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	Rebind(query string) string
+}
+
+// loginUser returns the logged-in account whose login settings are being
+// managed, or writes an error and returns nil: a 403 for API tokens, which
+// cannot change how their owner logs in, and a 422 when logins are disabled.
+func loginUser(w http.ResponseWriter, r *http.Request) *mm.User {
+	if viaToken(r.Context()) {
+		http.Error(w, "API tokens cannot manage accounts: log in instead", http.StatusForbidden)
+		return nil
+	}
+	u := currentUser(r.Context())
+	if u == nil {
+		http.Error(w, "logins are disabled: set MASTER_PASSWORD", http.StatusUnprocessableEntity)
+	}
+	return u
+}
+
+// twoFactorEnrollment is the response of TwoFactorHandler when enrollment
+// starts.
+type twoFactorEnrollment struct {
+	Secret string `json:"secret"` // base32, for typing into an app
+	URI    string `json:"uri"`
+	QR     string `json:"qr"` // the URI as an SVG QR code
+}
+
+// TwoFactorHandler returns the second factor status of the current user
+// (GET) or starts enrollment with a new TOTP secret (POST). The secret only
+// takes effect once a code from it is confirmed with
+// ConfirmTwoFactorHandler.
+func (a *App) TwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	u := loginUser(w, r)
+	if u == nil {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		st, err := a.twoFactorStatus(r.Context(), u.ID)
+		if err != nil {
+			slog.Error("failed to load two-factor status", "user_id", u.ID, "err", err)
+			http.Error(w, "failed to load two-factor status", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+	case http.MethodPost:
+		a.enrollTwoFactor(w, r, u.ID, u.Username)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *App) enrollTwoFactor(w http.ResponseWriter, r *http.Request, userID int64, username string) {
+	enabled, err := a.twoFactorEnabled(r.Context(), userID)
+	if err != nil {
+		slog.Error("failed to load two-factor status", "user_id", userID, "err", err)
+		http.Error(w, "failed to start enrollment: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		http.Error(w, "two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		http.Error(w, "failed to start enrollment: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	encrypted, err := a.Crypto.Encrypt(secret)
+	if err != nil {
+		slog.Error("failed to encrypt TOTP secret", "err", err)
+		http.Error(w, "failed to start enrollment: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = func() error {
+		tx, err := a.DB.BeginTxx(r.Context(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck
+		if err := removeTwoFactor(r.Context(), tx, userID); err != nil {
+			return err
+		}
+		q := tx.Rebind("INSERT INTO two_factor (user_id, secret, enabled, created_at) VALUES (?, ?, ?, ?)")
+		if _, err := tx.ExecContext(r.Context(), q, userID, encrypted, false, time.Now()); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		slog.Error("failed to store TOTP secret", "user_id", userID, "err", err)
+		http.Error(w, "failed to start enrollment: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	uri := totpURI(username, secret)
+	svg, err := qrSVG(uri)
+	if err != nil {
+		slog.Error("failed to render TOTP QR code", "err", err)
+		http.Error(w, "failed to render QR code", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("two-factor enrollment started", "user_id", userID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(twoFactorEnrollment{Secret: totpEncoding.EncodeToString(secret), URI: uri, QR: svg})
+}
+
+// ConfirmTwoFactorHandler enables the second factor enrolled with
+// TwoFactorHandler once "code" matches it, and returns the recovery codes.
+// They are stored hashed and shown only this once.
+func (a *App) ConfirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u := loginUser(w, r)
+	if u == nil {
+		return
+	}
+	tf, err := a.loadTwoFactor(r.Context(), u.ID)
+	if err != nil {
+		slog.Error("failed to load two-factor status", "user_id", u.ID, "err", err)
+		http.Error(w, "failed to confirm: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if tf == nil {
+		http.Error(w, "start enrollment first", http.StatusUnprocessableEntity)
+		return
+	}
+	if tf.Enabled {
+		http.Error(w, "two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	ok, err := a.acceptTOTP(r.Context(), u.ID, tf, normalizeCode(r.FormValue("code")))
+	if err != nil {
+		slog.Error("failed to verify TOTP code", "user_id", u.ID, "err", err)
+		http.Error(w, "failed to confirm: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "invalid code: check the time on your device and try the next code", http.StatusUnprocessableEntity)
+		return
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		if codes[i], err = newRecoveryCode(); err != nil {
+			http.Error(w, "failed to confirm: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	err = func() error {
+		tx, err := a.DB.BeginTxx(r.Context(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck
+		if _, err := tx.ExecContext(r.Context(), tx.Rebind("DELETE FROM recovery_codes WHERE user_id = ?"), u.ID); err != nil {
+			return err
+		}
+		for _, c := range codes {
+			if _, err := tx.ExecContext(r.Context(), tx.Rebind("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)"), u.ID, hashRecoveryCode(c)); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(r.Context(), tx.Rebind("UPDATE two_factor SET enabled = ? WHERE user_id = ?"), true, u.ID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		slog.Error("failed to enable two-factor authentication", "user_id", u.ID, "err", err)
+		http.Error(w, "failed to confirm: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("two-factor authentication enabled", "user_id", u.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// DisableTwoFactorHandler removes the second factor of the current user,
+// given a valid "code" or recovery code, or of account "id" when an
+// administrator resets it for a user who lost their device. A reset also
+// removes the user's passkeys.
+func (a *App) DisableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u := loginUser(w, r)
+	if u == nil {
+		return
+	}
+	id := u.ID
+	if s := r.FormValue("id"); s != "" {
+		var err error
+		if id, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(w, "invalid id", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if id != u.ID {
+		if !requireRole(w, r, RoleAdmin) {
+			return
+		}
+	} else {
+		ok, err := a.verifySecondFactor(r.Context(), id, r.FormValue("code"))
+		if err != nil {
+			slog.Error("failed to verify second factor", "user_id", id, "err", err)
+			http.Error(w, "failed to disable: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "invalid code", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	err := func() error {
+		tx, err := a.DB.BeginTxx(r.Context(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck
+		if err := removeTwoFactor(r.Context(), tx, id); err != nil {
+			return err
+		}
+		if id != u.ID {
+			if err := removePasskeys(r.Context(), tx, id); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		slog.Error("failed to disable two-factor authentication", "user_id", id, "err", err)
+		http.Error(w, "failed to disable: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("two-factor authentication disabled", "user_id", id, "by", u.ID)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
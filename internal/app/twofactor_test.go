@@ -0,0 +1,177 @@
+package app_test
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	apppkg "h-cloud.io/web-gpg/internal/app"
+)
+
+// TestTOTPCode verifies codes against the SHA-1 test vectors of RFC 6238,
+// truncated to six digits.
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	for unix, want := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		if got := apppkg.TOTPCode(secret, time.Unix(unix, 0)); got != want {
+			t.Errorf("TOTPCode at %d = %s, want %s", unix, got, want)
+		}
+	}
+}
+
+// secondStep posts code to AuthHandler with the second factor cookie from
+// the password step.
+func secondStep(a *apppkg.App, pending *http.Cookie, code string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(url.Values{"code": {code}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if pending != nil {
+		req.AddCookie(pending)
+	}
+	w := httptest.NewRecorder()
+	a.AuthHandler(w, req)
+	return w
+}
+
+func cookieNamed(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name && c.MaxAge >= 0 {
+			return c
+		}
+	}
+	return nil
+}
+
+// TestTwoFactorLogin verifies enrollment, that the auth cookie is only
+// issued after both factors, that codes cannot be replayed, that recovery
+// codes work once and that invalid codes lock the second step.
+func TestTwoFactorLogin(t *testing.T) {
+	a, db := setupTestApp(t)
+	bootstrap := login(t, a, "", "test-master-password")
+	as(a, bootstrap, a.UsersHandler, http.MethodPost, "/users", url.Values{"username": {"alice"}, "password": {"alice-password"}})
+	alice := login(t, a, "alice", "alice-password")
+
+	if w := as(a, alice, a.ConfirmTwoFactorHandler, http.MethodPost, "/2fa/confirm", url.Values{"code": {"123456"}}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("confirm before enrollment: expected 422, got %d", w.Code)
+	}
+	w := as(a, alice, a.TwoFactorHandler, http.MethodPost, "/2fa", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("enroll: %d %s", w.Code, w.Body.String())
+	}
+	var enrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+		QR     string `json:"qr"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &enrollment)
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/") || !strings.Contains(enrollment.QR, "<svg") {
+		t.Errorf("unexpected enrollment: %+v", enrollment)
+	}
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	if err != nil {
+		t.Fatalf("decode secret: %v", err)
+	}
+
+	// Until confirmed, the password alone still logs in.
+	login(t, a, "alice", "alice-password")
+
+	now := time.Now()
+	if w := as(a, alice, a.ConfirmTwoFactorHandler, http.MethodPost, "/2fa/confirm", url.Values{"code": {"abcdef"}}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("confirm with a wrong code: expected 422, got %d", w.Code)
+	}
+	code := apppkg.TOTPCode(secret, now)
+	w = as(a, alice, a.ConfirmTwoFactorHandler, http.MethodPost, "/2fa/confirm", url.Values{"code": {code}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("confirm: %d %s", w.Code, w.Body.String())
+	}
+	var result struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if len(result.RecoveryCodes) != 10 {
+		t.Fatalf("expected 10 recovery codes, got %d", len(result.RecoveryCodes))
+	}
+
+	password := postForm(a.AuthHandler, "/auth", url.Values{"username": {"alice"}, "password": {"alice-password"}})
+	if cookieNamed(password, "webgpg_auth") != nil || !strings.Contains(password.Body.String(), `name="code"`) {
+		t.Fatal("the password alone should no longer log in")
+	}
+	pending := cookieNamed(password, "webgpg_2fa")
+	if pending == nil {
+		t.Fatal("expected a second factor cookie")
+	}
+	passwordStep := func() *http.Cookie {
+		return cookieNamed(postForm(a.AuthHandler, "/auth", url.Values{"username": {"alice"}, "password": {"alice-password"}}), "webgpg_2fa")
+	}
+	tampered := *pending
+	tampered.Value += "x"
+	if w := secondStep(a, &tampered, code); cookieNamed(w, "webgpg_auth") != nil {
+		t.Error("a tampered second factor cookie should not log in")
+	}
+	if w := secondStep(a, nil, code); cookieNamed(w, "webgpg_auth") != nil {
+		t.Error("a code without the password step should not log in")
+	}
+	if w := secondStep(a, pending, code); cookieNamed(w, "webgpg_auth") != nil || !strings.Contains(w.Body.String(), "invalid code") {
+		t.Error("a code already used should be refused")
+	}
+	next := apppkg.TOTPCode(secret, now.Add(30*time.Second))
+	if w := secondStep(a, pending, next); cookieNamed(w, "webgpg_auth") != nil {
+		t.Error("the second factor cookie should only allow one attempt")
+	}
+	w = secondStep(a, passwordStep(), next)
+	if w.Code != http.StatusSeeOther || cookieNamed(w, "webgpg_auth") == nil {
+		t.Fatalf("second factor login: %d %s", w.Code, w.Body.String())
+	}
+
+	recovery := strings.ToUpper(result.RecoveryCodes[0])
+	if w := secondStep(a, passwordStep(), recovery); cookieNamed(w, "webgpg_auth") == nil {
+		t.Error("a recovery code should log in")
+	}
+	if w := secondStep(a, passwordStep(), recovery); cookieNamed(w, "webgpg_auth") != nil {
+		t.Error("a recovery code should only work once")
+	}
+	if w := as(a, alice, a.TwoFactorHandler, http.MethodGet, "/2fa", nil); !strings.Contains(w.Body.String(), `"recovery_codes":9`) {
+		t.Errorf("status after using a recovery code: %s", w.Body.String())
+	}
+
+	var failures int
+	db.Get(&failures, "SELECT failed_attempts FROM two_factor")
+	if failures != 1 {
+		t.Fatalf("expected the reused recovery code to count as a failure, got %d", failures)
+	}
+	for i := 2; i <= 5; i++ {
+		w := secondStep(a, passwordStep(), "wrong-code")
+		if locked := strings.Contains(w.Body.String(), "too many invalid codes"); locked != (i == 5) {
+			t.Fatalf("after %d invalid codes: locked %v", i, locked)
+		}
+	}
+	locked := postForm(a.AuthHandler, "/auth", url.Values{"username": {"alice"}, "password": {"alice-password"}})
+	if cookieNamed(locked, "webgpg_2fa") != nil || !strings.Contains(locked.Body.String(), "too many invalid codes") {
+		t.Error("a locked second factor should refuse the password step")
+	}
+	db.Exec("UPDATE two_factor SET locked_until = ?", time.Now().UTC().Add(-time.Minute))
+	if w := secondStep(a, passwordStep(), result.RecoveryCodes[1]); cookieNamed(w, "webgpg_auth") == nil {
+		t.Fatalf("login after the lock ran out: %d %s", w.Code, w.Body.String())
+	}
+	db.Get(&failures, "SELECT failed_attempts FROM two_factor")
+	if failures != 0 {
+		t.Errorf("a login should reset the invalid code count, got %d", failures)
+	}
+
+	if w := as(a, alice, a.DisableTwoFactorHandler, http.MethodPost, "/2fa/disable", url.Values{"code": {"wrong-code"}}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("disable with a wrong code: expected 422, got %d", w.Code)
+	}
+	if w := as(a, alice, a.DisableTwoFactorHandler, http.MethodPost, "/2fa/disable", url.Values{"code": {result.RecoveryCodes[2]}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("disable: %d %s", w.Code, w.Body.String())
+	}
+	login(t, a, "alice", "alice-password")
+}
@@ -0,0 +1,370 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	mm "h-cloud.io/web-gpg/internal/models"
+)
+
+// minUserPasswordLength is the shortest accepted account password.
+const minUserPasswordLength = 8
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	tokenContextKey
+	sessionContextKey
+)
+
+// bootstrapAdmin is the user logged in with the master password while no
+// accounts exist yet. It can create the first accounts; once one exists the
+// master password no longer logs in.
+var bootstrapAdmin = &mm.User{Username: "admin", Role: RoleAdmin}
+
+// withUser returns a copy of ctx carrying the user making the request.
+func withUser(ctx context.Context, u *mm.User) context.Context {
+	return context.WithValue(ctx, userContextKey, u)
+}
+
+// currentUser returns the user making the request, or nil when
+// authentication is disabled and every request may use every key.
+func currentUser(ctx context.Context) *mm.User {
+	u, _ := ctx.Value(userContextKey).(*mm.User)
+	return u
+}
+
+// keyScope returns a condition on the keys table restricting a query to the
+// keys the current user may use — their own keys and the shared keyring —
+// and its arguments. With owned set, only keys the user may change are
+// selected: their own, or any visible key for administrators.
+func keyScope(ctx context.Context, owned bool) (string, []interface{}) {
+	u := currentUser(ctx)
+	if u == nil || u.ID == 0 {
+		return "1 = 1", nil
+	}
+	if owned && u.Role != RoleAdmin {
+		return "owner_id = ?", []interface{}{u.ID}
+	}
+	return "(owner_id IS NULL OR shared = ? OR owner_id = ?)", []interface{}{true, u.ID}
+}
+
+// keyOwner returns the owner and initial shared flag for a key added by the
+// current user. Keys added without an account go to the shared keyring.
+func keyOwner(ctx context.Context) (*int64, bool) {
+	u := currentUser(ctx)
+	if u == nil || u.ID == 0 {
+		return nil, true
+	}
+	id := u.ID
+	return &id, false
+}
+
+// countUsers returns the number of accounts.
+func (a *App) countUsers(ctx context.Context) (int, error) {
+	var n int
+	err := a.DB.GetContext(ctx, &n, "SELECT COUNT(*) FROM users")
+	return n, err
+}
+
+// loadUser returns the account with the given id or username.
+func (a *App) loadUser(ctx context.Context, column string, value interface{}) (*mm.User, error) {
+	var u mm.User
+	q := a.DB.Rebind("SELECT id, username, password_hash, role, created_at FROM users WHERE " + column + " = ?")
+	if err := a.DB.GetContext(ctx, &u, q, value); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// validUsername reports whether name can be used as a login name.
+func validUsername(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.ContainsRune("._-@", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// UsersHandler lists the accounts (GET) or creates one from "username",
+// "password" and "role", which defaults to viewer (POST).
+func (a *App) UsersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		users, err := a.loadUsers(r.Context())
+		if err != nil {
+			slog.Error("failed to load users", "err", err)
+			http.Error(w, "failed to load users", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(users)
+	case http.MethodPost:
+		a.createUser(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// loadUsers returns all accounts ordered by username.
+func (a *App) loadUsers(ctx context.Context) ([]mm.User, error) {
+	users := []mm.User{}
+	err := a.DB.SelectContext(ctx, &users, "SELECT id, username, password_hash, role, created_at FROM users ORDER BY username")
+	return users, err
+}
+
+func (a *App) createUser(w http.ResponseWriter, r *http.Request) {
+	username := strings.ToLower(strings.TrimSpace(r.FormValue("username")))
+	if !validUsername(username) {
+		http.Error(w, "invalid username: use up to 64 lowercase letters, digits and . _ - @", http.StatusUnprocessableEntity)
+		return
+	}
+	password := r.FormValue("password")
+	if len(password) < minUserPasswordLength {
+		http.Error(w, "password must be at least "+strconv.Itoa(minUserPasswordLength)+" characters", http.StatusUnprocessableEntity)
+		return
+	}
+	role := r.FormValue("role")
+	if role == "" {
+		role = RoleViewer
+	}
+	if roleRank(role) < 0 {
+		http.Error(w, "invalid role: expected viewer, encryptor, decryptor or admin", http.StatusUnprocessableEntity)
+		return
+	}
+	n, err := a.countUsers(r.Context())
+	if err != nil {
+		slog.Error("failed to count users", "err", err)
+		http.Error(w, "failed to create user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		// The first account replaces the master password login and must be
+		// able to manage the others.
+		role = RoleAdmin
+	}
+	if _, err := a.loadUser(r.Context(), "username", username); err == nil {
+		http.Error(w, "username already taken", http.StatusConflict)
+		return
+	}
+	hash, err := bcryptPassphrase(password)
+	if err != nil {
+		slog.Error("failed to hash user password", "err", err)
+		http.Error(w, "failed to create user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	q := a.DB.Rebind("INSERT INTO users (username, password_hash, role, created_at) VALUES (?, ?, ?, ?)")
+	if _, err := a.DB.ExecContext(r.Context(), q, username, hash, role, time.Now()); err != nil {
+		slog.Error("failed to create user", "username", username, "err", err)
+		http.Error(w, "failed to create user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("user created", "username", username, "role", role)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// DeleteUserHandler removes the account "id". Its keys are handed to the
+// administrator deleting it, or to the oldest other administrator when the
+// master password login deletes it, keeping private keys private. An account
+// is not deleted while there is no administrator to take its keys, and
+// administrators cannot delete themselves.
+func (a *App) DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "missing or invalid id", http.StatusUnprocessableEntity)
+		return
+	}
+	var heir int64
+	if u := currentUser(r.Context()); u != nil && u.ID != 0 {
+		if u.ID == id {
+			http.Error(w, "you cannot delete your own account", http.StatusUnprocessableEntity)
+			return
+		}
+		heir = u.ID
+	} else {
+		q := a.DB.Rebind("SELECT id FROM users WHERE role = ? AND id <> ? ORDER BY id LIMIT 1")
+		err := a.DB.GetContext(r.Context(), &heir, q, RoleAdmin, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "no other administrator can take over the account's keys", http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to find an administrator for the keys of a deleted user", "user_id", id, "err", err)
+			http.Error(w, "failed to delete user: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	err = func() error {
+		tx, err := a.DB.BeginTxx(r.Context(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck
+		res, err := tx.ExecContext(r.Context(), tx.Rebind("DELETE FROM users WHERE id = ?"), id)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return sql.ErrNoRows
+		}
+		if _, err := tx.ExecContext(r.Context(), tx.Rebind("UPDATE keys SET owner_id = ? WHERE owner_id = ?"), heir, id); err != nil {
+			return err
+		}
+		if err := movePins(r.Context(), tx, id, &heir); err != nil {
+			return err
+		}
+		if err := removeTwoFactor(r.Context(), tx, id); err != nil {
+			return err
+		}
+		if err := removePasskeys(r.Context(), tx, id); err != nil {
+			return err
+		}
+		if err := removeAPITokens(r.Context(), tx, id); err != nil {
+			return err
+		}
+		if err := removeSessions(r.Context(), tx, id, 0); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to delete user", "user_id", id, "err", err)
+		http.Error(w, "failed to delete user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("user deleted", "user_id", id)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// UserPasswordHandler sets the password of account "id". Users may change
+// their own password by giving the current one in "current_password";
+// administrators may reset anyone else's without it. The account is
+// logged out everywhere else, keeping only the session of users who change
+// their own password. API tokens cannot set passwords.
+func (a *App) UserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if viaToken(r.Context()) {
+		http.Error(w, "API tokens cannot manage accounts: log in instead", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "missing or invalid id", http.StatusUnprocessableEntity)
+		return
+	}
+	var keep int64
+	if u := currentUser(r.Context()); u != nil && u.ID == id {
+		if !matchPassphrase(u.PasswordHash, r.FormValue("current_password")) {
+			slog.Warn("password change refused: invalid current password", "user_id", id, "ip", r.RemoteAddr)
+			http.Error(w, "current password is incorrect", http.StatusForbidden)
+			return
+		}
+		keep = currentSession(r.Context())
+	} else if u != nil && !requireRole(w, r, RoleAdmin) {
+		return
+	}
+	password := r.FormValue("password")
+	if len(password) < minUserPasswordLength {
+		http.Error(w, "password must be at least "+strconv.Itoa(minUserPasswordLength)+" characters", http.StatusUnprocessableEntity)
+		return
+	}
+	hash, err := bcryptPassphrase(password)
+	if err != nil {
+		slog.Error("failed to hash user password", "err", err)
+		http.Error(w, "failed to set password: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = func() error {
+		tx, err := a.DB.BeginTxx(r.Context(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck
+		res, err := tx.ExecContext(r.Context(), tx.Rebind("UPDATE users SET password_hash = ? WHERE id = ?"), hash, id)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return sql.ErrNoRows
+		}
+		if err := removeSessions(r.Context(), tx, id, keep); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to set user password", "user_id", id, "err", err)
+		http.Error(w, "failed to set password: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("user password changed", "user_id", id)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// UserRoleHandler sets the role of account "id". Administrators cannot
+// change their own role, so there is always one left.
+func (a *App) UserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "missing or invalid id", http.StatusUnprocessableEntity)
+		return
+	}
+	role := r.FormValue("role")
+	if roleRank(role) < 0 {
+		http.Error(w, "invalid role: expected viewer, encryptor, decryptor or admin", http.StatusUnprocessableEntity)
+		return
+	}
+	if u := currentUser(r.Context()); u != nil && u.ID == id {
+		http.Error(w, "you cannot change your own role", http.StatusUnprocessableEntity)
+		return
+	}
+	res, err := a.DB.ExecContext(r.Context(), a.DB.Rebind("UPDATE users SET role = ? WHERE id = ?"), role, id)
+	if err != nil {
+		slog.Error("failed to set user role", "user_id", id, "err", err)
+		http.Error(w, "failed to set role: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	slog.Info("user role changed", "user_id", id, "role", role)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// ShareKeyHandler moves a key between its owner's private keyring and the
+// shared keyring. "shared" defaults to true; "false" or "0" makes it private.
+func (a *App) ShareKeyHandler(w http.ResponseWriter, r *http.Request) {
+	a.setKeyFlag(w, r, "shared")
+}
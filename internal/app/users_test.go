@@ -0,0 +1,215 @@
+package app_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	apppkg "h-cloud.io/web-gpg/internal/app"
+)
+
+// login posts credentials to AuthHandler and returns the auth cookie.
+func login(t *testing.T, a *apppkg.App, username, password string) *http.Cookie {
+	t.Helper()
+	w := postForm(a.AuthHandler, "/auth", url.Values{"username": {username}, "password": {password}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("login %q: expected 303, got %d: %s", username, w.Code, w.Body.String())
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "webgpg_auth" {
+			return c
+		}
+	}
+	t.Fatalf("login %q: no auth cookie", username)
+	return nil
+}
+
+// as calls handler through WithAuth with the given auth cookie.
+func as(a *apppkg.App, c *http.Cookie, handler http.HandlerFunc, method, path string, form url.Values) *httptest.ResponseRecorder {
+	var req *http.Request
+	if method == http.MethodPost {
+		req = httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, path, nil)
+	}
+	req.AddCookie(c)
+	w := httptest.NewRecorder()
+	a.WithAuth(handler)(w, req)
+	return w
+}
+
+// TestUserAccounts verifies the master password only logs in until the
+// first account exists, and that accounts are managed by administrators.
+func TestUserAccounts(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	bootstrap := login(t, a, "", "test-master-password")
+	if w := as(a, bootstrap, a.UsersHandler, http.MethodPost, "/users", url.Values{"username": {"Alice"}, "password": {"alice-password"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("create first user: %d %s", w.Code, w.Body.String())
+	}
+	var role string
+	db.Get(&role, "SELECT role FROM users WHERE username = 'alice'")
+	if role != apppkg.RoleAdmin {
+		t.Error("the first account should be an administrator")
+	}
+
+	if w := as(a, bootstrap, a.IndexHandler, http.MethodGet, "/", nil); !strings.Contains(w.Body.String(), `name="username"`) {
+		t.Error("the master password login should end once an account exists")
+	}
+	if w := postForm(a.AuthHandler, "/auth", url.Values{"password": {"test-master-password"}}); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "invalid username or password") {
+		t.Errorf("master password login with accounts: %d", w.Code)
+	}
+	if w := postForm(a.AuthHandler, "/auth", url.Values{"username": {"alice"}, "password": {"wrong-password"}}); !strings.Contains(w.Body.String(), "invalid username or password") {
+		t.Error("wrong password should be refused")
+	}
+
+	alice := login(t, a, "Alice", "alice-password")
+	if w := as(a, alice, a.IndexHandler, http.MethodGet, "/", nil); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Add User") {
+		t.Fatalf("admin index: %d", w.Code)
+	}
+	for _, tc := range []struct {
+		form string
+		code int
+	}{
+		{"username=bob&password=bob-password", http.StatusSeeOther},
+		{"username=bob&password=other-password", http.StatusConflict},
+		{"username=carol&password=short", http.StatusUnprocessableEntity},
+		{"username=no+spaces&password=long-enough", http.StatusUnprocessableEntity},
+	} {
+		values, _ := url.ParseQuery(tc.form)
+		if w := as(a, alice, a.UsersHandler, http.MethodPost, "/users", values); w.Code != tc.code {
+			t.Errorf("create %s: expected %d, got %d", tc.form, tc.code, w.Code)
+		}
+	}
+
+	bob := login(t, a, "bob", "bob-password")
+	var bobID, aliceID int64
+	db.Get(&bobID, "SELECT id FROM users WHERE username = 'bob'")
+	db.Get(&aliceID, "SELECT id FROM users WHERE username = 'alice'")
+	if w := as(a, bob, apppkg.RequireRole(apppkg.RoleAdmin, a.UsersHandler), http.MethodGet, "/users", nil); w.Code != http.StatusForbidden {
+		t.Errorf("non-admin listing users: expected 403, got %d", w.Code)
+	}
+	if w := as(a, bob, a.IndexHandler, http.MethodGet, "/", nil); strings.Contains(w.Body.String(), "Add User") {
+		t.Error("non-admins should not see user management")
+	}
+	if w := as(a, bob, a.UserPasswordHandler, http.MethodPost, "/users/password", url.Values{"id": {fmt.Sprint(aliceID)}, "password": {"hijacked-password"}}); w.Code != http.StatusForbidden {
+		t.Errorf("changing another user's password: expected 403, got %d", w.Code)
+	}
+	for _, current := range []string{"", "wrong-password"} {
+		if w := as(a, bob, a.UserPasswordHandler, http.MethodPost, "/users/password", url.Values{"id": {fmt.Sprint(bobID)}, "current_password": {current}, "password": {"stolen-bob-password"}}); w.Code != http.StatusForbidden {
+			t.Errorf("changing own password with current password %q: expected 403, got %d", current, w.Code)
+		}
+	}
+	login(t, a, "bob", "bob-password")
+	if w := as(a, bob, a.UserPasswordHandler, http.MethodPost, "/users/password", url.Values{"id": {fmt.Sprint(bobID)}, "current_password": {"bob-password"}, "password": {"new-bob-password"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("changing own password: %d %s", w.Code, w.Body.String())
+	}
+	login(t, a, "bob", "new-bob-password")
+
+	if w := as(a, alice, a.DeleteUserHandler, http.MethodPost, "/users/delete", url.Values{"id": {fmt.Sprint(aliceID)}}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("deleting yourself: expected 422, got %d", w.Code)
+	}
+	if w := as(a, alice, a.DeleteUserHandler, http.MethodPost, "/users/delete", url.Values{"id": {fmt.Sprint(bobID)}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("delete bob: %d %s", w.Code, w.Body.String())
+	}
+	if w := as(a, bob, a.ViewKeyHandler, http.MethodGet, "/keys/view?id=1", nil); w.Code != http.StatusSeeOther {
+		t.Errorf("a deleted user's cookie should no longer authenticate, got %d", w.Code)
+	}
+}
+
+// TestPerUserKeyrings verifies keys are personal to the user who added them
+// until shared, and that keys from before accounts existed stay shared.
+func TestPerUserKeyrings(t *testing.T) {
+	a, db := setupTestApp(t)
+	bootstrap := login(t, a, "", "test-master-password")
+	as(a, bootstrap, a.UsersHandler, http.MethodPost, "/users", url.Values{"username": {"alice"}, "password": {"alice-password"}})
+	alice := login(t, a, "alice", "alice-password")
+	as(a, alice, a.UsersHandler, http.MethodPost, "/users", url.Values{"username": {"bob"}, "password": {"bob-password"}})
+	bob := login(t, a, "bob", "bob-password")
+
+	legacy := generateTestKey(t, "Legacy", "legacy@example.com", "")
+	legacyPub, _ := legacy.GetArmoredPublicKey()
+	db.MustExec("INSERT INTO keys (name, armored, is_private, fingerprint, created_at) VALUES (?, ?, ?, ?, ?)",
+		"legacy", legacyPub, false, legacy.GetFingerprint(), time.Now())
+
+	personal := generateTestKey(t, "Alice Personal", "alice@example.com", "")
+	personalArmored, _ := personal.Armor()
+	if w := as(a, alice, a.AddKeyHandler, http.MethodPost, "/keys", url.Values{"name": {"alice-personal"}, "armored": {personalArmored}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("alice adds key: %d %s", w.Code, w.Body.String())
+	}
+	var keyID int64
+	db.Get(&keyID, "SELECT id FROM keys WHERE name = 'alice-personal'")
+	id := url.Values{"id": {fmt.Sprint(keyID)}}
+
+	if body := as(a, bob, a.IndexHandler, http.MethodGet, "/", nil).Body.String(); strings.Contains(body, "alice-personal") || !strings.Contains(body, "legacy") {
+		t.Error("bob should see the shared keyring but not alice's personal key")
+	}
+	if body := as(a, alice, a.IndexHandler, http.MethodGet, "/", nil).Body.String(); !strings.Contains(body, "alice-personal") || !strings.Contains(body, "Personal") {
+		t.Error("alice should see her personal key")
+	}
+	if w := as(a, bob, a.ViewKeyHandler, http.MethodGet, "/keys/view?id="+fmt.Sprint(keyID), nil); w.Code != http.StatusNotFound {
+		t.Errorf("bob viewing alice's key: expected 404, got %d", w.Code)
+	}
+	if w := as(a, bob, a.EncryptHandler, http.MethodPost, "/encrypt", url.Values{"key": {fmt.Sprint(keyID)}, "input": {"hi"}}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("bob encrypting to alice's key: expected 422, got %d", w.Code)
+	}
+	if w := as(a, bob, a.EncryptHandler, http.MethodPost, "/encrypt", url.Values{"recipients": {"alice@example.com"}, "input": {"hi"}}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("bob encrypting to alice's pinned personal key: expected 422, got %d", w.Code)
+	}
+	if w := as(a, bob, a.ShareKeyHandler, http.MethodPost, "/keys/share", id); w.Code != http.StatusNotFound {
+		t.Errorf("bob sharing alice's key: expected 404, got %d", w.Code)
+	}
+
+	if w := as(a, alice, a.ShareKeyHandler, http.MethodPost, "/keys/share", id); w.Code != http.StatusSeeOther {
+		t.Fatalf("alice shares key: %d %s", w.Code, w.Body.String())
+	}
+	if body := as(a, bob, a.IndexHandler, http.MethodGet, "/", nil).Body.String(); !strings.Contains(body, "alice-personal") || !strings.Contains(body, "added by alice") {
+		t.Error("bob should see the shared key and who added it")
+	}
+	if w := as(a, bob, a.EncryptHandler, http.MethodPost, "/encrypt", url.Values{"key": {fmt.Sprint(keyID)}, "input": {"hi"}}); w.Code != http.StatusOK {
+		t.Errorf("bob encrypting to the shared key: expected 200, got %d", w.Code)
+	}
+	if w := as(a, bob, a.DeleteKeyHandler, http.MethodPost, "/keys/delete", id); w.Code != http.StatusNotFound {
+		t.Errorf("bob deleting alice's shared key: expected 404, got %d", w.Code)
+	}
+	if w := as(a, alice, a.DeleteKeyHandler, http.MethodPost, "/keys/delete", id); w.Code != http.StatusSeeOther {
+		t.Errorf("alice deleting her key: expected 303, got %d", w.Code)
+	}
+
+	// Keys of deleted users go to the administrator who deleted them.
+	bobsKey := generateTestKey(t, "Bob", "bob@example.com", "")
+	bobsPub, _ := bobsKey.GetArmoredPublicKey()
+	as(a, bob, a.AddKeyHandler, http.MethodPost, "/keys", url.Values{"name": {"bobs-key"}, "armored": {bobsPub}})
+	var bobID int64
+	db.Get(&bobID, "SELECT id FROM users WHERE username = 'bob'")
+	as(a, alice, a.DeleteUserHandler, http.MethodPost, "/users/delete", url.Values{"id": {fmt.Sprint(bobID)}})
+	if body := as(a, alice, a.IndexHandler, http.MethodGet, "/", nil).Body.String(); !strings.Contains(body, "bobs-key") {
+		t.Error("alice should inherit the keys of the user she deleted")
+	}
+
+	// Without a logged-in account there is no keyring to hand the keys to:
+	// an administrator inherits them instead of the shared keyring.
+	as(a, alice, a.UsersHandler, http.MethodPost, "/users", url.Values{"username": {"carol"}, "password": {"carol-password"}})
+	carol := login(t, a, "carol", "carol-password")
+	carolsKey, _ := generateTestKey(t, "Carol", "carol@example.com", "").Armor()
+	as(a, carol, a.AddKeyHandler, http.MethodPost, "/keys", url.Values{"name": {"carols-key"}, "armored": {carolsKey}})
+	var carolID, aliceID int64
+	db.Get(&carolID, "SELECT id FROM users WHERE username = 'carol'")
+	db.Get(&aliceID, "SELECT id FROM users WHERE username = 'alice'")
+	if w := postForm(a.DeleteUserHandler, "/users/delete", url.Values{"id": {fmt.Sprint(carolID)}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("delete carol without an account: %d %s", w.Code, w.Body.String())
+	}
+	var owner *int64
+	db.Get(&owner, "SELECT owner_id FROM keys WHERE name = 'carols-key'")
+	if owner == nil || *owner != aliceID {
+		t.Errorf("carol's key should go to alice, owner is %v", owner)
+	}
+	if w := postForm(a.DeleteUserHandler, "/users/delete", url.Values{"id": {fmt.Sprint(aliceID)}}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("deleting the last administrator without an account: expected 422, got %d", w.Code)
+	}
+}
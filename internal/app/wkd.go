@@ -0,0 +1,216 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v3/crypto"
+
+	kf "h-cloud.io/web-gpg/internal/keyfetch"
+)
+
+// wkdPrefix is the path under which the Web Key Directory is served.
+const wkdPrefix = "/.well-known/openpgpkey/"
+
+// splitEmail splits an address into local part and lower-cased domain.
+func splitEmail(email string) (local, domain string, ok bool) {
+	i := strings.LastIndex(email, "@")
+	if i <= 0 || i == len(email)-1 {
+		return "", "", false
+	}
+	return email[:i], strings.ToLower(email[i+1:]), true
+}
+
+// publishedKey is a key from the keys table with the published flag set.
+type publishedKey struct {
+	ID        int64
+	Key       *crypto.Key
+	CreatedAt time.Time
+}
+
+// publishedKeysFor returns the published keys with at least one user ID
+// address accepted by match, newest first. Addresses are passed lower-cased.
+func (a *App) publishedKeysFor(ctx context.Context, match func(email string) bool) ([]publishedKey, error) {
+	var rows []struct {
+		ID        int64     `db:"id"`
+		Armored   string    `db:"armored"`
+		CreatedAt time.Time `db:"created_at"`
+	}
+	q := a.DB.Rebind("SELECT id, armored, created_at FROM keys WHERE published = ? ORDER BY created_at DESC, id DESC")
+	if err := a.DB.SelectContext(ctx, &rows, q, true); err != nil {
+		return nil, err
+	}
+	var keys []publishedKey
+	for _, row := range rows {
+		k, err := crypto.NewKeyFromArmored(row.Armored)
+		if err != nil {
+			slog.Warn("skipping unparsable published key", "key_id", row.ID, "err", err)
+			continue
+		}
+		for _, email := range keyEmails(k) {
+			if match(email) {
+				keys = append(keys, publishedKey{ID: row.ID, Key: k, CreatedAt: row.CreatedAt})
+				break
+			}
+		}
+	}
+	return keys, nil
+}
+
+// pinnedFirst moves the keys pinned for email, in any keyring, to the front
+// of keys.
+func (a *App) pinnedFirst(ctx context.Context, keys []publishedKey, email string) error {
+	var ids []int64
+	if err := a.DB.SelectContext(ctx, &ids, a.DB.Rebind("SELECT key_id FROM identity_pins WHERE email = ?"), email); err != nil {
+		return err
+	}
+	pinned := map[int64]bool{}
+	for _, id := range ids {
+		pinned[id] = true
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return pinned[keys[i].ID] && !pinned[keys[j].ID] })
+	return nil
+}
+
+// ParseDomainList parses the WKD_DOMAINS env value, a comma or space
+// separated list of mail domains.
+func ParseDomainList(s string) []string {
+	var domains []string
+	for _, d := range splitList(s) {
+		domains = append(domains, strings.ToLower(strings.TrimSuffix(d, ".")))
+	}
+	return domains
+}
+
+// wkdDomainAllowed reports whether the directory serves domain.
+func (a *App) wkdDomainAllowed(domain string) bool {
+	if len(a.WKDDomains) == 0 {
+		return domain != ""
+	}
+	for _, d := range a.WKDDomains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// WKDHandler serves published keys as a Web Key Directory, in both the
+// direct layout (/.well-known/openpgpkey/hu/<hash>, domain taken from the
+// Host header) and the advanced layout
+// (/.well-known/openpgpkey/<domain>/hu/<hash>, served on openpgpkey.<domain>),
+// plus the policy file of each. It is public and must not be wrapped in
+// WithAuth.
+//
+// When several published keys carry the address they are returned
+// concatenated, the pinned key first, so clients see replaced and rotated
+// keys. User IDs for other addresses are stripped from the returned keys.
+func (a *App) WKDHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, wkdPrefix), "/")
+	var domain, hash string
+	isPolicy := false
+	switch {
+	case len(parts) == 1 && parts[0] == "policy":
+		domain, isPolicy = requestDomain(r), true
+	case len(parts) == 2 && parts[0] == "hu":
+		domain, hash = requestDomain(r), parts[1]
+	case len(parts) == 2 && parts[1] == "policy":
+		domain, isPolicy = strings.ToLower(parts[0]), true
+	case len(parts) == 3 && parts[1] == "hu":
+		domain, hash = strings.ToLower(parts[0]), parts[2]
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if !a.wkdDomainAllowed(domain) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if isPolicy {
+		// An empty policy file announces WKD support without any flags.
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		return
+	}
+	if !kf.IsWKDHash(hash) {
+		http.NotFound(w, r)
+		return
+	}
+
+	localHint := strings.ToLower(r.URL.Query().Get("l"))
+	var email string
+	keys, err := a.publishedKeysFor(r.Context(), func(e string) bool {
+		local, d, ok := splitEmail(e)
+		if !ok || d != domain || kf.WKDHash(local) != hash || (localHint != "" && local != localHint) {
+			return false
+		}
+		email = e
+		return true
+	})
+	if err != nil {
+		slog.Error("wkd: failed to load published keys", "domain", domain, "err", err)
+		http.Error(w, "failed to load keys", http.StatusInternalServerError)
+		return
+	}
+	if len(keys) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if err := a.pinnedFirst(r.Context(), keys, email); err != nil {
+		slog.Warn("wkd: failed to look up pinned key", "email", email, "err", err)
+	}
+
+	var buf bytes.Buffer
+	for _, pk := range keys {
+		if err := serializeForAddress(&buf, pk.Key, email); err != nil {
+			slog.Error("wkd: failed to serialize key", "key_id", pk.ID, "err", err)
+			http.Error(w, "failed to serialize key", http.StatusInternalServerError)
+			return
+		}
+	}
+	slog.Debug("wkd: served keys", "email", email, "keys", len(keys))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+}
+
+// serializeForAddress writes the binary public key of k with only the user
+// IDs for email.
+func serializeForAddress(buf *bytes.Buffer, k *crypto.Key, email string) error {
+	e := k.GetEntity()
+	for name, ident := range e.Identities {
+		if ident.UserId == nil || !strings.EqualFold(strings.TrimSpace(ident.UserId.Email), email) {
+			delete(e.Identities, name)
+		}
+	}
+	return e.Serialize(buf)
+}
+
+// requestDomain returns the lower-cased request host without port.
+func requestDomain(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// PublishKeyHandler sets whether a key is published through the public key
+// distribution endpoints. "published" defaults to true; "false" or "0"
+// withdraws the key.
+func (a *App) PublishKeyHandler(w http.ResponseWriter, r *http.Request) {
+	a.setKeyFlag(w, r, "published")
+}
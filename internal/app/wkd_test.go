@@ -0,0 +1,138 @@
+package app_test
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	openpgp "github.com/ProtonMail/go-crypto/openpgp/v2"
+	gcrypto "github.com/ProtonMail/gopenpgp/v3/crypto"
+
+	apppkg "h-cloud.io/web-gpg/internal/app"
+)
+
+// joeHash is the WKD hash of "Joe.Doe" from the WKD specification.
+const joeHash = "iy9q119eutrkn8s1mk4r39qejnbu3n5q"
+
+// wkdGet requests path from the WKD handler with the given Host header.
+func wkdGet(handler http.HandlerFunc, host, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Host = host
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+// addPublishedKey stores the public part of k and publishes it.
+func addPublishedKey(t *testing.T, a *apppkg.App, name string, k *gcrypto.Key, extra url.Values) int64 {
+	t.Helper()
+	pub, _ := k.GetArmoredPublicKey()
+	form := url.Values{"name": {name}, "armored": {pub}}
+	for key, v := range extra {
+		form[key] = v
+	}
+	if w := postForm(a.AddKeyHandler, "/keys", form); w.Code != http.StatusSeeOther {
+		t.Fatalf("add %s: expected 303, got %d: %s", name, w.Code, w.Body.String())
+	}
+	var id int64
+	a.DB.Get(&id, "SELECT id FROM keys WHERE name = ?", name)
+	if w := postForm(a.PublishKeyHandler, "/keys/publish", url.Values{"id": {fmt.Sprint(id)}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("publish %s: expected 303, got %d: %s", name, w.Code, w.Body.String())
+	}
+	return id
+}
+
+// TestWKDHandler verifies published keys are served in both layouts, with
+// user IDs for other addresses stripped, and unpublished keys are not.
+func TestWKDHandler(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	handle := gcrypto.PGP().KeyGeneration().AddUserId("Joe Doe", "Joe.Doe@Example.ORG").AddUserId("Joe Private", "joe@home.example").New()
+	joe, err := handle.GenerateKey()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	pub, _ := joe.GetArmoredPublicKey()
+	postForm(a.AddKeyHandler, "/keys", url.Values{"name": {"joe"}, "armored": {pub}})
+
+	advanced := "/.well-known/openpgpkey/example.org/hu/" + joeHash + "?l=Joe.Doe"
+	if w := wkdGet(a.WKDHandler, "openpgpkey.example.org", advanced); w.Code != http.StatusNotFound {
+		t.Fatalf("unpublished key: expected 404, got %d", w.Code)
+	}
+
+	var id int64
+	db.Get(&id, "SELECT id FROM keys WHERE name = 'joe'")
+	postForm(a.PublishKeyHandler, "/keys/publish", url.Values{"id": {fmt.Sprint(id)}})
+
+	w := wkdGet(a.WKDHandler, "openpgpkey.example.org", advanced)
+	if w.Code != http.StatusOK {
+		t.Fatalf("advanced layout: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Error("expected CORS header on WKD response")
+	}
+	entities, err := openpgp.ReadKeyRing(bytes.NewReader(w.Body.Bytes()))
+	if err != nil || len(entities) != 1 {
+		t.Fatalf("expected one binary key, got %d (%v)", len(entities), err)
+	}
+	if entities[0].PrivateKey != nil {
+		t.Error("WKD must never serve private key material")
+	}
+	if len(entities[0].Identities) != 1 {
+		t.Errorf("expected only the matching user ID, got %d identities", len(entities[0].Identities))
+	}
+
+	// Direct layout takes the domain from the Host header.
+	if w := wkdGet(a.WKDHandler, "example.org:443", "/.well-known/openpgpkey/hu/"+joeHash); w.Code != http.StatusOK {
+		t.Errorf("direct layout: expected 200, got %d", w.Code)
+	}
+	if w := wkdGet(a.WKDHandler, "example.com", "/.well-known/openpgpkey/hu/"+joeHash); w.Code != http.StatusNotFound {
+		t.Errorf("other domain: expected 404, got %d", w.Code)
+	}
+	for _, path := range []string{"/.well-known/openpgpkey/policy", "/.well-known/openpgpkey/example.org/policy"} {
+		if w := wkdGet(a.WKDHandler, "example.org", path); w.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", path, w.Code)
+		}
+	}
+
+	// WKD_DOMAINS restricts the served domains.
+	a.WKDDomains = []string{"example.net"}
+	if w := wkdGet(a.WKDHandler, "openpgpkey.example.org", advanced); w.Code != http.StatusNotFound {
+		t.Errorf("domain not in WKD_DOMAINS: expected 404, got %d", w.Code)
+	}
+}
+
+// TestWKDHandler_MultipleKeys verifies every published key for an address is
+// returned, the pinned key first.
+func TestWKDHandler_MultipleKeys(t *testing.T) {
+	a, db := setupTestApp(t)
+
+	current := generateTestKey(t, "Joe", "joe.doe@example.org", "")
+	rotated := generateTestKey(t, "Joe", "joe.doe@example.org", "")
+	addPublishedKey(t, a, "joe-current", current, nil)
+	addPublishedKey(t, a, "joe-rotated", rotated, url.Values{"pin": {"keep"}})
+
+	w := wkdGet(a.WKDHandler, "example.org", "/.well-known/openpgpkey/hu/"+joeHash)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	entities, err := openpgp.ReadKeyRing(bytes.NewReader(w.Body.Bytes()))
+	if err != nil || len(entities) != 2 {
+		t.Fatalf("expected two concatenated keys, got %d (%v)", len(entities), err)
+	}
+	if fmt.Sprintf("%x", entities[0].PrimaryKey.Fingerprint) != current.GetFingerprint() {
+		t.Error("expected the pinned key to be served first")
+	}
+
+	// Withdrawing a key removes it from the directory.
+	var id int64
+	db.Get(&id, "SELECT id FROM keys WHERE name = 'joe-rotated'")
+	postForm(a.PublishKeyHandler, "/keys/publish", url.Values{"id": {fmt.Sprint(id)}, "published": {"false"}})
+	w = wkdGet(a.WKDHandler, "example.org", "/.well-known/openpgpkey/hu/"+joeHash)
+	if entities, _ := openpgp.ReadKeyRing(bytes.NewReader(w.Body.Bytes())); len(entities) != 1 {
+		t.Errorf("expected one key after unpublishing, got %d", len(entities))
+	}
+}
@@ -1,14 +1,13 @@
 package crypto
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/rand"
-	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -17,21 +16,37 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/jmoiron/sqlx"
-	"golang.org/x/crypto/argon2"
 )
 
 // ErrMasterPasswordNotSet is returned when MASTER_PASSWORD env var is empty.
 var ErrMasterPasswordNotSet = errors.New("MASTER_PASSWORD not set")
 
+// ErrWrongMasterPassword is returned when a password opens none of the
+// wrapped data keys.
+var ErrWrongMasterPassword = errors.New("master password does not open the data key")
+
+// ErrNoDataKey is returned when managing master passwords while stored
+// secrets are still encrypted with the key derived from MASTER_PASSWORD, as
+// before data keys. RotateMasterPassword converts them.
+var ErrNoDataKey = errors.New("secrets are not encrypted with a data key yet")
+
 const defaultSaltFile = "./data/master_salt"
 
 // CryptoService provides encryption, decryption, and authentication
-// operations using a master password and a persisted salt.
+// operations. Secrets are encrypted with a random data key, stored in the
+// secrets table wrapped by one or more master passwords; MASTER_PASSWORD
+// must open one of them. Without a database, the key is derived from
+// MASTER_PASSWORD and a salt file instead.
 type CryptoService struct {
 	db *sqlx.DB
+
+	mu       sync.Mutex
+	password string      // MASTER_PASSWORD that opened key
+	key      []byte      // cached data key
+	wrapping *wrappedKey // wrapping opened by password; nil for a derived key
 }
 
 // NewCryptoService creates a CryptoService backed by the given database
@@ -63,38 +78,40 @@ func argon2Params() (uint32, uint32, uint8) {
 	return t, m, th
 }
 
-func deriveKey(password string, salt []byte) []byte {
-	t, m, th := argon2Params()
-	return argon2.IDKey([]byte(password), salt, t, m, th, 32)
-}
-
-// readOrCreateSalt reads the salt from the DB or falls back to a local file.
-func (cs *CryptoService) readOrCreateSalt() ([]byte, error) {
+// readOrCreateSalt reads the salt and its parameters from the DB or falls
+// back to a local file. A salt stored without parameters is stored again
+// with the configured ones, which it has been used with so far, so later
+// changes to ARGON2_* do not change the key.
+func (cs *CryptoService) readOrCreateSalt() (saltedKDF, error) {
 	if cs.db != nil {
 		var val string
 		q := cs.db.Rebind("SELECT value FROM secrets WHERE name = ? LIMIT 1")
 		err := cs.db.Get(&val, q, "master_salt")
 		if err == nil {
-			s, err := base64.StdEncoding.DecodeString(strings.TrimSpace(val))
+			k, err := parseSaltedKDF(val)
 			if err != nil {
-				return nil, fmt.Errorf("failed to decode master_salt: %w", err)
+				return saltedKDF{}, fmt.Errorf("failed to decode master_salt: %w", err)
+			}
+			if k.String() != val {
+				if _, err := cs.db.Exec(cs.db.Rebind("UPDATE secrets SET value = ? WHERE name = ?"), k.String(), "master_salt"); err != nil {
+					slog.Warn("failed to store argon2 parameters with master_salt", "err", err)
+				}
 			}
-			return s, nil
+			return k, nil
 		}
 		if !errors.Is(err, sql.ErrNoRows) {
-			return nil, fmt.Errorf("failed to read master_salt from DB: %w", err)
+			return saltedKDF{}, fmt.Errorf("failed to read master_salt from DB: %w", err)
 		}
-		s := make([]byte, 16)
-		if _, err := rand.Read(s); err != nil {
-			return nil, err
+		k, err := newSaltedKDF()
+		if err != nil {
+			return saltedKDF{}, err
 		}
-		enc := base64.StdEncoding.EncodeToString(s)
-		_, err = cs.db.NamedExec("INSERT INTO secrets (name, value) VALUES (:name, :value)", map[string]interface{}{"name": "master_salt", "value": enc})
+		_, err = cs.db.NamedExec("INSERT INTO secrets (name, value) VALUES (:name, :value)", map[string]interface{}{"name": "master_salt", "value": k.String()})
 		if err != nil {
-			return nil, fmt.Errorf("failed to insert master_salt: %w", err)
+			return saltedKDF{}, fmt.Errorf("failed to insert master_salt: %w", err)
 		}
 		slog.Info("generated master salt and stored in DB", "secrets_key", "master_salt")
-		return s, nil
+		return k, nil
 	}
 
 	// Fallback to file-based salt for compatibility
@@ -103,61 +120,157 @@ func (cs *CryptoService) readOrCreateSalt() ([]byte, error) {
 		path = defaultSaltFile
 	}
 	if data, err := os.ReadFile(path); err == nil {
-		s, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		k, err := parseSaltedKDF(string(data))
 		if err != nil {
-			return nil, err
+			return saltedKDF{}, err
+		}
+		if k.String() != strings.TrimSpace(string(data)) {
+			if err := os.WriteFile(path, []byte(k.String()+"\n"), 0o600); err != nil {
+				slog.Warn("failed to store argon2 parameters in salt file", "path", path, "err", err)
+			}
 		}
-		return s, nil
+		return k, nil
 	}
 	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
-		return nil, err
+		return saltedKDF{}, err
 	}
-	s := make([]byte, 16)
-	if _, err := rand.Read(s); err != nil {
-		return nil, err
+	k, err := newSaltedKDF()
+	if err != nil {
+		return saltedKDF{}, err
 	}
-	enc := base64.StdEncoding.EncodeToString(s)
-	if err := os.WriteFile(path, []byte(enc+"\n"), 0o600); err != nil {
-		return nil, err
+	if err := os.WriteFile(path, []byte(k.String()+"\n"), 0o600); err != nil {
+		return saltedKDF{}, err
 	}
 	fmt.Fprintf(os.Stderr, "INFO: generated master salt and wrote to %s; keep this file safe\n", path)
-	return s, nil
+	return k, nil
 }
 
-// masterKey derives the 32-byte master key from MASTER_PASSWORD and persisted salt.
+// masterKey returns the 32-byte data key opened by MASTER_PASSWORD.
 func (cs *CryptoService) masterKey() ([]byte, error) {
 	pass := os.Getenv("MASTER_PASSWORD")
 	if pass == "" {
 		return nil, ErrMasterPasswordNotSet
 	}
-	salt, err := cs.readOrCreateSalt()
+	if cs.db == nil {
+		k, err := cs.readOrCreateSalt()
+		if err != nil {
+			return nil, err
+		}
+		return k.key(pass), nil
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.key != nil && cs.password == pass {
+		return cs.key, nil
+	}
+	key, w, err := cs.loadDataKey(pass)
 	if err != nil {
 		return nil, err
 	}
-	return deriveKey(pass, salt), nil
+	cs.password, cs.key, cs.wrapping = pass, key, w
+	return key, nil
+}
+
+// loadDataKey opens the data key with pass. Databases from before data keys
+// have a master_salt instead, and keep using the key derived from it until
+// the master password is rotated. Otherwise a data key is generated on first
+// use, wrapped with pass.
+func (cs *CryptoService) loadDataKey(pass string) ([]byte, *wrappedKey, error) {
+	ctx := context.Background()
+	keys, err := loadWrappedKeys(ctx, cs.db)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(keys) > 0 {
+		pinParams(ctx, cs.db, keys)
+		key, w, err := openDataKey(keys, pass)
+		if err == nil && !w.kdf.current() {
+			slog.Warn("the data key is wrapped with other argon2 parameters than configured; run upgrade-encryption to apply them", "secrets_key", dataKeyPrefix+w.name)
+		}
+		return key, w, err
+	}
+	salt, err := legacySalt(ctx, cs.db)
+	if err != nil {
+		return nil, nil, err
+	}
+	if salt != nil {
+		k, err := cs.readOrCreateSalt()
+		if err != nil {
+			return nil, nil, err
+		}
+		return k.key(pass), nil, nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	w, err := wrapKey(firstMasterPassword, pass, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := w.insert(ctx, cs.db); err != nil {
+		// Another process may have stored a data key first; use that one.
+		if keys, _ := loadWrappedKeys(ctx, cs.db); len(keys) > 0 {
+			return openDataKey(keys, pass)
+		}
+		return nil, nil, fmt.Errorf("failed to store data key: %w", err)
+	}
+	slog.Info("generated data key and stored it wrapped with MASTER_PASSWORD", "secrets_key", dataKeyPrefix+w.name)
+	return key, &w, nil
 }
 
 // VerifyMasterPassword compares a candidate password against MASTER_PASSWORD
-// using argon2 key derivation with the persisted salt.
+// using argon2 key derivation: it must open the same wrapping of the data
+// key, or derive the same key with the persisted salt.
 func (cs *CryptoService) VerifyMasterPassword(candidate string) (bool, error) {
 	if os.Getenv("MASTER_PASSWORD") == "" {
 		return false, ErrMasterPasswordNotSet
 	}
-	salt, err := cs.readOrCreateSalt()
+	if cs.db != nil {
+		if _, err := cs.masterKey(); err != nil {
+			return false, err
+		}
+	}
+	if w := cs.currentWrapping(); w != nil {
+		_, ok := w.unwrap(candidate)
+		return ok, nil
+	}
+	k, err := cs.readOrCreateSalt()
 	if err != nil {
 		return false, err
 	}
-	derivedCandidate := deriveKey(candidate, salt)
-	derivedReal := deriveKey(os.Getenv("MASTER_PASSWORD"), salt)
+	derivedCandidate := k.key(candidate)
+	derivedReal := k.key(os.Getenv("MASTER_PASSWORD"))
 	return hmac.Equal(derivedCandidate, derivedReal), nil
 }
 
-// Encrypt encrypts plaintext and returns base64(nonce|ciphertext).
+// ciphertextVersion prefixes the output of Encrypt, which is
+// "v1:<base64(nonce|ciphertext)>". The prefix is authenticated as additional
+// data. Ciphertexts from before it are plain base64 and still decrypt. The
+// key's Argon2 parameters are stored with its salt, not in each ciphertext.
+const ciphertextVersion = "v1:"
+
+// Encrypt encrypts plaintext and returns it in the current ciphertext format.
 func (cs *CryptoService) Encrypt(plaintext []byte) (string, error) {
 	key, err := cs.masterKey()
 	if err != nil {
 		return "", err
 	}
+	return seal(key, plaintext)
+}
+
+// Decrypt decodes a ciphertext in the current or an older format and returns
+// plaintext.
+func (cs *CryptoService) Decrypt(b64 string) ([]byte, error) {
+	key, err := cs.masterKey()
+	if err != nil {
+		return nil, err
+	}
+	return open(key, b64)
+}
+
+func seal(key, plaintext []byte) (string, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return "", err
@@ -170,18 +283,19 @@ func (cs *CryptoService) Encrypt(plaintext []byte) (string, error) {
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return "", err
 	}
-	ct := aesgcm.Seal(nil, nonce, plaintext, nil)
+	ct := aesgcm.Seal(nil, nonce, plaintext, []byte(ciphertextVersion))
 	out := append(nonce, ct...)
-	return base64.StdEncoding.EncodeToString(out), nil
+	return ciphertextVersion + base64.StdEncoding.EncodeToString(out), nil
 }
 
-// Decrypt decodes base64(nonce|ciphertext) and returns plaintext.
-func (cs *CryptoService) Decrypt(b64 string) ([]byte, error) {
-	key, err := cs.masterKey()
-	if err != nil {
-		return nil, err
+func open(key []byte, ciphertext string) ([]byte, error) {
+	var ad []byte
+	if rest, ok := strings.CutPrefix(ciphertext, ciphertextVersion); ok {
+		ciphertext, ad = rest, []byte(ciphertextVersion)
+	} else if version, _, ok := strings.Cut(ciphertext, ":"); ok {
+		return nil, fmt.Errorf("unsupported ciphertext version %q", version)
 	}
-	payload, err := base64.StdEncoding.DecodeString(b64)
+	payload, err := base64.StdEncoding.DecodeString(ciphertext)
 	if err != nil {
 		return nil, err
 	}
@@ -199,54 +313,224 @@ func (cs *CryptoService) Decrypt(b64 string) ([]byte, error) {
 	}
 	nonce := payload[:ns]
 	ct := payload[ns:]
-	pt, err := aesgcm.Open(nil, nonce, ct, nil)
+	pt, err := aesgcm.Open(nil, nonce, ct, ad)
 	if err != nil {
 		return nil, err
 	}
 	return pt, nil
 }
 
-// CreateAuthCookieValue creates a signed timestamp token for the auth cookie.
-// Format: "<unix_ts>:<hex_hmac>" signed with the master key.
-func (cs *CryptoService) CreateAuthCookieValue() (string, error) {
+// Reencrypter turns a stored value into one encrypted with the current data
+// key in the current ciphertext format.
+type Reencrypter func(ciphertext string) (string, error)
+
+// RotateMasterPassword wraps the data key opened by oldPassword with
+// newPassword instead, under a fresh salt, in one transaction. reencrypt
+// runs in the same transaction; its re is nil unless the stored secrets
+// are still encrypted with the key derived from oldPassword, in which case
+// a data key is generated and reencrypt must rewrite every stored secret
+// with re. A value that does not decrypt with oldPassword fails the
+// rotation. If anything fails, nothing changes. MASTER_PASSWORD must be set
+// to newPassword before the next start.
+func (cs *CryptoService) RotateMasterPassword(ctx context.Context, oldPassword, newPassword string, reencrypt func(tx *sqlx.Tx, re Reencrypter) error) error {
+	if cs.db == nil {
+		return errors.New("rotating the master password requires a database")
+	}
+	if oldPassword == "" || newPassword == "" {
+		return ErrMasterPasswordNotSet
+	}
+	tx, err := cs.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	keys, err := loadWrappedKeys(ctx, tx)
+	if err != nil {
+		return err
+	}
+	var key []byte
+	var re Reencrypter
+	name := firstMasterPassword
+	if len(keys) > 0 {
+		var w *wrappedKey
+		if key, w, err = openDataKey(keys, oldPassword); err != nil {
+			return err
+		}
+		name = w.name
+		if _, err := tx.ExecContext(ctx, tx.Rebind("DELETE FROM secrets WHERE name = ?"), dataKeyPrefix+name); err != nil {
+			return err
+		}
+	} else {
+		salt, err := legacySalt(ctx, tx)
+		if err != nil {
+			return err
+		}
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		if salt != nil {
+			legacyKey := salt.key(oldPassword)
+			re = func(b64 string) (string, error) {
+				pt, err := open(legacyKey, b64)
+				if err != nil {
+					return "", fmt.Errorf("does not decrypt with the old master password: %w", err)
+				}
+				return seal(key, pt)
+			}
+			if _, err := tx.ExecContext(ctx, tx.Rebind("DELETE FROM secrets WHERE name = ?"), "master_salt"); err != nil {
+				return err
+			}
+		}
+	}
+	w, err := wrapKey(name, newPassword, key)
+	if err != nil {
+		return err
+	}
+	if err := w.insert(ctx, tx); err != nil {
+		return fmt.Errorf("failed to store data key: %w", err)
+	}
+	if err := reencrypt(tx, re); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	cs.forgetKey()
+	return nil
+}
+
+// UpgradeEncryption wraps the data key opened by MASTER_PASSWORD again with
+// the configured Argon2 parameters, unless it already is, and passes
+// reencrypt a Reencrypter that rewrites values in the current ciphertext
+// format, all in one transaction. Other master passwords are upgraded when
+// the server is started with them.
+func (cs *CryptoService) UpgradeEncryption(ctx context.Context, reencrypt func(tx *sqlx.Tx, re Reencrypter) error) error {
+	pass := os.Getenv("MASTER_PASSWORD")
 	key, err := cs.masterKey()
 	if err != nil {
-		return "", err
+		return err
+	}
+	current := cs.currentWrapping()
+	if cs.db == nil || current == nil {
+		return ErrNoDataKey
+	}
+	tx, err := cs.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if !current.kdf.current() {
+		w, err := wrapKey(current.name, pass, key)
+		if err != nil {
+			return err
+		}
+		q := tx.Rebind("UPDATE secrets SET value = ? WHERE name = ?")
+		if _, err := tx.ExecContext(ctx, q, w.value(), dataKeyPrefix+w.name); err != nil {
+			return fmt.Errorf("failed to store data key: %w", err)
+		}
+	}
+	re := func(ciphertext string) (string, error) {
+		pt, err := open(key, ciphertext)
+		if err != nil {
+			return "", err
+		}
+		return seal(key, pt)
+	}
+	if err := reencrypt(tx, re); err != nil {
+		return err
 	}
-	ts := time.Now().Unix()
-	payload := strconv.FormatInt(ts, 10)
-	mac := hmac.New(sha256.New, key)
-	mac.Write([]byte(payload))
-	sig := mac.Sum(nil)
-	return payload + ":" + hex.EncodeToString(sig), nil
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	cs.forgetKey()
+	return nil
 }
 
-// VerifyAuthCookieValue verifies a cookie value and checks the timestamp
-// is not older than maxAgeSeconds.
-func (cs *CryptoService) VerifyAuthCookieValue(val string, maxAgeSeconds int64) bool {
+// AddMasterPassword wraps the data key with password as well, stored under
+// name, so that password also opens it as MASTER_PASSWORD: a second
+// administrator's password, say, or a recovery key kept offline.
+func (cs *CryptoService) AddMasterPassword(ctx context.Context, name, password string) error {
+	if !validMasterPasswordName.MatchString(name) {
+		return fmt.Errorf("invalid name %q: use up to 64 letters, digits, dots, dashes and underscores", name)
+	}
+	if password == "" {
+		return errors.New("the password is empty")
+	}
 	key, err := cs.masterKey()
 	if err != nil {
-		return false
+		return err
 	}
-	parts := strings.SplitN(val, ":", 2)
-	if len(parts) != 2 {
-		return false
+	if cs.db == nil || cs.currentWrapping() == nil {
+		return ErrNoDataKey
 	}
-	payload := parts[0]
-	sigHex := parts[1]
-	sig, err := hex.DecodeString(sigHex)
+	keys, err := loadWrappedKeys(ctx, cs.db)
 	if err != nil {
-		return false
+		return err
 	}
-	mac := hmac.New(sha256.New, key)
-	mac.Write([]byte(payload))
-	expected := mac.Sum(nil)
-	if !hmac.Equal(expected, sig) {
-		return false
+	for _, k := range keys {
+		if k.name == name {
+			return fmt.Errorf("a master password named %q already exists", name)
+		}
 	}
-	ts, err := strconv.ParseInt(payload, 10, 64)
+	w, err := wrapKey(name, password, key)
 	if err != nil {
-		return false
+		return err
+	}
+	return w.insert(ctx, cs.db)
+}
+
+// RemoveMasterPassword deletes the wrapping of the data key stored under
+// name. The one MASTER_PASSWORD opens cannot be removed, so the data key
+// always stays wrapped at least once.
+func (cs *CryptoService) RemoveMasterPassword(ctx context.Context, name string) error {
+	if _, err := cs.masterKey(); err != nil {
+		return err
+	}
+	w := cs.currentWrapping()
+	if cs.db == nil || w == nil {
+		return ErrNoDataKey
+	}
+	if w.name == name {
+		return fmt.Errorf("%q is the master password in MASTER_PASSWORD; start with another one to remove it", name)
 	}
-	return time.Now().Unix()-ts <= maxAgeSeconds
+	res, err := cs.db.ExecContext(ctx, cs.db.Rebind("DELETE FROM secrets WHERE name = ?"), dataKeyPrefix+name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no master password named %q", name)
+	}
+	return nil
+}
+
+// MasterPasswords returns the names the data key is wrapped under.
+func (cs *CryptoService) MasterPasswords(ctx context.Context) ([]string, error) {
+	if cs.db == nil {
+		return nil, ErrNoDataKey
+	}
+	keys, err := loadWrappedKeys(ctx, cs.db)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = k.name
+	}
+	return names, nil
+}
+
+func (cs *CryptoService) currentWrapping() *wrappedKey {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.wrapping
+}
+
+// forgetKey drops the cached data key, so the next use opens it again.
+func (cs *CryptoService) forgetKey() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.password, cs.key, cs.wrapping = "", nil, nil
 }
@@ -1,10 +1,18 @@
 package crypto_test
 
 import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
 	"testing"
 
 	_ "modernc.org/sqlite"
 	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/argon2"
 
 	c "h-cloud.io/web-gpg/internal/crypto"
 	dbpkg "h-cloud.io/web-gpg/internal/db"
@@ -143,32 +151,6 @@ func TestVerifyMasterPassword_NotSet(t *testing.T) {
 	}
 }
 
-func TestVerifyAuthCookieValue_Expired(t *testing.T) {
-	t.Setenv("MASTER_PASSWORD", "test-master-password")
-	t.Setenv("MASTER_SALT_FILE", t.TempDir()+"/master_salt")
-
-	db, err := sqlx.Open("sqlite", "file::memory:?mode=memory&cache=shared")
-	if err != nil {
-		t.Fatalf("open db: %v", err)
-	}
-	t.Cleanup(func() { db.Close() })
-
-	if err := dbpkg.ApplySQLMigrations(db, "../../migrations/sql"); err != nil {
-		t.Fatalf("migrate: %v", err)
-	}
-
-	svc := c.NewCryptoService(db)
-	val, err := svc.CreateAuthCookieValue()
-	if err != nil {
-		t.Fatalf("create cookie: %v", err)
-	}
-
-	// maxAge of -1 means expired
-	if svc.VerifyAuthCookieValue(val, -1) {
-		t.Fatal("cookie with negative maxAge should be expired")
-	}
-}
-
 func TestEncryptDecrypt_FileSaltFallback(t *testing.T) {
 	t.Setenv("MASTER_PASSWORD", "file-salt-test")
 	saltFile := t.TempDir() + "/test_salt"
@@ -226,30 +208,239 @@ func TestArgon2ParamsFromEnv(t *testing.T) {
 	}
 }
 
-func TestAuthCookieRoundtrip(t *testing.T) {
-	t.Setenv("MASTER_PASSWORD", "test-master-password")
-	t.Setenv("MASTER_SALT_FILE", t.TempDir()+"/master_salt")
-
-	db, err := sqlx.Open("sqlite", "file::memory:?mode=memory&cache=shared")
+// openTestDB returns an empty migrated database.
+func openTestDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	db, err := sqlx.Open("sqlite", "file:"+t.TempDir()+"/test.db")
 	if err != nil {
 		t.Fatalf("open db: %v", err)
 	}
 	t.Cleanup(func() { db.Close() })
-
 	if err := dbpkg.ApplySQLMigrations(db, "../../migrations/sql"); err != nil {
 		t.Fatalf("migrate: %v", err)
 	}
+	return db
+}
+
+func TestRotateMasterPassword(t *testing.T) {
+	t.Setenv("MASTER_PASSWORD", "old-password")
+	db := openTestDB(t)
+
+	svc := c.NewCryptoService(db)
+	stored, err := svc.Encrypt([]byte("passphrase"))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	rotate := func(oldPassword string) error {
+		return svc.RotateMasterPassword(context.Background(), oldPassword, "new-password", func(tx *sqlx.Tx, re c.Reencrypter) error {
+			if re != nil {
+				t.Error("secrets encrypted with the data key need no re-encryption")
+			}
+			return nil
+		})
+	}
+
+	if err := rotate("wrong-password"); !errors.Is(err, c.ErrWrongMasterPassword) {
+		t.Fatalf("a wrong old password should fail the rotation, got %v", err)
+	}
+	if err := rotate("old-password"); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if _, err := svc.Decrypt(stored); !errors.Is(err, c.ErrWrongMasterPassword) {
+		t.Fatalf("the old password should no longer open the data key, got %v", err)
+	}
+	t.Setenv("MASTER_PASSWORD", "new-password")
+	if dec, err := svc.Decrypt(stored); err != nil || string(dec) != "passphrase" {
+		t.Fatalf("decrypt with the new password: %q %v", dec, err)
+	}
+	if ok, _ := svc.VerifyMasterPassword("new-password"); !ok {
+		t.Fatal("the new password should verify")
+	}
+	if ok, _ := svc.VerifyMasterPassword("old-password"); ok {
+		t.Fatal("the old password should not verify")
+	}
+}
+
+// TestRotateMasterPassword_Legacy verifies secrets encrypted with the key
+// derived from the master password, before data keys, are converted.
+func TestRotateMasterPassword_Legacy(t *testing.T) {
+	t.Setenv("MASTER_PASSWORD", "old-password")
+	db := openTestDB(t)
+	db.MustExec("INSERT INTO secrets (name, value) VALUES (?, ?)", "master_salt", "c2FsdHNhbHRzYWx0c2FsdA==")
 
 	svc := c.NewCryptoService(db)
+	stored, err := svc.Encrypt([]byte("passphrase"))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if err := svc.AddMasterPassword(context.Background(), "alice", "alice-password"); !errors.Is(err, c.ErrNoDataKey) {
+		t.Fatalf("adding a master password before conversion: expected ErrNoDataKey, got %v", err)
+	}
+	rotate := func(oldPassword string) error {
+		return svc.RotateMasterPassword(context.Background(), oldPassword, "new-password", func(tx *sqlx.Tx, re c.Reencrypter) error {
+			enc, err := re(stored)
+			if err != nil {
+				return err
+			}
+			stored = enc
+			return nil
+		})
+	}
+
+	if err := rotate("wrong-password"); err == nil {
+		t.Fatal("a wrong old password should fail the conversion")
+	}
+	if dec, err := svc.Decrypt(stored); err != nil || string(dec) != "passphrase" {
+		t.Fatalf("a failed conversion should change nothing: %q %v", dec, err)
+	}
+	if err := rotate("old-password"); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	t.Setenv("MASTER_PASSWORD", "new-password")
+	if dec, err := svc.Decrypt(stored); err != nil || string(dec) != "passphrase" {
+		t.Fatalf("decrypt with the new password: %q %v", dec, err)
+	}
+	var salts int
+	db.Get(&salts, "SELECT COUNT(*) FROM secrets WHERE name = 'master_salt'")
+	if salts != 0 {
+		t.Error("the old salt should be removed")
+	}
+}
+
+func TestMasterPasswords(t *testing.T) {
+	t.Setenv("MASTER_PASSWORD", "first-password")
+	db := openTestDB(t)
+	ctx := context.Background()
+
+	svc := c.NewCryptoService(db)
+	stored, err := svc.Encrypt([]byte("passphrase"))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if err := svc.AddMasterPassword(ctx, "recovery", "recovery-key"); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := svc.AddMasterPassword(ctx, "recovery", "other-key"); err == nil {
+		t.Error("adding a name twice should fail")
+	}
+	if err := svc.AddMasterPassword(ctx, "no spaces", "other-key"); err == nil {
+		t.Error("an invalid name should be refused")
+	}
+	if names, _ := svc.MasterPasswords(ctx); strings.Join(names, ",") != "master,recovery" {
+		t.Fatalf("unexpected master passwords: %v", names)
+	}
+	if err := svc.RemoveMasterPassword(ctx, "master"); err == nil {
+		t.Fatal("the master password in use should not be removable")
+	}
+
+	// A new process started with the recovery key opens the same data key.
+	t.Setenv("MASTER_PASSWORD", "recovery-key")
+	recovered := c.NewCryptoService(db)
+	if dec, err := recovered.Decrypt(stored); err != nil || string(dec) != "passphrase" {
+		t.Fatalf("decrypt with the recovery key: %q %v", dec, err)
+	}
+	if err := recovered.RemoveMasterPassword(ctx, "master"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	t.Setenv("MASTER_PASSWORD", "first-password")
+	if _, err := c.NewCryptoService(db).Decrypt(stored); !errors.Is(err, c.ErrWrongMasterPassword) {
+		t.Fatalf("a removed master password should no longer open the data key, got %v", err)
+	}
+}
+
+// TestCiphertextFormat verifies ciphertexts carry an authenticated version
+// and that those from before it still decrypt.
+func TestCiphertextFormat(t *testing.T) {
+	t.Setenv("MASTER_PASSWORD", "test-master-password")
+	saltFile := t.TempDir() + "/master_salt"
+	t.Setenv("MASTER_SALT_FILE", saltFile)
+	salt := []byte("0123456789abcdef")
+	os.WriteFile(saltFile, []byte(base64.StdEncoding.EncodeToString(salt)+"\n"), 0o600)
+
+	svc := c.NewCryptoService(nil)
+	enc, err := svc.Encrypt([]byte("passphrase"))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if !strings.HasPrefix(enc, "v1:") {
+		t.Fatalf("expected a version prefix: %s", enc)
+	}
+	if _, err := svc.Decrypt(strings.TrimPrefix(enc, "v1:")); err == nil {
+		t.Error("a ciphertext stripped of its version should not decrypt")
+	}
+	if _, err := svc.Decrypt("v9:" + strings.TrimPrefix(enc, "v1:")); err == nil {
+		t.Error("an unknown version should not decrypt")
+	}
+
+	// Before versions, ciphertexts were base64(nonce|ciphertext) with the
+	// key derived with the default parameters.
+	block, _ := aes.NewCipher(argon2.IDKey([]byte("test-master-password"), salt, 1, 32*1024, 2, 32))
+	aesgcm, _ := cipher.NewGCM(block)
+	nonce := make([]byte, aesgcm.NonceSize())
+	old := base64.StdEncoding.EncodeToString(aesgcm.Seal(nonce, nonce, []byte("old passphrase"), nil))
+	if dec, err := svc.Decrypt(old); err != nil || string(dec) != "old passphrase" {
+		t.Fatalf("decrypt a ciphertext from before versions: %q %v", dec, err)
+	}
+}
+
+// TestArgon2ParamsPersisted verifies changing ARGON2_* does not change the
+// key of an existing salt, including one stored before its parameters were,
+// and that UpgradeEncryption applies them.
+func TestArgon2ParamsPersisted(t *testing.T) {
+	t.Setenv("MASTER_PASSWORD", "test-master-password")
+	saltFile := t.TempDir() + "/master_salt"
+	t.Setenv("MASTER_SALT_FILE", saltFile)
+	os.WriteFile(saltFile, []byte(base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))+"\n"), 0o600)
+
+	enc, err := c.NewCryptoService(nil).Encrypt([]byte("file"))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if data, _ := os.ReadFile(saltFile); !strings.HasPrefix(string(data), "$argon2id$v=19$m=32768,t=1,p=2$") {
+		t.Fatalf("expected the parameters to be stored with the salt: %s", data)
+	}
+
+	db := openTestDB(t)
+	svc := c.NewCryptoService(db)
+	stored, err := svc.Encrypt([]byte("passphrase"))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	// Data keys wrapped before the parameters were stored have a bare salt.
+	var wrapped string
+	db.Get(&wrapped, "SELECT value FROM secrets WHERE name = 'data_key:master'")
+	kdf, rest, _ := strings.Cut(wrapped, ":")
+	db.MustExec("UPDATE secrets SET value = ? WHERE name = 'data_key:master'", kdf[strings.LastIndex(kdf, "$")+1:]+":"+rest)
+	if _, err := c.NewCryptoService(db).Decrypt(stored); err != nil {
+		t.Fatalf("decrypt with a bare salt: %v", err)
+	}
+	db.Get(&wrapped, "SELECT value FROM secrets WHERE name = 'data_key:master'")
+	if !strings.HasPrefix(wrapped, "$argon2id$v=19$m=32768,t=1,p=2$") {
+		t.Fatalf("expected the parameters to be stored with the data key: %s", wrapped)
+	}
+
+	t.Setenv("ARGON2_TIME", "2")
+	if dec, err := c.NewCryptoService(nil).Decrypt(enc); err != nil || string(dec) != "file" {
+		t.Fatalf("decrypt with the salt file after changing ARGON2_TIME: %q %v", dec, err)
+	}
+	svc = c.NewCryptoService(db)
+	if dec, err := svc.Decrypt(stored); err != nil || string(dec) != "passphrase" {
+		t.Fatalf("decrypt after changing ARGON2_TIME: %q %v", dec, err)
+	}
 
-	val, err := svc.CreateAuthCookieValue()
+	err = svc.UpgradeEncryption(context.Background(), func(tx *sqlx.Tx, re c.Reencrypter) error {
+		stored, err = re(stored)
+		return err
+	})
 	if err != nil {
-		t.Fatalf("create cookie: %v", err)
+		t.Fatalf("upgrade: %v", err)
 	}
-	if !svc.VerifyAuthCookieValue(val, 86400) {
-		t.Fatal("valid cookie should verify")
+	db.Get(&wrapped, "SELECT value FROM secrets WHERE name = 'data_key:master'")
+	if !strings.HasPrefix(wrapped, "$argon2id$v=19$m=32768,t=2,p=2$") {
+		t.Errorf("expected the data key to be wrapped with the new parameters: %s", wrapped)
 	}
-	if svc.VerifyAuthCookieValue("garbage:value", 86400) {
-		t.Fatal("garbage cookie should not verify")
+	t.Setenv("ARGON2_TIME", "")
+	if dec, err := c.NewCryptoService(db).Decrypt(stored); err != nil || string(dec) != "passphrase" {
+		t.Fatalf("decrypt after the upgrade: %q %v", dec, err)
 	}
 }
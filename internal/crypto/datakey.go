@@ -0,0 +1,129 @@
+package crypto
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// dataKeyPrefix starts the names of the wrapped data keys in the secrets
+// table; the rest is the name of the master password that wraps it.
+const dataKeyPrefix = "data_key:"
+
+// firstMasterPassword names the wrapping made with MASTER_PASSWORD when the
+// data key is generated.
+const firstMasterPassword = "master"
+
+var validMasterPasswordName = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// wrappedKey is the data key encrypted with a key derived from one master
+// password, stored as "<salt and parameters>:<ciphertext>".
+type wrappedKey struct {
+	name    string
+	kdf     saltedKDF
+	wrapped string
+	stored  string // value as stored, which lacks the parameters if older
+}
+
+// wrapKey encrypts key with password under a fresh salt and the configured
+// parameters.
+func wrapKey(name, password string, key []byte) (wrappedKey, error) {
+	kdf, err := newSaltedKDF()
+	if err != nil {
+		return wrappedKey{}, err
+	}
+	wrapped, err := seal(kdf.key(password), key)
+	if err != nil {
+		return wrappedKey{}, err
+	}
+	w := wrappedKey{name: name, kdf: kdf, wrapped: wrapped}
+	w.stored = w.value()
+	return w, nil
+}
+
+func (w wrappedKey) value() string {
+	return w.kdf.String() + ":" + w.wrapped
+}
+
+// unwrap returns the data key if password opens w.
+func (w wrappedKey) unwrap(password string) ([]byte, bool) {
+	key, err := open(w.kdf.key(password), w.wrapped)
+	return key, err == nil
+}
+
+func (w wrappedKey) insert(ctx context.Context, db sqlx.ExtContext) error {
+	q := db.Rebind("INSERT INTO secrets (name, value) VALUES (?, ?)")
+	_, err := db.ExecContext(ctx, q, dataKeyPrefix+w.name, w.value())
+	return err
+}
+
+// pinParams stores the wrappings of keys that were stored without their
+// Argon2 parameters again with them. Failures are only logged: the
+// parameters used so far are still the configured ones.
+func pinParams(ctx context.Context, db sqlx.ExtContext, keys []wrappedKey) {
+	for _, w := range keys {
+		if w.stored == w.value() {
+			continue
+		}
+		q := db.Rebind("UPDATE secrets SET value = ? WHERE name = ?")
+		if _, err := db.ExecContext(ctx, q, w.value(), dataKeyPrefix+w.name); err != nil {
+			slog.Warn("failed to store argon2 parameters with data key", "secrets_key", dataKeyPrefix+w.name, "err", err)
+		}
+	}
+}
+
+// loadWrappedKeys returns the wrappings of the data key, by name.
+func loadWrappedKeys(ctx context.Context, db sqlx.ExtContext) ([]wrappedKey, error) {
+	var rows []struct {
+		Name  string `db:"name"`
+		Value string `db:"value"`
+	}
+	q := db.Rebind("SELECT name, value FROM secrets WHERE name LIKE ? ORDER BY name")
+	if err := sqlx.SelectContext(ctx, db, &rows, q, dataKeyPrefix+"%"); err != nil {
+		return nil, fmt.Errorf("failed to read data keys: %w", err)
+	}
+	keys := make([]wrappedKey, 0, len(rows))
+	for _, r := range rows {
+		salt, wrapped, ok := strings.Cut(r.Value, ":")
+		kdf, err := parseSaltedKDF(salt)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("malformed %s", r.Name)
+		}
+		keys = append(keys, wrappedKey{name: strings.TrimPrefix(r.Name, dataKeyPrefix), kdf: kdf, wrapped: wrapped, stored: r.Value})
+	}
+	return keys, nil
+}
+
+// openDataKey returns the data key and the first of keys password opens.
+func openDataKey(keys []wrappedKey, password string) ([]byte, *wrappedKey, error) {
+	for i := range keys {
+		if key, ok := keys[i].unwrap(password); ok {
+			return key, &keys[i], nil
+		}
+	}
+	return nil, nil, ErrWrongMasterPassword
+}
+
+// legacySalt returns the master_salt of a database from before data keys,
+// or nil if there is none.
+func legacySalt(ctx context.Context, db sqlx.ExtContext) (*saltedKDF, error) {
+	var val string
+	err := sqlx.GetContext(ctx, db, &val, db.Rebind("SELECT value FROM secrets WHERE name = ?"), "master_salt")
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read master_salt from DB: %w", err)
+	}
+	k, err := parseSaltedKDF(val)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode master_salt: %w", err)
+	}
+	return &k, nil
+}
@@ -0,0 +1,88 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// kdfParams are the Argon2id parameters a key is derived with.
+type kdfParams struct {
+	time     uint32
+	memoryKB uint32
+	threads  uint8
+}
+
+// configuredKDFParams returns the parameters for new keys, from ARGON2_* env.
+func configuredKDFParams() kdfParams {
+	t, m, th := argon2Params()
+	return kdfParams{time: t, memoryKB: m, threads: th}
+}
+
+// saltedKDF is a salt with the parameters of the key derived with it. It is
+// stored like a PHC string without the hash:
+// "$argon2id$v=19$m=32768,t=1,p=2$<base64 salt>". Salts stored before the
+// parameters were are plain base64, and use the configured parameters.
+type saltedKDF struct {
+	params kdfParams
+	salt   []byte
+}
+
+// newSaltedKDF returns a fresh salt with the configured parameters.
+func newSaltedKDF() (saltedKDF, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return saltedKDF{}, err
+	}
+	return saltedKDF{params: configuredKDFParams(), salt: salt}, nil
+}
+
+func parseSaltedKDF(s string) (saltedKDF, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "$") {
+		salt, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return saltedKDF{}, err
+		}
+		return saltedKDF{params: configuredKDFParams(), salt: salt}, nil
+	}
+	var k saltedKDF
+	var version int
+	fields := strings.Split(s, "$")
+	if len(fields) != 5 || fields[1] != "argon2id" {
+		return saltedKDF{}, fmt.Errorf("unsupported key derivation %q", s)
+	}
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return saltedKDF{}, fmt.Errorf("unsupported argon2 version %q", fields[2])
+	}
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &k.params.memoryKB, &k.params.time, &k.params.threads); err != nil {
+		return saltedKDF{}, fmt.Errorf("malformed argon2 parameters %q: %w", fields[3], err)
+	}
+	if k.params.memoryKB == 0 || k.params.time == 0 || k.params.threads == 0 {
+		return saltedKDF{}, fmt.Errorf("malformed argon2 parameters %q", fields[3])
+	}
+	salt, err := base64.StdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return saltedKDF{}, err
+	}
+	k.salt = salt
+	return k, nil
+}
+
+func (k saltedKDF) String() string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s", argon2.Version,
+		k.params.memoryKB, k.params.time, k.params.threads, base64.StdEncoding.EncodeToString(k.salt))
+}
+
+// key derives the 32-byte key for password.
+func (k saltedKDF) key(password string) []byte {
+	return argon2.IDKey([]byte(password), k.salt, k.params.time, k.params.memoryKB, k.params.threads, 32)
+}
+
+// current reports whether k uses the configured parameters.
+func (k saltedKDF) current() bool {
+	return k.params == configuredKDFParams()
+}
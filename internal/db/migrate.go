@@ -19,7 +19,8 @@ const postgresOnlyMarker = "-- +migrate postgres-only"
 // environments. For PostgreSQL production deployments, use the golang-migrate
 // based RunMigrations in internal/migrate instead.
 //
-// Files containing the line "-- +migrate postgres-only" are skipped on SQLite.
+// Files containing the line "-- +migrate postgres-only" are skipped on SQLite,
+// and SERIAL primary keys are rewritten to INTEGER PRIMARY KEY.
 // After all files run, repairSQLiteSchema fixes any SERIAL-column artefacts.
 func ApplySQLMigrations(db *sqlx.DB, migrationsDir string) error {
 	files, err := filepath.Glob(filepath.Join(migrationsDir, "*.up.sql"))
@@ -39,7 +40,7 @@ func ApplySQLMigrations(db *sqlx.DB, migrationsDir string) error {
 			continue
 		}
 
-		if _, err := db.Exec(content); err != nil {
+		if _, err := db.Exec(sqliteCompatible(content)); err != nil {
 			// Ignore benign "already exists" errors when a migration was already applied.
 			if strings.Contains(err.Error(), "duplicate column") ||
 				strings.Contains(err.Error(), "already exists") {
@@ -57,10 +58,20 @@ func ApplySQLMigrations(db *sqlx.DB, migrationsDir string) error {
 	return nil
 }
 
+// sqliteCompatible rewrites PostgreSQL auto-increment columns to their SQLite
+// equivalent, mirroring the translation done in internal/migrate. Without it,
+// SERIAL ids are never populated on SQLite.
+func sqliteCompatible(sql string) string {
+	sql = strings.ReplaceAll(sql, "BIGSERIAL PRIMARY KEY", "INTEGER PRIMARY KEY")
+	return strings.ReplaceAll(sql, "SERIAL PRIMARY KEY", "INTEGER PRIMARY KEY")
+}
+
 // repairSQLiteSchema detects and fixes a stale SQLite schema where the keys
 // table was created with PostgreSQL syntax (SERIAL PRIMARY KEY instead of
 // INTEGER PRIMARY KEY). In that case rows end up with NULL ids, which breaks
-// scanning. It recreates the table with the correct schema and copies all rows.
+// scanning. It recreates the table with the correct schema and copies all rows,
+// keeping the ids they have so identity_pins.key_id and keys.certified_by
+// still point at the same keys; rows with a NULL id are given a new one.
 //
 // This is a no-op when the schema is already correct or when connected to
 // PostgreSQL (PRAGMA is not valid SQL there and returns an error, which we
@@ -109,13 +120,25 @@ func repairSQLiteSchema(db *sqlx.DB) error {
 			is_private INTEGER NOT NULL DEFAULT 0,
 			encrypted_password TEXT,
 			password_bcrypt TEXT,
+			trust_level TEXT NOT NULL DEFAULT 'unknown',
+			certified_by BIGINT,
+			certified_at TIMESTAMP,
+			fingerprint TEXT,
+			pin_conflict INTEGER NOT NULL DEFAULT 0,
+			lint_warnings TEXT,
+			published INTEGER NOT NULL DEFAULT 0,
+			drop_enabled INTEGER NOT NULL DEFAULT 0,
+			owner_id BIGINT,
+			shared INTEGER NOT NULL DEFAULT 1,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		)`,
 		// Normalise is_private regardless of how it was stored (boolean text vs int).
-		`INSERT INTO keys_repair (name, armored, is_private, encrypted_password, password_bcrypt, created_at)
-		 SELECT name, armored,
+		`INSERT INTO keys_repair (id, name, armored, is_private, encrypted_password, password_bcrypt,
+		                          trust_level, certified_by, certified_at, fingerprint, pin_conflict, lint_warnings, published, drop_enabled, owner_id, shared, created_at)
+		 SELECT id, name, armored,
 		        CASE WHEN is_private IN (1, TRUE, 'true', 'TRUE', 'True') THEN 1 ELSE 0 END,
-		        encrypted_password, password_bcrypt, created_at
+		        encrypted_password, password_bcrypt,
+		        trust_level, certified_by, certified_at, fingerprint, pin_conflict, lint_warnings, published, drop_enabled, owner_id, shared, created_at
 		 FROM keys`,
 		`DROP TABLE keys`,
 		`ALTER TABLE keys_repair RENAME TO keys`,
@@ -0,0 +1,310 @@
+// Package keyfetch looks up OpenPGP public keys for an email address on an
+// HKP keyserver and in the address domain's Web Key Directory.
+package keyfetch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	openpgp "github.com/ProtonMail/go-crypto/openpgp/v2"
+)
+
+// DefaultKeyserver is the HKP keyserver used when KEYSERVER_URL is unset.
+const DefaultKeyserver = "https://keys.openpgp.org"
+
+// maxResponseBytes caps the size of a keyserver or WKD response.
+const maxResponseBytes = 5 << 20
+
+// errNotFound is returned by the fetch helpers for a 404 response.
+var errNotFound = errors.New("not found")
+
+// zbase32Alphabet is the human-oriented base-32 alphabet used for WKD hashes.
+const zbase32Alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+
+// zbase32Encode encodes b with z-base-32, padding the last group with zero
+// bits. A 20-byte SHA-1 digest encodes to exactly 32 characters.
+func zbase32Encode(b []byte) string {
+	var sb strings.Builder
+	var buf, bits uint
+	for _, c := range b {
+		buf = buf<<8 | uint(c)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			sb.WriteByte(zbase32Alphabet[(buf>>bits)&31])
+		}
+	}
+	if bits > 0 {
+		sb.WriteByte(zbase32Alphabet[(buf<<(5-bits))&31])
+	}
+	return sb.String()
+}
+
+// WKDHash returns the WKD hash of an address's local part: the z-base-32
+// encoded SHA-1 digest of the lower-cased local part.
+func WKDHash(local string) string {
+	sum := sha1.Sum([]byte(strings.ToLower(local)))
+	return zbase32Encode(sum[:])
+}
+
+// IsWKDHash reports whether s has the form of a WKD hash.
+func IsWKDHash(s string) bool {
+	return len(s) == 32 && strings.Trim(s, zbase32Alphabet) == ""
+}
+
+// ErrInvalidEmail is returned for an address that SplitEmail rejects.
+var ErrInvalidEmail = errors.New("invalid email address")
+
+// SplitEmail returns the lower-cased local part and domain of email. The
+// domain becomes part of the WKD URLs, so it must be a DNS host name: dot
+// separated labels of letters, digits and hyphens, without a port, path or
+// IP address. Internationalized domains are accepted in their xn-- form.
+func SplitEmail(email string) (local, domain string, err error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	i := strings.Index(email, "@")
+	if i <= 0 || strings.Count(email, "@") != 1 {
+		return "", "", fmt.Errorf("%w %q", ErrInvalidEmail, email)
+	}
+	local, domain = email[:i], email[i+1:]
+	if !validDomain(domain) {
+		return "", "", fmt.Errorf("%w %q: the domain is not a host name", ErrInvalidEmail, email)
+	}
+	return local, domain, nil
+}
+
+// validDomain reports whether domain is a fully qualified DNS host name
+// whose last label is not numeric, which rules out IPv4 addresses.
+func validDomain(domain string) bool {
+	labels := strings.Split(domain, ".")
+	if len(domain) > 253 || len(labels) < 2 {
+		return false
+	}
+	for _, l := range labels {
+		if l == "" || len(l) > 63 || l[0] == '-' || l[len(l)-1] == '-' {
+			return false
+		}
+		for _, c := range l {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return strings.Trim(labels[len(labels)-1], "0123456789") != ""
+}
+
+// Candidate is a public key found for an address.
+type Candidate struct {
+	Source      string     `json:"source"` // "wkd" or "hkp"
+	Fingerprint string     `json:"fingerprint"`
+	UserIDs     []string   `json:"user_ids"`
+	Created     time.Time  `json:"created"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	Revoked     bool       `json:"revoked"`
+	Armored     string     `json:"armored"`
+}
+
+// Client fetches keys over HTTP.
+type Client struct {
+	HTTP *http.Client
+	// Keyserver is the base URL of the HKP keyserver; empty disables HKP.
+	Keyserver string
+	// WKD enables Web Key Directory lookups.
+	WKD bool
+}
+
+// New returns a client querying keyserver and WKD with the given timeout.
+func New(keyserver string, timeout time.Duration) *Client {
+	return &Client{
+		HTTP:      &http.Client{Timeout: timeout},
+		Keyserver: strings.TrimSuffix(keyserver, "/"),
+		WKD:       true,
+	}
+}
+
+// Lookup returns the keys found for email in the WKD and on the keyserver,
+// WKD results first and duplicates removed. Only keys with a user ID for
+// email are returned. A source that fails is logged and skipped; an error is
+// returned only if every enabled source failed.
+func (c *Client) Lookup(ctx context.Context, email string) ([]Candidate, error) {
+	local, domain, err := SplitEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	email = local + "@" + domain
+
+	type source struct {
+		name  string
+		fetch func(context.Context, string) ([]*openpgp.Entity, error)
+	}
+	var sources []source
+	if c.WKD {
+		sources = append(sources, source{"wkd", c.fetchWKD})
+	}
+	if c.Keyserver != "" {
+		sources = append(sources, source{"hkp", c.fetchHKP})
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("no key sources configured")
+	}
+
+	seen := map[string]bool{}
+	candidates := []Candidate{}
+	var errs []error
+	for _, src := range sources {
+		entities, err := src.fetch(ctx, email)
+		if err != nil {
+			slog.Warn("key lookup failed", "source", src.name, "email", email, "err", err)
+			errs = append(errs, fmt.Errorf("%s: %w", src.name, err))
+			continue
+		}
+		for _, e := range entities {
+			cand, err := newCandidate(src.name, e)
+			if err != nil || seen[cand.Fingerprint] || !hasEmail(e, email) {
+				continue
+			}
+			seen[cand.Fingerprint] = true
+			candidates = append(candidates, cand)
+		}
+	}
+	if len(errs) == len(sources) {
+		return nil, errors.Join(errs...)
+	}
+	return candidates, nil
+}
+
+// fetchWKD queries the advanced WKD layout on openpgpkey.<domain>, falling
+// back to the direct layout on <domain> if that host cannot be reached.
+func (c *Client) fetchWKD(ctx context.Context, email string) ([]*openpgp.Entity, error) {
+	local, domain, err := SplitEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	hash, query := WKDHash(local), "?l="+url.QueryEscape(local)
+
+	body, err := c.get(ctx, "https://openpgpkey."+domain+"/.well-known/openpgpkey/"+domain+"/hu/"+hash+query)
+	var status *statusError
+	if err != nil && !errors.Is(err, errNotFound) && !errors.As(err, &status) {
+		slog.Debug("advanced WKD unavailable, trying direct layout", "domain", domain, "err", err)
+		body, err = c.get(ctx, "https://"+domain+"/.well-known/openpgpkey/hu/"+hash+query)
+	}
+	if errors.Is(err, errNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return readKeys(body)
+}
+
+// fetchHKP searches the keyserver for keys with a user ID for email.
+func (c *Client) fetchHKP(ctx context.Context, email string) ([]*openpgp.Entity, error) {
+	q := url.Values{"op": {"get"}, "options": {"mr"}, "exact": {"on"}, "search": {email}}
+	body, err := c.get(ctx, c.Keyserver+"/pks/lookup?"+q.Encode())
+	if errors.Is(err, errNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return readKeys(body)
+}
+
+// statusError is an HTTP response other than 200 or 404.
+type statusError struct {
+	host   string
+	status string
+}
+
+func (e *statusError) Error() string {
+	return e.host + ": unexpected status " + e.status
+}
+
+// get fetches u, returning errNotFound for a 404 and a *statusError for
+// other unsuccessful responses.
+func (c *Client) get(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, errNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, &statusError{host: req.URL.Host, status: resp.Status}
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxResponseBytes {
+		return nil, fmt.Errorf("%s: response too large", req.URL.Host)
+	}
+	return body, nil
+}
+
+// readKeys parses binary (WKD) or armored (HKP) key data.
+func readKeys(data []byte) ([]*openpgp.Entity, error) {
+	if trimmed := bytes.TrimLeft(data, " \t\r\n"); len(trimmed) > 0 && trimmed[0]&0x80 != 0 {
+		return openpgp.ReadKeyRing(bytes.NewReader(trimmed))
+	}
+	return openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+}
+
+// hasEmail reports whether e has a user ID for email.
+func hasEmail(e *openpgp.Entity, email string) bool {
+	for _, ident := range e.Identities {
+		if ident.UserId != nil && strings.EqualFold(strings.TrimSpace(ident.UserId.Email), email) {
+			return true
+		}
+	}
+	return false
+}
+
+// newCandidate describes e and re-armors its public part.
+func newCandidate(source string, e *openpgp.Entity) (Candidate, error) {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, "PGP PUBLIC KEY BLOCK", nil)
+	if err != nil {
+		return Candidate{}, err
+	}
+	if err := e.Serialize(w); err != nil {
+		return Candidate{}, err
+	}
+	if err := w.Close(); err != nil {
+		return Candidate{}, err
+	}
+
+	now := time.Now()
+	cand := Candidate{
+		Source:      source,
+		Fingerprint: fmt.Sprintf("%X", e.PrimaryKey.Fingerprint),
+		Created:     e.PrimaryKey.CreationTime,
+		Revoked:     e.Revoked(now),
+		Armored:     buf.String(),
+	}
+	for name := range e.Identities {
+		cand.UserIDs = append(cand.UserIDs, name)
+	}
+	sort.Strings(cand.UserIDs)
+	if sig, err := e.PrimarySelfSignature(now, nil); err == nil && sig != nil && sig.KeyLifetimeSecs != nil && *sig.KeyLifetimeSecs != 0 {
+		expires := e.PrimaryKey.CreationTime.Add(time.Duration(*sig.KeyLifetimeSecs) * time.Second)
+		cand.Expires = &expires
+	}
+	return cand, nil
+}
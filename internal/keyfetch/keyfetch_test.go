@@ -0,0 +1,207 @@
+package keyfetch_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	gcrypto "github.com/ProtonMail/gopenpgp/v3/crypto"
+
+	kf "h-cloud.io/web-gpg/internal/keyfetch"
+)
+
+// standIn is a local server playing the keyserver and every WKD host. The
+// test certificate covers example.com and *.example.com.
+type standIn struct {
+	srv   *httptest.Server
+	wkd   map[string][]byte // host+path → binary key
+	hkp   map[string]string // search → armored keys
+	fails bool              // answer everything with 500
+}
+
+func newStandIn(t *testing.T) *standIn {
+	s := &standIn{wkd: map[string][]byte{}, hkp: map[string]string{}}
+	s.srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.fails {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Path == "/pks/lookup" {
+			if keys, ok := s.hkp[r.URL.Query().Get("search")]; ok && r.URL.Query().Get("op") == "get" {
+				w.Write([]byte(keys))
+				return
+			}
+			http.NotFound(w, r)
+			return
+		}
+		if key, ok := s.wkd[r.Host+r.URL.Path]; ok {
+			w.Write(key)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(s.srv.Close)
+	return s
+}
+
+// client returns a client that sends every request to the stand-in.
+// Hosts for which unreachable returns true fail to connect.
+func (s *standIn) client(unreachable func(host string) bool) *kf.Client {
+	c := kf.New("https://keys.example.com", 5*time.Second)
+	transport := s.srv.Client().Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(addr)
+		if unreachable != nil && unreachable(host) {
+			return nil, errors.New("no such host " + host)
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, s.srv.Listener.Addr().String())
+	}
+	c.HTTP.Transport = transport
+	return c
+}
+
+func generateKey(t *testing.T, email string) *gcrypto.Key {
+	t.Helper()
+	k, err := gcrypto.PGP().KeyGeneration().AddUserId("Test", email).New().GenerateKey()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return k
+}
+
+func binaryPublic(t *testing.T, k *gcrypto.Key) []byte {
+	t.Helper()
+	b, err := k.GetPublicKey()
+	if err != nil {
+		t.Fatalf("serialize key: %v", err)
+	}
+	return b
+}
+
+// armoredPublic armors the public keys together in one block, as
+// keyservers do.
+func armoredPublic(t *testing.T, keys ...*gcrypto.Key) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, "PGP PUBLIC KEY BLOCK", nil)
+	if err != nil {
+		t.Fatalf("armor keys: %v", err)
+	}
+	for _, k := range keys {
+		w.Write(binaryPublic(t, k))
+	}
+	w.Close()
+	return buf.String()
+}
+
+// TestWKDHash verifies the hash against the WKD specification example.
+func TestWKDHash(t *testing.T) {
+	if got := kf.WKDHash("Joe.Doe"); got != "iy9q119eutrkn8s1mk4r39qejnbu3n5q" {
+		t.Errorf("WKDHash(Joe.Doe) = %q", got)
+	}
+	if !kf.IsWKDHash("iy9q119eutrkn8s1mk4r39qejnbu3n5q") || kf.IsWKDHash("iy9q119eutrkn8s1mk4r39qejnbu3n5l") {
+		t.Error("IsWKDHash accepted or rejected the wrong input")
+	}
+}
+
+// TestLookup verifies WKD and keyserver results are merged, WKD first,
+// without duplicates or keys for other addresses.
+func TestLookup(t *testing.T) {
+	s := newStandIn(t)
+	wkdKey := generateKey(t, "joe.doe@example.com")
+	hkpKey := generateKey(t, "joe.doe@example.com")
+	other := generateKey(t, "someone@example.com")
+	s.wkd["openpgpkey.example.com/.well-known/openpgpkey/example.com/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q"] = binaryPublic(t, wkdKey)
+	s.hkp["joe.doe@example.com"] = armoredPublic(t, wkdKey, hkpKey, other)
+
+	got, err := s.client(nil).Lookup(context.Background(), "Joe.Doe@example.com")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 candidates, got %+v", got)
+	}
+	if got[0].Source != "wkd" || !strings.EqualFold(got[0].Fingerprint, wkdKey.GetFingerprint()) {
+		t.Errorf("first candidate = %s %s, want the WKD key", got[0].Source, got[0].Fingerprint)
+	}
+	if got[1].Source != "hkp" || !strings.EqualFold(got[1].Fingerprint, hkpKey.GetFingerprint()) {
+		t.Errorf("second candidate = %s %s, want the keyserver key", got[1].Source, got[1].Fingerprint)
+	}
+	if len(got[0].UserIDs) != 1 || got[0].UserIDs[0] != "Test <joe.doe@example.com>" || got[0].Revoked {
+		t.Errorf("unexpected candidate details %+v", got[0])
+	}
+	if k, err := gcrypto.NewKeyFromArmored(got[0].Armored); err != nil || k.IsPrivate() {
+		t.Errorf("candidate armor should hold the public key: %v", err)
+	}
+}
+
+// TestLookup_WKDDirect verifies the direct layout is used when
+// openpgpkey.<domain> cannot be reached.
+func TestLookup_WKDDirect(t *testing.T) {
+	s := newStandIn(t)
+	key := generateKey(t, "joe.doe@example.com")
+	s.wkd["example.com/.well-known/openpgpkey/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q"] = binaryPublic(t, key)
+
+	c := s.client(func(host string) bool { return strings.HasPrefix(host, "openpgpkey.") })
+	c.Keyserver = ""
+	got, err := c.Lookup(context.Background(), "joe.doe@example.com")
+	if err != nil || len(got) != 1 || got[0].Source != "wkd" {
+		t.Fatalf("expected the key from the direct layout, got %+v (%v)", got, err)
+	}
+}
+
+// TestLookup_Errors verifies not-found and failing sources.
+func TestLookup_Errors(t *testing.T) {
+	s := newStandIn(t)
+	got, err := s.client(nil).Lookup(context.Background(), "nobody@example.com")
+	if err != nil || len(got) != 0 {
+		t.Errorf("unknown address: expected no candidates and no error, got %+v (%v)", got, err)
+	}
+
+	s.fails = true
+	if _, err := s.client(nil).Lookup(context.Background(), "nobody@example.com"); err == nil {
+		t.Error("expected an error when every source fails")
+	}
+	if _, err := s.client(nil).Lookup(context.Background(), "not-an-address"); err == nil {
+		t.Error("expected an error for an invalid address")
+	}
+}
+
+// TestSplitEmail verifies only host names are accepted as the domain, so a
+// lookup cannot be pointed at other hosts, ports or paths.
+func TestSplitEmail(t *testing.T) {
+	local, domain, err := kf.SplitEmail(" Joe.Doe@Mail.Example.COM ")
+	if err != nil || local != "joe.doe" || domain != "mail.example.com" {
+		t.Errorf("SplitEmail = %q %q %v", local, domain, err)
+	}
+	if _, domain, err := kf.SplitEmail("joe@xn--bcher-kva.example"); err != nil || domain != "xn--bcher-kva.example" {
+		t.Errorf("punycode domain: %q %v", domain, err)
+	}
+	for _, email := range []string{
+		"x@10.0.0.5:8443/admin?",
+		"x@10.0.0.5",
+		"x@example.com:8443",
+		"x@example.com/admin",
+		"x@example.com?q",
+		"x@example.com#frag",
+		"x@evil.com@example.com",
+		"x@[::1]",
+		"x@localhost",
+		"x@-example.com",
+		"x@example..com",
+		"x@bücher.example",
+		"@example.com",
+		"x@",
+	} {
+		if _, _, err := kf.SplitEmail(email); !errors.Is(err, kf.ErrInvalidEmail) {
+			t.Errorf("%q: expected ErrInvalidEmail, got %v", email, err)
+		}
+	}
+}
@@ -1,13 +1,88 @@
 package models
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 type Key struct {
-	ID               int64     `db:"id" json:"id"`
-	Name             string    `db:"name" json:"name"`
-	Armored          string    `db:"armored" json:"armored"`
-	IsPrivate        bool      `db:"is_private" json:"is_private"`
-	EncryptedPasshex *string   `db:"encrypted_password" json:"encrypted_password"`
-	PasswordBcrypt   *string   `db:"password_bcrypt" json:"password_bcrypt"`
-	CreatedAt        time.Time `db:"created_at" json:"created_at"`
+	ID               int64      `db:"id" json:"id"`
+	Name             string     `db:"name" json:"name"`
+	Armored          string     `db:"armored" json:"armored"`
+	IsPrivate        bool       `db:"is_private" json:"is_private"`
+	EncryptedPasshex *string    `db:"encrypted_password" json:"encrypted_password"`
+	PasswordBcrypt   *string    `db:"password_bcrypt" json:"password_bcrypt"`
+	TrustLevel       string     `db:"trust_level" json:"trust_level"`
+	CertifiedBy      *int64     `db:"certified_by" json:"certified_by"`
+	CertifiedAt      *time.Time `db:"certified_at" json:"certified_at"`
+	Fingerprint      *string    `db:"fingerprint" json:"fingerprint"`
+	PinConflict      bool       `db:"pin_conflict" json:"pin_conflict"`
+	LintWarnings     *string    `db:"lint_warnings" json:"lint_warnings"`
+	Published        bool       `db:"published" json:"published"`
+	DropEnabled      bool       `db:"drop_enabled" json:"drop_enabled"`
+	OwnerID          *int64     `db:"owner_id" json:"owner_id"`
+	OwnerName        *string    `db:"owner_name" json:"owner_name"`
+	Shared           bool       `db:"shared" json:"shared"`
+	CreatedAt        time.Time  `db:"created_at" json:"created_at"`
+}
+
+// Weaknesses returns the key quality problems recorded by the last lint pass,
+// or nil if none were found or the key has not been linted.
+func (k Key) Weaknesses() []string {
+	if k.LintWarnings == nil || *k.LintWarnings == "" {
+		return nil
+	}
+	return strings.Split(*k.LintWarnings, "\n")
+}
+
+// OwnedBy reports whether k belongs to the user u.
+func (k Key) OwnedBy(u *User) bool {
+	return u != nil && k.OwnerID != nil && *k.OwnerID == u.ID
+}
+
+// IdentityEvent is one entry in the per-email key history kept for
+// trust-on-first-use pinning.
+type IdentityEvent struct {
+	ID          int64     `db:"id" json:"id"`
+	Email       string    `db:"email" json:"email"`
+	KeyID       *int64    `db:"key_id" json:"key_id"`
+	Fingerprint string    `db:"fingerprint" json:"fingerprint"`
+	Event       string    `db:"event" json:"event"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+}
+
+// RecipientGroup is a named set of email addresses that can be used as an
+// encryption target.
+type RecipientGroup struct {
+	ID        int64     `db:"id" json:"id"`
+	Name      string    `db:"name" json:"name"`
+	Members   []string  `db:"-" json:"members"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// InboxMessage is an encrypted submission received through a public drop
+// page. The plaintext is never stored; KeyName is empty if the key was
+// deleted.
+type InboxMessage struct {
+	ID               int64      `db:"id" json:"id"`
+	KeyID            int64      `db:"key_id" json:"key_id"`
+	KeyName          *string    `db:"key_name" json:"key_name"`
+	Filename         *string    `db:"filename" json:"filename"`
+	Size             int64      `db:"size" json:"size"`
+	SubmitterContact *string    `db:"submitter_contact" json:"submitter_contact"`
+	RemoteAddr       *string    `db:"remote_addr" json:"remote_addr"`
+	UserAgent        *string    `db:"user_agent" json:"user_agent"`
+	Status           string     `db:"status" json:"status"`
+	CreatedAt        time.Time  `db:"created_at" json:"created_at"`
+	ReadAt           *time.Time `db:"read_at" json:"read_at"`
+}
+
+// User is an account that can log in. Its role decides what it may do; keys
+// added by a user are owned by them and private to them unless shared.
+type User struct {
+	ID           int64     `db:"id" json:"id"`
+	Username     string    `db:"username" json:"username"`
+	PasswordHash string    `db:"password_hash" json:"-"`
+	Role         string    `db:"role" json:"role"`
+	CreatedAt    time.Time `db:"created_at" json:"created_at"`
 }
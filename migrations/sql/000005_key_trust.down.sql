@@ -0,0 +1,3 @@
+ALTER TABLE keys DROP COLUMN certified_at;
+ALTER TABLE keys DROP COLUMN certified_by;
+ALTER TABLE keys DROP COLUMN trust_level;
@@ -0,0 +1,6 @@
+-- Per-key verification state. trust_level uses the GnuPG ownertrust vocabulary
+-- (unknown, never, marginal, full, ultimate); certified_by points at the
+-- private key that signed this key's user IDs, if any.
+ALTER TABLE keys ADD COLUMN trust_level TEXT NOT NULL DEFAULT 'unknown';
+ALTER TABLE keys ADD COLUMN certified_by BIGINT;
+ALTER TABLE keys ADD COLUMN certified_at TIMESTAMP;
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS identity_history_email_idx;
+DROP TABLE IF EXISTS identity_history;
+DROP TABLE IF EXISTS identity_pins;
+ALTER TABLE keys DROP COLUMN pin_conflict;
+ALTER TABLE keys DROP COLUMN fingerprint;
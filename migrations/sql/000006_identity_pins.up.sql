@@ -0,0 +1,23 @@
+-- Trust-on-first-use pinning: each email address is pinned to the first key
+-- seen for it. Keys that claim a pinned address with a different fingerprint
+-- are flagged via pin_conflict until the pin is explicitly replaced.
+ALTER TABLE keys ADD COLUMN fingerprint TEXT;
+ALTER TABLE keys ADD COLUMN pin_conflict BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS identity_pins (
+  email TEXT PRIMARY KEY,
+  key_id BIGINT NOT NULL,
+  fingerprint TEXT NOT NULL,
+  pinned_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS identity_history (
+  id SERIAL PRIMARY KEY,
+  email TEXT NOT NULL,
+  key_id BIGINT,
+  fingerprint TEXT NOT NULL,
+  event TEXT NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS identity_history_email_idx ON identity_history (email);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS recipient_group_members;
+DROP TABLE IF EXISTS recipient_groups;
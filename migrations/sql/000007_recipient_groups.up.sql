@@ -0,0 +1,13 @@
+-- Named recipient groups. Members are email addresses, resolved to their
+-- currently pinned keys at encryption time.
+CREATE TABLE IF NOT EXISTS recipient_groups (
+  id SERIAL PRIMARY KEY,
+  name TEXT NOT NULL UNIQUE,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS recipient_group_members (
+  group_id BIGINT NOT NULL REFERENCES recipient_groups(id) ON DELETE CASCADE,
+  email TEXT NOT NULL,
+  PRIMARY KEY (group_id, email)
+);
@@ -0,0 +1,4 @@
+-- Key quality lint results: newline-separated weaknesses found in the key
+-- (weak algorithms, short keys, SHA-1 self-signatures). NULL means the key
+-- has not been linted, an empty string means no weaknesses were found.
+ALTER TABLE keys ADD COLUMN lint_warnings TEXT;
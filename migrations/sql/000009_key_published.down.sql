@@ -0,0 +1 @@
+ALTER TABLE keys DROP COLUMN published;
@@ -0,0 +1,3 @@
+-- Keys explicitly published through the Web Key Directory (and, later, other
+-- public key distribution endpoints). Unpublished keys are never served.
+ALTER TABLE keys ADD COLUMN published BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,2 @@
+-- Keys that accept anonymous submissions through the public drop page.
+ALTER TABLE keys ADD COLUMN drop_enabled BOOLEAN NOT NULL DEFAULT FALSE;
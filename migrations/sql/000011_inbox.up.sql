@@ -0,0 +1,18 @@
+-- Submissions received through the public drop pages. The message is stored
+-- only as ciphertext to key_id; the remaining columns are metadata about the
+-- submission. status is one of unread, read or archived.
+CREATE TABLE IF NOT EXISTS inbox_messages (
+  id SERIAL PRIMARY KEY,
+  key_id BIGINT NOT NULL,
+  ciphertext TEXT NOT NULL,
+  filename TEXT,
+  size BIGINT NOT NULL DEFAULT 0,
+  submitter_contact TEXT,
+  remote_addr TEXT,
+  user_agent TEXT,
+  status TEXT NOT NULL DEFAULT 'unread',
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  read_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS inbox_messages_status_idx ON inbox_messages (status);
@@ -0,0 +1,12 @@
+-- One-time secret links. Only the AES-GCM ciphertext is stored; its key
+-- travels in the URL fragment and never reaches the server. A row is deleted
+-- when the secret is viewed or once expires_at has passed.
+CREATE TABLE IF NOT EXISTS secret_links (
+  id TEXT PRIMARY KEY,
+  ciphertext TEXT NOT NULL,
+  passphrase_bcrypt TEXT,
+  expires_at TIMESTAMP NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS secret_links_expires_at_idx ON secret_links (expires_at);
@@ -0,0 +1,3 @@
+ALTER TABLE keys DROP COLUMN shared;
+ALTER TABLE keys DROP COLUMN owner_id;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,15 @@
+-- User accounts. Passwords are stored as bcrypt hashes of their SHA-256
+-- digest, like key passphrases.
+CREATE TABLE IF NOT EXISTS users (
+  id SERIAL PRIMARY KEY,
+  username TEXT NOT NULL UNIQUE,
+  password_hash TEXT NOT NULL,
+  is_admin BOOLEAN NOT NULL DEFAULT FALSE,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- The user who added a key. Keys without an owner predate user accounts and
+-- belong to the shared keyring; owned keys are private to their owner unless
+-- shared.
+ALTER TABLE keys ADD COLUMN owner_id BIGINT;
+ALTER TABLE keys ADD COLUMN shared BOOLEAN NOT NULL DEFAULT TRUE;
@@ -0,0 +1,6 @@
+-- Replace the admin flag with a role: viewer, encryptor, decryptor or admin.
+-- Existing non-admin accounts keep the use of private keys.
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'viewer';
+UPDATE users SET role = 'admin' WHERE is_admin = TRUE;
+UPDATE users SET role = 'decryptor' WHERE is_admin = FALSE;
+ALTER TABLE users DROP COLUMN is_admin;
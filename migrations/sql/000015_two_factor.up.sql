@@ -0,0 +1,20 @@
+-- TOTP second factors. user_id 0 is the master password login used before
+-- any account exists. The secret is encrypted with the master key; enabled
+-- stays false until the first code is confirmed. last_step is the time step
+-- of the last accepted code, so a code cannot be replayed.
+CREATE TABLE IF NOT EXISTS two_factor (
+  user_id BIGINT PRIMARY KEY,
+  secret TEXT NOT NULL,
+  enabled BOOLEAN NOT NULL DEFAULT FALSE,
+  last_step BIGINT NOT NULL DEFAULT 0,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Single-use recovery codes, stored as SHA-256 digests.
+CREATE TABLE IF NOT EXISTS recovery_codes (
+  id SERIAL PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  code_hash TEXT NOT NULL UNIQUE,
+  used_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS recovery_codes_user_id_idx ON recovery_codes (user_id);
@@ -0,0 +1,24 @@
+-- WebAuthn credentials (passkeys). user_id 0 is the master password login
+-- used before any account exists. credential_id is the base64url credential
+-- id; credential holds the JSON credential record, including the public key
+-- and signature counter.
+CREATE TABLE IF NOT EXISTS passkeys (
+  id SERIAL PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  name TEXT NOT NULL,
+  credential_id TEXT NOT NULL UNIQUE,
+  credential TEXT NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  last_used_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS passkeys_user_id_idx ON passkeys (user_id);
+
+-- Passkey registrations and logins in progress, between the browser fetching
+-- the challenge and returning the signed response. Each is used once.
+CREATE TABLE IF NOT EXISTS passkey_ceremonies (
+  id TEXT PRIMARY KEY,
+  purpose TEXT NOT NULL,
+  user_id BIGINT,
+  session TEXT NOT NULL,
+  expires_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,18 @@
+-- Personal API tokens, sent as "Authorization: Bearer <token>". Tokens are
+-- random, so only their SHA-256 digest is stored; prefix is the start of the
+-- token, shown to tell tokens apart. scope is the highest role the token
+-- may act with. Usage is recorded on every request.
+CREATE TABLE IF NOT EXISTS api_tokens (
+  id SERIAL PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  name TEXT NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  prefix TEXT NOT NULL,
+  scope TEXT NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  expires_at TIMESTAMP NOT NULL,
+  last_used_at TIMESTAMP,
+  last_used_ip TEXT,
+  use_count BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS api_tokens_user_id_idx ON api_tokens (user_id);
@@ -0,0 +1,15 @@
+-- Login sessions. The auth cookie holds a random token; only its SHA-256
+-- digest is stored, so a copy of the database cannot be used to log in.
+-- user_id 0 is the master password login used before any account exists.
+-- A session ends when revoked, when idle for too long or at expires_at.
+CREATE TABLE IF NOT EXISTS sessions (
+  id SERIAL PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  ip TEXT NOT NULL,
+  user_agent TEXT NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+  last_seen_at TIMESTAMP NOT NULL,
+  expires_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id);
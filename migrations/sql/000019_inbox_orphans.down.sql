@@ -0,0 +1 @@
+-- no rollback for deleted inbox messages
@@ -0,0 +1,3 @@
+-- Delete inbox messages left behind by deleted keys. They were listed to
+-- every user and, where key ids are reused, shown for the next key.
+DELETE FROM inbox_messages WHERE key_id NOT IN (SELECT id FROM keys);
@@ -0,0 +1,15 @@
+ALTER TABLE identity_history DROP COLUMN owner_id;
+
+-- Keeps the oldest pin of each address.
+CREATE TABLE IF NOT EXISTS identity_pins_global (
+  email TEXT PRIMARY KEY,
+  key_id BIGINT NOT NULL,
+  fingerprint TEXT NOT NULL,
+  pinned_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO identity_pins_global (email, key_id, fingerprint, pinned_at)
+  SELECT p.email, p.key_id, p.fingerprint, p.pinned_at FROM identity_pins p
+  WHERE NOT EXISTS (SELECT 1 FROM identity_pins o WHERE o.email = p.email
+                    AND (o.pinned_at < p.pinned_at OR (o.pinned_at = p.pinned_at AND o.key_id < p.key_id)));
+DROP TABLE identity_pins;
+ALTER TABLE identity_pins_global RENAME TO identity_pins;
@@ -0,0 +1,21 @@
+-- Identity pins and history belong to a keyring, like the keys they pin:
+-- owner_id is the owner of the pinned key, NULL for the shared keyring.
+-- Each keyring pins an address on its own, so users neither see nor move
+-- each other's pins. The ALTER comes first so that re-running this file on
+-- SQLite stops at "duplicate column" before the pins are copied again.
+ALTER TABLE identity_history ADD COLUMN owner_id BIGINT;
+UPDATE identity_history SET owner_id = (SELECT owner_id FROM keys WHERE keys.id = identity_history.key_id);
+
+CREATE TABLE IF NOT EXISTS identity_pins_owned (
+  owner_id BIGINT,
+  email TEXT NOT NULL,
+  key_id BIGINT NOT NULL,
+  fingerprint TEXT NOT NULL,
+  pinned_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO identity_pins_owned (owner_id, email, key_id, fingerprint, pinned_at)
+  SELECT (SELECT owner_id FROM keys WHERE keys.id = p.key_id), p.email, p.key_id, p.fingerprint, p.pinned_at
+  FROM identity_pins p;
+DROP TABLE identity_pins;
+ALTER TABLE identity_pins_owned RENAME TO identity_pins;
+CREATE UNIQUE INDEX IF NOT EXISTS identity_pins_keyring_email_idx ON identity_pins (COALESCE(owner_id, 0), email);
@@ -0,0 +1,3 @@
+ALTER TABLE two_factor DROP COLUMN locked_until;
+ALTER TABLE two_factor DROP COLUMN failed_attempts;
+DROP TABLE IF EXISTS pending_logins;
@@ -0,0 +1,14 @@
+-- Logins waiting for their second factor. The second factor cookie holds a
+-- random token; only its SHA-256 digest is stored, and the row is deleted
+-- when the code is checked, so each password step allows a single attempt.
+-- user_id 0 is the master password login used before any account exists.
+CREATE TABLE IF NOT EXISTS pending_logins (
+  token_hash TEXT PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  expires_at TIMESTAMP NOT NULL
+);
+
+-- Invalid second factor codes in a row. After too many the second login
+-- step is refused until locked_until.
+ALTER TABLE two_factor ADD COLUMN failed_attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE two_factor ADD COLUMN locked_until TIMESTAMP;